@@ -0,0 +1,444 @@
+// Package client is a Go client for the database's gRPC service. A Client
+// keeps a pool of HTTP/2 connections to one server, applies a default
+// deadline to calls made without one and retries calls that fail because
+// the server could not be reached.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/rpc"
+)
+
+// Default client options
+const (
+	DefaultPoolSize     = 4
+	DefaultTimeout      = 5 * time.Second
+	DefaultDialTimeout  = 5 * time.Second
+	DefaultMaxRetries   = 3
+	DefaultRetryBackoff = 50 * time.Millisecond
+)
+
+// maxRetryBackoff caps the delay between retries
+const maxRetryBackoff = 2 * time.Second
+
+// ErrClientClosed is returned by calls made after Close
+var ErrClientClosed = errors.New("client is closed")
+
+// Error is the status a failed call ended with. Use StatusCode or
+// IsNotFound to inspect it.
+type Error = rpc.Status
+
+// Code is a gRPC status code
+type Code = rpc.Code
+
+// The status codes calls fail with
+const (
+	CodeCanceled           = rpc.CodeCanceled
+	CodeUnknown            = rpc.CodeUnknown
+	CodeInvalidArgument    = rpc.CodeInvalidArgument
+	CodeDeadlineExceeded   = rpc.CodeDeadlineExceeded
+	CodeNotFound           = rpc.CodeNotFound
+	CodeAlreadyExists      = rpc.CodeAlreadyExists // Sets with IfAbsent of a key that exists
+	CodeResourceExhausted  = rpc.CodeResourceExhausted
+	CodeFailedPrecondition = rpc.CodeFailedPrecondition // Writes to a read-only follower
+	CodeAborted            = rpc.CodeAborted            // Deletes of a key written since the version given
+	CodeOutOfRange         = rpc.CodeOutOfRange         // Watches resuming from changes no longer kept
+	CodeUnimplemented      = rpc.CodeUnimplemented
+	CodeInternal           = rpc.CodeInternal
+	CodeUnavailable        = rpc.CodeUnavailable
+)
+
+// SetOptions controls how SetWithOptions stores a value
+type SetOptions struct {
+	TTL      time.Duration // Zero means the value does not expire
+	IfAbsent bool          // Only store the value if the key does not exist
+}
+
+// Options configures a Client
+type Options struct {
+	PoolSize       int           // Connections to the server, used in turn
+	Timeout        time.Duration // Deadline of unary calls whose context has none; negative disables it
+	DialTimeout    time.Duration // How long connecting may take
+	MaxRetries     int           // Retries of a call that found the server unavailable; negative disables them
+	RetryBackoff   time.Duration // Delay before the first retry, doubled for each one after
+	MaxMessageSize int           // Largest response message accepted
+}
+
+// Client calls the KeyValue service of one server. It is safe for
+// concurrent use.
+type Client struct {
+	addr    string
+	options Options
+	pool    []*http.Client
+	next    atomic.Uint64
+	mutex   sync.RWMutex
+	closed  bool
+}
+
+// New creates a client for the server at addr (host:port). Connections are
+// made when first needed.
+func New(addr string, options *Options) *Client {
+	c := &Client{addr: addr}
+	if options != nil {
+		c.options = *options
+	}
+	if c.options.PoolSize <= 0 {
+		c.options.PoolSize = DefaultPoolSize
+	}
+	if c.options.Timeout == 0 {
+		c.options.Timeout = DefaultTimeout
+	}
+	if c.options.DialTimeout <= 0 {
+		c.options.DialTimeout = DefaultDialTimeout
+	}
+	if c.options.MaxRetries == 0 {
+		c.options.MaxRetries = DefaultMaxRetries
+	}
+	if c.options.RetryBackoff <= 0 {
+		c.options.RetryBackoff = DefaultRetryBackoff
+	}
+	if c.options.MaxMessageSize <= 0 {
+		c.options.MaxMessageSize = rpc.DefaultMaxMessageSize
+	}
+
+	// One transport per pooled connection: an HTTP/2 transport multiplexes
+	// all calls over a single connection per server
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	dialer := &net.Dialer{Timeout: c.options.DialTimeout}
+
+	for i := 0; i < c.options.PoolSize; i++ {
+		c.pool = append(c.pool, &http.Client{
+			Transport: &http.Transport{
+				Protocols:   protocols,
+				DialContext: dialer.DialContext,
+			},
+		})
+	}
+	return c
+}
+
+// Get returns the value of a key. It fails with CodeNotFound if the key
+// does not exist.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := c.GetWithVersion(ctx, key)
+	return value, err
+}
+
+// GetWithVersion returns the value of a key along with its version
+func (c *Client) GetWithVersion(ctx context.Context, key string) ([]byte, uint64, error) {
+	response := &rpc.GetResponse{}
+	err := c.invoke(ctx, rpc.MethodGet, &rpc.GetRequest{Key: key}, response)
+	if err != nil {
+		return nil, 0, err
+	}
+	return response.Value, response.Version, nil
+}
+
+// Set stores a value for a key
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	return c.invoke(ctx, rpc.MethodSet, &rpc.SetRequest{Key: key, Value: value}, &rpc.SetResponse{})
+}
+
+// SetWithTTL stores a value that expires after ttl, which is rounded up to
+// whole milliseconds
+func (c *Client) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "ttl must be positive")
+	}
+
+	request := &rpc.SetRequest{
+		Key:       key,
+		Value:     value,
+		TTLMillis: int64((ttl + time.Millisecond - 1) / time.Millisecond),
+	}
+	return c.invoke(ctx, rpc.MethodSet, request, &rpc.SetResponse{})
+}
+
+// SetWithOptions stores a value subject to options and returns its
+// version. With IfAbsent it fails with CodeAlreadyExists if the key
+// exists, which after a retry can mean the first attempt stored it.
+func (c *Client) SetWithOptions(ctx context.Context, key string, value []byte, options *SetOptions) (uint64, error) {
+	if options == nil {
+		options = &SetOptions{}
+	}
+	if options.TTL < 0 {
+		return 0, rpc.Errorf(rpc.CodeInvalidArgument, "ttl must not be negative")
+	}
+
+	request := &rpc.SetRequest{
+		Key:       key,
+		Value:     value,
+		TTLMillis: int64((options.TTL + time.Millisecond - 1) / time.Millisecond),
+		IfAbsent:  options.IfAbsent,
+	}
+	response := &rpc.SetResponse{}
+	err := c.invoke(ctx, rpc.MethodSet, request, response)
+	if err != nil {
+		return 0, err
+	}
+	return response.Version, nil
+}
+
+// Delete removes a key. It fails with CodeNotFound if the key does not
+// exist, which after a retry can mean the first attempt removed it.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.invoke(ctx, rpc.MethodDelete, &rpc.DeleteRequest{Key: key}, &rpc.DeleteResponse{})
+}
+
+// DeleteIfVersion removes a key if it is still at the given version. It
+// fails with CodeAborted if the key has been written since, and
+// CodeNotFound if it no longer exists.
+func (c *Client) DeleteIfVersion(ctx context.Context, key string, version uint64) error {
+	if version == 0 {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "version must not be zero")
+	}
+	request := &rpc.DeleteRequest{Key: key, IfVersion: version}
+	return c.invoke(ctx, rpc.MethodDelete, request, &rpc.DeleteResponse{})
+}
+
+// Keys returns the keys starting with prefix in ascending order
+func (c *Client) Keys(ctx context.Context, prefix string) ([]string, error) {
+	response := &rpc.KeysResponse{}
+	err := c.invoke(ctx, rpc.MethodKeys, &rpc.KeysRequest{Prefix: prefix}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Keys, nil
+}
+
+// Size returns the number of keys
+func (c *Client) Size(ctx context.Context) (int64, error) {
+	response := &rpc.SizeResponse{}
+	err := c.invoke(ctx, rpc.MethodSize, &rpc.SizeRequest{}, response)
+	if err != nil {
+		return 0, err
+	}
+	return response.Size, nil
+}
+
+// Close closes the pooled connections. Calls in progress are not
+// interrupted.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	for _, conn := range c.pool {
+		conn.CloseIdleConnections()
+	}
+	return nil
+}
+
+// StatusCode returns the status code of an error returned by the client:
+// CodeOK for nil, CodeCanceled or CodeDeadlineExceeded for context errors
+// and CodeUnknown for anything else without a status
+func StatusCode(err error) Code {
+	if err == nil {
+		return rpc.CodeOK
+	}
+
+	var status *Error
+	switch {
+	case errors.As(err, &status):
+		return status.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	default:
+		return CodeUnknown
+	}
+}
+
+// IsNotFound reports whether err means the key does not exist
+func IsNotFound(err error) bool {
+	return StatusCode(err) == CodeNotFound
+}
+
+// IsAlreadyExists reports whether err means the key already exists
+func IsAlreadyExists(err error) bool {
+	return StatusCode(err) == CodeAlreadyExists
+}
+
+// invoke makes a unary call, retrying it while the server is unavailable
+func (c *Client) invoke(ctx context.Context, method string, request, response rpc.Message) error {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline && c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	return c.retry(ctx, func() error {
+		call, err := c.open(ctx, method, request)
+		if err != nil {
+			return err
+		}
+		defer call.close()
+
+		err = call.recv(response)
+		if errors.Is(err, io.EOF) {
+			return rpc.Errorf(rpc.CodeInternal, "server sent no response message")
+		}
+		return err
+	})
+}
+
+// retry runs attempt until it succeeds, fails for a reason other than the
+// server being unavailable, or runs out of retries or time
+func (c *Client) retry(ctx context.Context, attempt func() error) error {
+	backoff := c.options.RetryBackoff
+	for retries := 0; ; retries++ {
+		err := attempt()
+		if err == nil || retries >= c.options.MaxRetries || StatusCode(err) != CodeUnavailable {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// call is the response side of one call in progress
+type call struct {
+	response *http.Response
+	maxSize  int
+}
+
+// open sends a call's request and waits for the response headers
+func (c *Client) open(ctx context.Context, method string, request rpc.Message) (*call, error) {
+	c.mutex.RLock()
+	closed := c.closed
+	c.mutex.RUnlock()
+	if closed {
+		return nil, ErrClientClosed
+	}
+
+	var body bytes.Buffer
+	err := rpc.WriteMessage(&body, request)
+	if err != nil {
+		return nil, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+c.addr+method, &body)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInternal, "%v", err)
+	}
+	httpRequest.Header.Set("Content-Type", rpc.ContentType)
+	httpRequest.Header.Set("TE", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		httpRequest.Header.Set(rpc.HeaderTimeout, rpc.EncodeTimeout(time.Until(deadline)))
+	}
+
+	conn := c.pool[c.next.Add(1)%uint64(len(c.pool))]
+	response, err := conn.Do(httpRequest)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, contextStatus(ctx.Err())
+		}
+		return nil, rpc.Errorf(rpc.CodeUnavailable, "%v", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		code := rpc.CodeUnknown
+		switch response.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			code = rpc.CodeUnavailable
+		}
+		return nil, rpc.Errorf(code, "unexpected HTTP status %s", response.Status)
+	}
+
+	// A call that fails straight away carries its status in the headers
+	err = statusFrom(response.Header)
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+
+	return &call{
+		response: response,
+		maxSize:  c.options.MaxMessageSize,
+	}, nil
+}
+
+// recv reads the next response message. Once the server has sent them all
+// it returns io.EOF, or the status the call failed with.
+func (call *call) recv(m rpc.Message) error {
+	err := rpc.ReadMessage(call.response.Body, m, call.maxSize)
+	if err == nil {
+		return nil
+	}
+
+	ctx := call.response.Request.Context()
+	if ctx.Err() != nil {
+		return contextStatus(ctx.Err())
+	}
+	if !errors.Is(err, io.EOF) {
+		var status *Error
+		if errors.As(err, &status) {
+			return err
+		}
+		return rpc.Errorf(rpc.CodeUnavailable, "%v", err)
+	}
+
+	// Trailers are only available once the body has been read to the end
+	if call.response.Trailer.Get(rpc.HeaderStatus) == "" {
+		return rpc.Errorf(rpc.CodeInternal, "server sent no status")
+	}
+	err = statusFrom(call.response.Trailer)
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// close releases the call's connection stream
+func (call *call) close() {
+	call.response.Body.Close()
+}
+
+// statusFrom returns the error described by a grpc-status header, or nil
+// if there is none or it is OK
+func statusFrom(header http.Header) error {
+	value := header.Get(rpc.HeaderStatus)
+	if value == "" {
+		return nil
+	}
+
+	code, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return rpc.Errorf(rpc.CodeInternal, "invalid grpc-status %q", value)
+	}
+	if Code(code) == rpc.CodeOK {
+		return nil
+	}
+	return &Error{
+		Code:    Code(code),
+		Message: rpc.DecodeStatusMessage(header.Get(rpc.HeaderMessage)),
+	}
+}
+
+// contextStatus maps the error of a done context to a status
+func contextStatus(err error) *Error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return rpc.Errorf(rpc.CodeDeadlineExceeded, "%v", err)
+	}
+	return rpc.Errorf(rpc.CodeCanceled, "%v", err)
+}
@@ -0,0 +1,413 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/server"
+)
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// newTestDB opens a fresh database, closed when the test ends
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	config := database.DefaultConfig()
+	config.LogPath = t.TempDir()
+	config.SnapshotInterval = 0
+	db, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// startServer serves db over gRPC on a loopback port until the test ends
+func startServer(t *testing.T, db *database.DB) *countingListener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: listener}
+
+	s := server.NewGRPCServer(db, "")
+	go s.Serve(counting)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return counting
+}
+
+// newTestClient returns a client of addr, closed when the test ends
+func newTestClient(t *testing.T, addr string, options *Options) *Client {
+	t.Helper()
+
+	c := New(addr, options)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// TestCalls makes each call against a server and checks what it returns,
+// including values larger than a single HTTP/2 frame
+func TestCalls(t *testing.T) {
+	listener := startServer(t, newTestDB(t))
+	c := newTestClient(t, listener.Addr().String(), nil)
+	ctx := context.Background()
+
+	large := bytes.Repeat([]byte("0123456789"), 100000)
+	for _, value := range [][]byte{[]byte("1"), {}, large} {
+		err := c.Set(ctx, "key", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Get(ctx, "key")
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("Get of a %d byte value = %d bytes, %v", len(value), len(got), err)
+		}
+	}
+
+	version, err := c.SetWithOptions(ctx, "other", []byte("2"), &SetOptions{TTL: time.Minute, IfAbsent: true})
+	if err != nil || version == 0 {
+		t.Fatalf("SetWithOptions = %d, %v", version, err)
+	}
+	value, got, err := c.GetWithVersion(ctx, "other")
+	if err != nil || string(value) != "2" || got != version {
+		t.Fatalf("GetWithVersion = %q, %d, %v; want %q, %d", value, got, err, "2", version)
+	}
+	err = c.SetWithTTL(ctx, "expiring", []byte("3"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := c.Keys(ctx, "")
+	if want := []string{"expiring", "key", "other"}; err != nil || !slices.Equal(keys, want) {
+		t.Fatalf("Keys = %q, %v; want %q", keys, err, want)
+	}
+	size, err := c.Size(ctx)
+	if err != nil || size != 3 {
+		t.Fatalf("Size = %d, %v; want 3", size, err)
+	}
+
+	err = c.DeleteIfVersion(ctx, "other", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Delete(ctx, "expiring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = c.Keys(ctx, "")
+	if want := []string{"key"}; err != nil || !slices.Equal(keys, want) {
+		t.Fatalf("Keys after deletes = %q, %v; want %q", keys, err, want)
+	}
+}
+
+// TestStreams reads a scan of many messages and a watch
+func TestStreams(t *testing.T) {
+	listener := startServer(t, newTestDB(t))
+	c := newTestClient(t, listener.Addr().String(), nil)
+	ctx := context.Background()
+
+	var want []string
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		err := c.Set(ctx, key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+
+	stream, err := c.Scan(ctx, &ScanOptions{Prefix: "key:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		entry, err := stream.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Value) != entry.Key || entry.Version == 0 {
+			t.Fatalf("scanned %+v", entry)
+		}
+		got = append(got, entry.Key)
+	}
+	stream.Close()
+	if !slices.Equal(got, want) {
+		t.Fatalf("scanned %d keys, want %d", len(got), len(want))
+	}
+
+	// A scan closed early leaves the client usable
+	stream, err = c.Scan(ctx, &ScanOptions{Limit: 10, Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := stream.Next()
+	if err != nil || entry.Key != want[len(want)-1] {
+		t.Fatalf("first entry of a reverse scan = %q, %v; want %q", entry.Key, err, want[len(want)-1])
+	}
+	stream.Close()
+
+	watch, err := c.Watch(ctx, "watched:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Close()
+	version, err := c.SetWithOptions(ctx, "watched:a", []byte("1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Delete(ctx, "watched:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := watch.Recv()
+	if err != nil || event.Type != EventSet || event.Key != "watched:a" || string(event.Value) != "1" || event.Sequence != version {
+		t.Fatalf("first event = %+v, %v; want the set at %d", event, err, version)
+	}
+	event, err = watch.Recv()
+	if err != nil || event.Type != EventDelete || string(event.OldValue) != "1" || event.Sequence <= version {
+		t.Fatalf("second event = %+v, %v; want the delete", event, err)
+	}
+}
+
+// TestStatusCodes checks the code each failure is reported with
+func TestStatusCodes(t *testing.T) {
+	db := newTestDB(t)
+	listener := startServer(t, db)
+	addr := listener.Addr().String()
+	c := newTestClient(t, addr, nil)
+	ctx := context.Background()
+
+	version, err := c.SetWithOptions(ctx, "key", []byte("1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Set(ctx, "key", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RPush("list", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	tests := []struct {
+		name string
+		call func() error
+		want Code
+	}{
+		{"not found", func() error { _, err := c.Get(ctx, "missing"); return err }, CodeNotFound},
+		{"delete not found", func() error { return c.Delete(ctx, "missing") }, CodeNotFound},
+		{"already exists", func() error {
+			_, err := c.SetWithOptions(ctx, "key", []byte("3"), &SetOptions{IfAbsent: true})
+			return err
+		}, CodeAlreadyExists},
+		{"version mismatch", func() error { return c.DeleteIfVersion(ctx, "key", version) }, CodeAborted},
+		{"wrong type", func() error { _, err := c.Get(ctx, "list"); return err }, CodeFailedPrecondition},
+		{"empty key", func() error { return c.Set(ctx, "", []byte("1")) }, CodeInvalidArgument},
+		{"negative ttl", func() error { return c.SetWithTTL(ctx, "key", []byte("1"), -time.Second) }, CodeInvalidArgument},
+		{"zero version", func() error { return c.DeleteIfVersion(ctx, "key", 0) }, CodeInvalidArgument},
+		{"history lost", func() error {
+			watch, err := c.WatchWithOptions(ctx, &WatchOptions{After: 1})
+			if err == nil {
+				_, err = watch.Recv()
+				watch.Close()
+			}
+			return err
+		}, CodeOutOfRange},
+		{"too large", func() error {
+			small := New(addr, &Options{MaxMessageSize: 16})
+			defer small.Close()
+			err := small.Set(ctx, "large", bytes.Repeat([]byte("x"), 64))
+			if err != nil {
+				return err
+			}
+			_, err = small.Get(ctx, "large")
+			return err
+		}, CodeResourceExhausted},
+		{"deadline", func() error { _, err := c.Get(expired, "key"); return err }, CodeDeadlineExceeded},
+		{"canceled", func() error { _, err := c.Get(canceled, "key"); return err }, CodeCanceled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if got := StatusCode(err); got != test.want {
+				t.Fatalf("got %v (%s), want %s", err, got, test.want)
+			}
+		})
+	}
+
+	if !IsNotFound(tests[0].call()) || !IsAlreadyExists(tests[2].call()) {
+		t.Fatal("IsNotFound or IsAlreadyExists does not match its code")
+	}
+	if StatusCode(nil) != 0 || StatusCode(errors.New("other")) != CodeUnknown {
+		t.Fatal("StatusCode of an error without a status")
+	}
+
+	// A closed database is unavailable, as is a closed client
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newTestClient(t, addr, &Options{MaxRetries: -1}).Set(ctx, "key", []byte("1"))
+	if StatusCode(err) != CodeUnavailable {
+		t.Fatalf("Set on a closed database = %v, want %s", err, CodeUnavailable)
+	}
+	c.Close()
+	_, err = c.Get(ctx, "key")
+	if !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("Get on a closed client = %v, want %v", err, ErrClientClosed)
+	}
+}
+
+// TestRetries checks that calls are retried while the server is
+// unavailable, and only then
+func TestRetries(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	// Count the calls reaching the server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int64
+	grpc := server.NewGRPCServer(db, "")
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	s := &http.Server{
+		Protocols: protocols,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			grpc.ServeHTTP(w, r)
+		}),
+	}
+	go s.Serve(listener)
+	defer s.Close()
+	addr := listener.Addr().String()
+
+	c := newTestClient(t, addr, &Options{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	_, err = c.Get(ctx, "missing")
+	if !IsNotFound(err) || calls.Load() != 1 {
+		t.Fatalf("Get of a missing key = %v after %d calls; want not found after 1", err, calls.Load())
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls.Store(0)
+	_, err = c.Get(ctx, "key")
+	if StatusCode(err) != CodeUnavailable || calls.Load() != 3 {
+		t.Fatalf("Get on a closed database = %v after %d calls; want %s after 3", err, calls.Load(), CodeUnavailable)
+	}
+
+	calls.Store(0)
+	none := newTestClient(t, addr, &Options{MaxRetries: -1})
+	_, err = none.Get(ctx, "key")
+	if StatusCode(err) != CodeUnavailable || calls.Load() != 1 {
+		t.Fatalf("Get without retries = %v after %d calls; want %s after 1", err, calls.Load(), CodeUnavailable)
+	}
+
+	// A server that starts while the client is retrying is reached
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = listener.Addr().String()
+	listener.Close()
+
+	late := newTestClient(t, addr, &Options{MaxRetries: 10, RetryBackoff: 10 * time.Millisecond})
+	lateServer := server.NewGRPCServer(newTestDB(t), "")
+	defer lateServer.Shutdown(context.Background())
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		time.Sleep(50 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		go lateServer.Serve(listener)
+	}()
+	_, err = late.Get(ctx, "key")
+	<-started
+	if !IsNotFound(err) {
+		t.Fatalf("Get while the server starts = %v, want not found", err)
+	}
+}
+
+// TestPool checks that calls share the pool's connections in turn, and
+// that concurrent calls are multiplexed over them
+func TestPool(t *testing.T) {
+	listener := startServer(t, newTestDB(t))
+	c := newTestClient(t, listener.Addr().String(), &Options{PoolSize: 3})
+	ctx := context.Background()
+
+	for i := 0; i < 9; i++ {
+		err := c.Set(ctx, fmt.Sprintf("key:%d", i), []byte("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if accepted := listener.accepted.Load(); accepted != 3 {
+		t.Fatalf("%d connections for a pool of 3", accepted)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := c.Get(ctx, fmt.Sprintf("key:%d", i%9))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if accepted := listener.accepted.Load(); accepted != 3 {
+		t.Fatalf("%d connections after concurrent calls, want 3", accepted)
+	}
+}
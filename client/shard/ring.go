@@ -0,0 +1,129 @@
+// Package shard spreads a key space over several servers. A Ring assigns
+// every key to one server by consistent hashing, and a Router sends each
+// call to the server that owns its key, moving keys between servers as
+// they join and leave.
+package shard
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultVirtualNodes is how many points each node has on a ring. More
+// points spread keys more evenly at the cost of a larger ring.
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent-hash ring. Each node is hashed to many points on
+// the ring, its virtual nodes, and a key belongs to the node of the first
+// point at or after the key's hash. Adding or removing a node only moves
+// the keys of the points next to its own, about 1/n of them.
+//
+// A Ring never changes once made; Add and Remove return new rings. It is
+// safe for concurrent use.
+type Ring struct {
+	virtualNodes int
+	points       []point
+	nodes        []string
+}
+
+// point is one virtual node
+type point struct {
+	hash uint64
+	node string
+}
+
+// NewRing creates a ring of nodes, each with virtualNodes points, or
+// DefaultVirtualNodes if that is not positive. Rings made of the same
+// nodes with the same number of points assign keys the same way.
+func NewRing(virtualNodes int, nodes ...string) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{virtualNodes: virtualNodes}
+	for _, node := range nodes {
+		if !slices.Contains(r.nodes, node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	r.build()
+	return r
+}
+
+// Add returns a ring with node added
+func (r *Ring) Add(node string) *Ring {
+	return NewRing(r.virtualNodes, append(slices.Clone(r.nodes), node)...)
+}
+
+// Remove returns a ring without node
+func (r *Ring) Remove(node string) *Ring {
+	nodes := slices.DeleteFunc(slices.Clone(r.nodes), func(n string) bool { return n == node })
+	return NewRing(r.virtualNodes, nodes...)
+}
+
+// Owner returns the node key belongs to, or an empty string if the ring
+// has no nodes
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the nodes of the ring in ascending order
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+// Contains reports whether node is on the ring
+func (r *Ring) Contains(node string) bool {
+	_, found := slices.BinarySearch(r.nodes, node)
+	return found
+}
+
+// build places the points of every node on the ring
+func (r *Ring) build() {
+	slices.Sort(r.nodes)
+
+	r.points = make([]point, 0, len(r.nodes)*r.virtualNodes)
+	for _, node := range r.nodes {
+		for i := 0; i < r.virtualNodes; i++ {
+			r.points = append(r.points, point{
+				hash: hash(node + "#" + strconv.Itoa(i)),
+				node: node,
+			})
+		}
+	}
+
+	// Ties are broken by node so that the order does not depend on the
+	// order the nodes were given in
+	slices.SortFunc(r.points, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(a.node, b.node))
+	})
+}
+
+// hash maps s to a point on the ring. FNV-1a is stable across processes
+// and Go versions, which the ring needs for every router to agree; the
+// final mixing spreads the similar strings naming virtual nodes evenly.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
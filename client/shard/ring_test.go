@@ -0,0 +1,108 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testKeys returns n keys sharing a prefix, as real keys tend to
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+	return keys
+}
+
+// TestRingOwner checks that rings of the same nodes assign every key the
+// same way whatever order the nodes were given in, and that a ring without
+// nodes assigns none
+func TestRingOwner(t *testing.T) {
+	a := NewRing(0, "a:1", "b:1", "c:1")
+	b := NewRing(0, "c:1", "a:1", "b:1", "a:1")
+
+	if got := b.Nodes(); fmt.Sprint(got) != "[a:1 b:1 c:1]" {
+		t.Fatalf("Nodes() = %v", got)
+	}
+	for _, key := range testKeys(1000) {
+		if a.Owner(key) != b.Owner(key) {
+			t.Fatalf("rings disagree on the owner of %q: %s and %s", key, a.Owner(key), b.Owner(key))
+		}
+		if !a.Contains(a.Owner(key)) {
+			t.Fatalf("owner %q of %q is not on the ring", a.Owner(key), key)
+		}
+	}
+
+	if owner := NewRing(0).Owner("key"); owner != "" {
+		t.Fatalf("empty ring: Owner = %q, want none", owner)
+	}
+}
+
+// TestRingVirtualNodes checks that each node gets the points it is given,
+// and that with the default number each node owns close to its share of
+// the keys
+func TestRingVirtualNodes(t *testing.T) {
+	nodes := []string{"a:1", "b:1", "c:1", "d:1"}
+	keys := testKeys(40000)
+
+	tests := []struct {
+		virtualNodes int
+		points       int
+	}{
+		{0, DefaultVirtualNodes},
+		{-1, DefaultVirtualNodes},
+		{1, 1},
+		{16, 16},
+	}
+	for _, test := range tests {
+		ring := NewRing(test.virtualNodes, nodes...)
+		if got := len(ring.points); got != test.points*len(nodes) {
+			t.Errorf("NewRing(%d): %d points, want %d", test.virtualNodes, got, test.points*len(nodes))
+		}
+	}
+
+	ring := NewRing(0, nodes...)
+	owned := make(map[string]int)
+	for _, key := range keys {
+		owned[ring.Owner(key)]++
+	}
+	share := len(keys) / len(nodes)
+	for _, node := range nodes {
+		if owned[node] < share*3/4 || owned[node] > share*5/4 {
+			t.Errorf("%s owns %d of %d keys, want about %d", node, owned[node], len(keys), share)
+		}
+	}
+}
+
+// TestRingChange checks that adding a node only moves keys to it, about
+// its share of them, and that removing it moves those same keys back
+func TestRingChange(t *testing.T) {
+	ring := NewRing(0, "a:1", "b:1", "c:1")
+	added := ring.Add("d:1")
+	keys := testKeys(40000)
+
+	moved := 0
+	for _, key := range keys {
+		before, after := ring.Owner(key), added.Owner(key)
+		if before == after {
+			continue
+		}
+		if after != "d:1" {
+			t.Fatalf("%q moved from %s to %s, not to the added node", key, before, after)
+		}
+		moved++
+	}
+	if share := len(keys) / 4; moved < share*3/4 || moved > share*5/4 {
+		t.Errorf("%d of %d keys moved, want about %d", moved, len(keys), share)
+	}
+
+	removed := added.Remove("d:1")
+	if removed.Contains("d:1") || !added.Contains("d:1") {
+		t.Fatal("Remove changed the ring it was called on")
+	}
+	for _, key := range keys {
+		if ring.Owner(key) != removed.Owner(key) {
+			t.Fatalf("%q is owned by %s after removing the added node, want %s", key, removed.Owner(key), ring.Owner(key))
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/client"
+)
+
+// Errors returned by a Router
+var (
+	ErrNoNodes      = errors.New("no nodes to route to")
+	ErrNodeExists   = errors.New("node is already in the ring")
+	ErrUnknownNode  = errors.New("node is not in the ring")
+	ErrLastNode     = errors.New("cannot remove the last node")
+	ErrRouterClosed = errors.New("router is closed")
+
+	// Only strings can be moved over gRPC
+	ErrNotMovable = errors.New("key is not a string and cannot be moved")
+)
+
+// Options configures a Router
+type Options struct {
+	VirtualNodes int             // Points per node on the ring; zero uses DefaultVirtualNodes
+	Client       *client.Options // Options of the client of each node
+}
+
+// A Router sends each call to the server that owns its key. The servers
+// are ordinary gRPC servers, each holding its share of the keys, and know
+// nothing of each other; all of the routing happens here.
+//
+// When a node is added or removed, the keys whose owner changes are moved
+// to their new owner while the Router keeps serving calls. Until they all
+// have been, a key's previous owner is consulted as well: reads that miss
+// on the new owner fall back to it, deletes remove the key from both, and
+// writes go to the new owner only. A key is moved by copying it to its new
+// owner unless it has been written there since, and then deleting it from
+// its previous owner if it has not changed; if it was deleted in the
+// meantime, the copy is deleted too, and if it was written, it is moved
+// again.
+//
+// Only strings can be moved. AddNode and RemoveNode fail with
+// ErrNotMovable, leaving the nodes as they were, if a list, hash, set or
+// sorted set would change owner.
+//
+// Every process routing to the same servers must use the same nodes, and
+// only one Router may change them, with the others updated once it is
+// done.
+type Router struct {
+	options Options
+
+	// Calls hold the read lock while they are made, so a change of ring
+	// waits for those routed by the old one to finish
+	mutex    sync.RWMutex
+	ring     *Ring
+	previous *Ring // The ring before the change being rebalanced, or nil
+	clients  map[string]*client.Client
+	closed   bool
+
+	// changing serializes membership changes
+	changing sync.Mutex
+}
+
+// NewRouter creates a router over nodes, given as host:port addresses of
+// gRPC servers
+func NewRouter(nodes []string, options *Options) (*Router, error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	r := &Router{clients: make(map[string]*client.Client)}
+	if options != nil {
+		r.options = *options
+	}
+
+	r.ring = NewRing(r.options.VirtualNodes, nodes...)
+	for _, node := range r.ring.Nodes() {
+		r.clients[node] = client.New(node, r.options.Client)
+	}
+	return r, nil
+}
+
+// Get returns the value of a key. It fails with client.CodeNotFound if the
+// key does not exist.
+func (r *Router) Get(ctx context.Context, key string) ([]byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	owner, previous, err := r.route(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := owner.Get(ctx, key)
+	if previous == nil || !client.IsNotFound(err) {
+		return value, err
+	}
+
+	// The key may not have been moved yet. If it is moved between these
+	// reads, it is on its owner before it is gone from the previous one.
+	value, err = previous.Get(ctx, key)
+	if !client.IsNotFound(err) {
+		return value, err
+	}
+	return owner.Get(ctx, key)
+}
+
+// Set stores a value for a key
+func (r *Router) Set(ctx context.Context, key string, value []byte) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	owner, _, err := r.route(key)
+	if err != nil {
+		return err
+	}
+	return owner.Set(ctx, key, value)
+}
+
+// SetWithTTL stores a value that expires after ttl
+func (r *Router) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	owner, _, err := r.route(key)
+	if err != nil {
+		return err
+	}
+	return owner.SetWithTTL(ctx, key, value, ttl)
+}
+
+// Delete removes a key. It fails with client.CodeNotFound if the key does
+// not exist.
+func (r *Router) Delete(ctx context.Context, key string) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	owner, previous, err := r.route(key)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		return owner.Delete(ctx, key)
+	}
+
+	// Delete from the previous owner first: a copy made after that is
+	// deleted by the move itself once it finds the key gone
+	err = previous.Delete(ctx, key)
+	if err != nil && !client.IsNotFound(err) {
+		return err
+	}
+	deleted := err == nil
+
+	err = owner.Delete(ctx, key)
+	if deleted && client.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Owner returns the node that owns key
+func (r *Router) Owner(key string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.ring.Owner(key)
+}
+
+// Nodes returns the nodes in ascending order
+func (r *Router) Nodes() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.ring.Nodes()
+}
+
+// AddNode adds the server at addr and moves to it the keys it now owns,
+// returning once they all have been. If moving them fails, the node stays
+// added and calls keep being routed correctly; call Rebalance to finish.
+func (r *Router) AddNode(ctx context.Context, addr string) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	err := r.rebalance(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.RLock()
+	ring := r.ring
+	closed := r.closed
+	r.mutex.RUnlock()
+	switch {
+	case closed:
+		return ErrRouterClosed
+	case ring.Contains(addr):
+		return ErrNodeExists
+	}
+	next := ring.Add(addr)
+	err = r.checkMovable(ctx, ring, next)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRouterClosed
+	}
+	r.clients[addr] = client.New(addr, r.options.Client)
+	r.previous, r.ring = r.ring, next
+	r.mutex.Unlock()
+
+	return r.rebalance(ctx)
+}
+
+// RemoveNode moves the keys of the server at addr to the nodes that own
+// them without it, and then stops routing to it. If moving them fails, the
+// node stays removed and calls keep being routed correctly; call Rebalance
+// to finish.
+func (r *Router) RemoveNode(ctx context.Context, addr string) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	err := r.rebalance(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.RLock()
+	ring := r.ring
+	closed := r.closed
+	r.mutex.RUnlock()
+	switch {
+	case closed:
+		return ErrRouterClosed
+	case !ring.Contains(addr):
+		return ErrUnknownNode
+	case len(ring.Nodes()) == 1:
+		return ErrLastNode
+	}
+	next := ring.Remove(addr)
+	err = r.checkMovable(ctx, ring, next)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRouterClosed
+	}
+	r.previous, r.ring = r.ring, next
+	r.mutex.Unlock()
+
+	return r.rebalance(ctx)
+}
+
+// Rebalance finishes moving keys after AddNode or RemoveNode failed to. It
+// does nothing if there are none left to move.
+func (r *Router) Rebalance(ctx context.Context) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	return r.rebalance(ctx)
+}
+
+// Close closes the clients of every node
+func (r *Router) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+	for _, c := range r.clients {
+		c.Close()
+	}
+	return nil
+}
+
+// route returns the client of the node that owns key and, while keys are
+// being moved, the client of its previous owner if that is another node.
+// The caller must hold the read lock.
+func (r *Router) route(key string) (*client.Client, *client.Client, error) {
+	if r.closed {
+		return nil, nil, ErrRouterClosed
+	}
+
+	owner := r.ring.Owner(key)
+	var previous *client.Client
+	if r.previous != nil {
+		if node := r.previous.Owner(key); node != owner {
+			previous = r.clients[node]
+		}
+	}
+	return r.clients[owner], previous, nil
+}
+
+// rebalance moves every key whose owner has changed to its new owner, all
+// nodes that lost keys being scanned at once, and then forgets the
+// previous ring. The caller must hold the changing lock.
+func (r *Router) rebalance(ctx context.Context) error {
+	r.mutex.RLock()
+	previous, ring := r.previous, r.ring
+	r.mutex.RUnlock()
+	if previous == nil {
+		return nil
+	}
+
+	sources := sources(previous, ring)
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, node := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.migrate(ctx, node, ring)
+		}()
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.previous = nil
+	for node, c := range r.clients {
+		if !ring.Contains(node) {
+			c.Close()
+			delete(r.clients, node)
+		}
+	}
+	return nil
+}
+
+// sources returns the nodes of previous that lose keys in ring. Nodes only
+// lose keys to nodes that were added, so without any only the removed
+// nodes need scanning.
+func sources(previous, ring *Ring) []string {
+	var added bool
+	for _, node := range ring.Nodes() {
+		added = added || !previous.Contains(node)
+	}
+	var sources []string
+	for _, node := range previous.Nodes() {
+		if added || !ring.Contains(node) {
+			sources = append(sources, node)
+		}
+	}
+	return sources
+}
+
+// checkMovable fails with ErrNotMovable if a key that ring takes from a
+// node of previous is not a string. Collections created after the check
+// are not moved. The caller must hold the changing lock.
+func (r *Router) checkMovable(ctx context.Context, previous, ring *Ring) error {
+	for _, source := range sources(previous, ring) {
+		r.mutex.RLock()
+		from := r.clients[source]
+		r.mutex.RUnlock()
+
+		// Keys lists every key and Scan only the strings; a key in the
+		// first alone may also have been written between the two calls
+		strings := make(map[string]bool)
+		err := scan(ctx, from, nil, func(entry client.KeyValue) error {
+			strings[entry.Key] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys, err := from.Keys(ctx, "")
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if strings[key] || ring.Owner(key) == source {
+				continue
+			}
+			_, err = from.Get(ctx, key)
+			switch {
+			case client.StatusCode(err) == client.CodeFailedPrecondition:
+				return fmt.Errorf("%w: %q on %s", ErrNotMovable, key, source)
+			case err != nil && !client.IsNotFound(err):
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrate moves the keys of source that ring assigns to other nodes
+func (r *Router) migrate(ctx context.Context, source string, ring *Ring) error {
+	r.mutex.RLock()
+	from := r.clients[source]
+	r.mutex.RUnlock()
+
+	return scan(ctx, from, nil, func(entry client.KeyValue) error {
+		owner := ring.Owner(entry.Key)
+		if owner == source {
+			return nil
+		}
+		r.mutex.RLock()
+		to := r.clients[owner]
+		r.mutex.RUnlock()
+
+		return move(ctx, from, to, entry)
+	})
+}
+
+// scan calls fn for each entry c streams for options
+func scan(ctx context.Context, c *client.Client, options *client.ScanOptions, fn func(entry client.KeyValue) error) error {
+	stream, err := c.Scan(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	for {
+		entry, err := stream.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// move copies an entry read from one node to another and deletes it from
+// the first. If the entry was written on the first node since it was read,
+// the copy is dropped and the entry read again and moved as it is now.
+func move(ctx context.Context, from, to *client.Client, entry client.KeyValue) error {
+	for {
+		version, err := to.SetWithOptions(ctx, entry.Key, entry.Value, &client.SetOptions{
+			TTL:      entry.TTL,
+			IfAbsent: true,
+		})
+		if client.IsAlreadyExists(err) {
+			// Written through the router since the change began, so the
+			// entry is out of date
+			version, err = 0, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = from.DeleteIfVersion(ctx, entry.Key, entry.Version)
+		switch {
+		case err == nil:
+			return nil
+		case client.IsNotFound(err):
+			// Deleted through the router meanwhile, possibly before the
+			// copy was made
+			return drop(ctx, to, entry.Key, version)
+		case client.StatusCode(err) != client.CodeAborted:
+			return err
+		}
+
+		// Written other than through this router, by a client that has not
+		// seen the change yet
+		err = drop(ctx, to, entry.Key, version)
+		if err != nil {
+			return err
+		}
+		var found bool
+		err = scan(ctx, from, &client.ScanOptions{Start: entry.Key, Limit: 1}, func(next client.KeyValue) error {
+			entry, found = next, next.Key == entry.Key
+			return nil
+		})
+		if err != nil || !found {
+			return err
+		}
+	}
+}
+
+// drop deletes the copy of key that move wrote at version, unless it has
+// been written over since. A version of zero means no copy was written.
+func drop(ctx context.Context, to *client.Client, key string, version uint64) error {
+	if version == 0 {
+		return nil
+	}
+	err := to.DeleteIfVersion(ctx, key, version)
+	if client.IsNotFound(err) || client.StatusCode(err) == client.CodeAborted {
+		return nil
+	}
+	return err
+}
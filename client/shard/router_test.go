@@ -0,0 +1,359 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/client"
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/server"
+)
+
+// startNode serves a fresh database over gRPC on a loopback port, until
+// the test ends
+func startNode(t *testing.T) (string, *database.DB) {
+	t.Helper()
+
+	config := database.DefaultConfig()
+	config.LogPath = t.TempDir()
+	config.SnapshotInterval = 0
+	db, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.NewGRPCServer(db, "")
+	go s.Serve(listener)
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		db.Close()
+	})
+	return listener.Addr().String(), db
+}
+
+// newRouter returns a router over nodes, closed when the test ends
+func newRouter(t *testing.T, nodes ...string) *Router {
+	t.Helper()
+
+	r, err := NewRouter(nodes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// checkPlacement checks that every key in want is on its owner alone,
+// with its value, and that the keys want maps to nil exist nowhere
+func checkPlacement(t *testing.T, r *Router, want map[string][]byte) {
+	t.Helper()
+	ctx := context.Background()
+
+	nodes := r.Nodes()
+	clients := make(map[string]*client.Client)
+	for _, node := range nodes {
+		clients[node] = client.New(node, nil)
+		defer clients[node].Close()
+	}
+
+	for key, value := range want {
+		got, err := r.Get(ctx, key)
+		switch {
+		case value == nil && !client.IsNotFound(err):
+			t.Fatalf("Get(%s) = %q, %v; want not found", key, got, err)
+		case value != nil && (err != nil || string(got) != string(value)):
+			t.Fatalf("Get(%s) = %q, %v; want %q", key, got, err, value)
+		}
+
+		for _, node := range nodes {
+			got, err := clients[node].Get(ctx, key)
+			if value != nil && node == r.Owner(key) {
+				if err != nil || string(got) != string(value) {
+					t.Fatalf("%s on its owner %s = %q, %v; want %q", key, node, got, err, value)
+				}
+			} else if !client.IsNotFound(err) {
+				t.Fatalf("%s on %s = %q, %v; want not found", key, node, got, err)
+			}
+		}
+	}
+}
+
+// TestRouterPlacement checks that calls through the router reach the node
+// that owns each key
+func TestRouterPlacement(t *testing.T) {
+	a, _ := startNode(t)
+	b, _ := startNode(t)
+	r := newRouter(t, a, b)
+	ctx := context.Background()
+
+	want := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		want[key] = []byte(fmt.Sprint(i))
+		err := r.Set(ctx, key, want[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i += 3 {
+		key := fmt.Sprintf("key:%d", i)
+		err := r.Delete(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = nil
+	}
+	checkPlacement(t, r, want)
+
+	owned := make(map[string]int)
+	for key := range want {
+		owned[r.Owner(key)]++
+	}
+	if owned[a] == 0 || owned[b] == 0 {
+		t.Fatalf("keys are not spread over the nodes: %v", owned)
+	}
+}
+
+// TestRouterMigration checks that adding and removing nodes moves each key
+// to its new owner, keeping its expiry
+func TestRouterMigration(t *testing.T) {
+	a, _ := startNode(t)
+	b, _ := startNode(t)
+	c, _ := startNode(t)
+	r := newRouter(t, a, b)
+	ctx := context.Background()
+
+	want := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		want[key] = []byte(fmt.Sprint(i))
+		err := r.SetWithTTL(ctx, key, want[key], time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := r.AddNode(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPlacement(t, r, want)
+
+	err = r.RemoveNode(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(r.Nodes()); got != fmt.Sprint(NewRing(0, b, c).Nodes()) {
+		t.Fatalf("Nodes() = %s after removing %s", got, a)
+	}
+	checkPlacement(t, r, want)
+
+	// The expiry moved with every key
+	for _, node := range r.Nodes() {
+		c := client.New(node, nil)
+		defer c.Close()
+		err = scan(ctx, c, nil, func(entry client.KeyValue) error {
+			if entry.TTL <= 0 || entry.TTL > time.Hour {
+				t.Errorf("%s on %s has a TTL of %v", entry.Key, node, entry.TTL)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = r.AddNode(ctx, b); !errors.Is(err, ErrNodeExists) {
+		t.Fatalf("AddNode of a node in the ring: got %v, want %v", err, ErrNodeExists)
+	}
+	if err = r.RemoveNode(ctx, a); !errors.Is(err, ErrUnknownNode) {
+		t.Fatalf("RemoveNode of a node not in the ring: got %v, want %v", err, ErrUnknownNode)
+	}
+}
+
+// TestRouterRefusesCollections checks that a node is not added while a
+// collection would have to move to it
+func TestRouterRefusesCollections(t *testing.T) {
+	a, db := startNode(t)
+	b, _ := startNode(t)
+	r := newRouter(t, a)
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		_, err := db.RPush(fmt.Sprintf("list:%d", i), []byte("item"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := r.Set(ctx, "key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.AddNode(ctx, b)
+	if !errors.Is(err, ErrNotMovable) {
+		t.Fatalf("AddNode: got %v, want %v", err, ErrNotMovable)
+	}
+	if got := r.Nodes(); len(got) != 1 || got[0] != a {
+		t.Fatalf("Nodes() = %v after a refused AddNode, want [%s]", got, a)
+	}
+	checkPlacement(t, r, map[string][]byte{"key": []byte("value")})
+}
+
+// TestRouterWritesDuringMove checks that writes and deletes made while
+// nodes are added and removed are neither lost nor undone by the move
+func TestRouterWritesDuringMove(t *testing.T) {
+	const (
+		writers = 4
+		numKeys = 400
+	)
+
+	a, _ := startNode(t)
+	b, _ := startNode(t)
+	c, _ := startNode(t)
+	r := newRouter(t, a, b)
+	ctx := context.Background()
+
+	for i := 0; i < numKeys; i++ {
+		err := r.Set(ctx, fmt.Sprintf("key:%d", i), []byte("initial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each writer owns the keys equal to it modulo writers, so it knows
+	// what each of them should hold once it stops
+	wants := make([]map[string][]byte, writers)
+	errs := make([]error, writers)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wants[w] = make(map[string][]byte)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				key := fmt.Sprintf("key:%d", (n*writers+w)%numKeys)
+				if n%5 == 4 {
+					err := r.Delete(ctx, key)
+					if err != nil && !client.IsNotFound(err) {
+						errs[w] = err
+						return
+					}
+					wants[w][key] = nil
+					continue
+				}
+				value := []byte(fmt.Sprintf("%d-%d", w, n))
+				err := r.Set(ctx, key, value)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				wants[w][key] = value
+			}
+		}(w)
+	}
+
+	err := r.AddNode(ctx, c)
+	if err == nil {
+		err = r.RemoveNode(ctx, a)
+	}
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string][]byte)
+	for i := 0; i < numKeys; i++ {
+		want[fmt.Sprintf("key:%d", i)] = []byte("initial")
+	}
+	for w := range wants {
+		if errs[w] != nil {
+			t.Fatalf("writer %d: %v", w, errs[w])
+		}
+		for key, value := range wants[w] {
+			want[key] = value
+		}
+	}
+	checkPlacement(t, r, want)
+}
+
+// TestMoveRewritten checks that an entry written on its previous owner
+// after it was read is moved as it is now, not as it was read
+func TestMoveRewritten(t *testing.T) {
+	a, _ := startNode(t)
+	b, _ := startNode(t)
+	from, to := client.New(a, nil), client.New(b, nil)
+	defer from.Close()
+	defer to.Close()
+	ctx := context.Background()
+
+	err := from.Set(ctx, "key", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry client.KeyValue
+	err = scan(ctx, from, nil, func(e client.KeyValue) error {
+		entry = e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = from.Set(ctx, "key", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = move(ctx, from, to, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := to.Get(ctx, "key")
+	if err != nil || string(value) != "new" {
+		t.Fatalf("moved value = %q, %v; want %q", value, err, "new")
+	}
+	if _, err = from.Get(ctx, "key"); !client.IsNotFound(err) {
+		t.Fatalf("Get from the previous owner: got %v, want not found", err)
+	}
+
+	// An entry deleted since it was read is not moved at all
+	err = from.Set(ctx, "gone", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scan(ctx, from, &client.ScanOptions{Prefix: "gone"}, func(e client.KeyValue) error {
+		entry = e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = from.Delete(ctx, "gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = move(ctx, from, to, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = to.Get(ctx, "gone"); !client.IsNotFound(err) {
+		t.Fatalf("Get of a key deleted before it moved: got %v, want not found", err)
+	}
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/rpc"
+)
+
+// ScanOptions selects the entries streamed by Scan
+type ScanOptions struct {
+	Start   string // First key of the range, inclusive
+	End     string // Key the range stops before; empty for no upper bound
+	Prefix  string // Only keys starting with Prefix, within Start and End
+	Limit   int64  // Maximum number of entries; zero streams them all
+	Reverse bool   // Stream keys in descending order
+}
+
+// KeyValue is one entry streamed by Scan
+type KeyValue struct {
+	Key     string
+	Value   []byte
+	Version uint64
+	TTL     time.Duration // Time left before the key expires; zero if it does not
+}
+
+// EventType identifies the kind of change a WatchEvent reports
+type EventType int
+
+const (
+	EventSet    EventType = rpc.EventSet
+	EventDelete EventType = rpc.EventDelete
+
+	// EventExpire reports a key that expired. Expiries are not logged, so
+	// the event carries the sequence number of the last change before it.
+	EventExpire EventType = rpc.EventExpire
+)
+
+// WatchEvent is one change streamed by Watch
+type WatchEvent struct {
+	Type     EventType
+	Key      string
+	Value    []byte // New value, nil for deletes and expiries
+	OldValue []byte // Value before the change, nil if the key did not exist
+	Sequence uint64 // Sequence number of the log entry that made the change
+}
+
+// WatchOptions selects the changes streamed by WatchWithOptions
+type WatchOptions struct {
+	Prefix string // Keys starting with Prefix; empty watches every key
+	Key    string // Only this key, in place of Prefix
+
+	// After resumes a watch from the sequence number of the last event it
+	// received, replaying the changes since before streaming new ones
+	After uint64
+}
+
+// ScanStream receives the entries of a Scan
+type ScanStream struct {
+	call   *call
+	cancel context.CancelFunc
+}
+
+// WatchStream receives the changes of a Watch
+type WatchStream struct {
+	call   *call
+	cancel context.CancelFunc
+}
+
+// Scan streams the entries selected by options, in key order. Starting the
+// stream is retried like a unary call, but the default timeout does not
+// apply; use ctx to bound the whole scan.
+func (c *Client) Scan(ctx context.Context, options *ScanOptions) (*ScanStream, error) {
+	if options == nil {
+		options = &ScanOptions{}
+	}
+	request := &rpc.ScanRequest{
+		Start:   options.Start,
+		End:     options.End,
+		Prefix:  options.Prefix,
+		Limit:   options.Limit,
+		Reverse: options.Reverse,
+	}
+
+	call, cancel, err := c.openStream(ctx, rpc.MethodScan, request)
+	if err != nil {
+		return nil, err
+	}
+	return &ScanStream{call: call, cancel: cancel}, nil
+}
+
+// Next returns the next entry, or io.EOF once all have been received
+func (s *ScanStream) Next() (KeyValue, error) {
+	var entry rpc.KeyValue
+	err := s.call.recv(&entry)
+	if err != nil {
+		return KeyValue{}, err
+	}
+	return KeyValue{
+		Key:     entry.Key,
+		Value:   entry.Value,
+		Version: entry.Version,
+		TTL:     time.Duration(entry.TTLMillis) * time.Millisecond,
+	}, nil
+}
+
+// Close ends the stream, which may be done before it is exhausted
+func (s *ScanStream) Close() error {
+	s.cancel()
+	s.call.close()
+	return nil
+}
+
+// Watch streams changes to the keys starting with prefix, as they happen,
+// until ctx is done or Close is called. Changes made before Watch returns
+// are not reported. If the stream ends with CodeUnavailable the client fell
+// too far behind or the server went away; watch again and re-read the keys,
+// or resume with WatchWithOptions.
+func (c *Client) Watch(ctx context.Context, prefix string) (*WatchStream, error) {
+	return c.WatchWithOptions(ctx, &WatchOptions{Prefix: prefix})
+}
+
+// WatchWithOptions is Watch for the changes selected by options. Resuming
+// with After fails with CodeOutOfRange once the server no longer keeps the
+// changes since, or has restarted; re-read the keys instead.
+func (c *Client) WatchWithOptions(ctx context.Context, options *WatchOptions) (*WatchStream, error) {
+	if options == nil {
+		options = &WatchOptions{}
+	}
+	request := &rpc.WatchRequest{
+		Prefix: options.Prefix,
+		Key:    options.Key,
+		After:  options.After,
+	}
+
+	call, cancel, err := c.openStream(ctx, rpc.MethodWatch, request)
+	if err != nil {
+		return nil, err
+	}
+	return &WatchStream{call: call, cancel: cancel}, nil
+}
+
+// Recv waits for the next change
+func (s *WatchStream) Recv() (WatchEvent, error) {
+	var event rpc.WatchEvent
+	err := s.call.recv(&event)
+	if err != nil {
+		return WatchEvent{}, err
+	}
+
+	return WatchEvent{
+		Type:     EventType(event.Type),
+		Key:      event.Key,
+		Value:    event.Value,
+		OldValue: event.OldValue,
+		Sequence: event.Sequence,
+	}, nil
+}
+
+// Close ends the watch
+func (s *WatchStream) Close() error {
+	s.cancel()
+	s.call.close()
+	return nil
+}
+
+// openStream starts a server-streaming call that lives until the returned
+// cancel function is called
+func (c *Client) openStream(ctx context.Context, method string, request rpc.Message) (*call, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var opened *call
+	err := c.retry(ctx, func() error {
+		var err error
+		opened, err = c.open(ctx, method, request)
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return opened, cancel, nil
+}
@@ -2,26 +2,131 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+	"github.com/sidquark/KeyValueDatabase/internal/raft"
+	"github.com/sidquark/KeyValueDatabase/internal/replication"
+	"github.com/sidquark/KeyValueDatabase/internal/server"
 )
 
+// replicationBacklog is how many log entries a primary keeps for followers
+// that reconnect
+const replicationBacklog = 10000
+
 func main() {
+	mode := flag.String("mode", "repl", "how to serve the database: repl, resp, http or grpc")
+	addr := flag.String("addr", "", "address to listen on in server modes (default \""+server.DefaultRESPAddr+"\" for resp, \""+server.DefaultHTTPAddr+"\" for http, \""+server.DefaultGRPCAddr+"\" for grpc)")
+	dataDir := flag.String("data", database.DefaultConfig().LogPath, "directory holding the log and snapshots")
+	replicationAddr := flag.String("replication-addr", "", "address to serve followers on, making this database a primary")
+	replicateFrom := flag.String("replicate-from", "", "address of a primary to follow; the database becomes read-only")
+	clusterID := flag.String("cluster-id", "", "name of this server in a Raft cluster, turning on cluster mode")
+	clusterAddr := flag.String("cluster-addr", "", "address to serve the other cluster members on")
+	clusterBootstrap := flag.String("cluster-bootstrap", "", "founding members of a new cluster as id=host:port,...; leave empty to join an existing one")
+	pubsubBuffer := flag.Int("pubsub-buffer", database.DefaultConfig().PubSubBuffer, "pub/sub messages a subscriber may fall behind by")
+	watchHistory := flag.Int("watch-history", database.DefaultConfig().WatchHistory, "recent changes kept for watches to resume from; zero keeps none")
+	pubsubOverflow := flag.String("pubsub-overflow", database.DefaultConfig().PubSubOverflow.String(), "what happens to a subscriber further behind: disconnect or drop")
+	flag.Parse()
+	
+	switch *mode {
+	case "repl", "resp", "http", "grpc":
+	default:
+		fmt.Printf("Unknown mode %q, expected repl, resp, http or grpc\n", *mode)
+		os.Exit(2)
+	}
+	
+	var overflow database.OverflowPolicy
+	switch *pubsubOverflow {
+	case "disconnect":
+		overflow = database.OverflowDisconnect
+	case "drop":
+		overflow = database.OverflowDrop
+	default:
+		fmt.Printf("Unknown -pubsub-overflow %q, expected disconnect or drop\n", *pubsubOverflow)
+		os.Exit(2)
+	}
+	
+	var cluster *database.ClusterConfig
+	if *clusterID != "" {
+		if *clusterAddr == "" || *replicationAddr != "" || *replicateFrom != "" {
+			fmt.Println("Cluster mode needs -cluster-addr and cannot be combined with replication")
+			os.Exit(2)
+		}
+		members, err := parseMembers(*clusterBootstrap)
+		if err != nil {
+			fmt.Printf("Invalid -cluster-bootstrap: %v\n", err)
+			os.Exit(2)
+		}
+		cluster = &database.ClusterConfig{NodeID: *clusterID, Bootstrap: members}
+	}
+	
 	fmt.Println("Welcome to Key-Value Database")
 	fmt.Println("Starting database...")
 	
 	// Create database with default configuration
-	db, err := database.New(nil)
+	config := database.DefaultConfig()
+	config.LogPath = *dataDir
+	if *replicationAddr != "" {
+		config.ReplicationBacklog = replicationBacklog
+	}
+	config.Cluster = cluster
+	config.WatchHistory = *watchHistory
+	config.PubSubBuffer = *pubsubBuffer
+	config.PubSubOverflow = overflow
+	db, err := database.New(config)
 	if err != nil {
 		fmt.Printf("Error initializing database: %v\n", err)
 		os.Exit(1)
 	}
-	defer db.Close()
 	
 	fmt.Println("Database started successfully.")
+	printRecoveryReport(db.RecoveryReport())
+	
+	repl, err := startReplication(db, *replicationAddr, *replicateFrom)
+	if err == nil && cluster != nil {
+		err = serveCluster(db, *clusterAddr)
+	}
+	if err == nil {
+		switch *mode {
+		case "resp":
+			err = serveRESP(db, *addr, repl)
+		case "http":
+			err = serveHTTP(db, *addr, repl)
+		case "grpc":
+			err = serveGRPC(db, *addr)
+		default:
+			runREPL(db)
+		}
+		stopReplication(repl)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	
+	fmt.Println("Shutting down database...")
+	closeErr := db.Close()
+	if closeErr != nil {
+		fmt.Printf("Error closing database: %v\n", closeErr)
+	}
+	if err != nil || closeErr != nil {
+		os.Exit(1)
+	}
+}
+
+// runREPL reads commands from stdin until EOF or exit
+func runREPL(db *database.DB) {
 	fmt.Println("Type 'help' for available commands.")
 	
 	// Start command loop
@@ -40,8 +145,176 @@ func main() {
 		
 		processCommand(db, input)
 	}
+}
+
+// startReplication starts serving followers on primaryAddr and following
+// the primary at followAddr, whichever are set
+func startReplication(db *database.DB, primaryAddr, followAddr string) (*server.Replication, error) {
+	repl := &server.Replication{}
 	
-	fmt.Println("Shutting down database...")
+	if primaryAddr != "" {
+		listener, err := net.Listen("tcp", primaryAddr)
+		if err != nil {
+			return nil, err
+		}
+		repl.Primary = replication.NewPrimary(db, primaryAddr)
+		go repl.Primary.Serve(listener)
+		fmt.Printf("Serving followers on %s\n", listener.Addr())
+	}
+	
+	if followAddr != "" {
+		repl.Follower = replication.NewFollower(db, followAddr)
+		go repl.Follower.Run()
+		fmt.Printf("Following %s; the database is read-only\n", followAddr)
+	}
+	
+	return repl, nil
+}
+
+// parseMembers parses a list of cluster members written as
+// id=host:port,id=host:port
+func parseMembers(list string) ([]raft.Member, error) {
+	var members []raft.Member
+	for _, item := range strings.Split(list, ",") {
+		if item == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(item, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("expected id=host:port, got %q", item)
+		}
+		members = append(members, raft.Member{ID: id, Addr: addr})
+	}
+	
+	return members, nil
+}
+
+// serveCluster serves the other cluster members on addr. The node stops
+// serving when the database is closed.
+func serveCluster(db *database.DB, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	
+	node := db.Cluster()
+	go node.Serve(listener)
+	fmt.Printf("Cluster member %s serving peers on %s; status at http://%s/raft/status\n", node.ID(), listener.Addr(), listener.Addr())
+	
+	return nil
+}
+
+// stopReplication disconnects followers and stops following the primary
+func stopReplication(repl *server.Replication) {
+	if repl.Primary != nil {
+		repl.Primary.Close()
+	}
+	if repl.Follower != nil {
+		repl.Follower.Close()
+	}
+}
+
+// serveRESP serves Redis clients on addr until the process is interrupted
+func serveRESP(db *database.DB, addr string, repl *server.Replication) error {
+	if addr == "" {
+		addr = server.DefaultRESPAddr
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	
+	respServer := server.NewRESPServer(db, addr)
+	respServer.SetReplication(repl)
+	
+	stop := notifyShutdown()
+	go func() {
+		<-stop
+		fmt.Println("Shutting down server...")
+		respServer.Close()
+	}()
+	
+	fmt.Printf("Serving RESP clients on %s\n", listener.Addr())
+	err = respServer.Serve(listener)
+	if err != nil && !errors.Is(err, server.ErrServerClosed) {
+		return err
+	}
+	
+	return nil
+}
+
+// serveHTTP serves the REST API on addr until the process is interrupted.
+// Requests in progress are given a few seconds to finish.
+func serveHTTP(db *database.DB, addr string, repl *server.Replication) error {
+	if addr == "" {
+		addr = server.DefaultHTTPAddr
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	
+	httpServer := server.NewHTTPServer(db, addr)
+	httpServer.SetReplication(repl)
+	
+	stop := notifyShutdown()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-stop
+		fmt.Println("Shutting down server...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- httpServer.Shutdown(ctx)
+	}()
+	
+	fmt.Printf("Serving HTTP on %s\n", listener.Addr())
+	err = httpServer.Serve(listener)
+	if err != nil && !errors.Is(err, server.ErrServerClosed) {
+		return err
+	}
+	
+	// Serve returns as soon as shutdown starts, so wait for it to finish
+	return <-shutdown
+}
+
+// serveGRPC serves the gRPC service on addr until the process is
+// interrupted. Watch streams are ended and unary calls in progress are
+// given a few seconds to finish.
+func serveGRPC(db *database.DB, addr string) error {
+	if addr == "" {
+		addr = server.DefaultGRPCAddr
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	
+	grpcServer := server.NewGRPCServer(db, addr)
+	
+	stop := notifyShutdown()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-stop
+		fmt.Println("Shutting down server...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- grpcServer.Shutdown(ctx)
+	}()
+	
+	fmt.Printf("Serving gRPC on %s\n", listener.Addr())
+	err = grpcServer.Serve(listener)
+	if err != nil && !errors.Is(err, server.ErrServerClosed) {
+		return err
+	}
+	
+	return <-shutdown
+}
+
+// notifyShutdown returns a channel that receives SIGINT and SIGTERM
+func notifyShutdown() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return signals
 }
 
 func processCommand(db *database.DB, input string) {
@@ -67,6 +340,28 @@ func processCommand(db *database.DB, input string) {
 			fmt.Println("OK")
 		}
 		
+	case "mset":
+		if len(parts) < 3 || len(parts)%2 != 1 {
+			fmt.Println("Usage: MSET key value [key value ...]")
+			return
+		}
+		txn, err := db.Begin()
+		if err == nil {
+			for i := 1; i < len(parts) && err == nil; i += 2 {
+				err = txn.Set(parts[i], []byte(parts[i+1]))
+			}
+			if err == nil {
+				err = txn.Commit()
+			} else {
+				txn.Rollback()
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println("OK")
+		}
+		
 	case "get":
 		if len(parts) != 2 {
 			fmt.Println("Usage: GET key")
@@ -93,6 +388,121 @@ func processCommand(db *database.DB, input string) {
 			fmt.Println("OK")
 		}
 		
+	case "setex":
+		if len(parts) < 4 {
+			fmt.Println("Usage: SETEX key seconds value")
+			return
+		}
+		key := parts[1]
+		seconds, err := strconv.Atoi(parts[2])
+		if err != nil {
+			fmt.Println("Error: seconds must be an integer")
+			return
+		}
+		value := []byte(strings.Join(parts[3:], " "))
+		err = db.SetWithTTL(key, value, time.Duration(seconds)*time.Second)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println("OK")
+		}
+		
+	case "incr", "decr":
+		if len(parts) != 2 {
+			fmt.Printf("Usage: %s key\n", strings.ToUpper(command))
+			return
+		}
+		counter := db.Incr
+		if command == "decr" {
+			counter = db.Decr
+		}
+		n, err := counter(parts[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println(n)
+		}
+		
+	case "incrby":
+		if len(parts) != 3 {
+			fmt.Println("Usage: INCRBY key delta")
+			return
+		}
+		delta, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			fmt.Println("Error: delta must be an integer")
+			return
+		}
+		n, err := db.IncrBy(parts[1], delta)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println(n)
+		}
+		
+	case "incrbyfloat":
+		if len(parts) != 3 {
+			fmt.Println("Usage: INCRBYFLOAT key delta")
+			return
+		}
+		delta, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			fmt.Println("Error: delta must be a number")
+			return
+		}
+		n, err := db.IncrByFloat(parts[1], delta)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println(strconv.FormatFloat(n, 'f', -1, 64))
+		}
+		
+	case "expire":
+		if len(parts) != 3 {
+			fmt.Println("Usage: EXPIRE key seconds")
+			return
+		}
+		key := parts[1]
+		seconds, err := strconv.Atoi(parts[2])
+		if err != nil {
+			fmt.Println("Error: seconds must be an integer")
+			return
+		}
+		err = db.Expire(key, time.Duration(seconds)*time.Second)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println("OK")
+		}
+		
+	case "ttl":
+		if len(parts) != 2 {
+			fmt.Println("Usage: TTL key")
+			return
+		}
+		key := parts[1]
+		ttl, err := db.TTL(key)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else if ttl == database.NoExpiry {
+			fmt.Println("(no expiry)")
+		} else {
+			fmt.Printf("%v\n", ttl.Round(time.Second))
+		}
+		
+	case "persist":
+		if len(parts) != 2 {
+			fmt.Println("Usage: PERSIST key")
+			return
+		}
+		key := parts[1]
+		err := db.Persist(key)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println("OK")
+		}
+		
 	case "keys":
 		keys := db.Keys()
 		if len(keys) == 0 {
@@ -103,10 +513,326 @@ func processCommand(db *database.DB, input string) {
 			}
 		}
 		
+	case "scan":
+		if len(parts) < 2 || len(parts) > 3 {
+			fmt.Println("Usage: SCAN prefix [limit]")
+			return
+		}
+		limit := 0
+		if len(parts) == 3 {
+			var err error
+			limit, err = strconv.Atoi(parts[2])
+			if err != nil {
+				fmt.Println("Error: limit must be an integer")
+				return
+			}
+		}
+		result, err := db.ScanPrefix(parts[1], limit)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(result.Entries) == 0 {
+			fmt.Println("(no matching keys)")
+		}
+		for _, entry := range result.Entries {
+			if entry.Type != database.TypeString {
+				fmt.Printf("%s = (%s)\n", entry.Key, entry.Type)
+				continue
+			}
+			fmt.Printf("%s = %s\n", entry.Key, entry.Value)
+		}
+		if result.Cursor != "" {
+			fmt.Println("(more keys follow)")
+		}
+		
 	case "size":
 		size := db.Size()
 		fmt.Printf("Database size: %d entries\n", size)
 		
+	case "type":
+		if len(parts) != 2 {
+			fmt.Println("Usage: TYPE key")
+			return
+		}
+		valueType, err := db.Type(parts[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println(valueType)
+		}
+		
+	case "lpush", "rpush":
+		if len(parts) < 3 {
+			fmt.Printf("Usage: %s key value [value ...]\n", strings.ToUpper(command))
+			return
+		}
+		values := make([][]byte, 0, len(parts)-2)
+		for _, value := range parts[2:] {
+			values = append(values, []byte(value))
+		}
+		push := db.LPush
+		if command == "rpush" {
+			push = db.RPush
+		}
+		length, err := push(parts[1], values...)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("List length: %d\n", length)
+		}
+		
+	case "lpop", "rpop":
+		if len(parts) < 2 || len(parts) > 3 {
+			fmt.Printf("Usage: %s key [count]\n", strings.ToUpper(command))
+			return
+		}
+		count := 1
+		if len(parts) == 3 {
+			var err error
+			count, err = strconv.Atoi(parts[2])
+			if err != nil {
+				fmt.Println("Error: count must be an integer")
+				return
+			}
+		}
+		pop := db.LPop
+		if command == "rpop" {
+			pop = db.RPop
+		}
+		values, err := pop(parts[1], count)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		for _, value := range values {
+			fmt.Printf("%s\n", value)
+		}
+		
+	case "lrange":
+		if len(parts) != 4 {
+			fmt.Println("Usage: LRANGE key start stop")
+			return
+		}
+		start, err := strconv.Atoi(parts[2])
+		if err != nil {
+			fmt.Println("Error: start must be an integer")
+			return
+		}
+		stop, err := strconv.Atoi(parts[3])
+		if err != nil {
+			fmt.Println("Error: stop must be an integer")
+			return
+		}
+		values, err := db.LRange(parts[1], start, stop)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(values) == 0 {
+			fmt.Println("(empty list)")
+		}
+		for i, value := range values {
+			fmt.Printf("%d) %s\n", i+1, value)
+		}
+		
+	case "hset":
+		if len(parts) < 4 || len(parts)%2 != 0 {
+			fmt.Println("Usage: HSET key field value [field value ...]")
+			return
+		}
+		fields := make(map[string][]byte)
+		for i := 2; i < len(parts); i += 2 {
+			fields[parts[i]] = []byte(parts[i+1])
+		}
+		added, err := db.HSet(parts[1], fields)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Added %d fields\n", added)
+		}
+		
+	case "hget":
+		if len(parts) != 3 {
+			fmt.Println("Usage: HGET key field")
+			return
+		}
+		value, err := db.HGet(parts[1], parts[2])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("%s\n", value)
+		}
+		
+	case "hgetall":
+		if len(parts) != 2 {
+			fmt.Println("Usage: HGETALL key")
+			return
+		}
+		hash, err := db.HGetAll(parts[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(hash) == 0 {
+			fmt.Println("(empty hash)")
+		}
+		fields := make([]string, 0, len(hash))
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			fmt.Printf("%s = %s\n", field, hash[field])
+		}
+		
+	case "sadd":
+		if len(parts) < 3 {
+			fmt.Println("Usage: SADD key member [member ...]")
+			return
+		}
+		added, err := db.SAdd(parts[1], parts[2:]...)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Added %d members\n", added)
+		}
+		
+	case "sismember":
+		if len(parts) != 3 {
+			fmt.Println("Usage: SISMEMBER key member")
+			return
+		}
+		member, err := db.SIsMember(parts[1], parts[2])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println(member)
+		}
+		
+	case "sinter":
+		if len(parts) < 2 {
+			fmt.Println("Usage: SINTER key [key ...]")
+			return
+		}
+		members, err := db.SInter(parts[1:]...)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(members) == 0 {
+			fmt.Println("(empty set)")
+		}
+		for _, member := range members {
+			fmt.Println(member)
+		}
+		
+	case "zadd":
+		if len(parts) < 4 || len(parts)%2 != 0 {
+			fmt.Println("Usage: ZADD key score member [score member ...]")
+			return
+		}
+		members := make(map[string]float64)
+		for i := 2; i < len(parts); i += 2 {
+			score, err := strconv.ParseFloat(parts[i], 64)
+			if err != nil {
+				fmt.Println("Error: score must be a number")
+				return
+			}
+			members[parts[i+1]] = score
+		}
+		added, err := db.ZAdd(parts[1], members)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Added %d members\n", added)
+		}
+		
+	case "zrange":
+		if len(parts) != 4 {
+			fmt.Println("Usage: ZRANGE key start stop")
+			return
+		}
+		start, err := strconv.Atoi(parts[2])
+		if err != nil {
+			fmt.Println("Error: start must be an integer")
+			return
+		}
+		stop, err := strconv.Atoi(parts[3])
+		if err != nil {
+			fmt.Println("Error: stop must be an integer")
+			return
+		}
+		members, err := db.ZRange(parts[1], start, stop)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(members) == 0 {
+			fmt.Println("(empty sorted set)")
+		}
+		for i, member := range members {
+			fmt.Printf("%d) %s (%g)\n", i+1, member.Member, member.Score)
+		}
+		
+	case "zrank":
+		if len(parts) != 3 {
+			fmt.Println("Usage: ZRANK key member")
+			return
+		}
+		rank, err := db.ZRank(parts[1], parts[2])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println(rank)
+		}
+		
+	case "publish":
+		if len(parts) < 3 {
+			fmt.Println("Usage: PUBLISH channel message")
+			return
+		}
+		receivers, err := db.Publish(parts[1], []byte(strings.Join(parts[2:], " ")))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Delivered to %d subscribers\n", receivers)
+		}
+		
+	case "subscribe", "psubscribe":
+		if len(parts) < 2 {
+			fmt.Printf("Usage: %s name [name ...]\n", strings.ToUpper(command))
+			return
+		}
+		err := subscribe(db)
+		if err == nil && command == "subscribe" {
+			err = subscription.Subscribe(parts[1:]...)
+		} else if err == nil {
+			err = subscription.PSubscribe(parts[1:]...)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Subscribed to %d channels and %d patterns\n", len(subscription.Channels()), len(subscription.Patterns()))
+		}
+		
+	case "unsubscribe", "punsubscribe":
+		if subscription == nil {
+			fmt.Println("Not subscribed")
+			return
+		}
+		var err error
+		if command == "unsubscribe" {
+			err = subscription.Unsubscribe(parts[1:]...)
+		} else {
+			err = subscription.PUnsubscribe(parts[1:]...)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Printf("Subscribed to %d channels and %d patterns\n", len(subscription.Channels()), len(subscription.Patterns()))
+		}
+		
 	case "help":
 		printHelp()
 		
@@ -115,13 +841,93 @@ func processCommand(db *database.DB, input string) {
 	}
 }
 
+// subscription receives the messages of the REPL's SUBSCRIBE and
+// PSUBSCRIBE commands. It is nil until the first one.
+var subscription *database.Subscription
+
+// subscribe creates the REPL's subscription, printing its messages as they
+// arrive, unless it exists and has not ended
+func subscribe(db *database.DB) error {
+	if subscription != nil && subscription.Err() == nil {
+		return nil
+	}
+	
+	s, err := db.Subscribe()
+	if err != nil {
+		return err
+	}
+	subscription = s
+	
+	go func() {
+		for message := range s.Messages() {
+			if message.Pattern != "" {
+				fmt.Printf("\n[%s via %s] %s\n> ", message.Channel, message.Pattern, message.Payload)
+			} else {
+				fmt.Printf("\n[%s] %s\n> ", message.Channel, message.Payload)
+			}
+		}
+		if errors.Is(s.Err(), database.ErrSlowSubscriber) {
+			fmt.Print("\nUnsubscribed from everything: messages arrived faster than they could be shown\n> ")
+		}
+	}()
+	return nil
+}
+
+func printRecoveryReport(report *persistence.RecoveryReport) {
+	if report == nil {
+		return
+	}
+	
+	if report.SnapshotPath != "" {
+		fmt.Printf("Loaded %d entries from snapshot %s\n", report.SnapshotEntries, report.SnapshotPath)
+	}
+	for _, skipped := range report.SkippedSnapshots {
+		fmt.Printf("Warning: Skipped snapshot %s: %s\n", skipped.Path, skipped.Reason)
+	}
+	fmt.Printf("Replayed %d log entries (%d bytes) in %v\n", report.EntriesReplayed, report.BytesScanned, report.Duration)
+	for _, corrupted := range report.Corruptions {
+		fmt.Printf("Warning: Corrupted log data at position %d (%d bytes, %s): %s\n",
+			corrupted.Position, corrupted.Length, corrupted.Action, corrupted.Reason)
+	}
+}
+
 func printHelp() {
 	fmt.Println("Available commands:")
-	fmt.Println("  SET key value   - Store a key-value pair")
-	fmt.Println("  GET key         - Retrieve a value by key")
-	fmt.Println("  DELETE key      - Remove a key-value pair")
-	fmt.Println("  KEYS            - List all keys")
-	fmt.Println("  SIZE            - Show database size")
-	fmt.Println("  HELP            - Show this help")
-	fmt.Println("  EXIT/QUIT       - Exit the program")
+	fmt.Println("  SET key value           - Store a key-value pair")
+	fmt.Println("  MSET key value ...      - Store several key-value pairs atomically")
+	fmt.Println("  GET key                 - Retrieve a value by key")
+	fmt.Println("  DELETE key              - Remove a key-value pair")
+	fmt.Println("  SETEX key seconds value - Store a key-value pair that expires")
+	fmt.Println("  INCR key                - Add one to an integer")
+	fmt.Println("  DECR key                - Subtract one from an integer")
+	fmt.Println("  INCRBY key delta        - Add to an integer")
+	fmt.Println("  INCRBYFLOAT key delta   - Add to a number")
+	fmt.Println("  EXPIRE key seconds      - Make a key expire")
+	fmt.Println("  TTL key                 - Show the time left before a key expires")
+	fmt.Println("  PERSIST key             - Remove the expiry of a key")
+	fmt.Println("  KEYS                    - List all keys")
+	fmt.Println("  SCAN prefix [limit]     - List entries whose keys start with prefix")
+	fmt.Println("  SIZE                    - Show database size")
+	fmt.Println("  TYPE key                - Show the kind of value a key holds")
+	fmt.Println("  LPUSH key value ...     - Insert values at the head of a list")
+	fmt.Println("  RPUSH key value ...     - Append values to the tail of a list")
+	fmt.Println("  LPOP key [count]        - Remove elements from the head of a list")
+	fmt.Println("  RPOP key [count]        - Remove elements from the tail of a list")
+	fmt.Println("  LRANGE key start stop   - List the elements of a list in a range")
+	fmt.Println("  HSET key field value    - Set fields of a hash")
+	fmt.Println("  HGET key field          - Retrieve a field of a hash")
+	fmt.Println("  HGETALL key             - List the fields of a hash")
+	fmt.Println("  SADD key member ...     - Add members to a set")
+	fmt.Println("  SISMEMBER key member    - Check whether a set holds a member")
+	fmt.Println("  SINTER key ...          - List the members common to sets")
+	fmt.Println("  ZADD key score member   - Add members to a sorted set")
+	fmt.Println("  ZRANGE key start stop   - List the members of a sorted set by rank")
+	fmt.Println("  ZRANK key member        - Show the rank of a sorted set member")
+	fmt.Println("  PUBLISH channel message - Send a message to a channel's subscribers")
+	fmt.Println("  SUBSCRIBE channel ...   - Print the messages sent to channels")
+	fmt.Println("  PSUBSCRIBE pattern ...  - Print the messages sent to matching channels")
+	fmt.Println("  UNSUBSCRIBE [channel]   - Stop printing a channel's messages, or all")
+	fmt.Println("  PUNSUBSCRIBE [pattern]  - Stop printing a pattern's messages, or all")
+	fmt.Println("  HELP                    - Show this help")
+	fmt.Println("  EXIT/QUIT               - Exit the program")
 }
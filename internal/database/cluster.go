@@ -0,0 +1,172 @@
+package database
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+	"github.com/sidquark/KeyValueDatabase/internal/raft"
+)
+
+// proposeTimeout bounds how long a write waits for the cluster to commit it
+const proposeTimeout = 10 * time.Second
+
+// In cluster mode the database is one member of a Raft cluster. A write is
+// checked against memory under its key lock as usual, but instead of being
+// logged it is proposed to the leader's Raft log, still holding the lock.
+// Only once a majority has stored it is it committed and applied, on every
+// member alike: it is logged under its Raft index, which becomes its
+// version, and then applied to memory. The write returns once that has
+// happened here. Only the leader accepts writes; reads are served from
+// memory on every member, so a follower may return values that are
+// slightly out of date.
+//
+// The database's own log and snapshots keep what has been applied, so on
+// restart Raft only has to apply what came after. Members that need
+// entries the leader has discarded are sent a snapshot of the key space in
+// the snapshot file format.
+//
+// scripts/cluster.sh runs a three-member cluster on one machine for
+// testing.
+
+// ClusterConfig turns on cluster mode
+type ClusterConfig struct {
+	NodeID string
+
+	// Bootstrap lists the members a new cluster starts with, this one
+	// included. Leave it empty on a server joining an existing cluster,
+	// and add it through the leader instead.
+	Bootstrap []raft.Member
+
+	HeartbeatInterval time.Duration // Zero picks the Raft default
+	ElectionTimeout   time.Duration // Zero picks the Raft default
+}
+
+// ErrNotLeader is returned by writes to a cluster member that is not the
+// leader. The error returned names the leader when it is known.
+var ErrNotLeader = raft.ErrNotLeader
+
+// openCluster starts the database's Raft node. The Raft log is kept in a
+// directory of its own next to the database's log.
+func (db *DB) openCluster(config *ClusterConfig) error {
+	node, err := raft.NewNode(raft.Options{
+		ID:                config.NodeID,
+		Dir:               filepath.Join(db.config.LogPath, "raft"),
+		Bootstrap:         config.Bootstrap,
+		HeartbeatInterval: config.HeartbeatInterval,
+		ElectionTimeout:   config.ElectionTimeout,
+	}, clusterMachine{db})
+	if err != nil {
+		return err
+	}
+
+	db.cluster = node
+	return nil
+}
+
+// Cluster returns the database's Raft node, or nil if it is not in cluster
+// mode. The node must be served for the other members to reach it.
+func (db *DB) Cluster() *raft.Node {
+	return db.cluster
+}
+
+// propose replicates a write through the cluster and waits until it has
+// been applied here, returning its index. The caller must hold the key
+// locks of everything written.
+func (db *DB) propose(operation persistence.LogOperation, key string, value []byte) (uint64, error) {
+	data, err := persistence.EncodeEntry(&persistence.LogEntry{
+		Timestamp: time.Now().UnixNano(),
+		Operation: operation,
+		Key:       key,
+		Value:     value,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+	defer cancel()
+	return db.cluster.Propose(ctx, db.clusterTerm.Load(), data)
+}
+
+// clusterMachine is the database as the state machine Raft replicates
+type clusterMachine struct {
+	db *DB
+}
+
+// Apply logs a committed write under its index and applies it to memory
+func (m clusterMachine) Apply(index uint64, data []byte) error {
+	db := m.db
+	entry, err := persistence.DecodeEntry(data)
+	if err != nil {
+		return err
+	}
+	entry.Sequence = index
+
+	// The proposer holds the key locks while it waits for this, so the
+	// apply mutex stands in for them when snapshots are taken
+	db.applyMutex.Lock()
+	defer db.applyMutex.Unlock()
+
+	err = db.log.AppendEntries([]*persistence.LogEntry{entry})
+	if err != nil {
+		return err
+	}
+
+	watched := db.watchers.active()
+	var events []WatchEvent
+	if watched {
+		events = db.entryEvents(entry)
+	}
+	err = db.applyEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	if watched {
+		db.watchers.publish(events...)
+	}
+
+	return nil
+}
+
+// Snapshot writes the key space in the snapshot file format
+func (m clusterMachine) Snapshot(w io.Writer) error {
+	return persistence.WriteSnapshot(w, 0, m.db.iterateStorage)
+}
+
+// Restore replaces the key space with a snapshot covering the Raft log up
+// to index
+func (m clusterMachine) Restore(index uint64, r io.Reader) error {
+	var entries []*persistence.SnapshotEntry
+	_, err := persistence.ReadSnapshot(r, func(entry *persistence.SnapshotEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.db.LoadReplicaSnapshot(index, entries)
+}
+
+// Persisted syncs the log, in which every applied write is kept, and
+// returns the index of the last one
+func (m clusterMachine) Persisted() (uint64, error) {
+	err := m.db.log.Sync()
+	if err != nil {
+		return 0, err
+	}
+	return m.db.log.LastSequence(), nil
+}
+
+// LeaderReady lets writes through once this member leads term. Writes
+// check memory before they are proposed, so they must wait until it holds
+// everything committed by earlier leaders; taking every key lock makes
+// sure no write checked memory before then and proposes after.
+func (m clusterMachine) LeaderReady(term uint64) {
+	m.db.keyLocks.lockAll()
+	m.db.clusterTerm.Store(term)
+	m.db.keyLocks.unlockAll()
+}
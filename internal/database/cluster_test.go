@@ -0,0 +1,210 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+	"github.com/sidquark/KeyValueDatabase/internal/raft"
+)
+
+// TestClusterApplyRejectsBadLength checks that a committed write is not
+// trusted to be longer than the data Raft hands over
+func TestClusterApplyRejectsBadLength(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	machine := clusterMachine{db: db}
+
+	data, err := persistence.EncodeEntry(&persistence.LogEntry{Operation: persistence.OperationSet, Key: "key", Value: []byte("value")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = machine.Apply(1, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get("key")
+	if err != nil || string(value) != "value" {
+		t.Fatalf("Get = %q, %v; want %q", value, err, "value")
+	}
+
+	// A header claiming almost 4 GiB with nothing behind it
+	bad := append([]byte(nil), data[:5]...)
+	binary.LittleEndian.PutUint32(bad[1:5], 1<<32-1)
+	err = machine.Apply(2, bad)
+	if err == nil {
+		t.Fatal("Apply accepted a record longer than its data")
+	}
+
+	err = machine.Apply(2, append(data, 0))
+	if err == nil {
+		t.Fatal("Apply accepted trailing data")
+	}
+}
+
+// TestClusterRestoreRejectsBadLength checks that a snapshot from a peer
+// claiming an oversized value is rejected and leaves the key space alone
+func TestClusterRestoreRejectsBadLength(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	machine := clusterMachine{db: db}
+
+	err = db.Set("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	err = machine.Snapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Claim an oversized value for the only entry: the header is 13 bytes,
+	// then come the marker, the key length and the key
+	data := snapshot.Bytes()
+	binary.LittleEndian.PutUint32(data[13+3+len("key"):], 1<<32-1)
+	err = machine.Restore(5, bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("Restore accepted an oversized value")
+	}
+
+	value, err := db.Get("key")
+	if err != nil || string(value) != "value" {
+		t.Fatalf("Get = %q, %v; want %q", value, err, "value")
+	}
+}
+
+// TestCluster runs three members over loopback TCP. Writes go through the
+// leader and reach every member, followers turn writes away, another
+// member takes over when the leader goes, and the old leader catches up
+// when it comes back.
+func TestCluster(t *testing.T) {
+	var members []raft.Member
+	listeners := make(map[string]net.Listener)
+	for i := range 3 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprint("n", i+1)
+		listeners[id] = listener
+		members = append(members, raft.Member{ID: id, Addr: listener.Addr().String()})
+	}
+
+	dirs := make(map[string]string)
+	dbs := make(map[string]*DB)
+	start := func(member raft.Member, listener net.Listener) {
+		if dirs[member.ID] == "" {
+			dirs[member.ID] = t.TempDir()
+		}
+		config := testConfig(dirs[member.ID])
+		config.Cluster = &ClusterConfig{
+			NodeID:            member.ID,
+			Bootstrap:         members,
+			HeartbeatInterval: 20 * time.Millisecond,
+			ElectionTimeout:   200 * time.Millisecond,
+		}
+		db, err := New(config)
+		if err != nil {
+			listener.Close()
+			t.Fatal(err)
+		}
+		go db.Cluster().Serve(listener)
+		t.Cleanup(func() {
+			db.Close()
+		})
+		dbs[member.ID] = db
+	}
+	for _, member := range members {
+		start(member, listeners[member.ID])
+	}
+
+	leader := clusterLeader(t, dbs)
+	err := leader.Set("a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, dbs, "a", "1")
+
+	for _, db := range dbs {
+		if db == leader {
+			continue
+		}
+		err = db.Set("a", []byte("2"))
+		if !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("Set on a follower: got %v, want %v", err, ErrNotLeader)
+		}
+	}
+
+	// Another member takes over
+	var old raft.Member
+	for _, member := range members {
+		if dbs[member.ID] == leader {
+			old = member
+		}
+	}
+	leader.Close()
+	delete(dbs, old.ID)
+	leader = clusterLeader(t, dbs)
+	err = leader.Set("b", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader comes back and catches up
+	listener, err := net.Listen("tcp", old.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(old, listener)
+	waitForValue(t, dbs, "a", "1")
+	waitForValue(t, dbs, "b", "2")
+}
+
+// clusterLeader waits until one member leads and accepts writes, and
+// returns it
+func clusterLeader(t *testing.T, dbs map[string]*DB) *DB {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, db := range dbs {
+			status := db.Cluster().Status()
+			if status.Role == raft.Leader && db.clusterTerm.Load() == status.Term {
+				return db
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no member became leader")
+	return nil
+}
+
+// waitForValue waits until every member holds want for key
+func waitForValue(t *testing.T, dbs map[string]*DB, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for id, db := range dbs {
+		for {
+			value, err := db.Get(key)
+			if err == nil && string(value) == want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: Get(%s) = %q, %v; want %q", id, key, value, err, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
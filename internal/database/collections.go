@@ -0,0 +1,448 @@
+package database
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+	"github.com/sidquark/KeyValueDatabase/internal/storage"
+)
+
+// Besides strings, a key may hold a collection: a list, hash, set or sorted
+// set. Collections are changed in place by their own operations, each of
+// which checks the key under its lock, logs only the change it makes and
+// then applies that change, the same way replay does. A collection left
+// empty is removed, and operations on a key holding another kind of value
+// fail with ErrWrongType. Set replaces a collection like any other value.
+//
+// In memory a collection is kept decoded, so that a change costs as much as
+// the elements it touches rather than the whole collection. It is only
+// encoded, with persistence.EncodeItems, for snapshots.
+
+// ValueType is the kind of value a key holds
+type ValueType = storage.ValueType
+
+// The kinds of values a key may hold
+const (
+	TypeString    = storage.TypeString
+	TypeList      = storage.TypeList
+	TypeHash      = storage.TypeHash
+	TypeSet       = storage.TypeSet
+	TypeSortedSet = storage.TypeSortedSet
+)
+
+// collectionTypes maps every collection change to the type it applies to
+var collectionTypes = map[persistence.LogOperation]ValueType{
+	persistence.OperationListPushLeft:    TypeList,
+	persistence.OperationListPushRight:   TypeList,
+	persistence.OperationListPopLeft:     TypeList,
+	persistence.OperationListPopRight:    TypeList,
+	persistence.OperationHashSet:         TypeHash,
+	persistence.OperationHashDelete:      TypeHash,
+	persistence.OperationSetAdd:          TypeSet,
+	persistence.OperationSetRemove:       TypeSet,
+	persistence.OperationSortedSetAdd:    TypeSortedSet,
+	persistence.OperationSortedSetRemove: TypeSortedSet,
+}
+
+// Type returns the kind of value key holds
+func (db *DB) Type(key string) (ValueType, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	entry, exists := db.storage.GetEntry(key)
+	if !exists {
+		return 0, NewDatabaseError("type", key, ErrKeyNotFound)
+	}
+
+	return entry.Type, nil
+}
+
+// checkKey validates the key of an operation
+func (db *DB) checkKey(key string) error {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	return nil
+}
+
+// readCollection calls fn with the collection of type valueType at key,
+// read-locked, and reports whether the key holds one; an empty collection
+// stands in for a missing key. It fails with ErrWrongType if the key holds
+// another kind of value.
+func (db *DB) readCollection(operation, key string, valueType ValueType, fn func(c *collection)) (bool, error) {
+	entry, exists := db.storage.GetEntry(key)
+	if !exists {
+		fn(newCollection(valueType))
+		return false, nil
+	}
+	if entry.Type != valueType {
+		return false, NewDatabaseError(operation, key, ErrWrongType)
+	}
+
+	c, err := collectionOf(entry)
+	if err != nil {
+		return false, NewDatabaseError(operation, key, err)
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	fn(c)
+	return true, nil
+}
+
+// changeCollectionLocked logs a change to the collection at key, made of
+// items, and then applies it. create is set if the key does not hold the
+// collection yet. The caller must hold the key lock and have checked the
+// type of the key.
+func (db *DB) changeCollectionLocked(operation persistence.LogOperation, key string, create bool, items [][]byte) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+
+	data := persistence.EncodeCollectionChange(create, items)
+	if db.cluster != nil {
+		_, err := db.propose(operation, key, data)
+		return err
+	}
+
+	// Write to log
+	sequence, err := db.log.Append(operation, key, data)
+	if err != nil {
+		return err
+	}
+
+	// Apply to in-memory storage as replay would
+	entry := &persistence.LogEntry{Sequence: sequence, Operation: operation, Key: key, Value: data}
+	watched := db.watchers.active()
+	var events []WatchEvent
+	if watched {
+		events = db.entryEvents(entry)
+	}
+	err = db.applyEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	if watched {
+		db.watchers.publish(events...)
+	}
+
+	return nil
+}
+
+// applyCollection applies a logged collection change to in-memory storage.
+// Snapshots are read while writes carry on, so the key may already hold the
+// change, in which case it was written at the change's sequence or later.
+// As with other entries, a collection whose expiry has passed is changed
+// all the same.
+func (db *DB) applyCollection(entry *persistence.LogEntry) error {
+	previous, exists := db.storage.Lookup(entry.Key)
+	if exists && previous.Version >= entry.Sequence {
+		return nil
+	}
+	create, items, err := persistence.DecodeCollectionChange(entry.Value)
+	if err != nil {
+		return err
+	}
+
+	valueType := collectionTypes[entry.Operation]
+	var c *collection
+	switch {
+	case create:
+		c, previous = newCollection(valueType), storage.Entry{Type: valueType}
+	case !exists:
+		// The collection has expired, as would the result
+		return nil
+	case previous.Type != valueType:
+		return fmt.Errorf("operation %d applied to a %s", entry.Operation, previous.Type)
+	default:
+		c, err = collectionOf(previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mutex.Lock()
+	err = c.apply(entry.Operation, items, entry.Sequence)
+	empty := c.length() == 0
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if empty {
+		db.storage.Delete(entry.Key)
+		return nil
+	}
+	previous.Value, previous.Collection, previous.Version = nil, c, entry.Sequence
+	db.storage.SetEntry(entry.Key, previous)
+	return nil
+}
+
+// collectionEvents returns the watch event for a collection change that is
+// about to be applied. Watchers are only sent string values, so it carries
+// none.
+func (db *DB) collectionEvents(entry *persistence.LogEntry) []WatchEvent {
+	previous, exists := db.storage.Lookup(entry.Key)
+	if exists && previous.Version >= entry.Sequence {
+		return nil
+	}
+	create, items, err := persistence.DecodeCollectionChange(entry.Value)
+	if err != nil {
+		return nil
+	}
+
+	removed := false
+	if !create {
+		if !exists || previous.Type != collectionTypes[entry.Operation] {
+			return nil
+		}
+		c, err := collectionOf(previous)
+		if err != nil {
+			return nil
+		}
+		c.mutex.RLock()
+		removed = c.emptiedBy(entry.Operation, items)
+		c.mutex.RUnlock()
+	}
+
+	event := WatchEvent{Type: EventSet, Key: entry.Key, OldValue: stringValue(previous), Sequence: entry.Sequence}
+	if removed {
+		event.Type = EventDelete
+	}
+	return []WatchEvent{event}
+}
+
+// stringValue returns the value of an entry if it is a string, and nil
+// otherwise
+func stringValue(entry storage.Entry) []byte {
+	if entry.Type != TypeString {
+		return nil
+	}
+	return entry.Value
+}
+
+// collection is the decoded value of a list, hash, set or sorted set, which
+// changes are applied to in place. Readers do not take the key lock, so it
+// has a lock of its own, which writers hold while they apply a change. It
+// carries the version of the last change applied, for snapshots to read
+// along with its contents.
+type collection struct {
+	mutex     sync.RWMutex
+	valueType ValueType
+	version   uint64
+	list      list                // TypeList
+	hash      map[string][]byte   // TypeHash
+	set       map[string]struct{} // TypeSet
+	scores    map[string]float64  // TypeSortedSet
+}
+
+// newCollection creates an empty collection of type valueType
+func newCollection(valueType ValueType) *collection {
+	c := &collection{valueType: valueType}
+	switch valueType {
+	case TypeHash:
+		c.hash = make(map[string][]byte)
+	case TypeSet:
+		c.set = make(map[string]struct{})
+	case TypeSortedSet:
+		c.scores = make(map[string]float64)
+	}
+	return c
+}
+
+// collectionOf returns the collection an entry of a collection type holds.
+// One loaded from a snapshot that failed to decode is held encoded, and
+// fails to decode again here.
+func collectionOf(entry storage.Entry) (*collection, error) {
+	if c, ok := entry.Collection.(*collection); ok {
+		return c, nil
+	}
+
+	items, err := persistence.DecodeItems(entry.Value)
+	if err != nil {
+		return nil, err
+	}
+	c := &collection{valueType: entry.Type, version: entry.Version}
+	switch entry.Type {
+	case TypeList:
+		c.list = list{buffer: items}
+	case TypeHash:
+		c.hash = decodeHash(items)
+	case TypeSet:
+		c.set = decodeSet(items)
+	case TypeSortedSet:
+		c.scores, err = decodeSortedSet(items)
+	default:
+		err = fmt.Errorf("%s is not a collection", entry.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadedEntry returns the entry to store for a key read from a snapshot,
+// decoding it if it holds a collection
+func loadedEntry(entry *persistence.SnapshotEntry) storage.Entry {
+	loaded := storage.Entry{
+		Value:     entry.Value,
+		Type:      ValueType(entry.Type),
+		ExpiresAt: entry.ExpiresAt,
+		Version:   entry.Version,
+	}
+	if loaded.Type != TypeString {
+		c, err := collectionOf(loaded)
+		if err == nil {
+			loaded.Value, loaded.Collection = nil, c
+		}
+	}
+	return loaded
+}
+
+// snapshotEntry returns the snapshot entry for a key holding entry, or
+// false if the key should be left out. A collection may have been emptied,
+// and its key removed, since the entry was read; the changes that did so
+// are replayed after the snapshot all the same.
+func snapshotEntry(key string, entry storage.Entry) (*persistence.SnapshotEntry, bool) {
+	snapshot := &persistence.SnapshotEntry{
+		Key:       key,
+		Value:     entry.Value,
+		Type:      uint8(entry.Type),
+		ExpiresAt: entry.ExpiresAt,
+		Version:   entry.Version,
+	}
+	if c, ok := entry.Collection.(*collection); ok {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		if c.length() == 0 {
+			return nil, false
+		}
+		snapshot.Value = persistence.EncodeItems(c.items())
+		snapshot.Version = max(snapshot.Version, c.version)
+	}
+	return snapshot, true
+}
+
+// items returns the collection in the form snapshots hold it in. The
+// caller must hold the lock.
+func (c *collection) items() [][]byte {
+	switch c.valueType {
+	case TypeList:
+		return c.list.items()
+	case TypeHash:
+		return encodeHash(c.hash)
+	case TypeSet:
+		return encodeSet(c.set)
+	case TypeSortedSet:
+		return encodeSortedSet(c.scores)
+	}
+	return nil
+}
+
+// length returns the number of elements, fields or members in the
+// collection. The caller must hold the lock.
+func (c *collection) length() int {
+	switch c.valueType {
+	case TypeList:
+		return c.list.length()
+	case TypeHash:
+		return len(c.hash)
+	case TypeSet:
+		return len(c.set)
+	case TypeSortedSet:
+		return len(c.scores)
+	}
+	return 0
+}
+
+// apply applies a logged change, made of items, and gives the collection
+// version. A change that cannot be decoded is rejected before anything is
+// changed. The caller must hold the lock for writing.
+func (c *collection) apply(operation persistence.LogOperation, items [][]byte, version uint64) error {
+	switch operation {
+	case persistence.OperationListPushLeft:
+		c.list.pushLeft(items)
+	case persistence.OperationListPushRight:
+		c.list.pushRight(items)
+	case persistence.OperationListPopLeft, persistence.OperationListPopRight:
+		count, err := decodeCount(items)
+		if err != nil {
+			return err
+		}
+		c.list.pop(count, operation == persistence.OperationListPopLeft)
+	case persistence.OperationHashSet:
+		setFields(c.hash, items)
+	case persistence.OperationHashDelete:
+		deleteKeys(c.hash, items)
+	case persistence.OperationSetAdd:
+		addMembers(c.set, items)
+	case persistence.OperationSetRemove:
+		deleteKeys(c.set, items)
+	case persistence.OperationSortedSetAdd:
+		scores, err := decodeSortedSet(items)
+		if err != nil {
+			return err
+		}
+		maps.Copy(c.scores, scores)
+	case persistence.OperationSortedSetRemove:
+		deleteKeys(c.scores, items)
+	}
+
+	c.version = version
+	return nil
+}
+
+// emptiedBy reports whether a logged change, made of items, would leave
+// the collection empty. The caller must hold the lock.
+func (c *collection) emptiedBy(operation persistence.LogOperation, items [][]byte) bool {
+	switch operation {
+	case persistence.OperationListPopLeft, persistence.OperationListPopRight:
+		count, err := decodeCount(items)
+		return err == nil && count >= c.list.length()
+	case persistence.OperationHashDelete:
+		return len(present(c.hash, fromItems(items))) == len(c.hash)
+	case persistence.OperationSetRemove:
+		return len(present(c.set, fromItems(items))) == len(c.set)
+	case persistence.OperationSortedSetRemove:
+		return len(present(c.scores, fromItems(items))) == len(c.scores)
+	}
+	return false
+}
+
+// present returns the keys that m holds, each once, in the order they
+// first appear in keys
+func present[V any](m map[string]V, keys []string) []string {
+	var found []string
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := m[key]; !ok {
+			continue
+		}
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			found = append(found, key)
+		}
+	}
+	return found
+}
+
+// deleteKeys removes the keys of a logged removal from m
+func deleteKeys[V any](m map[string]V, items [][]byte) {
+	for _, key := range items {
+		delete(m, string(key))
+	}
+}
@@ -0,0 +1,306 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// TestListEnds checks pushes and pops at both ends of a list against a
+// plain slice, across the list growing and shrinking
+func TestListEnds(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var want [][]byte
+	for i := range 200 {
+		value := []byte(fmt.Sprint(i))
+		switch i % 5 {
+		case 0, 1:
+			_, err = db.RPush("list", value)
+			want = append(want, value)
+		case 2, 3:
+			_, err = db.LPush("list", value, value)
+			want = append([][]byte{value, value}, want...)
+		case 4:
+			var popped [][]byte
+			popped, err = db.LPop("list", 2)
+			if err == nil && !equalItems(popped, want[:2]) {
+				t.Fatalf("LPop = %q, want %q", popped, want[:2])
+			}
+			want = want[2:]
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	popped, err := db.RPop("list", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := want[len(want)-3:]
+	if !equalItems(popped, [][]byte{last[2], last[1], last[0]}) {
+		t.Fatalf("RPop = %q, want the last three of %q in reverse", popped, want)
+	}
+	want = want[:len(want)-3]
+
+	got, err := db.LRange("list", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalItems(got, want) {
+		t.Fatalf("LRange = %q, want %q", got, want)
+	}
+
+	// Popping everything removes the key
+	_, err = db.LPop("list", len(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Type("list")
+	if err == nil {
+		t.Fatal("emptied list was not removed")
+	}
+}
+
+// TestLRangeIsCopy checks that a range read from a list is not changed by
+// later writes to it
+func TestLRangeIsCopy(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.RPush("list", []byte("a"), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.LRange("list", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.LPop("list", 2)
+	if err == nil {
+		_, err = db.LPush("list", []byte("c"), []byte("d"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalItems(got, [][]byte{[]byte("a"), []byte("b")}) {
+		t.Fatalf("earlier LRange changed to %q", got)
+	}
+}
+
+// TestCollectionsSurviveRestart checks that collections come back the same
+// from the log alone, and from a snapshot followed by the log
+func TestCollectionsSurviveRestart(t *testing.T) {
+	for _, snapshot := range []bool{false, true} {
+		t.Run(fmt.Sprintf("snapshot=%v", snapshot), func(t *testing.T) {
+			config := testConfig(t.TempDir())
+			db, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fill := func(round int) {
+				for i := range 10 {
+					member := fmt.Sprint(round*10 + i)
+					_, err := db.RPush("list", []byte(member))
+					if err == nil {
+						_, err = db.HSet("hash", map[string][]byte{member: []byte(member)})
+					}
+					if err == nil {
+						_, err = db.SAdd("set", member)
+					}
+					if err == nil {
+						_, err = db.ZAdd("zset", map[string]float64{member: float64(i)})
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				_, err := db.LPop("list", 3)
+				if err == nil {
+					_, err = db.HDel("hash", fmt.Sprint(round*10))
+				}
+				if err == nil {
+					_, err = db.SRem("set", fmt.Sprint(round*10+1))
+				}
+				if err == nil {
+					_, err = db.ZRem("zset", fmt.Sprint(round*10+2))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			fill(0)
+			if snapshot {
+				err = db.takeSnapshot()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			fill(1)
+
+			want := readCollections(t, db)
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			got := readCollections(t, db)
+			if !maps.EqualFunc(got, want, slices.Equal) {
+				t.Fatalf("after restart got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestCollectionSnapshotWhileWriting checks that snapshots taken while a
+// list is being changed, and read while it is, come back the same after a
+// restart, without changes applied twice
+func TestCollectionSnapshotWhileWriting(t *testing.T) {
+	config := testConfig(t.TempDir())
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 2000 {
+			_, err := db.RPush("list", []byte(fmt.Sprint(i)))
+			if err == nil && i%3 == 0 {
+				_, err = db.LPop("list", 2)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		_, err = db.LRange("list", 0, -1)
+		if err == nil {
+			err = db.takeSnapshot()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := db.LRange("list", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	got, err := db.LRange("list", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalItems(got, want) {
+		t.Fatalf("after restart got %d elements, want %d", len(got), len(want))
+	}
+}
+
+// readCollections returns the contents of the collections written by
+// TestCollectionsSurviveRestart, as strings
+func readCollections(t *testing.T, db *DB) map[string][]string {
+	t.Helper()
+
+	list, err := db.LRange("list", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := db.HGetAll("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := db.SMembers("set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zset, err := db.ZRange("zset", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := map[string][]string{"list": fromItems(list), "set": set}
+	for _, field := range slices.Sorted(maps.Keys(hash)) {
+		contents["hash"] = append(contents["hash"], field+"="+string(hash[field]))
+	}
+	for _, member := range zset {
+		contents["zset"] = append(contents["zset"], fmt.Sprintf("%s=%g", member.Member, member.Score))
+	}
+	return contents
+}
+
+// equalItems reports whether two sequences of byte strings are the same
+func equalItems(a, b [][]byte) bool {
+	return slices.EqualFunc(a, b, bytes.Equal)
+}
+
+// BenchmarkQueue pushes to the tail of a long list and pops from its head,
+// which should not get slower as the list grows
+func BenchmarkQueue(b *testing.B) {
+	for _, length := range []int{100, 10000} {
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			db, err := New(testConfig(b.TempDir()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			value := []byte("value")
+			for range length {
+				_, err = db.RPush("queue", value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				_, err = db.RPush("queue", value)
+				if err == nil {
+					_, err = db.LPop("queue", 1)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/sidquark/KeyValueDatabase/internal/storage"
+)
+
+// A counter is a string holding a decimal number. It is read, changed,
+// logged and stored under the key lock, so no other change to the key can
+// come in between. The log records the value the counter ends up
+// with rather than the increment, so replay sets it to the same value
+// whatever it holds by then. A missing key counts from zero, and a counter
+// that expires keeps its expiry.
+
+// Incr adds one to the integer at key and returns the result
+func (db *DB) Incr(key string) (int64, error) {
+	return db.incrBy("incr", key, 1)
+}
+
+// Decr subtracts one from the integer at key and returns the result
+func (db *DB) Decr(key string) (int64, error) {
+	return db.incrBy("decr", key, -1)
+}
+
+// IncrBy adds delta to the integer at key and returns the result. It fails
+// with ErrNotInteger if the key holds something else, and with ErrOverflow
+// if the result does not fit in an int64.
+func (db *DB) IncrBy(key string, delta int64) (int64, error) {
+	return db.incrBy("incrby", key, delta)
+}
+
+// IncrByFloat adds delta to the number at key and returns the result. It
+// fails with ErrNotFloat if the key holds something else, and with
+// ErrOverflow if the result is infinite.
+func (db *DB) IncrByFloat(key string, delta float64) (float64, error) {
+	if math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return 0, NewDatabaseError("incrbyfloat", key, ErrNotFloat)
+	}
+
+	var result float64
+	err := db.updateCounter("incrbyfloat", key, func(value []byte) ([]byte, error) {
+		n, err := strconv.ParseFloat(string(value), 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, ErrNotFloat
+		}
+		result = n + delta
+		if math.IsInf(result, 0) {
+			return nil, ErrOverflow
+		}
+		return strconv.AppendFloat(nil, result, 'f', -1, 64), nil
+	})
+	return result, err
+}
+
+// incrBy adds delta to the integer at key on behalf of operation
+func (db *DB) incrBy(operation, key string, delta int64) (int64, error) {
+	var result int64
+	err := db.updateCounter(operation, key, func(value []byte) ([]byte, error) {
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, ErrOverflow
+		}
+		result = n + delta
+		return strconv.AppendInt(nil, result, 10), nil
+	})
+	return result, err
+}
+
+// updateCounter replaces the value at key with the one fn computes from
+// it, "0" standing in for a missing key
+func (db *DB) updateCounter(operation, key string, fn func(value []byte) ([]byte, error)) error {
+	err := db.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	if db.readOnly.Load() {
+		return NewDatabaseError(operation, key, ErrReadOnly)
+	}
+
+	entry, exists := db.storage.GetEntry(key)
+	value, err := counterValue(entry, exists, fn)
+	if err != nil {
+		return NewDatabaseError(operation, key, err)
+	}
+	logged, data := setOperation(value, entry.ExpiresAt)
+
+	// In a cluster the value reaches memory once committed
+	if db.cluster != nil {
+		_, err = db.propose(logged, key, data)
+		if err != nil {
+			return NewDatabaseError(operation, key, err)
+		}
+		return nil
+	}
+
+	// Write to log
+	sequence, err := db.log.Append(logged, key, data)
+	if err != nil {
+		return NewDatabaseError(operation, key, err)
+	}
+
+	// Update in-memory storage
+	db.storage.SetEntry(key, storage.Entry{Value: value, ExpiresAt: entry.ExpiresAt, Version: sequence})
+
+	if db.watchers.active() {
+		db.watchers.publish(WatchEvent{Type: EventSet, Key: key, Value: value, OldValue: entry.Value, Sequence: sequence})
+	}
+
+	return nil
+}
+
+// counterValue applies fn to the value of a counter, failing if the key
+// holds a collection
+func counterValue(entry storage.Entry, exists bool, fn func(value []byte) ([]byte, error)) ([]byte, error) {
+	if !exists {
+		return fn([]byte("0"))
+	}
+	if entry.Type != TypeString {
+		return nil, ErrWrongType
+	}
+	return fn(entry.Value)
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestIncrConcurrent checks that concurrent increments of a counter are
+// neither lost in memory nor on replay
+func TestIncrConcurrent(t *testing.T) {
+	const writers, increments = 8, 100
+
+	config := testConfig(t.TempDir())
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				_, err := db.Incr("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := int64(writers * increments)
+	n, err := db.IncrBy("counter", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want {
+		t.Fatalf("counter = %d, want %d", n, want)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n, err = db.IncrBy("counter", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want {
+		t.Fatalf("counter after restart = %d, want %d", n, want)
+	}
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+	"github.com/sidquark/KeyValueDatabase/internal/storage"
 )
 
 // Set stores a value for a given key
@@ -23,14 +24,11 @@ func (db *DB) Set(key string, value []byte) error {
 		return ErrNilValue
 	}
 
-	// Add to in-memory storage
-	db.storage.Set(key, value)
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
 	
-	// Write to log
-	err := db.log.Append(persistence.OperationSet, key, value)
+	_, err := db.putLocked(key, value, 0)
 	if err != nil {
-		// If we fail to log, roll back the in-memory change
-		db.storage.Delete(key)
 		return NewDatabaseError("set", key, err)
 	}
 	
@@ -52,12 +50,15 @@ func (db *DB) Get(key string) ([]byte, error) {
 		return nil, ErrEmptyKey
 	}
 
-	value, exists := db.storage.Get(key)
+	entry, exists := db.storage.GetEntry(key)
 	if !exists {
 		return nil, NewDatabaseError("get", key, ErrKeyNotFound)
 	}
+	if entry.Type != TypeString {
+		return nil, NewDatabaseError("get", key, ErrWrongType)
+	}
 	
-	return value, nil
+	return entry.Value, nil
 }
 
 // Delete removes a key-value pair
@@ -75,17 +76,16 @@ func (db *DB) Delete(key string) error {
 		return ErrEmptyKey
 	}
 
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+	
 	// Check if key exists
 	_, exists := db.storage.Get(key)
 	if !exists {
 		return NewDatabaseError("delete", key, ErrKeyNotFound)
 	}
 
-	// Remove from in-memory storage
-	db.storage.Delete(key)
-	
-	// Write to log
-	err := db.log.Append(persistence.OperationDelete, key, nil)
+	err := db.deleteLocked(key)
 	if err != nil {
 		return NewDatabaseError("delete", key, err)
 	}
@@ -118,3 +118,90 @@ func (db *DB) Size() int {
 	
 	return db.storage.Size()
 }
+
+// putLocked logs a write of value to key and then stores it, versioned with
+// the sequence number of its log entry. Logging first means memory never
+// holds a value that recovery would not reproduce. In cluster mode the
+// write is proposed instead, and stored once it is committed. The caller
+// must hold the key lock.
+func (db *DB) putLocked(key string, value []byte, expiresAt int64) (uint64, error) {
+	if db.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+	
+	operation, data := setOperation(value, expiresAt)
+	
+	// In a cluster the write reaches memory once committed
+	if db.cluster != nil {
+		return db.propose(operation, key, data)
+	}
+	
+	// Watchers are told the value replaced
+	watched := db.watchers.active()
+	var previous storage.Entry
+	if watched {
+		previous, _ = db.storage.GetEntry(key)
+	}
+	
+	// Write to log
+	version, err := db.log.Append(operation, key, data)
+	if err != nil {
+		return 0, err
+	}
+	
+	// Add to in-memory storage
+	db.storage.SetEntry(key, storage.Entry{
+		Value:     value,
+		ExpiresAt: expiresAt,
+		Version:   version,
+	})
+	
+	if watched {
+		db.watchers.publish(WatchEvent{Type: EventSet, Key: key, Value: value, OldValue: stringValue(previous), Sequence: version})
+	}
+	
+	return version, nil
+}
+
+// setOperation returns how a write of value to a key expiring at expiresAt
+// is logged
+func setOperation(value []byte, expiresAt int64) (persistence.LogOperation, []byte) {
+	if expiresAt != 0 {
+		return persistence.OperationSetWithExpiry, persistence.EncodeExpiry(expiresAt, value)
+	}
+	return persistence.OperationSet, value
+}
+
+// deleteLocked logs the deletion of key and then removes it. The caller
+// must hold the key lock.
+func (db *DB) deleteLocked(key string) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	
+	if db.cluster != nil {
+		_, err := db.propose(persistence.OperationDelete, key, nil)
+		return err
+	}
+	
+	watched := db.watchers.active()
+	var previous storage.Entry
+	if watched {
+		previous, _ = db.storage.GetEntry(key)
+	}
+	
+	// Write to log
+	sequence, err := db.log.Append(persistence.OperationDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	
+	// Remove from in-memory storage
+	db.storage.Delete(key)
+	
+	if watched {
+		db.watchers.publish(WatchEvent{Type: EventDelete, Key: key, OldValue: stringValue(previous), Sequence: sequence})
+	}
+	
+	return nil
+}
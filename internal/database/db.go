@@ -1,31 +1,68 @@
 package database
 
 import (
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sidquark/KeyValueDatabase/internal/storage"
 	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+	"github.com/sidquark/KeyValueDatabase/internal/raft"
 )
 
 // DB represents the main database instance
 type DB struct {
-	storage     *storage.HashTable
-	log         *persistence.Log
-	recovery    *persistence.Recovery
-	config      *Config
-	mutex       sync.RWMutex
-	isClosed    bool
-	closeChan   chan struct{}
+	storage        *storage.HashTable
+	log            *persistence.Log
+	recovery       *persistence.Recovery
+	snapshots      *persistence.Snapshotter
+	keyLocks       *keyLocks
+	watchers       *watchHub
+	pubsub         *pubSubHub
+	replication    *replicationHub
+	cluster        *raft.Node
+	clusterTerm    atomic.Uint64 // Term in which this member leads and accepts writes
+	config         *Config
+	recoveryReport *persistence.RecoveryReport
+	mutex          sync.RWMutex
+	isClosed       bool
+	readOnly       atomic.Bool
+	closeChan      chan struct{}
+	
+	// Snapshots, compaction and replica resyncs all rewrite or remove
+	// files, so they take turns
+	maintenanceMutex sync.Mutex
+	
+	// applyMutex is held while a committed cluster write is logged and
+	// applied to memory
+	applyMutex sync.Mutex
 }
 
 // Config holds database configuration options
 type Config struct {
 	NumBuckets          int
+	HashSeed            uint64 // Zero picks a random seed
 	LogPath             string
 	CompactionInterval  time.Duration
-	PersistenceInterval time.Duration
+	PersistenceInterval time.Duration // How often the log is fsynced with SyncInterval
+	SyncMode            persistence.SyncMode
+	CommitBatchSize     int           // Max appends grouped into one write and sync
+	CommitBatchDelay    time.Duration // How long a batch waits for more appends
+	SegmentSize         int64         // Size at which a new log segment is started
+	CorruptionPolicy    persistence.CorruptionPolicy
+	SnapshotInterval    time.Duration // Zero disables periodic snapshots
+	SnapshotRetention   int
+	ExpirySweepInterval time.Duration  // How often expired keys are swept; zero disables sweeping
+	ReplicationBacklog  int            // Log entries kept for followers to catch up from; zero keeps none
+	WatchHistory        int            // Recent changes kept for watches to resume from; zero keeps none, sparing writes a lookup
+	PubSubBuffer        int            // Messages a subscriber may fall behind by; zero picks a default
+	PubSubOverflow      OverflowPolicy // What happens to a subscriber further behind
+	Cluster             *ClusterConfig // Nil runs the database on its own
 	AutoRecover         bool
+	
+	// wrapSegment is passed on to the log, for tests to make its writes fail
+	wrapSegment func(file *os.File) persistence.SegmentFile
 }
 
 // DefaultConfig returns the default configuration
@@ -35,6 +72,16 @@ func DefaultConfig() *Config {
 		LogPath:             "./data",
 		CompactionInterval:  10 * time.Minute,
 		PersistenceInterval: 5 * time.Second,
+		SyncMode:            persistence.SyncInterval,
+		CommitBatchSize:     256,
+		CommitBatchDelay:    0,
+		SegmentSize:         64 << 20,
+		CorruptionPolicy:    persistence.CorruptionResync,
+		SnapshotInterval:    time.Minute,
+		SnapshotRetention:   2,
+		ExpirySweepInterval: 100 * time.Millisecond,
+		PubSubBuffer:        1024,
+		PubSubOverflow:      OverflowDisconnect,
 		AutoRecover:         true,
 	}
 }
@@ -45,32 +92,62 @@ func New(config *Config) (*DB, error) {
 		config = DefaultConfig()
 	}
 
-	// Create storage
-	store := storage.NewHashTable(config.NumBuckets)
-	
 	// Create recovery instance
-	recovery := persistence.NewRecovery(config.LogPath)
-	
-	// Create log
-	log, err := persistence.NewLog(config.LogPath)
-	if err != nil {
-		return nil, NewDatabaseError("initialization", "", err)
-	}
+	recovery := persistence.NewRecovery(config.LogPath, config.CorruptionPolicy)
 
 	db := &DB{
-		storage:   store,
-		log:       log,
-		recovery:  recovery,
-		config:    config,
-		closeChan: make(chan struct{}),
+		recovery:    recovery,
+		snapshots:   persistence.NewSnapshotter(config.LogPath, config.SnapshotRetention),
+		keyLocks:    newKeyLocks(),
+		watchers:    newWatchHub(config.WatchHistory),
+		pubsub:      newPubSubHub(config.PubSubBuffer, config.PubSubOverflow),
+		replication: newReplicationHub(config.ReplicationBacklog),
+		config:      config,
+		closeChan:   make(chan struct{}),
 	}
+	
+	// Create storage, reporting expiries to watchers
+	db.storage = storage.NewHashTableWithOptions(&storage.HashTableOptions{
+		NumBuckets: config.NumBuckets,
+		Seed:       config.HashSeed,
+		OnExpire: func(key string, entry storage.Entry) {
+			db.watchers.expire(key, stringValue(entry))
+		},
+	})
 
-	// Recover from log if enabled
+	// Recover from log if enabled. This runs before the log is opened for
+	// appending so that a torn tail can be truncated first.
 	if config.AutoRecover {
-		err = db.recoverFromLog()
+		report, err := db.recoverFromLog()
+		if err != nil {
+			return nil, NewDatabaseError("recovery", "", newRecoveryError(report, err))
+		}
+		db.recoveryReport = report
+	}
+	
+	// Create log
+	log, err := persistence.NewLog(config.LogPath, &persistence.LogOptions{
+		SyncMode:      config.SyncMode,
+		MaxBatchSize:  config.CommitBatchSize,
+		MaxBatchDelay: config.CommitBatchDelay,
+		SegmentSize:   config.SegmentSize,
+		OnCommit:      db.replication.commit,
+		WrapSegment:   config.wrapSegment,
+	})
+	if err != nil {
+		return nil, NewDatabaseError("initialization", "", err)
+	}
+	db.log = log
+	
+	// Whatever recovery expired is not a change to report, and watches
+	// from before the restart cannot resume
+	db.watchers.reset(log.LastSequence())
+	
+	if config.Cluster != nil {
+		err = db.openCluster(config.Cluster)
 		if err != nil {
 			log.Close()
-			return nil, NewDatabaseError("recovery", "", err)
+			return nil, NewDatabaseError("initialization", "", err)
 		}
 	}
 
@@ -80,43 +157,205 @@ func New(config *Config) (*DB, error) {
 	return db, nil
 }
 
-// recoverFromLog applies all operations from the log
-func (db *DB) recoverFromLog() error {
-	entries, err := db.recovery.RecoverEntries()
+// recoverFromLog loads the newest valid snapshot and applies the operations
+// logged after it. The returned report covers both steps.
+func (db *DB) recoverFromLog() (*persistence.RecoveryReport, error) {
+	start := time.Now()
+	
+	logEnd, err := db.recovery.EndPosition()
 	if err != nil {
-		return err
+		return &persistence.RecoveryReport{}, err
+	}
+	
+	snapshotEntries := 0
+	snapshot, skipped, err := db.snapshots.Load(logEnd, func(entry *persistence.SnapshotEntry) {
+		db.storage.SetEntry(entry.Key, loadedEntry(entry))
+		snapshotEntries++
+	})
+	if err != nil {
+		return &persistence.RecoveryReport{SkippedSnapshots: skipped}, err
 	}
 	
-	// Replay log entries
-	for _, entry := range entries {
-		switch entry.Operation {
-		case persistence.OperationSet:
-			db.storage.Set(entry.Key, entry.Value)
-		case persistence.OperationDelete:
-			db.storage.Delete(entry.Key)
+	// Replay log entries as they are read
+	report, err := db.recovery.Replay(snapshot.Position, db.applyEntry)
+	report.SnapshotPath = snapshot.Path
+	report.SnapshotPosition = snapshot.Position
+	report.SnapshotEntries = snapshotEntries
+	report.SkippedSnapshots = skipped
+	report.Duration = time.Since(start)
+	
+	return report, err
+}
+
+// applyEntry applies a replayed log entry to in-memory storage. Values are
+// versioned with the sequence number of the entry that wrote them. Entries
+// are applied whether or not their expiry has passed, since a later entry
+// may clear it; expired keys are dropped once read or swept.
+func (db *DB) applyEntry(entry *persistence.LogEntry) error {
+	switch entry.Operation {
+	case persistence.OperationSet:
+		db.storage.SetEntry(entry.Key, storage.Entry{
+			Value:   entry.Value,
+			Version: entry.Sequence,
+		})
+	case persistence.OperationDelete:
+		db.storage.Delete(entry.Key)
+	case persistence.OperationSetWithExpiry:
+		expiresAt, value, err := persistence.DecodeExpiry(entry.Value)
+		if err != nil {
+			return err
+		}
+		db.storage.SetEntry(entry.Key, storage.Entry{
+			Value:     value,
+			ExpiresAt: expiresAt,
+			Version:   entry.Sequence,
+		})
+	case persistence.OperationExpire:
+		expiresAt, _, err := persistence.DecodeExpiry(entry.Value)
+		if err != nil {
+			return err
+		}
+		db.storage.Expire(entry.Key, expiresAt, entry.Sequence)
+	case persistence.OperationBatch:
+		return db.applyBatch(entry)
+	default:
+		if entry.Operation.IsCollectionChange() {
+			return db.applyCollection(entry)
 		}
 	}
 	
 	return nil
 }
 
+// RecoveryReport describes what happened when the database was recovered
+// from disk. It is nil if AutoRecover was disabled.
+func (db *DB) RecoveryReport() *persistence.RecoveryReport {
+	return db.recoveryReport
+}
+
+// takeSnapshot writes a snapshot of the current key space and removes log
+// segments that no retained snapshot needs
+func (db *DB) takeSnapshot() error {
+	// Writes are logged before they reach memory, so the position is read
+	// while no write is in progress. Everything before it is then in memory
+	// and the snapshot reflects at least everything up to it.
+	db.maintenanceMutex.Lock()
+	defer db.maintenanceMutex.Unlock()
+	
+	db.keyLocks.lockAll()
+	db.applyMutex.Lock()
+	position := db.log.Position()
+	db.applyMutex.Unlock()
+	db.keyLocks.unlockAll()
+	err := db.snapshots.Save(position, db.iterateStorage)
+	if err != nil {
+		return err
+	}
+	
+	// Keep every segment the oldest snapshot might need, so recovery can
+	// still fall back to it if a newer one turns out to be corrupt
+	snapshots, err := db.snapshots.List()
+	if err != nil || len(snapshots) == 0 {
+		return err
+	}
+	
+	return db.log.RemoveSegmentsBefore(snapshots[0].Position)
+}
+
+// iterateStorage calls fn for every key in memory, as a snapshot entry
+func (db *DB) iterateStorage(fn func(entry *persistence.SnapshotEntry)) {
+	db.storage.ForEach(func(key string, entry storage.Entry) {
+		snapshot, ok := snapshotEntry(key, entry)
+		if ok {
+			fn(snapshot)
+		}
+	})
+}
+
 // startBackgroundTasks starts all background tasks
 func (db *DB) startBackgroundTasks() {
 	// Start log compaction
 	compactionTicker := time.NewTicker(db.config.CompactionInterval)
 	defer compactionTicker.Stop()
 	
+	// Start periodic snapshots
+	var snapshotChan <-chan time.Time
+	if db.config.SnapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(db.config.SnapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshotChan = snapshotTicker.C
+	}
+	
+	// Start periodic fsync of the log
+	var syncChan <-chan time.Time
+	if db.config.SyncMode == persistence.SyncInterval && db.config.PersistenceInterval > 0 {
+		syncTicker := time.NewTicker(db.config.PersistenceInterval)
+		defer syncTicker.Stop()
+		syncChan = syncTicker.C
+	}
+	
+	// Start sweeping expired keys
+	var sweepChan <-chan time.Time
+	if db.config.ExpirySweepInterval > 0 {
+		sweepTicker := time.NewTicker(db.config.ExpirySweepInterval)
+		defer sweepTicker.Stop()
+		sweepChan = sweepTicker.C
+	}
+	
 	for {
 		select {
+		case <-syncChan:
+			db.log.Sync()
 		case <-compactionTicker.C:
-			// Compact log
-			db.log.Compact()
+			// Compact sealed log segments
+			db.compact()
+		case <-snapshotChan:
+			db.takeSnapshot()
+		case <-sweepChan:
+			db.sweepExpired()
 		case <-db.closeChan:
 			return
 		}
 	}
 }
 
+// compact compacts sealed log segments
+func (db *DB) compact() error {
+	db.maintenanceMutex.Lock()
+	defer db.maintenanceMutex.Unlock()
+	
+	return db.log.Compact()
+}
+
+// Sync forces all logged operations to stable storage
+func (db *DB) Sync() error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	
+	if db.isClosed {
+		return ErrDatabaseClosed
+	}
+	
+	err := db.log.Sync()
+	if err != nil {
+		return NewDatabaseError("sync", "", err)
+	}
+	
+	return nil
+}
+
+// LogPosition returns the offset just past the last logged operation
+func (db *DB) LogPosition() int64 {
+	return db.log.Position()
+}
+
+// SyncedPosition returns the log offset up to which operations are
+// guaranteed to survive power loss. It trails LogPosition unless SyncMode
+// is SyncAlways or Sync has just been called.
+func (db *DB) SyncedPosition() int64 {
+	return db.log.SyncedPosition()
+}
+
 // Close closes the database
 func (db *DB) Close() error {
 	db.mutex.Lock()
@@ -126,16 +365,29 @@ func (db *DB) Close() error {
 		return nil
 	}
 	
+	// The database is closed even if closing the log fails, so that a
+	// second call does not stop everything again
+	db.isClosed = true
+	
 	// Signal background tasks to stop
 	close(db.closeChan)
 	
+	// Leave the cluster first, as it writes to the log
+	if db.cluster != nil {
+		db.cluster.Close()
+	}
+	
 	// Close log
 	err := db.log.Close()
+	
+	// End all watches and replication streams
+	db.watchers.closeAll()
+	db.pubsub.closeAll()
+	db.replication.closeAll(ErrDatabaseClosed)
+	
 	if err != nil {
 		return NewDatabaseError("close", "", err)
 	}
 	
-	db.isClosed = true
-	
 	return nil
 }
@@ -3,18 +3,35 @@ package database
 import (
 	"errors"
 	"fmt"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
 )
 
 // Common database errors
 var (
-	ErrKeyNotFound     = errors.New("key not found")
-	ErrEmptyKey        = errors.New("key cannot be empty")
-	ErrInvalidKeyType  = errors.New("key must be a string")
-	ErrNilValue        = errors.New("value cannot be nil")
-	ErrDatabaseClosed  = errors.New("database is closed")
-	ErrLogWriteFailed  = errors.New("failed to write to log")
-	ErrCorruptedEntry  = errors.New("log entry is corrupted")
-	ErrRecoveryFailed  = errors.New("failed to recover from log")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrEmptyKey           = errors.New("key cannot be empty")
+	ErrInvalidKeyType     = errors.New("key must be a string")
+	ErrNilValue           = errors.New("value cannot be nil")
+	ErrDatabaseClosed     = errors.New("database is closed")
+	ErrLogWriteFailed     = errors.New("failed to write to log")
+	ErrCorruptedEntry     = errors.New("log entry is corrupted")
+	ErrRecoveryFailed     = errors.New("failed to recover from log")
+	ErrInvalidTTL         = errors.New("ttl must be positive")
+	ErrInvalidLimit       = errors.New("limit cannot be negative")
+	ErrTxnDone            = errors.New("transaction has already been committed or rolled back")
+	ErrVersionMismatch    = errors.New("key has been modified since the given version")
+	ErrReadOnly           = errors.New("database is read-only")
+	ErrReplicaBehind      = errors.New("replica fell too far behind")
+	ErrWatchHistoryLost   = errors.New("changes to resume the watch from are no longer kept")
+	ErrSubscriptionClosed = errors.New("subscription is closed")
+	ErrSlowSubscriber     = errors.New("subscriber fell too far behind")
+	ErrWrongType          = errors.New("operation against a key holding the wrong kind of value")
+	ErrInvalidCount       = errors.New("count must be positive")
+	ErrInvalidScore       = errors.New("score is not a number")
+	ErrNotInteger         = errors.New("value is not an integer or out of range")
+	ErrNotFloat           = errors.New("value is not a valid float")
+	ErrOverflow           = errors.New("increment or decrement would overflow")
 )
 
 // DatabaseError wraps database-specific errors with context
@@ -45,3 +62,48 @@ func NewDatabaseError(operation, key string, err error) *DatabaseError {
 		Err:       err,
 	}
 }
+
+// CorruptionError reports a corrupted range of the log found during recovery
+type CorruptionError struct {
+	persistence.CorruptedRange
+}
+
+// Error implements the error interface
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v at position %d in %s: %s", ErrCorruptedEntry, e.Position, e.Segment, e.Reason)
+}
+
+// Unwrap returns the underlying error
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorruptedEntry
+}
+
+// RecoveryError is returned when the database cannot be recovered from disk.
+// The report describes how far recovery got before failing.
+type RecoveryError struct {
+	Report *persistence.RecoveryReport
+	Err    error
+}
+
+// Error implements the error interface
+func (e *RecoveryError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrRecoveryFailed, e.Err)
+}
+
+// Unwrap returns both ErrRecoveryFailed and the underlying error
+func (e *RecoveryError) Unwrap() []error {
+	return []error{ErrRecoveryFailed, e.Err}
+}
+
+// newRecoveryError wraps a recovery failure, translating corruption reported
+// by the persistence layer into a CorruptionError
+func newRecoveryError(report *persistence.RecoveryReport, err error) *RecoveryError {
+	var corruption *persistence.CorruptionError
+	if errors.As(err, &corruption) {
+		err = &CorruptionError{CorruptedRange: corruption.Range}
+	}
+	return &RecoveryError{
+		Report: report,
+		Err:    err,
+	}
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// In snapshots, a hash is stored as its fields and values, alternating, in
+// ascending order of field
+
+// HSet sets fields of the hash at key, creating the hash if needed, and
+// returns how many of the fields are new
+func (db *DB) HSet(key string, fields map[string][]byte) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	// Only log the fields that change
+	added := 0
+	changed := make(map[string][]byte)
+	exists, err := db.readCollection("hset", key, TypeHash, func(c *collection) {
+		for field, value := range fields {
+			current, ok := c.hash[field]
+			if !ok {
+				added++
+			}
+			if !ok || !bytes.Equal(current, value) {
+				changed[field] = value
+			}
+		}
+	})
+	if err != nil || len(changed) == 0 {
+		return 0, err
+	}
+
+	err = db.changeCollectionLocked(persistence.OperationHashSet, key, !exists, encodeHash(changed))
+	if err != nil {
+		return 0, NewDatabaseError("hset", key, err)
+	}
+	return added, nil
+}
+
+// HGet returns the value of a field of the hash at key. It fails with
+// ErrKeyNotFound if there is no such field.
+func (db *DB) HGet(key, field string) ([]byte, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	ok := false
+	_, err = db.readCollection("hget", key, TypeHash, func(c *collection) {
+		value, ok = c.hash[field]
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, NewDatabaseError("hget", key, ErrKeyNotFound)
+	}
+	return value, nil
+}
+
+// HGetAll returns every field of the hash at key, none if there is no hash
+func (db *DB) HGetAll(key string) (map[string][]byte, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var hash map[string][]byte
+	_, err = db.readCollection("hgetall", key, TypeHash, func(c *collection) {
+		hash = maps.Clone(c.hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// HDel removes fields from the hash at key and returns how many it had
+func (db *DB) HDel(key string, fields ...string) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	var removed []string
+	_, err = db.readCollection("hdel", key, TypeHash, func(c *collection) {
+		removed = present(c.hash, fields)
+	})
+	if err != nil || len(removed) == 0 {
+		return 0, err
+	}
+
+	err = db.changeCollectionLocked(persistence.OperationHashDelete, key, false, toItems(removed))
+	if err != nil {
+		return 0, NewDatabaseError("hdel", key, err)
+	}
+	return len(removed), nil
+}
+
+// decodeHash turns stored or logged field and value pairs into a map
+func decodeHash(items [][]byte) map[string][]byte {
+	hash := make(map[string][]byte, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		hash[string(items[i])] = items[i+1]
+	}
+	return hash
+}
+
+// encodeHash turns a hash into field and value pairs in ascending order of
+// field
+func encodeHash(hash map[string][]byte) [][]byte {
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	items := make([][]byte, 0, 2*len(fields))
+	for _, field := range fields {
+		items = append(items, []byte(field), hash[field])
+	}
+	return items
+}
+
+// setFields sets the field and value pairs of a logged HSet in hash
+func setFields(hash map[string][]byte, items [][]byte) {
+	for i := 0; i+1 < len(items); i += 2 {
+		hash[string(items[i])] = items[i+1]
+	}
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"hash/maphash"
+	"sort"
+	"sync"
+)
+
+// numKeyLockStripes is the number of locks keys are spread over
+const numKeyLockStripes = 1024
+
+// keyLocks serializes writes to the same key. Each key maps to one of a
+// fixed set of mutexes, so unrelated keys rarely wait for each other and
+// no per-key state has to be created or cleaned up.
+type keyLocks struct {
+	seed    maphash.Seed
+	stripes [numKeyLockStripes]sync.Mutex
+}
+
+// newKeyLocks creates a set of key locks
+func newKeyLocks() *keyLocks {
+	return &keyLocks{
+		seed: maphash.MakeSeed(),
+	}
+}
+
+// stripe returns the index of the mutex guarding key
+func (k *keyLocks) stripe(key string) int {
+	return int(maphash.String(k.seed, key) % numKeyLockStripes)
+}
+
+// lock acquires the lock for key
+func (k *keyLocks) lock(key string) {
+	k.stripes[k.stripe(key)].Lock()
+}
+
+// unlock releases the lock for key
+func (k *keyLocks) unlock(key string) {
+	k.stripes[k.stripe(key)].Unlock()
+}
+
+// lockKeys acquires the locks for several keys, in stripe order so that
+// concurrent callers cannot deadlock. It returns the stripes held, to be
+// passed to unlockStripes.
+func (k *keyLocks) lockKeys(keys []string) []int {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, k.stripe(key))
+	}
+	sort.Ints(stripes)
+
+	held := make([]int, 0, len(stripes))
+	for i, stripe := range stripes {
+		if i > 0 && stripe == stripes[i-1] {
+			continue
+		}
+		k.stripes[stripe].Lock()
+		held = append(held, stripe)
+	}
+	return held
+}
+
+// unlockStripes releases the stripes returned by lockKeys
+func (k *keyLocks) unlockStripes(stripes []int) {
+	for _, stripe := range stripes {
+		k.stripes[stripe].Unlock()
+	}
+}
+
+// lockAll acquires every stripe, waiting for all writes in progress to
+// finish and holding off new ones
+func (k *keyLocks) lockAll() {
+	for i := range k.stripes {
+		k.stripes[i].Lock()
+	}
+}
+
+// unlockAll releases every stripe
+func (k *keyLocks) unlockAll() {
+	for i := range k.stripes {
+		k.stripes[i].Unlock()
+	}
+}
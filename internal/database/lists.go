@@ -0,0 +1,228 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// LPush inserts values at the head of the list at key, one after another,
+// creating the list if needed, and returns its new length
+func (db *DB) LPush(key string, values ...[]byte) (int, error) {
+	return db.push("lpush", persistence.OperationListPushLeft, key, values)
+}
+
+// RPush appends values to the tail of the list at key, creating the list if
+// needed, and returns its new length
+func (db *DB) RPush(key string, values ...[]byte) (int, error) {
+	return db.push("rpush", persistence.OperationListPushRight, key, values)
+}
+
+// LPop removes and returns up to count elements from the head of the list
+// at key. It fails with ErrKeyNotFound if there is no list.
+func (db *DB) LPop(key string, count int) ([][]byte, error) {
+	return db.pop("lpop", persistence.OperationListPopLeft, key, count)
+}
+
+// RPop removes and returns up to count elements from the tail of the list
+// at key, the last one first
+func (db *DB) RPop(key string, count int) ([][]byte, error) {
+	return db.pop("rpop", persistence.OperationListPopRight, key, count)
+}
+
+// LRange returns the elements of the list at key from start to stop,
+// inclusive. Negative indexes count from the tail, -1 being the last
+// element. A missing key is an empty list.
+func (db *DB) LRange(key string, start, stop int) ([][]byte, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	values := [][]byte{}
+	_, err = db.readCollection("lrange", key, TypeList, func(c *collection) {
+		items := c.list.items()
+		start, stop = clampRange(start, stop, len(items))
+		if start <= stop {
+			values = slices.Clone(items[start : stop+1])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// LLen returns the length of the list at key, zero if there is none
+func (db *DB) LLen(key string) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	length := 0
+	_, err = db.readCollection("llen", key, TypeList, func(c *collection) {
+		length = c.list.length()
+	})
+	return length, err
+}
+
+// push adds values to one end of a list
+func (db *DB) push(name string, operation persistence.LogOperation, key string, values [][]byte) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	length := 0
+	exists, err := db.readCollection(name, key, TypeList, func(c *collection) {
+		length = c.list.length()
+	})
+	if err != nil || len(values) == 0 {
+		return length, err
+	}
+
+	err = db.changeCollectionLocked(operation, key, !exists, values)
+	if err != nil {
+		return 0, NewDatabaseError(name, key, err)
+	}
+	return length + len(values), nil
+}
+
+// pop removes elements from one end of a list
+func (db *DB) pop(name string, operation persistence.LogOperation, key string, count int) ([][]byte, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, NewDatabaseError(name, key, ErrInvalidCount)
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	var popped [][]byte
+	exists, err := db.readCollection(name, key, TypeList, func(c *collection) {
+		popped = c.list.peek(count, operation == persistence.OperationListPopLeft)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, NewDatabaseError(name, key, ErrKeyNotFound)
+	}
+
+	err = db.changeCollectionLocked(operation, key, false, [][]byte{[]byte(strconv.Itoa(len(popped)))})
+	if err != nil {
+		return nil, NewDatabaseError(name, key, err)
+	}
+	return popped, nil
+}
+
+// list holds the elements of a list in a buffer with room to spare at both
+// ends, so that pushing and popping at either end takes constant amortized
+// time. The elements are buffer[head:].
+type list struct {
+	buffer [][]byte
+	head   int
+}
+
+// length returns the number of elements in the list
+func (l *list) length() int {
+	return len(l.buffer) - l.head
+}
+
+// items returns the elements of the list, which change along with it
+func (l *list) items() [][]byte {
+	return l.buffer[l.head:]
+}
+
+// pushLeft inserts items at the head one after another, so that the last
+// item comes first
+func (l *list) pushLeft(items [][]byte) {
+	if l.head < len(items) {
+		// Leave as much room at the head as the list will hold
+		length := l.length()
+		head := length + len(items)
+		buffer := make([][]byte, head+length)
+		copy(buffer[head:], l.items())
+		l.buffer, l.head = buffer, head
+	}
+
+	for _, item := range items {
+		l.head--
+		l.buffer[l.head] = item
+	}
+}
+
+// pushRight appends items at the tail
+func (l *list) pushRight(items [][]byte) {
+	// Once the room left at the head by pops is as large as the list, move
+	// the elements back into it rather than let append copy it along
+	if len(l.buffer)+len(items) > cap(l.buffer) && l.head >= l.length() {
+		n := copy(l.buffer, l.items())
+		clear(l.buffer[n:])
+		l.buffer, l.head = l.buffer[:n], 0
+	}
+	l.buffer = append(l.buffer, items...)
+}
+
+// pop removes up to count elements from one end of the list
+func (l *list) pop(count int, left bool) {
+	count = min(count, l.length())
+	if left {
+		clear(l.buffer[l.head : l.head+count])
+		l.head += count
+		return
+	}
+
+	rest := len(l.buffer) - count
+	clear(l.buffer[rest:])
+	l.buffer = l.buffer[:rest]
+}
+
+// peek returns the elements pop would remove, in the order they are popped
+func (l *list) peek(count int, left bool) [][]byte {
+	items := l.items()
+	count = min(count, len(items))
+	if left {
+		return slices.Clone(items[:count])
+	}
+
+	popped := make([][]byte, 0, count)
+	for i := len(items) - 1; i >= len(items)-count; i-- {
+		popped = append(popped, items[i])
+	}
+	return popped
+}
+
+// decodeCount parses the single item of a logged pop
+func decodeCount(items [][]byte) (int, error) {
+	if len(items) != 1 {
+		return 0, fmt.Errorf("pop has %d items", len(items))
+	}
+	count, err := strconv.Atoi(string(items[0]))
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid pop count %q", items[0])
+	}
+	return count, nil
+}
+
+// clampRange resolves an inclusive range with Redis-style negative indexes
+// against a sequence of length elements. The range is empty if start ends
+// up after stop.
+func clampRange(start, stop, length int) (int, int) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	return max(start, 0), min(stop, length-1)
+}
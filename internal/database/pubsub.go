@@ -0,0 +1,372 @@
+package database
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sidquark/KeyValueDatabase/internal/glob"
+)
+
+// defaultPubSubBuffer is how many messages a subscriber may fall behind by
+// when Config.PubSubBuffer is not positive
+const defaultPubSubBuffer = 1024
+
+// OverflowPolicy decides what happens to a subscriber that falls so far
+// behind that its buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowDisconnect ends the subscription, which then reports
+	// ErrSlowSubscriber
+	OverflowDisconnect OverflowPolicy = iota
+
+	// OverflowDrop discards the messages that do not fit, counting them,
+	// and keeps the subscription
+	OverflowDrop
+)
+
+// String returns the name of the policy
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDisconnect:
+		return "disconnect"
+	case OverflowDrop:
+		return "drop"
+	default:
+		return "unknown"
+	}
+}
+
+// Message is one message published to a channel
+type Message struct {
+	Channel string
+	Pattern string // Pattern the channel matched, empty for channel subscriptions
+	Payload []byte // Shared by every subscriber, so it must not be modified
+}
+
+// Pub/sub carries messages between clients without storing them: a message
+// published to a channel goes to the subscriptions of that channel, and of
+// every pattern matching it, at the time it is published, and is then
+// forgotten. Messages are neither logged nor replicated, so they only reach
+// subscribers of this database, in cluster mode as well. Each subscription
+// buffers up to Config.PubSubBuffer messages; publishing never waits for a
+// subscriber, and Config.PubSubOverflow decides what happens to one whose
+// buffer is full.
+
+// Subscription receives the messages published to the channels and
+// patterns it is subscribed to. Its subscriptions can be changed while it
+// receives them; it is safe for concurrent use.
+type Subscription struct {
+	hub      *pubSubHub
+	messages chan Message
+	done     chan struct{}
+	dropped  atomic.Uint64
+
+	// Guarded by the hub mutex
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	err      error // Why the subscription ended, nil while it is active
+}
+
+// pubSubHub fans messages out to subscriptions
+type pubSubHub struct {
+	mutex         sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+	channels      map[string]map[*Subscription]struct{}
+	patterns      map[string]map[*Subscription]struct{}
+	buffer        int
+	overflow      OverflowPolicy
+}
+
+// newPubSubHub creates a hub without subscriptions
+func newPubSubHub(buffer int, overflow OverflowPolicy) *pubSubHub {
+	if buffer <= 0 {
+		buffer = defaultPubSubBuffer
+	}
+	return &pubSubHub{
+		subscriptions: make(map[*Subscription]struct{}),
+		channels:      make(map[string]map[*Subscription]struct{}),
+		patterns:      make(map[string]map[*Subscription]struct{}),
+		buffer:        buffer,
+		overflow:      overflow,
+	}
+}
+
+// Publish sends a message to the subscribers of channel and of the
+// patterns matching it, returning how many received it. Subscribers whose
+// buffer is full are not counted.
+func (db *DB) Publish(channel string, payload []byte) (int, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.isClosed {
+		return 0, ErrDatabaseClosed
+	}
+
+	return db.pubsub.publish(channel, bytes.Clone(payload)), nil
+}
+
+// Subscribe returns a subscription to channels, which may be empty to
+// subscribe later. It must be closed once no longer needed.
+func (db *DB) Subscribe(channels ...string) (*Subscription, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.isClosed {
+		return nil, ErrDatabaseClosed
+	}
+
+	s := db.pubsub.add()
+	return s, s.Subscribe(channels...)
+}
+
+// PSubscribe returns a subscription to the channels matching any of
+// patterns, given in the glob syntax of KEYS
+func (db *DB) PSubscribe(patterns ...string) (*Subscription, error) {
+	s, err := db.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	return s, s.PSubscribe(patterns...)
+}
+
+// Messages returns the channel messages are received on. It is closed when
+// the subscription ends, after which Err tells why.
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Done returns a channel that is closed when the subscription ends. Messages
+// still buffered can be received after that.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the subscription ended: ErrSubscriptionClosed once it has
+// been closed, ErrSlowSubscriber if it fell behind under
+// OverflowDisconnect, or ErrDatabaseClosed. It returns nil while the
+// subscription is active.
+func (s *Subscription) Err() error {
+	s.hub.mutex.RLock()
+	defer s.hub.mutex.RUnlock()
+
+	return s.err
+}
+
+// Dropped returns how many messages were discarded under OverflowDrop
+// because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Subscribe adds channels to the subscription
+func (s *Subscription) Subscribe(channels ...string) error {
+	return s.hub.subscribe(s, s.channels, s.hub.channels, channels)
+}
+
+// PSubscribe adds patterns to the subscription
+func (s *Subscription) PSubscribe(patterns ...string) error {
+	return s.hub.subscribe(s, s.patterns, s.hub.patterns, patterns)
+}
+
+// Unsubscribe removes channels from the subscription, or every channel if
+// none are given. The subscription stays open, even with nothing left.
+func (s *Subscription) Unsubscribe(channels ...string) error {
+	return s.hub.unsubscribe(s, s.channels, s.hub.channels, channels)
+}
+
+// PUnsubscribe removes patterns from the subscription, or every pattern if
+// none are given
+func (s *Subscription) PUnsubscribe(patterns ...string) error {
+	return s.hub.unsubscribe(s, s.patterns, s.hub.patterns, patterns)
+}
+
+// Channels returns the channels subscribed to, in ascending order
+func (s *Subscription) Channels() []string {
+	s.hub.mutex.RLock()
+	defer s.hub.mutex.RUnlock()
+
+	return sortedKeys(s.channels)
+}
+
+// Patterns returns the patterns subscribed to, in ascending order
+func (s *Subscription) Patterns() []string {
+	s.hub.mutex.RLock()
+	defer s.hub.mutex.RUnlock()
+
+	return sortedKeys(s.patterns)
+}
+
+// Count returns how many channels and patterns are subscribed to
+func (s *Subscription) Count() int {
+	s.hub.mutex.RLock()
+	defer s.hub.mutex.RUnlock()
+
+	return len(s.channels) + len(s.patterns)
+}
+
+// Close ends the subscription and closes its message channel
+func (s *Subscription) Close() error {
+	s.hub.close(s, ErrSubscriptionClosed)
+	return nil
+}
+
+// add creates a subscription without channels or patterns
+func (h *pubSubHub) add() *Subscription {
+	s := &Subscription{
+		hub:      h,
+		messages: make(chan Message, h.buffer),
+		done:     make(chan struct{}),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.subscriptions[s] = struct{}{}
+	return s
+}
+
+// subscribe adds names to one of the subscription's sets, own, and to the
+// matching index of the hub
+func (h *pubSubHub) subscribe(s *Subscription, own map[string]struct{}, index map[string]map[*Subscription]struct{}, names []string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	for _, name := range names {
+		own[name] = struct{}{}
+		if index[name] == nil {
+			index[name] = make(map[*Subscription]struct{})
+		}
+		index[name][s] = struct{}{}
+	}
+	return nil
+}
+
+// unsubscribe removes names, or all of them if there are none, from one of
+// the subscription's sets and from the matching index of the hub
+func (h *pubSubHub) unsubscribe(s *Subscription, own map[string]struct{}, index map[string]map[*Subscription]struct{}, names []string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		delete(own, name)
+		unindex(index, name, s)
+	}
+	return nil
+}
+
+// publish delivers a message to every subscription it is for and returns
+// how many it was delivered to. Subscriptions ended for falling behind
+// are removed once the message has gone to the others.
+func (h *pubSubHub) publish(channel string, payload []byte) int {
+	h.mutex.RLock()
+
+	receivers := 0
+	var slow []*Subscription
+	deliver := func(s *Subscription, message Message) {
+		select {
+		case s.messages <- message:
+			receivers++
+			return
+		default:
+		}
+
+		if h.overflow == OverflowDrop {
+			s.dropped.Add(1)
+		} else {
+			slow = append(slow, s)
+		}
+	}
+
+	for s := range h.channels[channel] {
+		deliver(s, Message{Channel: channel, Payload: payload})
+	}
+	for pattern, subscriptions := range h.patterns {
+		if !glob.Match(pattern, channel) {
+			continue
+		}
+		for s := range subscriptions {
+			deliver(s, Message{Channel: channel, Pattern: pattern, Payload: payload})
+		}
+	}
+	h.mutex.RUnlock()
+
+	for _, s := range slow {
+		h.close(s, ErrSlowSubscriber)
+	}
+	return receivers
+}
+
+// close ends a subscription for reason, unless it has already ended
+func (h *pubSubHub) close(s *Subscription, reason error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closeLocked(s, reason)
+}
+
+// closeLocked is close with the hub mutex held
+func (h *pubSubHub) closeLocked(s *Subscription, reason error) {
+	if s.err != nil {
+		return
+	}
+	s.err = reason
+
+	for name := range s.channels {
+		unindex(h.channels, name, s)
+	}
+	for name := range s.patterns {
+		unindex(h.patterns, name, s)
+	}
+	clear(s.channels)
+	clear(s.patterns)
+	delete(h.subscriptions, s)
+	close(s.messages)
+	close(s.done)
+}
+
+// closeAll ends every subscription, once the database is closed
+func (h *pubSubHub) closeAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for s := range h.subscriptions {
+		h.closeLocked(s, ErrDatabaseClosed)
+	}
+}
+
+// unindex removes a subscription from the entry for name in index,
+// dropping the entry once it is empty
+func unindex(index map[string]map[*Subscription]struct{}, name string, s *Subscription) {
+	delete(index[name], s)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+}
+
+// sortedKeys returns the keys of a set in ascending order
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
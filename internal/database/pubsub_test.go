@@ -0,0 +1,290 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// received drains the messages buffered for a subscription
+func received(s *Subscription) []Message {
+	var messages []Message
+	for {
+		select {
+		case message, ok := <-s.Messages():
+			if !ok {
+				return messages
+			}
+			messages = append(messages, message)
+		default:
+			return messages
+		}
+	}
+}
+
+// newPubSubDB opens a database whose subscriptions buffer buffer messages
+// and overflow by policy
+func newPubSubDB(t *testing.T, buffer int, policy OverflowPolicy) *DB {
+	t.Helper()
+
+	config := testConfig(t.TempDir())
+	config.PubSubBuffer = buffer
+	config.PubSubOverflow = policy
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestPublishMatching checks which subscriptions a message goes to, and
+// that one subscribed to a channel and a pattern matching it receives both
+func TestPublishMatching(t *testing.T) {
+	db := newPubSubDB(t, 16, OverflowDisconnect)
+
+	news, err := db.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer news.Close()
+	pattern, err := db.PSubscribe("news.*", "n?ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pattern.Close()
+	both, err := db.Subscribe("news.sport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer both.Close()
+	err = both.PSubscribe("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		channel   string
+		receivers int
+		news      []Message
+		pattern   []Message
+		both      []Message
+	}{
+		{
+			channel:   "news",
+			receivers: 3,
+			news:      []Message{{Channel: "news"}},
+			pattern:   []Message{{Channel: "news", Pattern: "n?ws"}},
+			both:      []Message{{Channel: "news", Pattern: "*"}},
+		},
+		{
+			channel:   "news.sport",
+			receivers: 3,
+			pattern:   []Message{{Channel: "news.sport", Pattern: "news.*"}},
+			both:      []Message{{Channel: "news.sport"}, {Channel: "news.sport", Pattern: "*"}},
+		},
+		{
+			channel:   "weather",
+			receivers: 1,
+			both:      []Message{{Channel: "weather", Pattern: "*"}},
+		},
+	}
+	for _, test := range tests {
+		payload := []byte(test.channel)
+		receivers, err := db.Publish(test.channel, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receivers != test.receivers {
+			t.Errorf("Publish(%s) reached %d, want %d", test.channel, receivers, test.receivers)
+		}
+		for _, want := range [][]Message{test.news, test.pattern, test.both} {
+			for i := range want {
+				want[i].Payload = payload
+			}
+		}
+		if got := received(news); !reflect.DeepEqual(got, test.news) {
+			t.Errorf("%s: channel subscription received %+v, want %+v", test.channel, got, test.news)
+		}
+		if got := received(pattern); !reflect.DeepEqual(got, test.pattern) {
+			t.Errorf("%s: pattern subscription received %+v, want %+v", test.channel, got, test.pattern)
+		}
+		if got := received(both); !reflect.DeepEqual(got, test.both) {
+			t.Errorf("%s: subscription to both received %+v, want %+v", test.channel, got, test.both)
+		}
+	}
+
+	// Unsubscribing stops delivery without ending the subscription
+	err = pattern.PUnsubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receivers, err := db.Publish("news", nil)
+	if err != nil || receivers != 2 {
+		t.Fatalf("Publish after PUnsubscribe reached %d, %v; want 2", receivers, err)
+	}
+	if got := received(pattern); len(got) != 0 || pattern.Err() != nil {
+		t.Fatalf("unsubscribed pattern received %+v and ended with %v", got, pattern.Err())
+	}
+}
+
+// TestPublishOverflow fills a subscription's buffer under each policy
+func TestPublishOverflow(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		db := newPubSubDB(t, 2, OverflowDrop)
+		slow, err := db.Subscribe("channel")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer slow.Close()
+
+		for i, want := range []int{1, 1, 0, 0} {
+			receivers, err := db.Publish("channel", []byte{byte(i)})
+			if err != nil || receivers != want {
+				t.Fatalf("Publish %d reached %d, %v; want %d", i, receivers, err, want)
+			}
+		}
+		if slow.Dropped() != 2 || slow.Err() != nil {
+			t.Fatalf("dropped %d and ended with %v, want 2 dropped and still open", slow.Dropped(), slow.Err())
+		}
+
+		// The oldest messages were kept, and there is room again once they
+		// have been received
+		got := received(slow)
+		if len(got) != 2 || got[0].Payload[0] != 0 || got[1].Payload[0] != 1 {
+			t.Fatalf("received %+v, want the first two messages", got)
+		}
+		receivers, err := db.Publish("channel", []byte{4})
+		if err != nil || receivers != 1 {
+			t.Fatalf("Publish after draining reached %d, %v; want 1", receivers, err)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		db := newPubSubDB(t, 2, OverflowDisconnect)
+		slow, err := db.Subscribe("channel")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fast, err := db.PSubscribe("chan*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fast.Close()
+
+		for i, want := range []int{2, 2} {
+			receivers, err := db.Publish("channel", []byte{byte(i)})
+			if err != nil || receivers != want {
+				t.Fatalf("Publish %d reached %d, %v; want %d", i, receivers, err, want)
+			}
+			received(fast)
+		}
+
+		// The message that does not fit ends the slow subscription but
+		// still reaches the other one
+		receivers, err := db.Publish("channel", []byte{2})
+		if err != nil || receivers != 1 {
+			t.Fatalf("Publish to a full buffer reached %d, %v; want 1", receivers, err)
+		}
+		if got := received(fast); len(got) != 1 {
+			t.Fatalf("other subscription received %+v", got)
+		}
+		select {
+		case <-slow.Done():
+		default:
+			t.Fatal("slow subscription is still open")
+		}
+		if !errors.Is(slow.Err(), ErrSlowSubscriber) {
+			t.Fatalf("slow subscription ended with %v, want %v", slow.Err(), ErrSlowSubscriber)
+		}
+
+		// What was buffered can still be received before the channel closes
+		if got := received(slow); len(got) != 2 {
+			t.Fatalf("slow subscription received %d buffered messages, want 2", len(got))
+		}
+		if _, ok := <-slow.Messages(); ok {
+			t.Fatal("messages of an ended subscription are still open")
+		}
+		if err := slow.Subscribe("other"); !errors.Is(err, ErrSlowSubscriber) {
+			t.Fatalf("Subscribe after ending = %v, want %v", err, ErrSlowSubscriber)
+		}
+		if slow.Count() != 0 || len(db.pubsub.channels["channel"]) != 0 {
+			t.Fatal("ended subscription is still indexed")
+		}
+		receivers, err = db.Publish("channel", nil)
+		if err != nil || receivers != 1 {
+			t.Fatalf("Publish after the disconnect reached %d, %v; want 1", receivers, err)
+		}
+	})
+}
+
+// TestPubSubClose checks that closing a subscription or the database ends
+// subscriptions with the right error
+func TestPubSubClose(t *testing.T) {
+	db := newPubSubDB(t, 16, OverflowDisconnect)
+
+	closed, err := db.Subscribe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = closed.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(closed.Err(), ErrSubscriptionClosed) {
+		t.Fatalf("closed subscription ended with %v, want %v", closed.Err(), ErrSubscriptionClosed)
+	}
+
+	var open []*Subscription
+	for _, channel := range []string{"a", "b"} {
+		s, err := db.Subscribe(channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		open = append(open, s)
+	}
+	s, err := db.PSubscribe("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open = append(open, s)
+	_, err = db.Publish("a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range open {
+		select {
+		case <-s.Done():
+		default:
+			t.Fatalf("subscription %d is still open", i)
+		}
+		if !errors.Is(s.Err(), ErrDatabaseClosed) {
+			t.Fatalf("subscription %d ended with %v, want %v", i, s.Err(), ErrDatabaseClosed)
+		}
+		received(s)
+		if _, ok := <-s.Messages(); ok {
+			t.Fatalf("messages of subscription %d are still open", i)
+		}
+		s.Close()
+	}
+	if !errors.Is(closed.Err(), ErrSubscriptionClosed) {
+		t.Fatalf("closing the database changed the error of a closed subscription to %v", closed.Err())
+	}
+	if len(db.pubsub.subscriptions) != 0 || len(db.pubsub.channels) != 0 || len(db.pubsub.patterns) != 0 {
+		t.Fatal("subscriptions are still indexed after closing the database")
+	}
+
+	_, err = db.Publish("a", nil)
+	if !errors.Is(err, ErrDatabaseClosed) {
+		t.Fatalf("Publish after close = %v, want %v", err, ErrDatabaseClosed)
+	}
+	_, err = db.Subscribe("a")
+	if !errors.Is(err, ErrDatabaseClosed) {
+		t.Fatalf("Subscribe after close = %v, want %v", err, ErrDatabaseClosed)
+	}
+}
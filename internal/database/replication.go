@@ -0,0 +1,407 @@
+package database
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// replicationQueueLimit is how many entries a follower's stream may fall
+// behind by before it is ended
+const replicationQueueLimit = 1 << 16
+
+// A primary streams its log to followers. Every entry the log writes is
+// handed to the replication hub, which keeps the most recent ones in a
+// backlog so that a follower reconnecting shortly after it dropped out can
+// carry on where it stopped. A follower that is too far behind, or new,
+// first receives a snapshot of the key space instead.
+
+// replicationHub fans written log entries out to replication streams
+type replicationHub struct {
+	mutex       sync.Mutex
+	backlog     []*persistence.LogEntry // Newest entries, in sequence order
+	backlogSize int
+	streams     map[*ReplicationStream]struct{}
+}
+
+// newReplicationHub creates a hub keeping up to backlogSize entries
+func newReplicationHub(backlogSize int) *replicationHub {
+	return &replicationHub{
+		backlogSize: backlogSize,
+		streams:     make(map[*ReplicationStream]struct{}),
+	}
+}
+
+// commit is the log's OnCommit hook. The log calls it in sequence order
+// before the appends return, so by the time a write holding a key lock
+// is done, its entry has reached every stream.
+func (h *replicationHub) commit(entries []*persistence.LogEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.backlogSize > 0 {
+		h.backlog = append(h.backlog, entries...)
+		// Trim only once twice the size is reached so appends stay cheap
+		if len(h.backlog) >= 2*h.backlogSize {
+			h.backlog = append([]*persistence.LogEntry(nil), h.backlog[len(h.backlog)-h.backlogSize:]...)
+		}
+	}
+
+	for stream := range h.streams {
+		if !stream.push(entries) {
+			delete(h.streams, stream)
+		}
+	}
+}
+
+// since returns the backlogged entries after sequence, or false if the
+// backlog no longer reaches back that far
+func (h *replicationHub) since(sequence, last uint64) ([]*persistence.LogEntry, bool) {
+	if sequence == last {
+		return nil, true
+	}
+	if sequence > last || len(h.backlog) == 0 || h.backlog[0].Sequence > sequence+1 {
+		return nil, false
+	}
+
+	start := len(h.backlog)
+	for start > 0 && h.backlog[start-1].Sequence > sequence {
+		start--
+	}
+	return append([]*persistence.LogEntry(nil), h.backlog[start:]...), true
+}
+
+// remove unregisters a stream
+func (h *replicationHub) remove(stream *ReplicationStream) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.streams, stream)
+}
+
+// closeAll ends every stream with err
+func (h *replicationHub) closeAll(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for stream := range h.streams {
+		stream.fail(err)
+		delete(h.streams, stream)
+	}
+}
+
+// ReplicationStream delivers a primary's log entries to one follower.
+// When it starts with a full sync, the follower must first load the
+// snapshot read with Snapshot and then apply the entries from Next.
+type ReplicationStream struct {
+	db       *DB
+	sequence uint64
+	fullSync bool
+
+	mutex  sync.Mutex
+	queue  []*persistence.LogEntry
+	err    error
+	notify chan struct{}
+}
+
+// OpenReplication starts streaming the log to a follower whose log ends at
+// sequence, zero for an empty one. If the backlog still holds every entry
+// after it, the stream carries on from there; otherwise it starts with a
+// full sync.
+func (db *DB) OpenReplication(sequence uint64) (*ReplicationStream, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.isClosed {
+		return nil, ErrDatabaseClosed
+	}
+
+	stream := &ReplicationStream{
+		db:     db,
+		notify: make(chan struct{}, 1),
+	}
+
+	// With every write held off, the log, the backlog and memory all end
+	// at the same entry, and every later one will reach the stream
+	db.keyLocks.lockAll()
+	defer db.keyLocks.unlockAll()
+
+	hub := db.replication
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	last := db.log.LastSequence()
+	entries, ok := hub.since(sequence, last)
+	if ok {
+		stream.sequence = sequence
+		stream.queue = entries
+	} else {
+		stream.sequence = last
+		stream.fullSync = true
+	}
+	hub.streams[stream] = struct{}{}
+
+	return stream, nil
+}
+
+// FullSync reports whether the follower must load a snapshot first
+func (s *ReplicationStream) FullSync() bool {
+	return s.fullSync
+}
+
+// Sequence returns the sequence number the stream starts after. For a full
+// sync this is the sequence the snapshot covers.
+func (s *ReplicationStream) Sequence() uint64 {
+	return s.sequence
+}
+
+// Snapshot calls fn for every key for a full sync. Like the snapshots taken
+// on disk, it is read while writes carry on, so it may already include
+// some of the entries that follow; applying those again leaves the same
+// result.
+func (s *ReplicationStream) Snapshot(fn func(entry *persistence.SnapshotEntry)) {
+	s.db.iterateStorage(fn)
+}
+
+// Next waits for entries and returns all that are queued, in sequence
+// order. It returns ErrReplicaBehind if the follower fell more than
+// replicationQueueLimit entries behind, and ErrDatabaseClosed once the
+// database is closed.
+func (s *ReplicationStream) Next(ctx context.Context) ([]*persistence.LogEntry, error) {
+	for {
+		s.mutex.Lock()
+		entries, err := s.queue, s.err
+		s.queue = nil
+		s.mutex.Unlock()
+
+		if len(entries) > 0 {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops the stream
+func (s *ReplicationStream) Close() {
+	s.db.replication.remove(s)
+	s.fail(ErrDatabaseClosed)
+}
+
+// push queues entries for the follower. It returns false, ending the
+// stream, if the queue would grow past its limit.
+func (s *ReplicationStream) push(entries []*persistence.LogEntry) bool {
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return false
+	}
+	if len(s.queue)+len(entries) > replicationQueueLimit {
+		s.mutex.Unlock()
+		s.fail(ErrReplicaBehind)
+		return false
+	}
+	s.queue = append(s.queue, entries...)
+	s.mutex.Unlock()
+
+	s.wake()
+	return true
+}
+
+// fail ends the stream with err, keeping the first error
+func (s *ReplicationStream) fail(err error) {
+	s.mutex.Lock()
+	if s.err == nil {
+		s.err = err
+		s.queue = nil
+	}
+	s.mutex.Unlock()
+
+	s.wake()
+}
+
+// wake lets a waiting Next check the queue again
+func (s *ReplicationStream) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// LastSequence returns the sequence number of the last logged entry. A
+// follower passes it to its primary to pick up where it left off.
+func (db *DB) LastSequence() uint64 {
+	return db.log.LastSequence()
+}
+
+// SetReadOnly makes every write fail with ErrReadOnly, or allows writes
+// again. Followers are read-only so that they only change through
+// replication.
+func (db *DB) SetReadOnly(readOnly bool) {
+	db.readOnly.Store(readOnly)
+}
+
+// ReadOnly reports whether writes are refused
+func (db *DB) ReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// ApplyReplicated logs entries received from a primary, keeping their
+// sequence numbers, and applies them to memory. It works whether or not
+// the database is read-only.
+func (db *DB) ApplyReplicated(entries []*persistence.LogEntry) error {
+	// Check if database is closed
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.isClosed {
+		return ErrDatabaseClosed
+	}
+
+	db.keyLocks.lockAll()
+	defer db.keyLocks.unlockAll()
+
+	err := db.log.AppendEntries(entries)
+	if err != nil {
+		return NewDatabaseError("replicate", "", err)
+	}
+
+	// Events are built before each entry is applied, to tell watchers
+	// the values replaced
+	watched := db.watchers.active()
+	var events []WatchEvent
+	for _, entry := range entries {
+		if watched {
+			events = append(events, db.entryEvents(entry)...)
+		}
+		err = db.applyEntry(entry)
+		if err != nil {
+			return NewDatabaseError("replicate", entry.Key, err)
+		}
+	}
+
+	if watched {
+		db.watchers.publish(events...)
+	}
+
+	return nil
+}
+
+// entryEvents returns the watch events for a logged entry that is about to
+// be applied. The caller must hold the locks of the keys written.
+func (db *DB) entryEvents(entry *persistence.LogEntry) []WatchEvent {
+	if entry.Operation.IsCollectionChange() {
+		return db.collectionEvents(entry)
+	}
+
+	var operations []persistence.BatchOperation
+	switch entry.Operation {
+	case persistence.OperationSet, persistence.OperationSetWithExpiry, persistence.OperationDelete:
+		operations = []persistence.BatchOperation{{Operation: entry.Operation, Key: entry.Key, Value: entry.Value}}
+	case persistence.OperationBatch:
+		var err error
+		operations, err = persistence.DecodeBatch(entry.Value)
+		if err != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	// A batch may write a key more than once, each write replacing the one
+	// before
+	written := make(map[string][]byte, len(operations))
+	events := make([]WatchEvent, 0, len(operations))
+	for _, operation := range operations {
+		oldValue, ok := written[operation.Key]
+		if !ok {
+			previous, _ := db.storage.GetEntry(operation.Key)
+			oldValue = stringValue(previous)
+		}
+
+		event := WatchEvent{Key: operation.Key, OldValue: oldValue, Sequence: entry.Sequence}
+		switch operation.Operation {
+		case persistence.OperationSet:
+			event.Type, event.Value = EventSet, operation.Value
+		case persistence.OperationSetWithExpiry:
+			_, value, err := persistence.DecodeExpiry(operation.Value)
+			if err != nil {
+				continue
+			}
+			event.Type, event.Value = EventSet, value
+		case persistence.OperationDelete:
+			event.Type = EventDelete
+		default:
+			continue
+		}
+
+		written[operation.Key] = event.Value
+		events = append(events, event)
+	}
+	return events
+}
+
+// LoadReplicaSnapshot replaces the whole database with a snapshot received
+// from a primary or cluster leader, covering its log up to sequence. The snapshot is saved
+// before the log is restarted at the following sequence number, so if this
+// is interrupted, recovery comes back with either the old contents or the
+// snapshot. Watches are ended, as they would miss the changes, and cannot
+// resume from before the snapshot.
+func (db *DB) LoadReplicaSnapshot(sequence uint64, entries []*persistence.SnapshotEntry) error {
+	// Check if database is closed
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.isClosed {
+		return ErrDatabaseClosed
+	}
+
+	db.maintenanceMutex.Lock()
+	defer db.maintenanceMutex.Unlock()
+
+	db.keyLocks.lockAll()
+	defer db.keyLocks.unlockAll()
+
+	// The restarted log begins right where the current one ends
+	position := db.log.Position()
+	err := db.snapshots.Save(position, func(fn func(entry *persistence.SnapshotEntry)) {
+		for _, entry := range entries {
+			fn(entry)
+		}
+	})
+	if err != nil {
+		return NewDatabaseError("resync", "", err)
+	}
+
+	_, err = db.log.Restart(sequence + 1)
+	if err != nil {
+		return NewDatabaseError("resync", "", err)
+	}
+
+	err = db.log.RemoveSegmentsBefore(position)
+	if err != nil {
+		return NewDatabaseError("resync", "", err)
+	}
+
+	keep := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		keep[entry.Key] = struct{}{}
+		db.storage.SetEntry(entry.Key, loadedEntry(entry))
+	}
+	for _, key := range db.storage.Keys() {
+		if _, exists := keep[key]; !exists {
+			db.storage.Delete(key)
+		}
+	}
+
+	db.watchers.closeAll()
+	db.watchers.reset(sequence)
+
+	return nil
+}
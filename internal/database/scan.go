@@ -0,0 +1,140 @@
+package database
+
+import (
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/storage"
+)
+
+// DefaultScanLimit is the page size used when a scan does not set a limit
+const DefaultScanLimit = 100
+
+// KeyValue is a key and its value returned by a scan. Only strings have
+// their value returned; for other types Value is nil.
+type KeyValue struct {
+	Key       string
+	Value     []byte
+	Type      ValueType
+	Version   uint64
+	ExpiresAt time.Time // Zero if the key does not expire
+}
+
+// ScanOptions selects the keys returned by ScanWithOptions
+type ScanOptions struct {
+	Start   string // First key of the range, inclusive
+	End     string // Key the range stops before; empty for no upper bound
+	Prefix  string // Only keys starting with Prefix, within Start and End
+	Limit   int    // Maximum entries per page; zero uses DefaultScanLimit
+	Reverse bool   // Return keys in descending order
+	Cursor  string // Cursor of the previous page, empty for the first page
+}
+
+// ScanResult is one page of a scan
+type ScanResult struct {
+	Entries []KeyValue
+
+	// Cursor continues the scan after this page when passed back in
+	// ScanOptions. It is the last key returned, so it stays valid whatever
+	// is written in the meantime. It is empty once the range is exhausted.
+	Cursor string
+}
+
+// Scan returns the entries with keys in [start, end) in ascending order. An
+// empty end means no upper bound.
+func (db *DB) Scan(start, end string, limit int) (*ScanResult, error) {
+	return db.ScanWithOptions(&ScanOptions{
+		Start: start,
+		End:   end,
+		Limit: limit,
+	})
+}
+
+// ScanPrefix returns the entries whose keys start with prefix in ascending
+// order
+func (db *DB) ScanPrefix(prefix string, limit int) (*ScanResult, error) {
+	return db.ScanWithOptions(&ScanOptions{
+		Prefix: prefix,
+		Limit:  limit,
+	})
+}
+
+// ScanWithOptions returns one page of the entries selected by options
+func (db *DB) ScanWithOptions(options *ScanOptions) (*ScanResult, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return nil, ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if options == nil {
+		options = &ScanOptions{}
+	}
+
+	limit := options.Limit
+	if limit < 0 {
+		return nil, ErrInvalidLimit
+	}
+	if limit == 0 {
+		limit = DefaultScanLimit
+	}
+
+	start, end := options.Start, options.End
+	if options.Prefix != "" {
+		if options.Prefix > start {
+			start = options.Prefix
+		}
+		if prefixEnd := prefixUpperBound(options.Prefix); isBefore(prefixEnd, end) {
+			end = prefixEnd
+		}
+	}
+
+	// Resume after the last key of the previous page
+	if options.Cursor != "" {
+		if options.Reverse {
+			if isBefore(options.Cursor, end) {
+				end = options.Cursor
+			}
+		} else if after := options.Cursor + "\x00"; after > start {
+			start = after
+		}
+	}
+
+	result := &ScanResult{}
+	db.storage.Range(start, end, options.Reverse, func(key string, entry storage.Entry) bool {
+		if len(result.Entries) == limit {
+			// There is at least one more entry, so the scan can continue
+			result.Cursor = result.Entries[limit-1].Key
+			return false
+		}
+		kv := KeyValue{Key: key, Value: stringValue(entry), Type: entry.Type, Version: entry.Version}
+		if entry.ExpiresAt != 0 {
+			kv.ExpiresAt = time.Unix(0, entry.ExpiresAt)
+		}
+		result.Entries = append(result.Entries, kv)
+		return true
+	})
+
+	return result, nil
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix, or an empty string if there is none
+func prefixUpperBound(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// isBefore reports whether the upper bound a is tighter than b, where an
+// empty bound means no bound at all
+func isBefore(a, b string) bool {
+	return a != "" && (b == "" || a < b)
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/storage"
+)
+
+// scanKeys returns the keys of a page of a scan
+func scanKeys(t *testing.T, db *DB, options ScanOptions) ([]string, string) {
+	t.Helper()
+	result, err := db.ScanWithOptions(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, entry := range result.Entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys, result.Cursor
+}
+
+// scanAll pages through a scan and returns every key it yields
+func scanAll(t *testing.T, db *DB, options ScanOptions) []string {
+	t.Helper()
+	var all []string
+	for {
+		keys, cursor := scanKeys(t, db, options)
+		all = append(all, keys...)
+		if cursor == "" {
+			return all
+		}
+		options.Cursor = cursor
+	}
+}
+
+// setKeys stores each key with itself as its value
+func setKeys(t *testing.T, db *DB, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		err := db.Set(key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestScanPrefix checks that a prefix bounds the scan, on its own and with
+// Start and End, including prefixes that have no upper bound
+func TestScanPrefix(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	setKeys(t, db, "a", "ab", "ab\xff", "abc", "ac", "b", "\xfe", "\xff", "\xff\xff", "\xff\xffa")
+
+	tests := []struct {
+		options ScanOptions
+		want    []string
+	}{
+		{ScanOptions{Prefix: "ab"}, []string{"ab", "abc", "ab\xff"}},
+		{ScanOptions{Prefix: "ab", Reverse: true}, []string{"ab\xff", "abc", "ab"}},
+		{ScanOptions{Prefix: "ab", Start: "ab\x01"}, []string{"abc", "ab\xff"}},
+		{ScanOptions{Prefix: "ab", End: "ab\xff"}, []string{"ab", "abc"}},
+		{ScanOptions{Prefix: "ab", Start: "a", End: "z"}, []string{"ab", "abc", "ab\xff"}},
+		{ScanOptions{Prefix: "a\xff"}, nil},
+		{ScanOptions{Prefix: "\xff"}, []string{"\xff", "\xff\xff", "\xff\xffa"}},
+		{ScanOptions{Prefix: "\xff\xff"}, []string{"\xff\xff", "\xff\xffa"}},
+		{ScanOptions{Prefix: "\xff\xff", Reverse: true}, []string{"\xff\xffa", "\xff\xff"}},
+		{ScanOptions{Prefix: "\xff", End: "\xff\xff"}, []string{"\xff"}},
+	}
+	for _, test := range tests {
+		if got := scanAll(t, db, test.options); !slices.Equal(got, test.want) {
+			t.Errorf("scan %+v = %q, want %q", test.options, got, test.want)
+		}
+		options := test.options
+		options.Limit = 1
+		if got := scanAll(t, db, options); !slices.Equal(got, test.want) {
+			t.Errorf("scan %+v one key a page = %q, want %q", options, got, test.want)
+		}
+	}
+}
+
+// TestScanPages checks that pages follow on from each other in both
+// directions, across the batches the index is read in, and that a cursor
+// stays valid once its key is deleted
+func TestScanPages(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var want []string
+	for i := 0; i < 150; i++ {
+		want = append(want, fmt.Sprintf("key:%03d", i))
+	}
+	setKeys(t, db, want...)
+	reversed := slices.Clone(want)
+	slices.Reverse(reversed)
+
+	for _, reverse := range []bool{false, true} {
+		wantOrder := want
+		if reverse {
+			wantOrder = reversed
+		}
+		for _, limit := range []int{1, 7, 64, 100, 150, 200} {
+			got := scanAll(t, db, ScanOptions{Limit: limit, Reverse: reverse})
+			if !slices.Equal(got, wantOrder) {
+				t.Errorf("reverse %v, %d a page: got %d keys, want %d", reverse, limit, len(got), len(wantOrder))
+			}
+		}
+
+		// Delete the last key of the first page before asking for the next
+		page, cursor := scanKeys(t, db, ScanOptions{Limit: 100, Reverse: reverse})
+		if len(page) != 100 || cursor != page[99] {
+			t.Fatalf("reverse %v: first page holds %d keys and cursor %q", reverse, len(page), cursor)
+		}
+		err = db.Delete(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, cursor := scanKeys(t, db, ScanOptions{Limit: 100, Reverse: reverse, Cursor: cursor})
+		if !slices.Equal(rest, wantOrder[100:]) || cursor != "" {
+			t.Fatalf("reverse %v: page after a deleted cursor = %q, %q; want %q", reverse, rest, cursor, wantOrder[100:])
+		}
+		setKeys(t, db, page[99])
+	}
+}
+
+// TestScanSkipsExpired checks that expired keys are left out of pages, and
+// that a page full of them does not end the scan
+func TestScanSkipsExpired(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	past := time.Now().Add(-time.Minute).UnixNano()
+	var want []string
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		if i >= 20 && i < 120 {
+			db.storage.SetEntry(key, storage.Entry{Value: []byte(key), ExpiresAt: past})
+			continue
+		}
+		setKeys(t, db, key)
+		want = append(want, key)
+	}
+	err = db.SetWithTTL("soon", []byte("value"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	for _, limit := range []int{10, 50, 0} {
+		if got := scanAll(t, db, ScanOptions{Limit: limit}); !slices.Equal(got, want) {
+			t.Errorf("%d a page: got %d keys, want %d", limit, len(got), len(want))
+		}
+	}
+}
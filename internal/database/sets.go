@@ -0,0 +1,167 @@
+package database
+
+import (
+	"maps"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// In snapshots, a set is stored as its members in ascending order
+
+// SAdd adds members to the set at key, creating the set if needed, and
+// returns how many of them are new
+func (db *DB) SAdd(key string, members ...string) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	var added []string
+	exists, err := db.readCollection("sadd", key, TypeSet, func(c *collection) {
+		seen := make(map[string]struct{}, len(members))
+		for _, member := range members {
+			_, ok := c.set[member]
+			_, repeated := seen[member]
+			if !ok && !repeated {
+				seen[member] = struct{}{}
+				added = append(added, member)
+			}
+		}
+	})
+	if err != nil || len(added) == 0 {
+		return 0, err
+	}
+
+	err = db.changeCollectionLocked(persistence.OperationSetAdd, key, !exists, toItems(added))
+	if err != nil {
+		return 0, NewDatabaseError("sadd", key, err)
+	}
+	return len(added), nil
+}
+
+// SRem removes members from the set at key and returns how many it had
+func (db *DB) SRem(key string, members ...string) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	var removed []string
+	_, err = db.readCollection("srem", key, TypeSet, func(c *collection) {
+		removed = present(c.set, members)
+	})
+	if err != nil || len(removed) == 0 {
+		return 0, err
+	}
+
+	err = db.changeCollectionLocked(persistence.OperationSetRemove, key, false, toItems(removed))
+	if err != nil {
+		return 0, NewDatabaseError("srem", key, err)
+	}
+	return len(removed), nil
+}
+
+// SIsMember reports whether member is in the set at key
+func (db *DB) SIsMember(key, member string) (bool, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	ok := false
+	_, err = db.readCollection("sismember", key, TypeSet, func(c *collection) {
+		_, ok = c.set[member]
+	})
+	return ok, err
+}
+
+// SMembers returns the members of the set at key in ascending order, none
+// if there is no set
+func (db *DB) SMembers(key string) ([]string, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []string
+	_, err = db.readCollection("smembers", key, TypeSet, func(c *collection) {
+		members = sortedKeys(c.set)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SInter returns the members found in every one of the sets at keys, in
+// ascending order. A missing key is an empty set, which empties the result.
+func (db *DB) SInter(keys ...string) ([]string, error) {
+	var common map[string]struct{}
+	for _, key := range keys {
+		err := db.checkKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = db.readCollection("sinter", key, TypeSet, func(c *collection) {
+			if common == nil {
+				common = maps.Clone(c.set)
+				return
+			}
+			for member := range common {
+				if _, ok := c.set[member]; !ok {
+					delete(common, member)
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sortedKeys(common), nil
+}
+
+// decodeSet turns stored or logged members into a set
+func decodeSet(items [][]byte) map[string]struct{} {
+	set := make(map[string]struct{}, len(items))
+	for _, member := range items {
+		set[string(member)] = struct{}{}
+	}
+	return set
+}
+
+// encodeSet turns a set into its members in ascending order
+func encodeSet(set map[string]struct{}) [][]byte {
+	return toItems(sortedKeys(set))
+}
+
+// addMembers adds the members of a logged SAdd to set
+func addMembers(set map[string]struct{}, items [][]byte) {
+	for _, member := range items {
+		set[string(member)] = struct{}{}
+	}
+}
+
+// toItems turns strings into items
+func toItems(values []string) [][]byte {
+	items := make([][]byte, len(values))
+	for i, value := range values {
+		items[i] = []byte(value)
+	}
+	return items
+}
+
+// fromItems turns items into strings
+func fromItems(items [][]byte) []string {
+	values := make([]string, len(items))
+	for i, item := range items {
+		values[i] = string(item)
+	}
+	return values
+}
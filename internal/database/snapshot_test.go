@@ -0,0 +1,129 @@
+package database
+
+import (
+	"os"
+	"testing"
+)
+
+// TestSnapshotFallback damages snapshots and checks that recovery passes
+// over them, starting from the previous snapshot or from the start of the
+// log, and that no key is lost either way
+func TestSnapshotFallback(t *testing.T) {
+	corrupt := func(t *testing.T, path string) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)/2] ^= 0xff
+		err = os.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	truncate := func(t *testing.T, path string) {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Truncate(path, info.Size()/2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		segmentSize int64
+		damage      []func(t *testing.T, path string) // Applied to the snapshots, newest first
+		fallback    int                               // Snapshot recovery starts from, newest first; -1 for none
+	}{
+		{"newest corrupt", 0, []func(*testing.T, string){corrupt}, 1},
+		{"newest truncated", 0, []func(*testing.T, string){truncate}, 1},
+		{"newest corrupt with small segments", 64, []func(*testing.T, string){corrupt}, 1},
+		{"all damaged", 0, []func(*testing.T, string){truncate, corrupt}, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t.TempDir())
+			config.SnapshotRetention = 2
+			if test.segmentSize > 0 {
+				config.SegmentSize = test.segmentSize
+			}
+			db, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Each snapshot is followed by one more key
+			keys := []string{"a", "b", "c"}
+			for i, key := range keys {
+				err = db.Set(key, []byte(key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i < len(keys)-1 {
+					err = db.takeSnapshot()
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			snapshots, err := db.snapshots.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshots) != 2 {
+				t.Fatalf("%d snapshots, want 2", len(snapshots))
+			}
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, damage := range test.damage {
+				damage(t, snapshots[len(snapshots)-1-i].Path)
+			}
+
+			db, err = New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			report := db.RecoveryReport()
+			if len(report.SkippedSnapshots) != len(test.damage) {
+				t.Fatalf("skipped %+v, want the %d damaged snapshots", report.SkippedSnapshots, len(test.damage))
+			}
+			for i, skipped := range report.SkippedSnapshots {
+				if want := snapshots[len(snapshots)-1-i].Path; skipped.Path != want {
+					t.Fatalf("skipped snapshot %d is %s, want %s", i, skipped.Path, want)
+				}
+			}
+
+			// Recovery replays the keys written after the snapshot it used
+			var wantPath string
+			var wantPosition int64
+			replayed := len(keys)
+			if test.fallback >= 0 {
+				snapshot := snapshots[len(snapshots)-1-test.fallback]
+				wantPath, wantPosition = snapshot.Path, snapshot.Position
+				replayed = test.fallback + 1
+			}
+			if report.SnapshotPath != wantPath || report.SnapshotPosition != wantPosition || report.StartPosition != wantPosition {
+				t.Fatalf("recovered from %q at %d, replaying from %d; want %q at %d",
+					report.SnapshotPath, report.SnapshotPosition, report.StartPosition, wantPath, wantPosition)
+			}
+			if report.EntriesReplayed != replayed {
+				t.Fatalf("replayed %d entries, want %d", report.EntriesReplayed, replayed)
+			}
+
+			for _, key := range keys {
+				value, err := db.Get(key)
+				if err != nil || string(value) != key {
+					t.Fatalf("Get(%s) = %q, %v; want %q", key, value, err, key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// In snapshots, a sorted set is stored as its members and scores,
+// alternating, in ascending order of member. Each score takes 8 bytes: the bits of the
+// float64, little-endian.
+
+// ScoredMember is a member of a sorted set along with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ZAdd sets the scores of members of the sorted set at key, creating the
+// sorted set if needed, and returns how many of the members are new
+func (db *DB) ZAdd(key string, members map[string]float64) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+	for _, score := range members {
+		if math.IsNaN(score) {
+			return 0, NewDatabaseError("zadd", key, ErrInvalidScore)
+		}
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	// Only log the members whose score changes
+	added := 0
+	changed := make(map[string]float64)
+	exists, err := db.readCollection("zadd", key, TypeSortedSet, func(c *collection) {
+		for member, score := range members {
+			current, ok := c.scores[member]
+			if !ok {
+				added++
+			}
+			if !ok || current != score {
+				changed[member] = score
+			}
+		}
+	})
+	if err != nil || len(changed) == 0 {
+		return 0, err
+	}
+
+	err = db.changeCollectionLocked(persistence.OperationSortedSetAdd, key, !exists, encodeSortedSet(changed))
+	if err != nil {
+		return 0, NewDatabaseError("zadd", key, err)
+	}
+	return added, nil
+}
+
+// ZRem removes members from the sorted set at key and returns how many it
+// had
+func (db *DB) ZRem(key string, members ...string) (int, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	var removed []string
+	_, err = db.readCollection("zrem", key, TypeSortedSet, func(c *collection) {
+		removed = present(c.scores, members)
+	})
+	if err != nil || len(removed) == 0 {
+		return 0, err
+	}
+
+	err = db.changeCollectionLocked(persistence.OperationSortedSetRemove, key, false, toItems(removed))
+	if err != nil {
+		return 0, NewDatabaseError("zrem", key, err)
+	}
+	return len(removed), nil
+}
+
+// ZRange returns the members of the sorted set at key ranked from start to
+// stop, inclusive, in ascending order of score and then of member. Negative
+// ranks count from the highest, -1 being the last member.
+func (db *DB) ZRange(key string, start, stop int) ([]ScoredMember, error) {
+	ranked, err := db.rankSortedSet("zrange", key)
+	if err != nil {
+		return nil, err
+	}
+
+	start, stop = clampRange(start, stop, len(ranked))
+	if start > stop {
+		return []ScoredMember{}, nil
+	}
+	return ranked[start : stop+1], nil
+}
+
+// ZRank returns the rank of member in the sorted set at key, counting from
+// zero for the lowest score. It fails with ErrKeyNotFound if there is no
+// such member.
+func (db *DB) ZRank(key, member string) (int, error) {
+	ranked, err := db.rankSortedSet("zrank", key)
+	if err != nil {
+		return 0, err
+	}
+
+	for rank, scored := range ranked {
+		if scored.Member == member {
+			return rank, nil
+		}
+	}
+	return 0, NewDatabaseError("zrank", key, ErrKeyNotFound)
+}
+
+// ZScore returns the score of member in the sorted set at key. It fails
+// with ErrKeyNotFound if there is no such member.
+func (db *DB) ZScore(key, member string) (float64, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var score float64
+	ok := false
+	_, err = db.readCollection("zscore", key, TypeSortedSet, func(c *collection) {
+		score, ok = c.scores[member]
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, NewDatabaseError("zscore", key, ErrKeyNotFound)
+	}
+	return score, nil
+}
+
+// rankSortedSet returns the members of the sorted set at key in ascending
+// order of score and then of member
+func (db *DB) rankSortedSet(operation, key string) ([]ScoredMember, error) {
+	err := db.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranked []ScoredMember
+	_, err = db.readCollection(operation, key, TypeSortedSet, func(c *collection) {
+		ranked = make([]ScoredMember, 0, len(c.scores))
+		for member, score := range c.scores {
+			ranked = append(ranked, ScoredMember{Member: member, Score: score})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(ranked, func(a, b ScoredMember) int {
+		return cmp.Or(cmp.Compare(a.Score, b.Score), cmp.Compare(a.Member, b.Member))
+	})
+	return ranked, nil
+}
+
+// decodeSortedSet turns stored or logged member and score pairs into a map
+func decodeSortedSet(items [][]byte) (map[string]float64, error) {
+	scores := make(map[string]float64, len(items)/2)
+	return scores, addScores(scores, items)
+}
+
+// encodeSortedSet turns a sorted set into member and score pairs in
+// ascending order of member
+func encodeSortedSet(scores map[string]float64) [][]byte {
+	members := make([]string, 0, len(scores))
+	for member := range scores {
+		members = append(members, member)
+	}
+	slices.Sort(members)
+
+	items := make([][]byte, 0, 2*len(members))
+	for _, member := range members {
+		score := binary.LittleEndian.AppendUint64(nil, math.Float64bits(scores[member]))
+		items = append(items, []byte(member), score)
+	}
+	return items
+}
+
+// addScores sets the member and score pairs of a logged ZAdd in scores
+func addScores(scores map[string]float64, items [][]byte) error {
+	if len(items)%2 != 0 {
+		return fmt.Errorf("member without a score")
+	}
+	for i := 0; i < len(items); i += 2 {
+		if len(items[i+1]) != 8 {
+			return fmt.Errorf("invalid score for member %q", items[i])
+		}
+		scores[string(items[i])] = math.Float64frombits(binary.LittleEndian.Uint64(items[i+1]))
+	}
+	return nil
+}
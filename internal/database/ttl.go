@@ -0,0 +1,162 @@
+package database
+
+import (
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// NoExpiry is returned by TTL for keys that never expire
+const NoExpiry time.Duration = -1
+
+const (
+	// sweepBuckets is how many buckets one sweep round examines
+	sweepBuckets = 64
+
+	// sweepBudget bounds how long a single sweep may keep going
+	sweepBudget = 25 * time.Millisecond
+)
+
+// SetWithTTL stores a value for a given key that expires after ttl
+func (db *DB) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	if value == nil {
+		return ErrNilValue
+	}
+
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	expiresAt := time.Now().Add(ttl).UnixNano()
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	_, err := db.putLocked(key, value, expiresAt)
+	if err != nil {
+		return NewDatabaseError("set", key, err)
+	}
+
+	return nil
+}
+
+// Expire makes an existing key expire after ttl
+func (db *DB) Expire(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	return db.setExpiry("expire", key, time.Now().Add(ttl).UnixNano())
+}
+
+// Persist removes the expiry of an existing key
+func (db *DB) Persist(key string) error {
+	return db.setExpiry("persist", key, 0)
+}
+
+// setExpiry changes the expiry time of an existing key
+func (db *DB) setExpiry(operation, key string, expiresAt int64) error {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	// Check if key exists
+	previous, exists := db.storage.GetEntry(key)
+	if !exists {
+		return NewDatabaseError(operation, key, ErrKeyNotFound)
+	}
+	if previous.ExpiresAt == expiresAt {
+		return nil
+	}
+	if db.readOnly.Load() {
+		return NewDatabaseError(operation, key, ErrReadOnly)
+	}
+
+	data := persistence.EncodeExpiry(expiresAt, nil)
+	if db.cluster != nil {
+		_, err := db.propose(persistence.OperationExpire, key, data)
+		if err != nil {
+			return NewDatabaseError(operation, key, err)
+		}
+		return nil
+	}
+
+	// Write to log
+	sequence, err := db.log.Append(persistence.OperationExpire, key, data)
+	if err != nil {
+		return NewDatabaseError(operation, key, err)
+	}
+
+	db.storage.Expire(key, expiresAt, sequence)
+
+	return nil
+}
+
+// TTL returns the time left before a key expires, or NoExpiry if it does
+// not expire
+func (db *DB) TTL(key string) (time.Duration, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return 0, ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+
+	entry, exists := db.storage.GetEntry(key)
+	if !exists {
+		return 0, NewDatabaseError("ttl", key, ErrKeyNotFound)
+	}
+	if entry.ExpiresAt == 0 {
+		return NoExpiry, nil
+	}
+
+	return time.Until(time.Unix(0, entry.ExpiresAt)), nil
+}
+
+// sweepExpired removes expired keys in the background so that keys which
+// are never read again do not hold on to memory. Like Redis, it keeps
+// sampling while a large share of the examined keys turn out to be expired.
+// Expiry times are logged as absolute times, so a replay of the log expires
+// the same keys and their removal needs no log entry. Replay keeps expired
+// keys around, as a later entry may clear their expiry, and leaves them to
+// be removed here or when read.
+func (db *DB) sweepExpired() {
+	start := time.Now()
+	for time.Since(start) < sweepBudget {
+		examined, removed := db.storage.DeleteExpired(sweepBuckets)
+		if examined == 0 || removed*4 < examined {
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestPersistSurvivesRestart checks that a key whose expiry was cleared is
+// still there after a restart that replays the expiry once it has passed
+func TestPersistSurvivesRestart(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		expire func(db *DB, key string) error
+	}{
+		{"SetWithTTL", func(db *DB, key string) error {
+			return db.SetWithTTL(key, []byte("value"), ttl)
+		}},
+		{"Expire", func(db *DB, key string) error {
+			err := db.Set(key, []byte("value"))
+			if err != nil {
+				return err
+			}
+			return db.Expire(key, ttl)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t.TempDir())
+			db, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = test.expire(db, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Persist("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(ttl + 100*time.Millisecond)
+
+			db, err = New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			value, err := db.Get("key")
+			if err != nil {
+				t.Fatalf("Get after restart: %v", err)
+			}
+			if string(value) != "value" {
+				t.Fatalf("Get after restart = %q, want %q", value, "value")
+			}
+		})
+	}
+}
+
+// TestExpiredKeyRemovedAfterRestart checks that a key whose expiry passed
+// while the database was closed is gone once it is open again
+func TestExpiredKeyRemovedAfterRestart(t *testing.T) {
+	config := testConfig(t.TempDir())
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.SetWithTTL("key", []byte("value"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	db, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Get("key")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after restart: got %v, want key not found", err)
+	}
+}
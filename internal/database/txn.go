@@ -0,0 +1,242 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+	"github.com/sidquark/KeyValueDatabase/internal/storage"
+)
+
+// Txn groups writes to several keys so that they take effect together.
+// Writes are buffered until Commit, which logs them as a single entry and
+// applies them at once; recovery likewise applies all of them or none.
+// Reads see the transaction's own writes on top of the current database;
+// they are not isolated from other writers. A Txn must not be used from
+// several goroutines at once.
+type Txn struct {
+	db     *DB
+	writes map[string]*txnWrite
+	order  []string // Keys in the order they were first written
+	done   bool
+}
+
+// txnWrite is the latest buffered change to a key
+type txnWrite struct {
+	value  []byte
+	delete bool
+}
+
+// Begin starts a new transaction
+func (db *DB) Begin() (*Txn, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.isClosed {
+		return nil, ErrDatabaseClosed
+	}
+
+	return &Txn{
+		db:     db,
+		writes: make(map[string]*txnWrite),
+	}, nil
+}
+
+// Get retrieves a value for a given key, including uncommitted writes made
+// in this transaction
+func (txn *Txn) Get(key string) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+
+	// Input validation
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+
+	if write, exists := txn.writes[key]; exists {
+		if write.delete {
+			return nil, NewDatabaseError("get", key, ErrKeyNotFound)
+		}
+		return write.value, nil
+	}
+
+	return txn.db.Get(key)
+}
+
+// Set stores a value for a given key when the transaction commits
+func (txn *Txn) Set(key string, value []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	// Input validation
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	if value == nil {
+		return ErrNilValue
+	}
+
+	txn.write(key, &txnWrite{value: value})
+	return nil
+}
+
+// Delete removes a key-value pair when the transaction commits
+func (txn *Txn) Delete(key string) error {
+	// Check if key exists, as seen from the transaction. Keys of other
+	// types than strings exist too.
+	_, err := txn.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return NewDatabaseError("delete", key, ErrKeyNotFound)
+	}
+	if err != nil && !errors.Is(err, ErrWrongType) {
+		return err
+	}
+
+	txn.write(key, &txnWrite{delete: true})
+	return nil
+}
+
+// write buffers a change, replacing any earlier one to the same key
+func (txn *Txn) write(key string, write *txnWrite) {
+	if _, exists := txn.writes[key]; !exists {
+		txn.order = append(txn.order, key)
+	}
+	txn.writes[key] = write
+}
+
+// Commit logs and applies all buffered writes. The batch is logged before
+// it is applied, so if logging fails the database is left unchanged. The
+// transaction cannot be used after Commit, whatever the outcome.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+
+	if len(txn.order) == 0 {
+		return nil
+	}
+
+	// Check if database is closed
+	db := txn.db
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	if db.readOnly.Load() {
+		return NewDatabaseError("commit", "", ErrReadOnly)
+	}
+
+	logged := make([]persistence.BatchOperation, 0, len(txn.order))
+	applied := make([]storage.Operation, 0, len(txn.order))
+	for _, key := range txn.order {
+		write := txn.writes[key]
+		if write.delete {
+			logged = append(logged, persistence.BatchOperation{Operation: persistence.OperationDelete, Key: key})
+		} else {
+			logged = append(logged, persistence.BatchOperation{Operation: persistence.OperationSet, Key: key, Value: write.value})
+		}
+		applied = append(applied, storage.Operation{Key: key, Value: write.value, Delete: write.delete})
+	}
+
+	// Hold every key written so that the batch is applied in the same order
+	// relative to other writes as it is logged
+	stripes := db.keyLocks.lockKeys(txn.order)
+	defer db.keyLocks.unlockStripes(stripes)
+
+	// In a cluster the batch reaches memory once committed
+	if db.cluster != nil {
+		data, err := persistence.EncodeBatch(logged)
+		if err == nil {
+			_, err = db.propose(persistence.OperationBatch, "", data)
+		}
+		if err != nil {
+			return NewDatabaseError("commit", "", err)
+		}
+		return nil
+	}
+
+	// Watchers are told the values replaced
+	watched := db.watchers.active()
+	var previous []storage.Entry
+	if watched {
+		previous = make([]storage.Entry, len(applied))
+		for i, operation := range applied {
+			previous[i], _ = db.storage.GetEntry(operation.Key)
+		}
+	}
+
+	// Write to log
+	version, err := db.log.AppendBatch(logged)
+	if err != nil {
+		return NewDatabaseError("commit", "", err)
+	}
+
+	// Add to in-memory storage, versioning every write with the batch
+	for i := range applied {
+		applied[i].Version = version
+	}
+	db.storage.Apply(applied)
+
+	if watched {
+		events := make([]WatchEvent, 0, len(applied))
+		for i, operation := range applied {
+			event := WatchEvent{Type: EventSet, Key: operation.Key, Value: operation.Value, Sequence: version}
+			if operation.Delete {
+				event = WatchEvent{Type: EventDelete, Key: operation.Key, Sequence: version}
+			}
+			event.OldValue = stringValue(previous[i])
+			events = append(events, event)
+		}
+		db.watchers.publish(events...)
+	}
+
+	return nil
+}
+
+// Rollback discards all buffered writes
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	txn.writes = nil
+	txn.order = nil
+
+	return nil
+}
+
+// applyBatch applies the operations of a replayed batch entry together
+func (db *DB) applyBatch(entry *persistence.LogEntry) error {
+	operations, err := persistence.DecodeBatch(entry.Value)
+	if err != nil {
+		return err
+	}
+
+	applied := make([]storage.Operation, 0, len(operations))
+	for _, operation := range operations {
+		switch operation.Operation {
+		case persistence.OperationSet:
+			applied = append(applied, storage.Operation{Key: operation.Key, Value: operation.Value, Version: entry.Sequence})
+		case persistence.OperationDelete:
+			applied = append(applied, storage.Operation{Key: operation.Key, Delete: true})
+		case persistence.OperationSetWithExpiry:
+			expiresAt, value, err := persistence.DecodeExpiry(operation.Value)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, storage.Operation{Key: operation.Key, Value: value, ExpiresAt: expiresAt, Version: entry.Sequence})
+		default:
+			return fmt.Errorf("operation %d is not supported in a batch", operation.Operation)
+		}
+	}
+
+	db.storage.Apply(applied)
+	return nil
+}
@@ -0,0 +1,315 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// testConfig returns a configuration keeping its data in dir, without
+// background snapshots
+func testConfig(dir string) *Config {
+	config := DefaultConfig()
+	config.LogPath = dir
+	config.SnapshotInterval = 0
+	return config
+}
+
+// errInjected is the failure faultyFile reports
+var errInjected = errors.New("injected failure")
+
+// faultyFile is a log segment whose writes or syncs fail on demand. A
+// failing write still writes half of what it is given, as a write cut
+// short by a full disk would. Each counter is the number of calls left to
+// fail; a negative one fails every call.
+type faultyFile struct {
+	*os.File
+	failWrites atomic.Int32
+	failSyncs  atomic.Int32
+}
+
+func (f *faultyFile) Write(data []byte) (int, error) {
+	if fail(&f.failWrites) {
+		n, _ := f.File.Write(data[:len(data)/2])
+		return n, errInjected
+	}
+	return f.File.Write(data)
+}
+
+func (f *faultyFile) Sync() error {
+	if fail(&f.failSyncs) {
+		return errInjected
+	}
+	return f.File.Sync()
+}
+
+// fail reports whether a call should fail, counting it against failures
+func fail(failures *atomic.Int32) bool {
+	n := failures.Load()
+	if n > 0 {
+		failures.Add(-1)
+	}
+	return n != 0
+}
+
+// size returns the size of the segment on disk
+func (f *faultyFile) size(t *testing.T) int64 {
+	t.Helper()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// TestCommitFailure checks that a transaction whose log write or sync fails
+// changes nothing: memory keeps the old values, the segment is cut back to
+// where it was, and the log replays cleanly after a restart. If the sync
+// keeps failing, the failed write cannot be made durably undone, and the
+// log refuses further writes.
+func TestCommitFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		arm     func(f *faultyFile)
+		wantErr error
+		broken  bool
+	}{
+		{"write", func(f *faultyFile) { f.failWrites.Store(1) }, errInjected, false},
+		{"sync", func(f *faultyFile) { f.failSyncs.Store(1) }, errInjected, false},
+		{"sync keeps failing", func(f *faultyFile) { f.failSyncs.Store(-1) }, persistence.ErrLogFailed, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var file *faultyFile
+			config := testConfig(t.TempDir())
+			config.SyncMode = persistence.SyncAlways
+			config.wrapSegment = func(f *os.File) persistence.SegmentFile {
+				file = &faultyFile{File: f}
+				return file
+			}
+			db, err := New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.Set("a", []byte("1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := file.size(t)
+
+			test.arm(file)
+			txn, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			txn.Set("a", []byte("2"))
+			txn.Set("b", []byte("3"))
+			txn.Delete("a")
+			txn.Set("c", []byte("4"))
+			err = txn.Commit()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Commit: got %v, want %v", err, test.wantErr)
+			}
+
+			value, err := db.Get("a")
+			if err != nil || string(value) != "1" {
+				t.Fatalf("Get(a) after failed commit = %q, %v; want %q", value, err, "1")
+			}
+			for _, key := range []string{"b", "c"} {
+				_, err = db.Get(key)
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("Get(%s) after failed commit: got %v, want %v", key, err, ErrKeyNotFound)
+				}
+			}
+			if got := file.size(t); got != size {
+				t.Fatalf("segment is %d bytes after failed commit, want %d", got, size)
+			}
+
+			// The log carries on once writes succeed again, unless it could
+			// not undo the failed one
+			want := map[string]string{"a": "1"}
+			err = db.Set("d", []byte("5"))
+			switch {
+			case test.broken && !errors.Is(err, persistence.ErrLogFailed):
+				t.Fatalf("Set after the log failed: got %v, want %v", err, persistence.ErrLogFailed)
+			case !test.broken && err != nil:
+				t.Fatal(err)
+			case !test.broken:
+				want["d"] = "5"
+			}
+			db.Close()
+
+			config.wrapSegment = nil
+			db, err = New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if corruptions := db.RecoveryReport().Corruptions; len(corruptions) != 0 {
+				t.Fatalf("recovery found corruption: %+v", corruptions)
+			}
+			for key, want := range want {
+				value, err := db.Get(key)
+				if err != nil || string(value) != want {
+					t.Fatalf("Get(%s) after restart = %q, %v; want %q", key, value, err, want)
+				}
+			}
+			for _, key := range []string{"b", "c", "d"} {
+				if _, ok := want[key]; ok {
+					continue
+				}
+				_, err = db.Get(key)
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("Get(%s) after restart: got %v, want %v", key, err, ErrKeyNotFound)
+				}
+			}
+		})
+	}
+}
+
+// TestSetFailure checks that a single write whose log write fails leaves
+// the previous value in memory and on disk
+func TestSetFailure(t *testing.T) {
+	var file *faultyFile
+	config := testConfig(t.TempDir())
+	config.wrapSegment = func(f *os.File) persistence.SegmentFile {
+		file = &faultyFile{File: f}
+		return file
+	}
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Set("key", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := file.size(t)
+
+	file.failWrites.Store(1)
+	err = db.Set("key", []byte("new"))
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("Set: got %v, want %v", err, errInjected)
+	}
+
+	value, err := db.Get("key")
+	if err != nil || string(value) != "old" {
+		t.Fatalf("Get after failed Set = %q, %v; want %q", value, err, "old")
+	}
+	if got := file.size(t); got != size {
+		t.Fatalf("segment is %d bytes after failed Set, want %d", got, size)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.wrapSegment = nil
+	db, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value, err = db.Get("key")
+	if err != nil || string(value) != "old" {
+		t.Fatalf("Get after restart = %q, %v; want %q", value, err, "old")
+	}
+}
+
+// TestBatchFailure checks that when a write fails partway through a batch
+// of concurrent appends, every one in the batch fails and none of them
+// reaches memory or comes back after a restart
+func TestBatchFailure(t *testing.T) {
+	const writers = 16
+
+	var file *faultyFile
+	config := testConfig(t.TempDir())
+	config.CommitBatchDelay = 5 * time.Millisecond
+	config.wrapSegment = func(f *os.File) persistence.SegmentFile {
+		file = &faultyFile{File: f}
+		return file
+	}
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.failWrites.Store(1)
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Set(fmt.Sprint(i), []byte("value"))
+		}(i)
+	}
+	wg.Wait()
+
+	check := func(when string) {
+		failed := 0
+		for i, err := range errs {
+			_, getErr := db.Get(fmt.Sprint(i))
+			if err != nil {
+				failed++
+				if !errors.Is(getErr, ErrKeyNotFound) {
+					t.Fatalf("%s: key %d of a failed write: got %v, want %v", when, i, getErr, ErrKeyNotFound)
+				}
+			} else if getErr != nil {
+				t.Fatalf("%s: key %d of a successful write: %v", when, i, getErr)
+			}
+		}
+		if failed == 0 {
+			t.Fatalf("%s: no write failed", when)
+		}
+	}
+	check("before restart")
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.wrapSegment = nil
+	db, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("after restart")
+}
+
+// TestTxnDelete checks that deleting a missing key fails with
+// ErrKeyNotFound and that other failures to read the key are returned as
+// they are
+func TestTxnDelete(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Delete("missing")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Delete of a missing key: got %v, want %v", err, ErrKeyNotFound)
+	}
+
+	db.Close()
+	err = txn.Delete("key")
+	if !errors.Is(err, ErrDatabaseClosed) {
+		t.Fatalf("Delete after Close: got %v, want %v", err, ErrDatabaseClosed)
+	}
+}
@@ -0,0 +1,224 @@
+package database
+
+import (
+	"bytes"
+	"time"
+)
+
+// Every stored value carries a version, the sequence number of the log
+// entry that wrote it. Versions only ever increase, so a version read with
+// GetWithVersion identifies that exact write. The conditional operations
+// below check their condition and log their change while holding the key
+// lock, so no other write to the key can slip in between.
+
+// GetWithVersion retrieves a value for a given key along with its version
+func (db *DB) GetWithVersion(key string) ([]byte, uint64, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return nil, 0, ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if key == "" {
+		return nil, 0, ErrEmptyKey
+	}
+
+	entry, exists := db.storage.GetEntry(key)
+	if !exists {
+		return nil, 0, NewDatabaseError("get", key, ErrKeyNotFound)
+	}
+	if entry.Type != TypeString {
+		return nil, 0, NewDatabaseError("get", key, ErrWrongType)
+	}
+
+	return entry.Value, entry.Version, nil
+}
+
+// CompareAndSwap stores newValue for key if its current value equals
+// oldValue. It reports whether the value was swapped; a missing key is
+// never swapped. As with Set, any expiry is cleared.
+func (db *DB) CompareAndSwap(key string, oldValue, newValue []byte) (bool, error) {
+	err := db.checkWrite(key, newValue)
+	if err != nil {
+		return false, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	entry, exists := db.storage.GetEntry(key)
+	if !exists || entry.Type != TypeString || !bytes.Equal(entry.Value, oldValue) {
+		return false, nil
+	}
+
+	_, err = db.putLocked(key, newValue, 0)
+	if err != nil {
+		return false, NewDatabaseError("compare-and-swap", key, err)
+	}
+
+	return true, nil
+}
+
+// SetIfAbsent stores a value for key unless the key already exists. It
+// reports whether the value was stored.
+func (db *DB) SetIfAbsent(key string, value []byte) (bool, error) {
+	err := db.checkWrite(key, value)
+	if err != nil {
+		return false, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	_, exists := db.storage.GetEntry(key)
+	if exists {
+		return false, nil
+	}
+
+	_, err = db.putLocked(key, value, 0)
+	if err != nil {
+		return false, NewDatabaseError("set-if-absent", key, err)
+	}
+
+	return true, nil
+}
+
+// SetOptions controls how SetWithOptions stores a value
+type SetOptions struct {
+	TTL      time.Duration // Zero means the value does not expire
+	IfAbsent bool          // Only store the value if the key does not exist
+	IfExists bool          // Only store the value if the key already exists
+}
+
+// SetWithOptions stores a value for key subject to options, checking the
+// conditions and storing the value as one step. It returns the new
+// version, or zero if the conditions kept the value from being stored.
+func (db *DB) SetWithOptions(key string, value []byte, options *SetOptions) (uint64, error) {
+	err := db.checkWrite(key, value)
+	if err != nil {
+		return 0, err
+	}
+	if options == nil {
+		options = &SetOptions{}
+	}
+	if options.TTL < 0 {
+		return 0, ErrInvalidTTL
+	}
+
+	var expiresAt int64
+	if options.TTL > 0 {
+		expiresAt = time.Now().Add(options.TTL).UnixNano()
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	_, exists := db.storage.GetEntry(key)
+	if (options.IfAbsent && exists) || (options.IfExists && !exists) {
+		return 0, nil
+	}
+
+	version, err := db.putLocked(key, value, expiresAt)
+	if err != nil {
+		return 0, NewDatabaseError("set", key, err)
+	}
+
+	return version, nil
+}
+
+// SetIfVersion stores a value for key if the key is still at the given
+// version, and returns the new version. It fails with ErrVersionMismatch if
+// the key has been written since, and ErrKeyNotFound if it no longer exists.
+func (db *DB) SetIfVersion(key string, value []byte, version uint64) (uint64, error) {
+	err := db.checkWrite(key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	err = db.checkVersion("set-if-version", key, version)
+	if err != nil {
+		return 0, err
+	}
+
+	newVersion, err := db.putLocked(key, value, 0)
+	if err != nil {
+		return 0, NewDatabaseError("set-if-version", key, err)
+	}
+
+	return newVersion, nil
+}
+
+// DeleteIfVersion removes key if it is still at the given version. It fails
+// with ErrVersionMismatch if the key has been written since, and
+// ErrKeyNotFound if it no longer exists.
+func (db *DB) DeleteIfVersion(key string, version uint64) error {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	db.keyLocks.lock(key)
+	defer db.keyLocks.unlock(key)
+
+	err := db.checkVersion("delete-if-version", key, version)
+	if err != nil {
+		return err
+	}
+
+	err = db.deleteLocked(key)
+	if err != nil {
+		return NewDatabaseError("delete-if-version", key, err)
+	}
+
+	return nil
+}
+
+// checkWrite validates the arguments of a write
+func (db *DB) checkWrite(key string, value []byte) error {
+	// Check if database is closed
+	db.mutex.RLock()
+	if db.isClosed {
+		db.mutex.RUnlock()
+		return ErrDatabaseClosed
+	}
+	db.mutex.RUnlock()
+
+	// Input validation
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	if value == nil {
+		return ErrNilValue
+	}
+
+	return nil
+}
+
+// checkVersion verifies that key exists at the given version. The caller
+// must hold the key lock.
+func (db *DB) checkVersion(operation, key string, version uint64) error {
+	entry, exists := db.storage.GetEntry(key)
+	if !exists {
+		return NewDatabaseError(operation, key, ErrKeyNotFound)
+	}
+	if entry.Version != version {
+		return NewDatabaseError(operation, key, ErrVersionMismatch)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestVersions checks the conditional writes against the versions they
+// are given, and that versions survive a restart
+func TestVersions(t *testing.T) {
+	config := testConfig(t.TempDir())
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := db.SetWithOptions("key", []byte("1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, got, err := db.GetWithVersion("key")
+	if err != nil || string(value) != "1" || got != version {
+		t.Fatalf("GetWithVersion = %q, %d, %v; want %q, %d", value, got, err, "1", version)
+	}
+
+	// A write moves the version on, so the old one no longer matches
+	next, err := db.SetIfVersion("key", []byte("2"), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= version {
+		t.Fatalf("SetIfVersion returned version %d after %d", next, version)
+	}
+	_, err = db.SetIfVersion("key", []byte("3"), version)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("SetIfVersion with an old version: got %v, want %v", err, ErrVersionMismatch)
+	}
+	err = db.DeleteIfVersion("key", version)
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("DeleteIfVersion with an old version: got %v, want %v", err, ErrVersionMismatch)
+	}
+	value, _ = db.Get("key")
+	if string(value) != "2" {
+		t.Fatalf("value after failed conditional writes = %q, want %q", value, "2")
+	}
+
+	// CompareAndSwap compares values rather than versions
+	swapped, err := db.CompareAndSwap("key", []byte("1"), []byte("4"))
+	if err != nil || swapped {
+		t.Fatalf("CompareAndSwap of a stale value = %v, %v; want no swap", swapped, err)
+	}
+	swapped, err = db.CompareAndSwap("key", []byte("2"), []byte("4"))
+	if err != nil || !swapped {
+		t.Fatalf("CompareAndSwap of the current value = %v, %v; want a swap", swapped, err)
+	}
+	_, swappedVersion, err := db.GetWithVersion("key")
+	if err != nil || swappedVersion <= next {
+		t.Fatalf("version after CompareAndSwap = %d, %v; want more than %d", swappedVersion, err, next)
+	}
+
+	// Missing keys
+	_, err = db.SetIfVersion("missing", []byte("1"), version)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("SetIfVersion of a missing key: got %v, want %v", err, ErrKeyNotFound)
+	}
+	err = db.DeleteIfVersion("missing", version)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("DeleteIfVersion of a missing key: got %v, want %v", err, ErrKeyNotFound)
+	}
+	swapped, err = db.CompareAndSwap("missing", nil, []byte("1"))
+	if err != nil || swapped {
+		t.Fatalf("CompareAndSwap of a missing key = %v, %v; want no swap", swapped, err)
+	}
+
+	// Versions are sequence numbers in the log, so a restart keeps them
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, got, err = db.GetWithVersion("key")
+	if err != nil || got != swappedVersion {
+		t.Fatalf("version after restart = %d, %v; want %d", got, err, swappedVersion)
+	}
+	err = db.DeleteIfVersion("key", swappedVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get("key")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after DeleteIfVersion: got %v, want %v", err, ErrKeyNotFound)
+	}
+
+	// New writes are numbered after every version from before the restart
+	version, err = db.SetWithOptions("key", []byte("5"), nil)
+	if err != nil || version <= swappedVersion {
+		t.Fatalf("version of a write after restart = %d, %v; want more than %d", version, err, swappedVersion)
+	}
+}
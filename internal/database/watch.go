@@ -0,0 +1,350 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// watchBufferSize is how many events a watcher may fall behind by before
+// it is dropped
+const watchBufferSize = 1024
+
+// EventType identifies the kind of change a WatchEvent reports
+type EventType int
+
+const (
+	EventSet EventType = iota + 1
+	EventDelete
+
+	// EventExpire reports a key removed because it expired. Expiries are
+	// not logged, so the event carries the sequence number of the last
+	// change published before it, and a watch resuming from that number
+	// may be told of the expiry again.
+	EventExpire
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	default:
+		return "unknown"
+	}
+}
+
+// WatchEvent describes one change to a watched key
+type WatchEvent struct {
+	Type     EventType
+	Key      string
+	Value    []byte // New value, nil for deletes and expiries
+	OldValue []byte // Value before the change, nil if the key did not exist
+	Sequence uint64 // Sequence number of the log entry that made the change
+}
+
+// WatchOptions selects the changes WatchWithOptions reports
+type WatchOptions struct {
+	Prefix string // Keys starting with Prefix; empty watches every key
+	Key    string // Only this key, in place of Prefix
+
+	// After resumes a watch: the changes published after the one with
+	// this sequence number are replayed before new ones are reported. Zero
+	// reports new changes only.
+	After uint64
+}
+
+// watcher is one registered Watch call
+type watcher struct {
+	prefix string
+	key    string
+	events chan WatchEvent
+	done   chan struct{}
+}
+
+// watchHub fans changes out to watchers and keeps the most recent ones
+// for watchers that resume. Changes are published while the key lock is
+// held, so the events for any one key arrive in the order the changes
+// were made. Events for different keys arrive in the order they were
+// published, which may differ slightly from the order of their sequence
+// numbers; resuming replays whatever was published after the change
+// resumed from, so nothing is skipped.
+type watchHub struct {
+	mutex    sync.Mutex
+	watchers map[*watcher]struct{}
+	count    atomic.Int32
+	history  eventHistory
+	sequence uint64 // Highest sequence number published, for expiries
+}
+
+// eventHistory is a ring buffer of the most recently published events
+type eventHistory struct {
+	events []WatchEvent
+	start  int
+	length int
+
+	// horizon is the highest sequence number of a logged change no longer
+	// held, below which watches cannot resume
+	horizon uint64
+}
+
+// newWatchHub creates a hub without watchers, keeping up to history
+// events for watches to resume from
+func newWatchHub(history int) *watchHub {
+	return &watchHub{
+		watchers: make(map[*watcher]struct{}),
+		history:  eventHistory{events: make([]WatchEvent, max(history, 0))},
+	}
+}
+
+// Watch returns a channel receiving an event for every change to a key
+// starting with prefix; an empty prefix watches every key. Only changes
+// made after Watch returns are reported. The channel is closed when ctx is
+// done, when the database is closed, or when the caller falls more than
+// watchBufferSize events behind, in which case it should watch again and
+// re-read the keys it cares about.
+func (db *DB) Watch(ctx context.Context, prefix string) (<-chan WatchEvent, error) {
+	return db.WatchWithOptions(ctx, &WatchOptions{Prefix: prefix})
+}
+
+// WatchWithOptions is Watch for the changes selected by options. A watch
+// that ended can be resumed by passing the sequence number of the last
+// event it received as After. Recent changes are kept in memory, as many
+// as Config.WatchHistory, so a watch that fell too far behind, or one
+// resuming across a restart, fails with ErrWatchHistoryLost and must
+// re-read its keys instead. Keeping them costs every write a lookup of the
+// value it replaces, so none are kept unless WatchHistory is set.
+func (db *DB) WatchWithOptions(ctx context.Context, options *WatchOptions) (<-chan WatchEvent, error) {
+	// Check if database is closed
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.isClosed {
+		return nil, ErrDatabaseClosed
+	}
+
+	if options == nil {
+		options = &WatchOptions{}
+	}
+	w := &watcher{
+		prefix: options.Prefix,
+		key:    options.Key,
+		done:   make(chan struct{}),
+	}
+	err := db.watchers.add(w, options.After)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.watchers.remove(w)
+		case <-w.done:
+		}
+	}()
+
+	return w.events, nil
+}
+
+// active reports whether events are needed at all, so writers can skip
+// building events nobody receives. Without history that is only while
+// someone is watching.
+func (h *watchHub) active() bool {
+	return h.count.Load() > 0 || len(h.history.events) > 0
+}
+
+// add registers a watcher, first queueing the events published after the
+// change with sequence number after, if it is not zero
+func (h *watchHub) add(w *watcher, after uint64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var replay []WatchEvent
+	if after != 0 {
+		var ok bool
+		replay, ok = h.history.since(after, w.matches)
+		if !ok {
+			return ErrWatchHistoryLost
+		}
+	}
+
+	w.events = make(chan WatchEvent, len(replay)+watchBufferSize)
+	for _, event := range replay {
+		w.events <- event
+	}
+
+	h.watchers[w] = struct{}{}
+	h.count.Add(1)
+	return nil
+}
+
+// remove unregisters a watcher and closes its channel, unless that has
+// already happened
+func (h *watchHub) remove(w *watcher) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.removeLocked(w)
+}
+
+// removeLocked is remove with the hub mutex held
+func (h *watchHub) removeLocked(w *watcher) {
+	if _, exists := h.watchers[w]; !exists {
+		return
+	}
+	delete(h.watchers, w)
+	h.count.Add(-1)
+	close(w.events)
+	close(w.done)
+}
+
+// publish records events and delivers them to the watchers they match.
+// Sends never block; a watcher whose buffer is full is dropped.
+func (h *watchHub) publish(events ...WatchEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.publishLocked(events)
+}
+
+// publishLocked is publish with the hub mutex held
+func (h *watchHub) publishLocked(events []WatchEvent) {
+	for _, event := range events {
+		h.history.add(event)
+		h.sequence = max(h.sequence, event.Sequence)
+	}
+
+	for w := range h.watchers {
+		if !w.deliver(events) {
+			h.removeLocked(w)
+		}
+	}
+}
+
+// expire publishes the expiry of key, which held value. The storage calls
+// it with the key's bucket locked, so a write that recreates the key is
+// published after it.
+func (h *watchHub) expire(key string, value []byte) {
+	if !h.active() {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.publishLocked([]WatchEvent{{Type: EventExpire, Key: key, OldValue: value, Sequence: h.sequence}})
+}
+
+// reset forgets the history, after which watches can only resume from
+// sequence on. It is called once the key space has been replaced, and
+// after recovery.
+func (h *watchHub) reset(sequence uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	clear(h.history.events)
+	h.history.start, h.history.length = 0, 0
+	h.history.horizon = sequence
+	h.sequence = sequence
+}
+
+// matches reports whether the watcher is watching key
+func (w *watcher) matches(key string) bool {
+	if w.key != "" {
+		return key == w.key
+	}
+	return strings.HasPrefix(key, w.prefix)
+}
+
+// deliver sends the events the watcher is watching. It returns false if
+// the buffer filled up.
+func (w *watcher) deliver(events []WatchEvent) bool {
+	for _, event := range events {
+		if !w.matches(event.Key) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// closeAll closes every watcher's channel
+func (h *watchHub) closeAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for w := range h.watchers {
+		h.removeLocked(w)
+	}
+}
+
+// add appends an event, dropping the oldest one if the history is full
+func (h *eventHistory) add(event WatchEvent) {
+	size := len(h.events)
+	if size == 0 {
+		h.forget(event)
+		return
+	}
+
+	if h.length < size {
+		h.events[(h.start+h.length)%size] = event
+		h.length++
+		return
+	}
+	h.forget(h.events[h.start])
+	h.events[h.start] = event
+	h.start = (h.start + 1) % size
+}
+
+// forget moves the horizon past an event no longer held
+func (h *eventHistory) forget(event WatchEvent) {
+	if event.Type != EventExpire {
+		h.horizon = max(h.horizon, event.Sequence)
+	}
+}
+
+// at returns the i-th oldest event held
+func (h *eventHistory) at(i int) WatchEvent {
+	return h.events[(h.start+i)%len(h.events)]
+}
+
+// since returns the events matching match published after the logged
+// change with sequence number after. If that change is no longer held,
+// the events with that sequence number or a later one are returned, as
+// long as no logged change after it has been forgotten. It reports false
+// if one has, and always when no history is kept, as changes are then not
+// published unless someone is watching.
+func (h *eventHistory) since(after uint64, match func(key string) bool) ([]WatchEvent, bool) {
+	if len(h.events) == 0 {
+		return nil, false
+	}
+
+	from := -1
+	for i := h.length - 1; i >= 0; i-- {
+		if event := h.at(i); event.Sequence == after && event.Type != EventExpire {
+			from = i + 1
+			break
+		}
+	}
+	if from < 0 && after < h.horizon {
+		return nil, false
+	}
+
+	var events []WatchEvent
+	for i := max(from, 0); i < h.length; i++ {
+		event := h.at(i)
+		if (from >= 0 || event.Sequence >= after) && match(event.Key) {
+			events = append(events, event)
+		}
+	}
+	return events, true
+}
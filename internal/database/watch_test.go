@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// receive returns the next event on events, failing the test if none
+// arrives in time
+func receive(t *testing.T, events <-chan WatchEvent) WatchEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("watch ended")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	return WatchEvent{}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := db.Watch(ctx, "user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"other", "user:1"} {
+		err = db.Set(key, []byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Set("user:1", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := receive(t, events)
+	if event.Type != EventSet || event.Key != "user:1" || string(event.Value) != "a" || event.OldValue != nil {
+		t.Fatalf("first event = %+v", event)
+	}
+	event = receive(t, events)
+	if event.Type != EventSet || string(event.Value) != "b" || string(event.OldValue) != "a" {
+		t.Fatalf("second event = %+v", event)
+	}
+}
+
+// TestWatchResume checks that a watch resumes after the last event it
+// received when history is kept, and cannot when it is not
+func TestWatchResume(t *testing.T) {
+	config := testConfig(t.TempDir())
+	config.WatchHistory = 16
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, value := range []string{"a", "b", "c"} {
+		err = db.Set("key", []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, version, err := db.GetWithVersion("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := db.WatchWithOptions(ctx, &WatchOptions{Key: "key", After: version - 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"b", "c"} {
+		event := receive(t, events)
+		if string(event.Value) != want {
+			t.Fatalf("resumed event = %+v, want value %q", event, want)
+		}
+	}
+
+	db, err = New(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Set("key", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.WatchWithOptions(ctx, &WatchOptions{Key: "key", After: 1})
+	if !errors.Is(err, ErrWatchHistoryLost) {
+		t.Fatalf("resume without history: got %v, want %v", err, ErrWatchHistoryLost)
+	}
+}
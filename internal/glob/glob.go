@@ -0,0 +1,112 @@
+// Package glob matches strings against the Redis-style glob patterns
+// taken by KEYS and PSUBSCRIBE.
+package glob
+
+// Match reports whether s matches a Redis-style glob pattern: '*'
+// matches any run of bytes, '?' any single byte, '[...]' a set or range of
+// bytes ('[^...]' negated) and '\' escapes the next byte. Unlike
+// path.Match, '/' has no special meaning.
+func Match(pattern, s string) bool {
+	// Where to resume after the most recent '*', for backtracking
+	starPattern, starString := -1, 0
+
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starString = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if matched, next, ok := matchClass(pattern, p, s[i]); ok && matched {
+					p = next
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+
+		// Mismatch: let the last '*' swallow one more byte
+		if starPattern < 0 {
+			return false
+		}
+		starString++
+		p, i = starPattern+1, starString
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the bracket expression starting at
+// pattern[start]. It returns whether c matched, the index just past the
+// expression, and false if the expression is not terminated.
+func matchClass(pattern string, start int, c byte) (bool, int, bool) {
+	p := start + 1
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+
+	matched := false
+	for first := true; p < len(pattern) && (first || pattern[p] != ']'); first = false {
+		lo := pattern[p]
+		if lo == '\\' && p+1 < len(pattern) {
+			p++
+			lo = pattern[p]
+		}
+		p++
+
+		hi := lo
+		if p+1 < len(pattern) && pattern[p] == '-' && pattern[p+1] != ']' {
+			hi = pattern[p+1]
+			if hi == '\\' && p+2 < len(pattern) {
+				p++
+				hi = pattern[p+1]
+			}
+			p += 2
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if p >= len(pattern) {
+		return false, 0, false
+	}
+
+	return matched != negate, p + 1, true
+}
+
+// Prefix returns the literal text a pattern starts with, which every
+// matching key must start with too
+func Prefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
@@ -0,0 +1,124 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BatchOperation is one operation inside a batch entry
+type BatchOperation struct {
+	Operation LogOperation
+	Key       string
+	Value     []byte
+}
+
+// AppendBatch logs several operations as a single entry and returns its
+// sequence number. The entry is checksummed as a whole, so recovery either
+// sees every operation in it or none of them.
+func (l *Log) AppendBatch(operations []BatchOperation) (uint64, error) {
+	data, err := EncodeBatch(operations)
+	if err != nil {
+		return 0, err
+	}
+	
+	return l.Append(OperationBatch, "", data)
+}
+
+// EncodeBatch serializes operations into the value of a batch entry: an
+// operation count followed by, for each operation, its code, key length,
+// key, value length and value
+func EncodeBatch(operations []BatchOperation) ([]byte, error) {
+	size := 4
+	for _, operation := range operations {
+		if !operation.Operation.isValid() || operation.Operation == OperationBatch {
+			return nil, fmt.Errorf("invalid operation %d in batch", operation.Operation)
+		}
+		size += 9 + len(operation.Key) + len(operation.Value)
+	}
+	
+	data := make([]byte, 0, size)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(operations)))
+	for _, operation := range operations {
+		data = append(data, byte(operation.Operation))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(operation.Key)))
+		data = append(data, operation.Key...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(operation.Value)))
+		data = append(data, operation.Value...)
+	}
+	
+	return data, nil
+}
+
+// DecodeBatch parses the value of a batch entry
+func DecodeBatch(data []byte) ([]BatchOperation, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("batch too short")
+	}
+	count := binary.LittleEndian.Uint32(data[0:4])
+	data = data[4:]
+	
+	var operations []BatchOperation
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("batch operation %d truncated", i)
+		}
+		operation := LogOperation(data[0])
+		if !operation.isValid() || operation == OperationBatch {
+			return nil, fmt.Errorf("invalid operation %d in batch", operation)
+		}
+		
+		keyLen := uint64(binary.LittleEndian.Uint32(data[1:5]))
+		if uint64(len(data)) < 9+keyLen {
+			return nil, fmt.Errorf("batch operation %d truncated", i)
+		}
+		key := string(data[5 : 5+keyLen])
+		
+		valueLen := uint64(binary.LittleEndian.Uint32(data[5+keyLen : 9+keyLen]))
+		if uint64(len(data)) < 9+keyLen+valueLen {
+			return nil, fmt.Errorf("batch operation %d truncated", i)
+		}
+		value := data[9+keyLen : 9+keyLen+valueLen]
+		
+		operations = append(operations, BatchOperation{
+			Operation: operation,
+			Key:       key,
+			Value:     value,
+		})
+		data = data[9+keyLen+valueLen:]
+	}
+	
+	if len(data) != 0 {
+		return nil, fmt.Errorf("unexpected data after batch")
+	}
+	
+	return operations, nil
+}
+
+// expandBatches replaces batch entries by one entry per operation, sharing
+// the sequence number and timestamp of the batch. It is used when a sealed
+// segment is rewritten, since the rewrite is atomic as a whole.
+func expandBatches(entries []*LogEntry) ([]*LogEntry, error) {
+	var expanded []*LogEntry
+	for _, entry := range entries {
+		if entry.Operation != OperationBatch {
+			expanded = append(expanded, entry)
+			continue
+		}
+		
+		operations, err := DecodeBatch(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, operation := range operations {
+			expanded = append(expanded, &LogEntry{
+				Sequence:  entry.Sequence,
+				Timestamp: entry.Timestamp,
+				Operation: operation.Operation,
+				Key:       operation.Key,
+				Value:     operation.Value,
+			})
+		}
+	}
+	
+	return expanded, nil
+}
@@ -0,0 +1,396 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// On-disk format versions. Version 1 is the original headerless format;
+// every segment written since starts with a header naming its version.
+const (
+	FormatVersion1       uint16 = 1
+	FormatVersion2       uint16 = 2
+	CurrentFormatVersion        = FormatVersion2
+)
+
+const (
+	segmentMagic      = "KVLG"
+	segmentHeaderSize = 20
+
+	// recordMagic starts every version 2 record, which lets recovery find
+	// the next record boundary quickly after corruption
+	recordMagic byte = 0xA7
+
+	// recordHeaderSize is the magic byte plus the 32-bit body length
+	recordHeaderSize = 5
+	
+	// maxEntrySize bounds records and snapshot values read from other
+	// nodes, so that a corrupt or hostile length is not trusted. It leaves
+	// room for the largest value a client can send.
+	maxEntrySize = 1 << 30
+)
+
+// errEntryTooLong is returned when an entry claims more bytes than remain
+var errEntryTooLong = errors.New("entry extends past end of segment")
+
+// segmentHeader is written at the start of every versioned segment
+type segmentHeader struct {
+	Version      uint16
+	Flags        uint16
+	BaseSequence uint64 // Sequence number of the first entry in the segment
+}
+
+// encodeSegmentHeader serializes a segment header: magic, version, flags,
+// base sequence and a checksum over the preceding bytes
+func encodeSegmentHeader(header segmentHeader) []byte {
+	data := make([]byte, segmentHeaderSize)
+	copy(data[0:4], segmentMagic)
+	binary.LittleEndian.PutUint16(data[4:6], header.Version)
+	binary.LittleEndian.PutUint16(data[6:8], header.Flags)
+	binary.LittleEndian.PutUint64(data[8:16], header.BaseSequence)
+	binary.LittleEndian.PutUint32(data[16:20], crc32.ChecksumIEEE(data[0:16]))
+	return data
+}
+
+// readSegmentHeader reads the header of a segment file and returns it along
+// with its length. Files that do not start with a valid header are legacy
+// version 1 segments, which have no header at all.
+func readSegmentHeader(file *os.File) (segmentHeader, int64, error) {
+	data := make([]byte, segmentHeaderSize)
+	_, err := file.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return segmentHeader{}, 0, fmt.Errorf("failed to read segment header: %w", err)
+	}
+	
+	legacy := segmentHeader{Version: FormatVersion1}
+	if err == io.EOF || string(data[0:4]) != segmentMagic {
+		return legacy, 0, nil
+	}
+	if binary.LittleEndian.Uint32(data[16:20]) != crc32.ChecksumIEEE(data[0:16]) {
+		// A legacy entry starting with the magic bytes is possible, if
+		// unlikely, so a header only counts if its checksum holds
+		return legacy, 0, nil
+	}
+	
+	header := segmentHeader{
+		Version:      binary.LittleEndian.Uint16(data[4:6]),
+		Flags:        binary.LittleEndian.Uint16(data[6:8]),
+		BaseSequence: binary.LittleEndian.Uint64(data[8:16]),
+	}
+	if header.Version < FormatVersion2 || header.Version > CurrentFormatVersion {
+		return segmentHeader{}, 0, fmt.Errorf("unsupported log format version %d", header.Version)
+	}
+	
+	return header, segmentHeaderSize, nil
+}
+
+// recordCodec encodes and decodes the records of one format version
+type recordCodec interface {
+	// decode reads one record. remaining is the number of bytes left in the
+	// segment and bounds the lengths the record may claim.
+	decode(reader io.Reader, remaining int64) (*LogEntry, int64, error)
+	
+	// nextCandidate returns the first offset in data at which a record
+	// might start, or -1, so recovery can skip ahead after corruption
+	nextCandidate(data []byte) int
+}
+
+// codecFor returns the codec for a format version
+func codecFor(version uint16) (recordCodec, error) {
+	switch version {
+	case FormatVersion1:
+		return codecV1{}, nil
+	case FormatVersion2:
+		return codecV2{}, nil
+	}
+	return nil, fmt.Errorf("unsupported log format version %d", version)
+}
+
+// codecV1 reads the original headerless format. It is never written again;
+// legacy segments are upgraded when the log is opened.
+type codecV1 struct{}
+
+// nextCandidate accepts every offset, as version 1 records have no marker
+func (codecV1) nextCandidate(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// decode reads a single legacy entry: timestamp, operation, 16-bit key
+// length, key, 32-bit value length, value and a checksum over timestamp,
+// operation, key and value
+func (codecV1) decode(reader io.Reader, remaining int64) (*LogEntry, int64, error) {
+	var bytesRead int64 = 0
+	
+	// Read timestamp (8 bytes)
+	timeBytes := make([]byte, 8)
+	n, err := io.ReadFull(reader, timeBytes)
+	bytesRead += int64(n)
+	if err != nil {
+		return nil, bytesRead, err
+	}
+	timestamp := int64(binary.LittleEndian.Uint64(timeBytes))
+	
+	// Read operation (1 byte)
+	opByte := make([]byte, 1)
+	n, err = io.ReadFull(reader, opByte)
+	bytesRead += int64(n)
+	if err != nil {
+		return nil, bytesRead, err
+	}
+	operation := LogOperation(opByte[0])
+	if !operation.isValid() {
+		return nil, bytesRead, fmt.Errorf("unknown operation %d", opByte[0])
+	}
+	
+	// Read key length (2 bytes)
+	keyLenBytes := make([]byte, 2)
+	n, err = io.ReadFull(reader, keyLenBytes)
+	bytesRead += int64(n)
+	if err != nil {
+		return nil, bytesRead, err
+	}
+	keyLen := binary.LittleEndian.Uint16(keyLenBytes)
+	if bytesRead+int64(keyLen)+8 > remaining {
+		return nil, bytesRead, errEntryTooLong
+	}
+	
+	// Read key
+	keyBytes := make([]byte, keyLen)
+	n, err = io.ReadFull(reader, keyBytes)
+	bytesRead += int64(n)
+	if err != nil {
+		return nil, bytesRead, err
+	}
+	key := string(keyBytes)
+	
+	// Read value length (4 bytes)
+	valueLenBytes := make([]byte, 4)
+	n, err = io.ReadFull(reader, valueLenBytes)
+	bytesRead += int64(n)
+	if err != nil {
+		return nil, bytesRead, err
+	}
+	valueLen := binary.LittleEndian.Uint32(valueLenBytes)
+	if bytesRead+int64(valueLen)+4 > remaining {
+		return nil, bytesRead, errEntryTooLong
+	}
+	
+	// Read value (if present)
+	var value []byte
+	if valueLen > 0 {
+		value = make([]byte, valueLen)
+		n, err = io.ReadFull(reader, value)
+		bytesRead += int64(n)
+		if err != nil {
+			return nil, bytesRead, err
+		}
+	}
+	
+	// Read checksum (4 bytes)
+	checksumBytes := make([]byte, 4)
+	n, err = io.ReadFull(reader, checksumBytes)
+	bytesRead += int64(n)
+	if err != nil {
+		return nil, bytesRead, err
+	}
+	checksum := binary.LittleEndian.Uint32(checksumBytes)
+	
+	// Create log entry
+	entry := &LogEntry{
+		Timestamp: timestamp,
+		Operation: operation,
+		Key:       key,
+		Value:     value,
+		Checksum:  checksum,
+	}
+	
+	// Validate checksum
+	var data []byte
+	
+	// Add timestamp
+	timeBytes = make([]byte, 8)
+	binary.LittleEndian.PutUint64(timeBytes, uint64(entry.Timestamp))
+	data = append(data, timeBytes...)
+	
+	// Add operation
+	data = append(data, byte(entry.Operation))
+	
+	// Add key
+	data = append(data, []byte(entry.Key)...)
+	
+	// Add value if present
+	if entry.Value != nil {
+		data = append(data, entry.Value...)
+	}
+	
+	calculatedChecksum := crc32.ChecksumIEEE(data)
+	if calculatedChecksum != checksum {
+		return nil, bytesRead, fmt.Errorf("checksum mismatch: expected %d, got %d", checksum, calculatedChecksum)
+	}
+	
+	return entry, bytesRead, nil
+}
+
+// codecV2 is the current record format:
+//
+//	magic (1) | body length (4) | body | checksum (4)
+//	body: sequence (8) | timestamp (8) | operation (1) | flags (1) |
+//	      key length (4) | key | value length (4) | value
+//
+// The checksum covers the body length and the body. Flags are reserved for
+// features such as compression and must be zero for now.
+type codecV2 struct{}
+
+// encode serializes an entry as a version 2 record
+func (codecV2) encode(entry *LogEntry) ([]byte, error) {
+	if uint64(len(entry.Key)) > 0xFFFFFFFF || uint64(len(entry.Value)) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("entry is too large")
+	}
+	
+	bodyLen := 8 + 8 + 1 + 1 + 4 + len(entry.Key) + 4 + len(entry.Value)
+	data := make([]byte, recordHeaderSize+bodyLen+4)
+	
+	data[0] = recordMagic
+	binary.LittleEndian.PutUint32(data[1:5], uint32(bodyLen))
+	
+	body := data[recordHeaderSize:]
+	binary.LittleEndian.PutUint64(body[0:8], entry.Sequence)
+	binary.LittleEndian.PutUint64(body[8:16], uint64(entry.Timestamp))
+	body[16] = byte(entry.Operation)
+	body[17] = 0
+	binary.LittleEndian.PutUint32(body[18:22], uint32(len(entry.Key)))
+	n := 22 + copy(body[22:], entry.Key)
+	binary.LittleEndian.PutUint32(body[n:n+4], uint32(len(entry.Value)))
+	copy(body[n+4:], entry.Value)
+	
+	checksum := crc32.ChecksumIEEE(data[1 : recordHeaderSize+bodyLen])
+	binary.LittleEndian.PutUint32(data[recordHeaderSize+bodyLen:], checksum)
+	entry.Checksum = checksum
+	
+	return data, nil
+}
+
+// decode reads a single version 2 record
+func (codecV2) decode(reader io.Reader, remaining int64) (*LogEntry, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	bytesRead := int64(n)
+	if err != nil {
+		return nil, bytesRead, err
+	}
+	if header[0] != recordMagic {
+		return nil, bytesRead, fmt.Errorf("bad record magic %#x", header[0])
+	}
+	
+	bodyLen := int64(binary.LittleEndian.Uint32(header[1:5]))
+	if bodyLen < 26 {
+		return nil, bytesRead, fmt.Errorf("record body too short")
+	}
+	if recordHeaderSize+bodyLen+4 > remaining {
+		return nil, bytesRead, errEntryTooLong
+	}
+	
+	rest := make([]byte, bodyLen+4)
+	n, err = io.ReadFull(reader, rest)
+	bytesRead += int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, bytesRead, err
+	}
+	
+	body := rest[:bodyLen]
+	checksum := binary.LittleEndian.Uint32(rest[bodyLen:])
+	calculated := crc32.Update(crc32.ChecksumIEEE(header[1:5]), crc32.IEEETable, body)
+	if calculated != checksum {
+		return nil, bytesRead, fmt.Errorf("checksum mismatch: expected %d, got %d", checksum, calculated)
+	}
+	
+	operation := LogOperation(body[16])
+	if !operation.isValid() {
+		return nil, bytesRead, fmt.Errorf("unknown operation %d", body[16])
+	}
+	if body[17] != 0 {
+		return nil, bytesRead, fmt.Errorf("unsupported record flags %#x", body[17])
+	}
+	
+	keyLen := int64(binary.LittleEndian.Uint32(body[18:22]))
+	if 22+keyLen+4 > bodyLen {
+		return nil, bytesRead, fmt.Errorf("key length exceeds record")
+	}
+	key := string(body[22 : 22+keyLen])
+	
+	valueStart := 22 + keyLen + 4
+	valueLen := int64(binary.LittleEndian.Uint32(body[22+keyLen : valueStart]))
+	if valueStart+valueLen != bodyLen {
+		return nil, bytesRead, fmt.Errorf("value length does not match record")
+	}
+	
+	var value []byte
+	if valueLen > 0 {
+		value = body[valueStart:bodyLen]
+	}
+	
+	entry := &LogEntry{
+		Sequence:  binary.LittleEndian.Uint64(body[0:8]),
+		Timestamp: int64(binary.LittleEndian.Uint64(body[8:16])),
+		Operation: operation,
+		Key:       key,
+		Value:     value,
+		Checksum:  checksum,
+	}
+	
+	return entry, bytesRead, nil
+}
+
+// EncodeEntry serializes an entry as a checksummed record in the current
+// format, for sending it elsewhere. Unlike appending, it leaves the entry
+// untouched, so entries shared between goroutines may be encoded.
+func EncodeEntry(entry *LogEntry) ([]byte, error) {
+	copied := *entry
+	return codecV2{}.encode(&copied)
+}
+
+// ReadEntry reads a record written by EncodeEntry, verifying its checksum.
+// Records longer than maxEntrySize are rejected before they are read.
+func ReadEntry(reader io.Reader) (*LogEntry, error) {
+	entry, _, err := codecV2{}.decode(reader, maxEntrySize)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err == errEntryTooLong {
+		return nil, fmt.Errorf("record is longer than %d bytes", maxEntrySize)
+	}
+	return entry, err
+}
+
+// DecodeEntry decodes a record written by EncodeEntry that is already in
+// memory. The record must fill data exactly, so its length is never
+// trusted beyond what data holds.
+func DecodeEntry(data []byte) (*LogEntry, error) {
+	entry, n, err := codecV2{}.decode(bytes.NewReader(data), int64(len(data)))
+	if err == io.EOF || err == errEntryTooLong {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n != int64(len(data)) {
+		return nil, fmt.Errorf("%d bytes left after record", int64(len(data))-n)
+	}
+	return entry, nil
+}
+
+// nextCandidate returns the offset of the next record magic byte
+func (codecV2) nextCandidate(data []byte) int {
+	return bytes.IndexByte(data, recordMagic)
+}
@@ -0,0 +1,97 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestReadEntry(t *testing.T) {
+	entry := &LogEntry{Sequence: 7, Operation: OperationSet, Key: "key", Value: []byte("value")}
+	data, err := EncodeEntry(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadEntry(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Sequence != 7 || read.Key != "key" || string(read.Value) != "value" {
+		t.Fatalf("read %+v, want %+v", read, entry)
+	}
+
+	_, err = ReadEntry(bytes.NewReader(data[:len(data)-1]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated record: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// TestReadEntryTooLong checks that a record claiming more than maxEntrySize
+// bytes is rejected from its header alone
+func TestReadEntryTooLong(t *testing.T) {
+	header := make([]byte, recordHeaderSize)
+	header[0] = recordMagic
+	binary.LittleEndian.PutUint32(header[1:5], maxEntrySize)
+
+	_, err := ReadEntry(bytes.NewReader(header))
+	if err == nil || err == io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want the record to be rejected as too long", err)
+	}
+}
+
+// TestReadSnapshotValueTooLong checks that a snapshot entry claiming a
+// value longer than maxEntrySize is rejected from its length alone
+func TestReadSnapshotValueTooLong(t *testing.T) {
+	var data bytes.Buffer
+	header := make([]byte, 13)
+	binary.LittleEndian.PutUint32(header[0:4], snapshotMagic)
+	header[4] = snapshotVersion
+	data.Write(header)
+	data.Write([]byte{snapshotEntryPlain, 1, 0, 'k'})
+	data.Write(binary.LittleEndian.AppendUint32(nil, maxEntrySize+1))
+
+	_, err := ReadSnapshot(&data, nil)
+	if err == nil || err == io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want the value to be rejected as too long", err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	entries := []*SnapshotEntry{
+		{Key: "a", Value: []byte("1"), Version: 1},
+		{Key: "b", Value: []byte("2"), ExpiresAt: 1 << 40, Version: 2, Type: 1},
+	}
+
+	var data bytes.Buffer
+	err := WriteSnapshot(&data, 42, func(fn func(entry *SnapshotEntry)) {
+		for _, entry := range entries {
+			fn(entry)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var read []*SnapshotEntry
+	position, err := ReadSnapshot(&data, func(entry *SnapshotEntry) {
+		read = append(read, entry)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 42 {
+		t.Fatalf("position = %d, want 42", position)
+	}
+	if len(read) != len(entries) {
+		t.Fatalf("read %d entries, want %d", len(read), len(entries))
+	}
+	for i, entry := range read {
+		want := entries[i]
+		if entry.Key != want.Key || !bytes.Equal(entry.Value, want.Value) || entry.ExpiresAt != want.ExpiresAt ||
+			entry.Version != want.Version || entry.Type != want.Type {
+			t.Fatalf("entry %d = %+v, want %+v", i, entry, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Lists, hashes, sets and sorted sets are logged one change at a time
+// rather than as a whole, so that adding to a large collection writes
+// little. The value of such an entry is a flag byte, telling whether the
+// change created the key, followed by the items the change is made of,
+// encoded with EncodeItems.
+//
+// A change that created the key applies to an empty collection, whatever
+// the key held before. Any other change applies to the collection the key
+// holds when it is replayed; if it no longer holds one, the collection has
+// expired by the time of the replay, and so would the result, which keeps
+// its expiry. Replay therefore never depends on when it happens. Unlike
+// other writes, changes are not idempotent, so a change must be skipped if
+// its key already holds it, as a snapshot read while writes carry on may.
+// The version of the key tells: it is at least the change's sequence.
+
+// Flags starting the value of a collection change
+const (
+	collectionUpdate byte = 0
+	collectionCreate byte = 1
+)
+
+// IsCollectionChange reports whether the operation changes a collection in
+// place
+func (op LogOperation) IsCollectionChange() bool {
+	return op >= OperationListPushLeft && op <= OperationSortedSetRemove
+}
+
+// EncodeCollectionChange serializes the value of a collection change:
+// whether it creates the key, then its items
+func EncodeCollectionChange(create bool, items [][]byte) []byte {
+	flag := collectionUpdate
+	if create {
+		flag = collectionCreate
+	}
+	return appendItems([]byte{flag}, items)
+}
+
+// DecodeCollectionChange parses the value of a collection change
+func DecodeCollectionChange(data []byte) (bool, [][]byte, error) {
+	if len(data) == 0 || data[0] > collectionCreate {
+		return false, nil, fmt.Errorf("invalid collection change")
+	}
+	items, err := DecodeItems(data[1:])
+	if err != nil {
+		return false, nil, err
+	}
+	return data[0] == collectionCreate, items, nil
+}
+
+// replacesKey reports whether an entry leaves its key without regard to
+// what it held before, so that earlier entries for the key are not needed
+// to replay it. Expiry changes and collection changes that did not create
+// the key build on what came before.
+func replacesKey(entry *LogEntry) bool {
+	switch {
+	case entry.Operation == OperationExpire:
+		return false
+	case entry.Operation.IsCollectionChange():
+		return len(entry.Value) > 0 && entry.Value[0] == collectionCreate
+	}
+	return true
+}
+
+// EncodeItems serializes a sequence of byte strings, each preceded by its
+// length as a varint. Snapshots store collections in this form, and the
+// changes logged to them their items; in memory, collections are kept
+// decoded.
+func EncodeItems(items [][]byte) []byte {
+	return appendItems(nil, items)
+}
+
+// appendItems appends items to data in the form of EncodeItems
+func appendItems(data []byte, items [][]byte) []byte {
+	size := len(data)
+	for _, item := range items {
+		size += binary.MaxVarintLen64 + len(item)
+	}
+
+	data = append(make([]byte, 0, size), data...)
+	for _, item := range items {
+		data = binary.AppendUvarint(data, uint64(len(item)))
+		data = append(data, item...)
+	}
+	return data
+}
+
+// DecodeItems parses byte strings serialized by EncodeItems. The items
+// share data rather than being copied.
+func DecodeItems(data []byte) ([][]byte, error) {
+	var items [][]byte
+	for len(data) > 0 {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return nil, fmt.Errorf("item %d truncated", len(items))
+		}
+		data = data[n:]
+		items = append(items, data[:length:length])
+		data = data[length:]
+	}
+	return items, nil
+}
@@ -0,0 +1,241 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLogClosed is returned when appending to a log that has been closed
+var ErrLogClosed = errors.New("log is closed")
+
+// ErrLogFailed is returned by every append after a failed write could not
+// be undone, since the log may then hold entries no caller was told about
+var ErrLogFailed = errors.New("log is unusable after a failed write")
+
+// commitRequest is a serialized entry waiting to be written by the committer
+type commitRequest struct {
+	entry    *LogEntry
+	sequence uint64
+	data     []byte
+	done     chan error
+}
+
+// startCommitter launches the goroutine that batches concurrent appends
+func (l *Log) startCommitter() {
+	l.requests = make(chan *commitRequest, l.maxBatchSize)
+	l.closing = make(chan struct{})
+	l.stopped = make(chan struct{})
+	go l.runCommitter()
+}
+
+// stopCommitter stops the committer after it has written every request that
+// was queued before the call
+func (l *Log) stopCommitter() {
+	l.stopOnce.Do(func() {
+		close(l.closing)
+	})
+	<-l.stopped
+}
+
+// enqueue numbers and serializes an entry, hands it to the committer and
+// waits until its batch is written and, depending on the sync mode, fsynced
+func (l *Log) enqueue(entry *LogEntry) error {
+	l.sequenceMutex.Lock()
+	entry.Sequence = l.nextSequence
+	data, err := codecV2{}.encode(entry)
+	if err != nil {
+		l.sequenceMutex.Unlock()
+		return fmt.Errorf("failed to serialize log entry: %w", err)
+	}
+
+	req := &commitRequest{
+		entry:    entry,
+		sequence: entry.Sequence,
+		data:     data,
+		done:     make(chan error, 1),
+	}
+
+	select {
+	case l.requests <- req:
+		l.nextSequence++
+		l.sequenceMutex.Unlock()
+	case <-l.closing:
+		l.sequenceMutex.Unlock()
+		return ErrLogClosed
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-l.stopped:
+		// The committer may have handled the request right before exiting
+		select {
+		case err := <-req.done:
+			return err
+		default:
+			return ErrLogClosed
+		}
+	}
+}
+
+// runCommitter collects queued requests into batches and commits each batch
+// with a single write and a single sync
+func (l *Log) runCommitter() {
+	defer close(l.stopped)
+
+	for {
+		var first *commitRequest
+		select {
+		case first = <-l.requests:
+		case <-l.closing:
+			// Drain whatever was queued before closing
+			for {
+				select {
+				case req := <-l.requests:
+					l.commitBatch([]*commitRequest{req})
+				default:
+					return
+				}
+			}
+		}
+
+		l.commitBatch(l.collectBatch(first))
+	}
+}
+
+// collectBatch gathers requests behind first until the batch is full, the
+// delay expires, or, with no delay configured, the queue is empty
+func (l *Log) collectBatch(first *commitRequest) []*commitRequest {
+	batch := []*commitRequest{first}
+	size := len(first.data)
+
+	var timeout <-chan time.Time
+	if l.maxBatchDelay > 0 {
+		timer := time.NewTimer(l.maxBatchDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(batch) < l.maxBatchSize && size < l.maxBatchBytes {
+		if timeout == nil {
+			select {
+			case req := <-l.requests:
+				batch = append(batch, req)
+				size += len(req.data)
+				continue
+			default:
+				return batch
+			}
+		}
+
+		select {
+		case req := <-l.requests:
+			batch = append(batch, req)
+			size += len(req.data)
+		case <-timeout:
+			return batch
+		case <-l.closing:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// commitBatch writes a batch, flushes it, syncs it if required and releases
+// every waiting caller with the outcome
+func (l *Log) commitBatch(batch []*commitRequest) {
+	err := l.writeBatch(batch)
+	if err == nil {
+		l.notifyCommit(batch)
+	}
+	for _, req := range batch {
+		req.done <- err
+	}
+}
+
+// notifyCommit passes the entries of a written batch to the OnCommit hook
+func (l *Log) notifyCommit(batch []*commitRequest) {
+	if l.onCommit == nil {
+		return
+	}
+
+	entries := make([]*LogEntry, len(batch))
+	for i, req := range batch {
+		entries[i] = req.entry
+	}
+	l.onCommit(entries)
+}
+
+// writeBatch performs the actual write of a batch under the log mutex
+func (l *Log) writeBatch(batch []*commitRequest) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.failure != nil {
+		return l.failure
+	}
+	if l.file == nil {
+		return ErrLogClosed
+	}
+
+	// Join the batch so it reaches the file in a single write
+	var data []byte
+	for _, req := range batch {
+		data = append(data, req.data...)
+	}
+
+	// A batch never straddles two segments
+	if l.currSize > segmentHeaderSize && l.currSize+int64(len(data)) > l.segmentSize {
+		err := l.rotateLocked(batch[0].sequence)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := l.writer.Write(data)
+	if err != nil {
+		return l.undoBatchLocked(fmt.Errorf("failed to write to log buffer: %w", err))
+	}
+
+	// Flush to disk
+	err = l.writer.Flush()
+	if err != nil {
+		return l.undoBatchLocked(fmt.Errorf("failed to flush log to disk: %w", err))
+	}
+
+	if l.syncMode == SyncAlways {
+		err = l.file.Sync()
+		if err != nil {
+			return l.undoBatchLocked(fmt.Errorf("failed to sync log to disk: %w", err))
+		}
+		l.syncedPos = l.segmentBase + l.currSize + int64(len(data))
+	}
+
+	// Update size
+	l.currSize += int64(len(data))
+	l.lastWritten = batch[len(batch)-1].sequence
+
+	return nil
+}
+
+// undoBatchLocked removes whatever part of a failed batch reached the file.
+// Every caller in the batch is told that its append failed, so none of it
+// may come back during recovery. If the file cannot be cut back, the log
+// stops accepting appends altogether. The caller must hold the mutex.
+func (l *Log) undoBatchLocked(cause error) error {
+	// Discard anything still buffered
+	l.writer.Reset(l.file)
+	
+	err := l.file.Truncate(l.currSize)
+	if err == nil && l.syncMode == SyncAlways {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.failure = fmt.Errorf("%w: %v; undoing it: %v", ErrLogFailed, cause, err)
+		return l.failure
+	}
+	
+	return cause
+}
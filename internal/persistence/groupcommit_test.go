@@ -0,0 +1,71 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+)
+
+// BenchmarkAppend measures appends from a single writer and from many in
+// parallel, in every sync mode. Batches of one commit every entry on its
+// own, with a write and a sync each, as appends did before group commit.
+func BenchmarkAppend(b *testing.B) {
+	modes := []struct {
+		name string
+		mode SyncMode
+	}{
+		{"always", SyncAlways},
+		{"interval", SyncInterval},
+		{"none", SyncNone},
+	}
+	value := make([]byte, 100)
+
+	for _, mode := range modes {
+		for _, batchSize := range []int{1, DefaultLogOptions().MaxBatchSize} {
+			name := fmt.Sprintf("sync=%s/batch=%d", mode.name, batchSize)
+			options := &LogOptions{
+				SyncMode:      mode.mode,
+				MaxBatchSize:  batchSize,
+				MaxBatchBytes: 1 << 20,
+			}
+
+			b.Run(name+"/single", func(b *testing.B) {
+				log := newBenchmarkLog(b, options)
+				for i := 0; i < b.N; i++ {
+					_, err := log.Append(OperationSet, "key", value)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(name+"/parallel", func(b *testing.B) {
+				log := newBenchmarkLog(b, options)
+				b.SetParallelism(16)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						_, err := log.Append(OperationSet, "key", value)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// newBenchmarkLog opens a log in a temporary directory that is closed when
+// the benchmark ends
+func newBenchmarkLog(b *testing.B, options *LogOptions) *Log {
+	b.Helper()
+	log, err := NewLog(b.TempDir(), options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		log.Close()
+	})
+	b.ResetTimer()
+	return log
+}
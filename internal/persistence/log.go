@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
-	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -17,10 +17,120 @@ type LogOperation byte
 const (
 	OperationSet LogOperation = iota + 1
 	OperationDelete
+	// OperationSetWithExpiry stores a value that expires; see EncodeExpiry
+	OperationSetWithExpiry
+	// OperationExpire changes the expiry of an existing key. Its value holds
+	// only the expiry time, zero removing it.
+	OperationExpire
+	// OperationBatch holds several operations that are applied together;
+	// see EncodeBatch
+	OperationBatch
+	
+	// The operations below change a list, hash, set or sorted set in
+	// place; see EncodeCollectionChange
+	OperationListPushLeft
+	OperationListPushRight
+	OperationListPopLeft
+	OperationListPopRight
+	OperationHashSet
+	OperationHashDelete
+	OperationSetAdd
+	OperationSetRemove
+	OperationSortedSetAdd
+	OperationSortedSetRemove
 )
 
-// LogEntry represents a single entry in the append-only log
+// isValid reports whether the operation is one this version understands
+func (op LogOperation) isValid() bool {
+	switch op {
+	case OperationSet, OperationDelete, OperationSetWithExpiry, OperationExpire, OperationBatch:
+		return true
+	}
+	return op.IsCollectionChange()
+}
+
+// EncodeExpiry prefixes value with an absolute expiry time in Unix
+// nanoseconds, as stored in the value of expiry operations. Recording the
+// time rather than the TTL keeps replay independent of when it happens.
+func EncodeExpiry(expiresAt int64, value []byte) []byte {
+	data := make([]byte, 8+len(value))
+	binary.LittleEndian.PutUint64(data[0:8], uint64(expiresAt))
+	copy(data[8:], value)
+	return data
+}
+
+// DecodeExpiry splits the value of an expiry operation into the expiry time
+// and the stored value
+func DecodeExpiry(data []byte) (int64, []byte, error) {
+	if len(data) < 8 {
+		return 0, nil, fmt.Errorf("expiry value too short")
+	}
+	return int64(binary.LittleEndian.Uint64(data[0:8])), data[8:], nil
+}
+
+// SyncMode controls when appended entries are fsynced to stable storage
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs after every append before it returns
+	SyncAlways SyncMode = iota
+	// SyncInterval leaves fsync to periodic calls to Sync
+	SyncInterval
+	// SyncNone never fsyncs explicitly and lets the OS decide
+	SyncNone
+)
+
+// LogOptions configures the behaviour of a Log
+type LogOptions struct {
+	SyncMode SyncMode
+	
+	// Concurrent appends are grouped into batches that share one write and
+	// one sync. A batch is closed when it reaches MaxBatchSize entries or
+	// MaxBatchBytes bytes, or MaxBatchDelay after its first entry arrived.
+	// With no delay, a batch holds whatever queued up during the previous
+	// commit. MaxBatchSize of 1 commits every entry on its own.
+	MaxBatchSize  int
+	MaxBatchBytes int
+	MaxBatchDelay time.Duration
+	
+	// SegmentSize is the size at which the active segment is sealed and a
+	// new one started
+	SegmentSize int64
+	
+	// OnCommit, if set, is called by the committer with every batch of
+	// entries once it has been written, in sequence order and before the
+	// appends return. It must not block or append to the log.
+	OnCommit func(entries []*LogEntry)
+	
+	// WrapSegment, if set, wraps every segment file the log appends to.
+	// Tests use it to make writes or syncs fail.
+	WrapSegment func(file *os.File) SegmentFile
+}
+
+// SegmentFile is the active segment as the log appends to it
+type SegmentFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// DefaultLogOptions returns the default log options
+func DefaultLogOptions() *LogOptions {
+	return &LogOptions{
+		SyncMode:      SyncAlways,
+		MaxBatchSize:  256,
+		MaxBatchBytes: 1 << 20,
+		MaxBatchDelay: 0,
+		SegmentSize:   64 << 20,
+	}
+}
+
+// LogEntry represents a single entry in the append-only log. Sequence
+// numbers increase with every append; entries upgraded from the legacy
+// format are numbered when they are rewritten.
 type LogEntry struct {
+	Sequence  uint64
 	Timestamp int64
 	Operation LogOperation
 	Key       string
@@ -28,52 +138,219 @@ type LogEntry struct {
 	Checksum  uint32
 }
 
-// Log represents an append-only log for durability
+// Log represents an append-only log for durability. It is split into
+// segments; only the newest one is written to.
 type Log struct {
 	dir         string
-	file        *os.File
+	file        SegmentFile
 	writer      *bufio.Writer
 	mutex       sync.Mutex
-	currSize    int64
+	segmentBase int64 // Logical position of the active segment
+	currSize    int64 // Bytes in the active segment
+	segmentSize int64
+	syncedPos   int64
+	syncMode    SyncMode
 	isCompacted bool
+	failure     error  // Set once a failed write could not be undone
+	lastWritten uint64 // Sequence number of the last entry written
+	onCommit    func(entries []*LogEntry)
+	wrapSegment func(file *os.File) SegmentFile
+	
+	// Sequence numbers are handed out in the order entries are queued, and
+	// the committer writes them in that same order
+	sequenceMutex sync.Mutex
+	nextSequence  uint64
+	
+	// Group commit
+	maxBatchSize  int
+	maxBatchBytes int
+	maxBatchDelay time.Duration
+	requests      chan *commitRequest
+	closing       chan struct{}
+	stopped       chan struct{}
+	stopOnce      sync.Once
 }
 
 // NewLog creates a new append-only log
-func NewLog(dir string) (*Log, error) {
+func NewLog(dir string, options *LogOptions) (*Log, error) {
+	if options == nil {
+		options = DefaultLogOptions()
+	}
+	
 	// Create directory if it doesn't exist
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create log directory: %w", err)
 	}
 	
-	logPath := filepath.Join(dir, "database.log")
-	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	err = migrateLegacyLog(dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %w", err)
+		return nil, err
+	}
+	
+	err = upgradeLegacySegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	
+	log := &Log{
+		dir:         dir,
+		segmentSize: options.SegmentSize,
+		syncMode:    options.SyncMode,
+		
+		maxBatchSize:  options.MaxBatchSize,
+		maxBatchBytes: options.MaxBatchBytes,
+		maxBatchDelay: options.MaxBatchDelay,
+		onCommit:      options.OnCommit,
+		wrapSegment:   options.WrapSegment,
+	}
+	if log.maxBatchSize < 1 {
+		log.maxBatchSize = 1
+	}
+	if log.maxBatchBytes < 1 {
+		log.maxBatchBytes = 1 << 20
+	}
+	if log.segmentSize < 1 {
+		log.segmentSize = 64 << 20
+	}
+	
+	// Continue appending to the newest segment
+	var base int64
+	log.nextSequence = 1
+	if len(segments) > 0 {
+		newest := segments[len(segments)-1]
+		base = newest.Base
+		log.nextSequence, err = nextSequenceAfter(newest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = log.openSegment(base, log.nextSequence)
+	if err != nil {
+		return nil, err
+	}
+	log.lastWritten = log.nextSequence - 1
+	
+	// Whatever is already in the files is assumed to be on disk
+	log.syncedPos = log.segmentBase + log.currSize
+	
+	log.startCommitter()
+	
+	return log, nil
+}
+
+// openSegment opens the segment starting at base as the active segment,
+// creating it with a header if needed. baseSequence is the sequence number
+// of the first entry a new segment will hold.
+func (l *Log) openSegment(base int64, baseSequence uint64) error {
+	path := filepath.Join(l.dir, segmentName(base))
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
 	}
 	
 	// Get current file size
 	info, err := file.Stat()
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to get log file info: %w", err)
+		return fmt.Errorf("failed to get log file info: %w", err)
 	}
 	
-	log := &Log{
-		dir:      dir,
-		file:     file,
-		writer:   bufio.NewWriter(file),
-		currSize: info.Size(),
+	size := info.Size()
+	if size == 0 {
+		header := encodeSegmentHeader(segmentHeader{
+			Version:      CurrentFormatVersion,
+			BaseSequence: baseSequence,
+		})
+		_, err = file.Write(header)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write segment header: %w", err)
+		}
+		size = int64(len(header))
 	}
 	
-	return log, nil
+	l.file = file
+	if l.wrapSegment != nil {
+		l.file = l.wrapSegment(file)
+	}
+	l.writer = bufio.NewWriter(l.file)
+	l.segmentBase = base
+	l.currSize = size
+	
+	return nil
 }
 
-// Append adds a new entry to the log
-func (l *Log) Append(operation LogOperation, key string, value []byte) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+// nextSequenceAfter finds the sequence number following the last entry in
+// a segment
+func nextSequenceAfter(segment segmentInfo) (uint64, error) {
+	file, err := os.Open(segment.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open log file: %w", err)
+	}
+	header, _, err := readSegmentHeader(file)
+	file.Close()
+	if err != nil {
+		return 0, err
+	}
+	
+	next := header.BaseSequence
+	if next == 0 {
+		next = 1
+	}
+	
+	recovery := NewRecovery(filepath.Dir(segment.Path), CorruptionResync)
+	_, err = recovery.recoverSegment(segment, 0, false, &RecoveryReport{}, func(entry *LogEntry) error {
+		if entry.Sequence >= next {
+			next = entry.Sequence + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
 	
+	return next, nil
+}
+
+// rotateLocked seals the active segment and starts a new one whose first
+// entry has baseSequence. The caller must hold the mutex.
+func (l *Log) rotateLocked(baseSequence uint64) error {
+	err := l.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush log to disk: %w", err)
+	}
+	
+	// Sealed segments are always on disk, whatever the sync mode
+	err = l.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync log to disk: %w", err)
+	}
+	l.syncedPos = l.segmentBase + l.currSize
+	
+	err = l.file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close log segment: %w", err)
+	}
+	
+	err = l.openSegment(l.segmentBase+l.currSize, baseSequence)
+	if err != nil {
+		l.file = nil
+		return err
+	}
+	
+	return syncDir(l.dir)
+}
+
+// Append adds a new entry to the log and returns once the batch it was
+// committed in has been written. It returns the sequence number assigned
+// to the entry.
+func (l *Log) Append(operation LogOperation, key string, value []byte) (uint64, error) {
 	// Create log entry
 	entry := &LogEntry{
 		Timestamp: time.Now().UnixNano(),
@@ -82,101 +359,152 @@ func (l *Log) Append(operation LogOperation, key string, value []byte) error {
 		Value:     value,
 	}
 	
-	// Calculate checksum
-	entry.Checksum = l.calculateChecksum(entry)
-	
-	// Serialize entry
-	data, err := l.serializeEntry(entry)
+	err := l.enqueue(entry)
 	if err != nil {
-		return fmt.Errorf("failed to serialize log entry: %w", err)
+		return 0, err
 	}
 	
-	// Write to buffer
-	_, err = l.writer.Write(data)
+	return entry.Sequence, nil
+}
+
+// AppendEntries adds entries that already carry their sequence numbers and
+// timestamps, as copied from another log. They are written as one batch,
+// so either all of them are logged or none are, and numbering carries on
+// after the last one. Sequence numbers must increase, and the caller must
+// not append by other means at the same time.
+func (l *Log) AppendEntries(entries []*LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	
+	l.sequenceMutex.Lock()
+	defer l.sequenceMutex.Unlock()
+	
+	batch := make([]*commitRequest, 0, len(entries))
+	next := l.nextSequence
+	for _, entry := range entries {
+		if entry.Sequence < next {
+			return fmt.Errorf("entry sequence %d is not after %d", entry.Sequence, next-1)
+		}
+		next = entry.Sequence + 1
+		
+		data, err := codecV2{}.encode(entry)
+		if err != nil {
+			return fmt.Errorf("failed to serialize log entry: %w", err)
+		}
+		batch = append(batch, &commitRequest{
+			entry:    entry,
+			sequence: entry.Sequence,
+			data:     data,
+		})
+	}
+	
+	err := l.writeBatch(batch)
 	if err != nil {
-		return fmt.Errorf("failed to write to log buffer: %w", err)
+		return err
+	}
+	l.nextSequence = next
+	l.notifyCommit(batch)
+	
+	return nil
+}
+
+// LastSequence returns the sequence number of the last entry written, or
+// zero if the log is empty
+func (l *Log) LastSequence() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	
+	return l.lastWritten
+}
+
+// Restart seals the active segment and starts a new one whose first entry
+// will have baseSequence, as if every earlier sequence number had been
+// used. It returns the position the new segment starts at. It is used when
+// a snapshot taken elsewhere replaces the contents of the log, and must
+// not be called while appends are in progress.
+func (l *Log) Restart(baseSequence uint64) (int64, error) {
+	l.sequenceMutex.Lock()
+	defer l.sequenceMutex.Unlock()
+	
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	
+	if l.failure != nil {
+		return 0, l.failure
+	}
+	if l.file == nil {
+		return 0, ErrLogClosed
 	}
 	
-	// Flush to disk
-	err = l.writer.Flush()
+	err := l.rotateLocked(baseSequence)
 	if err != nil {
-		return fmt.Errorf("failed to flush log to disk: %w", err)
+		return 0, err
 	}
 	
-	// Update size
-	l.currSize += int64(len(data))
+	l.nextSequence = baseSequence
+	l.lastWritten = baseSequence - 1
 	
-	return nil
+	return l.segmentBase, nil
 }
 
-// calculateChecksum computes the checksum for a log entry
-func (l *Log) calculateChecksum(entry *LogEntry) uint32 {
-	// Create a byte buffer for checksum calculation
-	var data []byte
+// Sync flushes buffered entries and fsyncs the log file
+func (l *Log) Sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	
-	// Add timestamp
-	timeBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(timeBytes, uint64(entry.Timestamp))
-	data = append(data, timeBytes...)
+	if l.file == nil {
+		return nil
+	}
 	
-	// Add operation
-	data = append(data, byte(entry.Operation))
+	err := l.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush log to disk: %w", err)
+	}
 	
-	// Add key
-	data = append(data, []byte(entry.Key)...)
+	return l.syncLocked()
+}
+
+// syncLocked fsyncs the log file. The caller must hold the mutex and have
+// flushed the writer.
+func (l *Log) syncLocked() error {
+	position := l.segmentBase + l.currSize
+	if l.syncedPos == position {
+		return nil
+	}
 	
-	// Add value if present
-	if entry.Value != nil {
-		data = append(data, entry.Value...)
+	err := l.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync log to disk: %w", err)
 	}
 	
-	// Calculate checksum
-	return crc32.ChecksumIEEE(data)
+	l.syncedPos = position
+	
+	return nil
+}
+
+// SyncedPosition returns the offset up to which the log is known to be on
+// stable storage. Entries past it may be lost on power failure.
+func (l *Log) SyncedPosition() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	
+	return l.syncedPos
 }
 
-// serializeEntry converts a log entry to a byte array
-func (l *Log) serializeEntry(entry *LogEntry) ([]byte, error) {
-	var data []byte
-	
-	// Write timestamp (8 bytes)
-	timeBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(timeBytes, uint64(entry.Timestamp))
-	data = append(data, timeBytes...)
-	
-	// Write operation (1 byte)
-	data = append(data, byte(entry.Operation))
-	
-	// Write key length (2 bytes) and key
-	keyBytes := []byte(entry.Key)
-	keyLenBytes := make([]byte, 2)
-	if len(keyBytes) > 65535 {
-		return nil, fmt.Errorf("key is too long")
-	}
-	binary.LittleEndian.PutUint16(keyLenBytes, uint16(len(keyBytes)))
-	data = append(data, keyLenBytes...)
-	data = append(data, keyBytes...)
-	
-	// Write value length (4 bytes) and value (if present)
-	valueLenBytes := make([]byte, 4)
-	if entry.Value != nil {
-		binary.LittleEndian.PutUint32(valueLenBytes, uint32(len(entry.Value)))
-		data = append(data, valueLenBytes...)
-		data = append(data, entry.Value...)
-	} else {
-		binary.LittleEndian.PutUint32(valueLenBytes, 0)
-		data = append(data, valueLenBytes...)
-	}
-	
-	// Write checksum (4 bytes)
-	checksumBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(checksumBytes, entry.Checksum)
-	data = append(data, checksumBytes...)
-	
-	return data, nil
+// Position returns the logical position just past the last appended entry
+func (l *Log) Position() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	
+	return l.segmentBase + l.currSize
 }
 
 // Close closes the log file
 func (l *Log) Close() error {
+	// Let queued appends finish before the file goes away
+	l.stopCommitter()
+	
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	
@@ -190,78 +518,189 @@ func (l *Log) Close() error {
 		return fmt.Errorf("failed to flush log on close: %w", err)
 	}
 	
+	err = l.syncLocked()
+	if err != nil {
+		return err
+	}
+	
 	err = l.file.Close()
 	l.file = nil
 	
 	return err
 }
 
-// Compact compacts the log by removing redundant entries
+// Compact rewrites sealed segments so that each holds only the last entry
+// for every key it touches. The active segment is never rewritten, so
+// appends carry on undisturbed while compaction runs.
 func (l *Log) Compact() error {
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	
-	if l.isCompacted {
-		return nil // Already compacting
+	if l.isCompacted || l.file == nil {
+		l.mutex.Unlock()
+		return nil // Already compacting or closed
 	}
-	
 	l.isCompacted = true
-	defer func() { l.isCompacted = false }()
+	activeBase := l.segmentBase
+	l.mutex.Unlock()
+	
+	defer l.finishCompaction()
 	
-	// Create a temporary log file
-	tempPath := filepath.Join(l.dir, "temp.log")
-	tempFile, err := os.Create(tempPath)
+	segments, err := listSegments(l.dir)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary log file: %w", err)
+		return err
 	}
 	
-	// Implementation of log compaction logic would go here
-	// For now, we'll just create an empty log (simplified)
-	
-	// Close current log file
-	err = l.writer.Flush()
+	snapshots, err := listSnapshots(l.dir)
 	if err != nil {
-		tempFile.Close()
-		os.Remove(tempPath)
-		return fmt.Errorf("failed to flush log: %w", err)
+		return err
 	}
 	
-	err = l.file.Close()
-	if err != nil {
-		tempFile.Close()
-		os.Remove(tempPath)
-		return fmt.Errorf("failed to close log file: %w", err)
+	for i, segment := range segments {
+		if segment.Base >= activeBase {
+			break
+		}
+		// Sealed segments never change once compacted. Segments upgraded
+		// from the legacy format grow, so they are still compacted once.
+		end := segmentEnd(segments, i)
+		if segment.Size < end-segment.Base {
+			continue
+		}
+		
+		// A delete must be kept while anything older could still be
+		// replayed before it: an earlier segment, or a snapshot taken
+		// before the segment ends. Once earlier segments are removed, the
+		// snapshot they were removed for holds the keys deleted here.
+		dropDeletes := i == 0
+		for _, snapshot := range snapshots {
+			if snapshot.Position > 0 && snapshot.Position < end {
+				dropDeletes = false
+			}
+		}
+		
+		// Carry on with the other segments if one cannot be compacted
+		segmentErr := l.compactSegment(segment, dropDeletes)
+		if segmentErr != nil && err == nil {
+			err = segmentErr
+		}
 	}
 	
-	// Close temporary file
-	err = tempFile.Close()
+	return err
+}
+
+// finishCompaction clears the compaction flag
+func (l *Log) finishCompaction() {
+	l.mutex.Lock()
+	l.isCompacted = false
+	l.mutex.Unlock()
+}
+
+// compactSegment rewrites a sealed segment keeping only the last entry per
+// key, in their original order, and atomically replaces it. A trailing
+// expiry change is kept together with the write before it, and so are the
+// changes made in place to a collection since it was last replaced.
+func (l *Log) compactSegment(segment segmentInfo, dropDeletes bool) error {
+	// Corrupted segments are left untouched so no evidence is destroyed;
+	// recovery deals with them according to its policy
+	recovery := NewRecovery(l.dir, CorruptionFail)
+	var entries []*LogEntry
+	_, err := recovery.recoverSegment(segment, 0, false, &RecoveryReport{}, func(entry *LogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
 	if err != nil {
-		os.Remove(tempPath)
-		return fmt.Errorf("failed to close temporary log file: %w", err)
+		return fmt.Errorf("skipped compacting segment %s: %w", segment.Path, err)
 	}
 	
-	// Replace the old log with the new one
-	logPath := filepath.Join(l.dir, "database.log")
-	err = os.Rename(tempPath, logPath)
+	// Operations in a batch may be superseded one by one
+	entries, err = expandBatches(entries)
 	if err != nil {
-		return fmt.Errorf("failed to replace log file: %w", err)
+		return fmt.Errorf("skipped compacting segment %s: %w", segment.Path, err)
 	}
 	
-	// Reopen the log file
-	l.file, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to reopen log file: %w", err)
+	// An expiry change only matters on top of the value it applies to, so
+	// the last one is kept along with the last write when it follows it.
+	// Collection changes build on each other, so every one after the last
+	// write replacing the key is kept.
+	last := make(map[string]int)
+	lastExpire := make(map[string]int)
+	for i, entry := range entries {
+		if entry.Operation == OperationExpire {
+			lastExpire[entry.Key] = i
+			continue
+		}
+		if replacesKey(entry) {
+			last[entry.Key] = i
+		}
 	}
 	
-	l.writer = bufio.NewWriter(l.file)
+	var kept []*LogEntry
+	for i, entry := range entries {
+		write, written := last[entry.Key]
+		switch {
+		case entry.Operation == OperationExpire:
+			if lastExpire[entry.Key] != i || (written && write > i) {
+				continue
+			}
+		case !replacesKey(entry):
+			if written && write > i {
+				continue
+			}
+		case write != i:
+			continue
+		}
+		if dropDeletes && entry.Operation == OperationDelete {
+			continue
+		}
+		kept = append(kept, entry)
+	}
 	
-	// Update size
-	info, err := l.file.Stat()
+	baseSequence := uint64(0)
+	if len(entries) > 0 {
+		baseSequence = entries[0].Sequence
+	}
+	
+	return rewriteSegment(segment.Path, baseSequence, kept)
+}
+
+// RemoveSegmentsBefore deletes sealed segments that end at or before
+// position. Callers pass the position of the oldest snapshot they keep,
+// after which those segments are never needed for recovery again.
+func (l *Log) RemoveSegmentsBefore(position int64) error {
+	l.mutex.Lock()
+	activeBase := l.segmentBase
+	l.mutex.Unlock()
+	
+	segments, err := listSegments(l.dir)
 	if err != nil {
-		return fmt.Errorf("failed to get log file info: %w", err)
+		return err
 	}
 	
-	l.currSize = info.Size()
+	removed := false
+	for i, segment := range segments {
+		if segment.Base >= activeBase || segmentEnd(segments, i) > position {
+			break
+		}
+		
+		err = os.Remove(segment.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove segment: %w", err)
+		}
+		removed = true
+	}
+	
+	if removed {
+		return syncDir(l.dir)
+	}
 	
 	return nil
 }
+
+// syncDir flushes directory metadata so that renames survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	
+	return d.Sync()
+}
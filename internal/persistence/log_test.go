@@ -0,0 +1,312 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeSegments writes each list of entries as a segment of a log in dir,
+// numbering the entries in order, and returns the segments
+func writeSegments(t *testing.T, dir string, lists ...[]*LogEntry) []segmentInfo {
+	t.Helper()
+
+	var segments []segmentInfo
+	var base int64
+	var sequence uint64 = 1
+	for _, entries := range lists {
+		data := encodeSegmentHeader(segmentHeader{Version: CurrentFormatVersion, BaseSequence: sequence})
+		for _, entry := range entries {
+			entry.Sequence = sequence
+			sequence++
+			record, err := codecV2{}.encode(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, record...)
+		}
+
+		path := filepath.Join(dir, segmentName(base))
+		err := os.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, segmentInfo{Path: path, Base: base, Size: int64(len(data))})
+		base += int64(len(data))
+	}
+	return segments
+}
+
+// testValue is the state of one key after replaying a log
+type testValue struct {
+	Value     string
+	ExpiresAt int64
+	Items     []string
+}
+
+// replayState replays the log in dir from position into a map of keys
+func replayState(t *testing.T, dir string, position int64) map[string]testValue {
+	t.Helper()
+
+	state := make(map[string]testValue)
+	_, err := NewRecovery(dir, CorruptionFail).Replay(position, func(entry *LogEntry) error {
+		entries, err := expandBatches([]*LogEntry{entry})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = applyTestEntry(state, entry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// applyTestEntry applies one entry to state
+func applyTestEntry(state map[string]testValue, entry *LogEntry) error {
+	value := state[entry.Key]
+	switch {
+	case entry.Operation == OperationSet:
+		state[entry.Key] = testValue{Value: string(entry.Value)}
+	case entry.Operation == OperationSetWithExpiry:
+		expiresAt, data, err := DecodeExpiry(entry.Value)
+		if err != nil {
+			return err
+		}
+		state[entry.Key] = testValue{Value: string(data), ExpiresAt: expiresAt}
+	case entry.Operation == OperationDelete:
+		delete(state, entry.Key)
+	case entry.Operation == OperationExpire:
+		expiresAt, _, err := DecodeExpiry(entry.Value)
+		if err != nil {
+			return err
+		}
+		value.ExpiresAt = expiresAt
+		state[entry.Key] = value
+	case entry.Operation.IsCollectionChange():
+		create, items, err := DecodeCollectionChange(entry.Value)
+		if err != nil {
+			return err
+		}
+		if create {
+			value = testValue{}
+		}
+		for _, item := range items {
+			value.Items = append(value.Items, string(item))
+		}
+		state[entry.Key] = value
+	default:
+		return fmt.Errorf("unexpected operation %d", entry.Operation)
+	}
+	return nil
+}
+
+// segmentEntries returns the operations and keys left in a segment
+func segmentEntries(t *testing.T, segment string) []string {
+	t.Helper()
+
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	_, err = NewRecovery(filepath.Dir(segment), CorruptionFail).recoverSegment(
+		segmentInfo{Path: segment, Size: info.Size()}, 0, false, &RecoveryReport{},
+		func(entry *LogEntry) error {
+			entries = append(entries, fmt.Sprintf("%d %s", entry.Operation, entry.Key))
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// TestCompact compacts the sealed segments of a log and checks what each
+// keeps, and that replaying the log gives the same keys before compaction
+// and after reopening it
+func TestCompact(t *testing.T) {
+	set := func(key, value string) *LogEntry {
+		return &LogEntry{Operation: OperationSet, Key: key, Value: []byte(value)}
+	}
+	setWithExpiry := func(key, value string, expiresAt int64) *LogEntry {
+		return &LogEntry{Operation: OperationSetWithExpiry, Key: key, Value: EncodeExpiry(expiresAt, []byte(value))}
+	}
+	del := func(key string) *LogEntry {
+		return &LogEntry{Operation: OperationDelete, Key: key}
+	}
+	expire := func(key string, expiresAt int64) *LogEntry {
+		return &LogEntry{Operation: OperationExpire, Key: key, Value: EncodeExpiry(expiresAt, nil)}
+	}
+	push := func(key string, create bool, item string) *LogEntry {
+		return &LogEntry{Operation: OperationListPushRight, Key: key, Value: EncodeCollectionChange(create, [][]byte{[]byte(item)})}
+	}
+	batch := func(t *testing.T, operations ...BatchOperation) *LogEntry {
+		data, err := EncodeBatch(operations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &LogEntry{Operation: OperationBatch, Value: data}
+	}
+	entry := func(operation LogOperation, key string) string {
+		return fmt.Sprintf("%d %s", operation, key)
+	}
+	const future = 1 << 62
+
+	// The first segment holds every kind of entry; the second deletes keys
+	// written in the first, and a key it writes itself
+	first := func(t *testing.T) []*LogEntry {
+		return []*LogEntry{
+			set("a", "1"),
+			set("b", "1"),
+			set("a", "2"),
+			del("b"),
+			set("c", "1"),
+			expire("c", future),
+			expire("c", future+1),
+			setWithExpiry("d", "1", future),
+			expire("d", 0),
+			set("e", "1"),
+			expire("e", future),
+			set("e", "2"),
+			push("l", true, "x"),
+			push("l", false, "y"),
+			push("l", true, "z"),
+			push("l", false, "w"),
+			batch(t, BatchOperation{Operation: OperationSet, Key: "f", Value: []byte("1")},
+				BatchOperation{Operation: OperationSet, Key: "g", Value: []byte("1")}),
+			set("f", "2"),
+			set("h", "1"),
+		}
+	}
+	second := []*LogEntry{
+		del("a"),
+		set("i", "1"),
+		del("i"),
+		push("l", false, "v"),
+	}
+	active := []*LogEntry{set("j", "1")}
+
+	// What compaction leaves in the first segment, with and without its
+	// deletes
+	firstKept := []string{
+		entry(OperationSet, "a"),
+		entry(OperationSet, "c"),
+		entry(OperationExpire, "c"),
+		entry(OperationSetWithExpiry, "d"),
+		entry(OperationExpire, "d"),
+		entry(OperationSet, "e"),
+		entry(OperationListPushRight, "l"),
+		entry(OperationListPushRight, "l"),
+		entry(OperationSet, "g"),
+		entry(OperationSet, "f"),
+		entry(OperationSet, "h"),
+	}
+	firstKeptWithDelete := append([]string{firstKept[0], entry(OperationDelete, "b")}, firstKept[1:]...)
+	secondKept := []string{
+		entry(OperationDelete, "a"),
+		entry(OperationDelete, "i"),
+		entry(OperationListPushRight, "l"),
+	}
+	secondKeptWithoutDeletes := secondKept[2:]
+
+	tests := []struct {
+		name        string
+		removeFirst bool
+		snapshot    func(segments []segmentInfo) int64 // Position of a snapshot to take, or zero
+		first       []string
+		second      []string
+	}{
+		{
+			name:   "deletes dropped from the first segment only",
+			first:  firstKept,
+			second: secondKept,
+		},
+		{
+			name:     "snapshot inside the first segment",
+			snapshot: func(segments []segmentInfo) int64 { return segments[0].Base + segments[0].Size/2 },
+			first:    firstKeptWithDelete,
+			second:   secondKept,
+		},
+		{
+			name:        "earlier segment removed",
+			removeFirst: true,
+			second:      secondKeptWithoutDeletes,
+		},
+		{
+			name:        "earlier segment removed for a snapshot",
+			removeFirst: true,
+			snapshot:    func(segments []segmentInfo) int64 { return segments[1].Base },
+			second:      secondKept,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			segments := writeSegments(t, dir, first(t), second, active)
+
+			if test.snapshot != nil {
+				err := NewSnapshotter(dir, 1).Save(test.snapshot(segments), func(fn func(entry *SnapshotEntry)) {})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			var position int64
+			if test.removeFirst {
+				err := os.Remove(segments[0].Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				position = segments[1].Base
+			}
+
+			// The snapshots hold nothing, so replaying what is left of the
+			// log gives every key, including those a dropped delete could
+			// bring back
+			before := replayState(t, dir, position)
+
+			log, err := NewLog(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = log.Compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = log.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.removeFirst {
+				if got := segmentEntries(t, segments[0].Path); !reflect.DeepEqual(got, test.first) {
+					t.Errorf("first segment holds %v, want %v", got, test.first)
+				}
+			}
+			if got := segmentEntries(t, segments[1].Path); !reflect.DeepEqual(got, test.second) {
+				t.Errorf("second segment holds %v, want %v", got, test.second)
+			}
+			if got := segmentEntries(t, segments[2].Path); len(got) != len(active) {
+				t.Errorf("active segment holds %v", got)
+			}
+
+			log, err = NewLog(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			if after := replayState(t, dir, position); !reflect.DeepEqual(after, before) {
+				t.Fatalf("replay after compacting and reopening gives\n%v\nwant\n%v", after, before)
+			}
+		})
+	}
+}
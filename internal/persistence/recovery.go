@@ -2,167 +2,334 @@ package persistence
 
 import (
 	"bufio"
-	"encoding/binary"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
-	"path/filepath"
+	"time"
+)
+
+// CorruptionPolicy decides what recovery does with a corrupted entry that
+// is followed by valid ones. A torn write at the very end of the log is
+// always truncated away, whatever the policy.
+type CorruptionPolicy int
+
+const (
+	// CorruptionFail aborts recovery with an error
+	CorruptionFail CorruptionPolicy = iota
+	// CorruptionStop keeps everything before the corruption and discards
+	// the rest of the log, moving it aside into .discarded files
+	CorruptionStop
+	// CorruptionResync skips the damaged bytes and carries on from the next
+	// position at which a valid entry decodes
+	CorruptionResync
 )
 
 // Recovery handles the database recovery from the log
 type Recovery struct {
 	logDir string
+	policy CorruptionPolicy
 }
 
 // NewRecovery creates a new recovery instance
-func NewRecovery(logDir string) *Recovery {
+func NewRecovery(logDir string, policy CorruptionPolicy) *Recovery {
 	return &Recovery{
 		logDir: logDir,
+		policy: policy,
 	}
 }
 
 // RecoverEntries reads the log and returns all valid entries
-func (r *Recovery) RecoverEntries() ([]*LogEntry, error) {
-	logPath := filepath.Join(r.logDir, "database.log")
+func (r *Recovery) RecoverEntries() ([]*LogEntry, *RecoveryReport, error) {
+	return r.RecoverEntriesFrom(0)
+}
+
+// RecoverEntriesFrom returns all valid entries at or after the given log
+// position. It holds the whole log in memory; prefer Replay for large logs.
+func (r *Recovery) RecoverEntriesFrom(position int64) ([]*LogEntry, *RecoveryReport, error) {
+	var entries []*LogEntry
+	report, err := r.Replay(position, func(entry *LogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, report, err
+	}
 	
-	// Check if log file exists
-	if _, err := os.Stat(logPath); os.IsNotExist(err) {
-		// No log file, nothing to recover
-		return nil, nil
+	return entries, report, nil
+}
+
+// Replay decodes the log from the given position, typically the position
+// covered by a snapshot, and passes each valid entry to apply as soon as it
+// is read, so memory use does not grow with the length of the log. An
+// error from apply stops the replay and is returned.
+//
+// Segments are replayed in order. If the position falls inside a compacted
+// segment the whole segment is replayed, so entries a snapshot already
+// holds are applied again. Not every entry is idempotent: expiry changes,
+// batches and collection changes depend on what the key held before. The
+// first two still yield the same state, as the entries before the position
+// are applied again in their original order and expiry changes carry
+// absolute times. Collection changes would be applied twice, so apply must
+// skip those a key already holds; the database does this by ignoring a
+// change whose sequence number is not above the key's version.
+//
+// A torn entry at the end of the log is truncated so that the log can be
+// appended to again; other corruption is handled according to the policy.
+// The report describes what was found and is returned even on failure.
+func (r *Recovery) Replay(position int64, apply func(entry *LogEntry) error) (*RecoveryReport, error) {
+	start := time.Now()
+	report := &RecoveryReport{
+		StartPosition: position,
+		EndPosition:   position,
 	}
+	defer func() { report.Duration = time.Since(start) }()
 	
-	file, err := os.Open(logPath)
+	segments, err := listSegments(r.logDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open log file for recovery: %w", err)
+		return report, err
 	}
-	defer file.Close()
-	
-	reader := bufio.NewReader(file)
 	
-	var entries []*LogEntry
-	var offset int64 = 0
-	
-	for {
-		entry, bytesRead, err := r.readEntry(reader)
-		if err != nil {
-			if err == io.EOF {
-				break // End of file
-			}
-			// Skip corrupted entry and continue
-			fmt.Printf("Warning: Skipping corrupted entry at offset %d: %v\n", offset, err)
-			offset += bytesRead
+	for i, segment := range segments {
+		if segmentEnd(segments, i) <= position {
 			continue
 		}
 		
-		offset += bytesRead
-		entries = append(entries, entry)
+		var offset int64
+		if segment.Base < position && !isRewritten(segments, i) {
+			offset = position - segment.Base
+		}
+		
+		last := i == len(segments)-1
+		stopAt, err := r.recoverSegment(segment, offset, last, report, apply)
+		report.SegmentsScanned++
+		if err != nil {
+			return report, err
+		}
+		
+		if stopAt >= 0 {
+			report.EndPosition = segment.Base + stopAt
+			err = r.discardFrom(segments[i:], stopAt)
+			if err != nil {
+				return report, err
+			}
+			break
+		}
+		report.EndPosition = segmentEnd(segments, i)
 	}
 	
-	return entries, nil
+	return report, nil
 }
 
-// readEntry reads a single entry from the log
-func (r *Recovery) readEntry(reader *bufio.Reader) (*LogEntry, int64, error) {
-	var bytesRead int64 = 0
-	
-	// Read timestamp (8 bytes)
-	timeBytes := make([]byte, 8)
-	n, err := io.ReadFull(reader, timeBytes)
-	bytesRead += int64(n)
-	if err != nil {
-		return nil, bytesRead, err
+// EndPosition returns the logical position just past the end of the log
+func (r *Recovery) EndPosition() (int64, error) {
+	segments, err := listSegments(r.logDir)
+	if err != nil || len(segments) == 0 {
+		return 0, err
 	}
-	timestamp := int64(binary.LittleEndian.Uint64(timeBytes))
 	
-	// Read operation (1 byte)
-	opByte := make([]byte, 1)
-	n, err = io.ReadFull(reader, opByte)
-	bytesRead += int64(n)
+	return segmentEnd(segments, len(segments)-1), nil
+}
+
+// recoverSegment passes the valid entries of one segment from offset
+// onwards to apply, recording scanned bytes and corruption in report. It
+// returns the offset at which the log must be cut off, or -1 if the whole
+// segment is usable.
+func (r *Recovery) recoverSegment(segment segmentInfo, offset int64, last bool, report *RecoveryReport, apply func(entry *LogEntry) error) (int64, error) {
+	file, err := os.Open(segment.Path)
 	if err != nil {
-		return nil, bytesRead, err
+		return -1, fmt.Errorf("failed to open log file for recovery: %w", err)
 	}
-	operation := LogOperation(opByte[0])
+	defer file.Close()
 	
-	// Read key length (2 bytes)
-	keyLenBytes := make([]byte, 2)
-	n, err = io.ReadFull(reader, keyLenBytes)
-	bytesRead += int64(n)
+	// The header tells which codec the records are written with
+	header, headerLen, err := readSegmentHeader(file)
 	if err != nil {
-		return nil, bytesRead, err
+		return -1, err
 	}
-	keyLen := binary.LittleEndian.Uint16(keyLenBytes)
-	
-	// Read key
-	keyBytes := make([]byte, keyLen)
-	n, err = io.ReadFull(reader, keyBytes)
-	bytesRead += int64(n)
+	codec, err := codecFor(header.Version)
 	if err != nil {
-		return nil, bytesRead, err
+		return -1, err
+	}
+	if offset < headerLen {
+		offset = headerLen
 	}
-	key := string(keyBytes)
 	
-	// Read value length (4 bytes)
-	valueLenBytes := make([]byte, 4)
-	n, err = io.ReadFull(reader, valueLenBytes)
-	bytesRead += int64(n)
+	_, err = file.Seek(offset, io.SeekStart)
 	if err != nil {
-		return nil, bytesRead, err
+		return -1, fmt.Errorf("failed to seek log file for recovery: %w", err)
 	}
-	valueLen := binary.LittleEndian.Uint32(valueLenBytes)
 	
-	// Read value (if present)
-	var value []byte
-	if valueLen > 0 {
-		value = make([]byte, valueLen)
-		n, err = io.ReadFull(reader, value)
-		bytesRead += int64(n)
-		if err != nil {
-			return nil, bytesRead, err
+	reader := bufio.NewReader(file)
+	report.BytesScanned += segment.Size - offset
+	
+	for {
+		entry, bytesRead, err := codec.decode(reader, segment.Size-offset)
+		if err == nil {
+			offset += bytesRead
+			err = apply(entry)
+			if err != nil {
+				return -1, err
+			}
+			report.EntriesReplayed++
+			continue
+		}
+		if err == io.EOF {
+			break // End of file
+		}
+		
+		corrupted := CorruptedRange{
+			Segment:  segment.Path,
+			Position: segment.Base + offset,
+			Length:   segment.Size - offset,
+			Reason:   err.Error(),
+		}
+		
+		next := r.resync(file, codec, offset+1, segment.Size)
+		if next < 0 && last {
+			// Nothing valid follows, so this is a write that was torn by
+			// a crash rather than damage to acknowledged data
+			corrupted.Action = ActionTruncated
+			report.Corruptions = append(report.Corruptions, corrupted)
+			return offset, nil
+		}
+		
+		switch r.policy {
+		case CorruptionStop:
+			corrupted.Action = ActionDiscarded
+			report.Corruptions = append(report.Corruptions, corrupted)
+			return offset, nil
+		case CorruptionResync:
+			corrupted.Action = ActionSkipped
+			if next < 0 {
+				report.Corruptions = append(report.Corruptions, corrupted)
+				return -1, nil
+			}
+			corrupted.Length = next - offset
+			report.Corruptions = append(report.Corruptions, corrupted)
+			
+			offset = next
+			_, err = file.Seek(offset, io.SeekStart)
+			if err != nil {
+				return -1, fmt.Errorf("failed to seek log file for recovery: %w", err)
+			}
+			reader.Reset(file)
+		default:
+			if next >= 0 {
+				corrupted.Length = next - offset
+			}
+			corrupted.Action = ActionFailed
+			report.Corruptions = append(report.Corruptions, corrupted)
+			return -1, &CorruptionError{Range: corrupted}
 		}
 	}
 	
-	// Read checksum (4 bytes)
-	checksumBytes := make([]byte, 4)
-	n, err = io.ReadFull(reader, checksumBytes)
-	bytesRead += int64(n)
-	if err != nil {
-		return nil, bytesRead, err
+	return -1, nil
+}
+
+// resync returns the first offset at or after start from which a valid
+// entry decodes, or -1 if there is none before size. An entry only counts
+// if it decodes completely and its checksum matches.
+func (r *Recovery) resync(file *os.File, codec recordCodec, start, size int64) int64 {
+	window := make([]byte, 64*1024)
+	for base := start; base < size; {
+		n, err := file.ReadAt(window[:min(int64(len(window)), size-base)], base)
+		if n == 0 {
+			if err != nil {
+				return -1
+			}
+			continue
+		}
+		
+		// Only try offsets the codec considers possible record starts
+		for i := 0; i < n; {
+			j := codec.nextCandidate(window[i:n])
+			if j < 0 {
+				break
+			}
+			
+			candidate := base + int64(i+j)
+			section := io.NewSectionReader(file, candidate, size-candidate)
+			_, _, err := codec.decode(section, size-candidate)
+			if err == nil {
+				return candidate
+			}
+			i += j + 1
+		}
+		
+		base += int64(n)
 	}
-	checksum := binary.LittleEndian.Uint32(checksumBytes)
+	return -1
+}
+
+// discardFrom cuts the log off at offset within the first of segments and
+// moves every later segment aside. The removed bytes are kept in .discarded
+// files next to the log for inspection.
+func (r *Recovery) discardFrom(segments []segmentInfo, offset int64) error {
+	segment := segments[0]
 	
-	// Create log entry
-	entry := &LogEntry{
-		Timestamp: timestamp,
-		Operation: operation,
-		Key:       key,
-		Value:     value,
-		Checksum:  checksum,
+	if offset < segment.Size {
+		err := saveDiscarded(segment, offset)
+		if err != nil {
+			return err
+		}
+		
+		err = truncateFile(segment.Path, offset)
+		if err != nil {
+			return fmt.Errorf("failed to truncate log segment: %w", err)
+		}
 	}
 	
-	// Validate checksum
-	var data []byte
+	for _, later := range segments[1:] {
+		err := os.Rename(later.Path, later.Path+".discarded")
+		if err != nil {
+			return fmt.Errorf("failed to discard log segment: %w", err)
+		}
+	}
 	
-	// Add timestamp
-	timeBytes = make([]byte, 8)
-	binary.LittleEndian.PutUint64(timeBytes, uint64(entry.Timestamp))
-	data = append(data, timeBytes...)
+	return syncDir(r.logDir)
+}
+
+// saveDiscarded copies the bytes of a segment from offset onwards into a
+// .discarded file
+func saveDiscarded(segment segmentInfo, offset int64) error {
+	source, err := os.Open(segment.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open log segment: %w", err)
+	}
+	defer source.Close()
 	
-	// Add operation
-	data = append(data, byte(entry.Operation))
+	target, err := os.Create(segment.Path + ".discarded")
+	if err != nil {
+		return fmt.Errorf("failed to save discarded log data: %w", err)
+	}
 	
-	// Add key
-	data = append(data, []byte(entry.Key)...)
+	_, err = io.Copy(target, io.NewSectionReader(source, offset, segment.Size-offset))
+	if err == nil {
+		err = target.Sync()
+	}
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save discarded log data: %w", err)
+	}
 	
-	// Add value if present
-	if entry.Value != nil {
-		data = append(data, entry.Value...)
+	return nil
+}
+
+// truncateFile cuts a file down to size and fsyncs it
+func truncateFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 	
-	calculatedChecksum := crc32.ChecksumIEEE(data)
-	if calculatedChecksum != checksum {
-		return nil, bytesRead, fmt.Errorf("checksum mismatch: expected %d, got %d", checksum, calculatedChecksum)
+	err = file.Truncate(size)
+	if err != nil {
+		return err
 	}
 	
-	return entry, bytesRead, nil
+	return file.Sync()
 }
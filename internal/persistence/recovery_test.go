@@ -0,0 +1,243 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testSegments          = 3
+	testEntriesPerSegment = 4
+)
+
+// writeTestLog writes a log of testSegments segments holding
+// testEntriesPerSegment entries each, all of the same size, and returns
+// the segments and the size of an entry
+func writeTestLog(t *testing.T, dir string) ([]segmentInfo, int64) {
+	t.Helper()
+
+	var segments []segmentInfo
+	var base int64
+	var sequence uint64 = 1
+	var recordSize int64
+	for i := 0; i < testSegments; i++ {
+		data := encodeSegmentHeader(segmentHeader{Version: CurrentFormatVersion, BaseSequence: sequence})
+		for j := 0; j < testEntriesPerSegment; j++ {
+			record, err := codecV2{}.encode(&LogEntry{
+				Sequence:  sequence,
+				Timestamp: 1,
+				Operation: OperationSet,
+				Key:       fmt.Sprintf("key-%02d", sequence),
+				Value:     []byte("value"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			recordSize = int64(len(record))
+			data = append(data, record...)
+			sequence++
+		}
+
+		path := filepath.Join(dir, segmentName(base))
+		err := os.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, segmentInfo{Path: path, Base: base, Size: int64(len(data))})
+		base += int64(len(data))
+	}
+	return segments, recordSize
+}
+
+// fileSize returns the size of the file at path, or -1 if there is none
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return -1
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// TestRecoveryPolicies damages a log of three segments in different ways
+// and checks what each corruption policy replays, reports and leaves on
+// disk
+func TestRecoveryPolicies(t *testing.T) {
+	const perSegment = testEntriesPerSegment
+	header := int64(segmentHeaderSize)
+
+	// Outcomes are counted in entries, all of which are the same size
+	type outcome struct {
+		fail     bool
+		replayed int
+		action   CorruptionAction
+		length   int64   // Entries in the corrupted range; -1 for the rest of the segment
+		end      int     // Entries before the position replay ends at, unless it fails
+		sizes    []int64 // Entries left in each segment; -1 if it was moved aside
+	}
+	tests := []struct {
+		name    string
+		segment int
+		entry   int
+		damage  func(t *testing.T, segment segmentInfo, offset, recordSize int64)
+		fail    outcome
+		stop    outcome
+		resync  outcome
+	}{
+		{
+			// A torn write at the end of the log is cut off whatever the
+			// policy
+			name:    "cut mid-entry",
+			segment: 2,
+			entry:   2,
+			damage: func(t *testing.T, segment segmentInfo, offset, recordSize int64) {
+				err := os.Truncate(segment.Path, offset+recordSize/2)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			fail:   outcome{false, 10, ActionTruncated, -1, 10, []int64{4, 4, 2}},
+			stop:   outcome{false, 10, ActionTruncated, -1, 10, []int64{4, 4, 2}},
+			resync: outcome{false, 10, ActionTruncated, -1, 10, []int64{4, 4, 2}},
+		},
+		{
+			name:    "checksum in the tail segment",
+			segment: 2,
+			entry:   1,
+			damage:  flipChecksum,
+			fail:    outcome{true, 9, ActionFailed, 1, 0, []int64{4, 4, 4}},
+			stop:    outcome{false, 9, ActionDiscarded, -1, 9, []int64{4, 4, 1}},
+			resync:  outcome{false, 11, ActionSkipped, 1, 12, []int64{4, 4, 4}},
+		},
+		{
+			name:    "checksum in a middle segment",
+			segment: 1,
+			entry:   1,
+			damage:  flipChecksum,
+			fail:    outcome{true, 5, ActionFailed, 1, 0, []int64{4, 4, 4}},
+			stop:    outcome{false, 5, ActionDiscarded, -1, 5, []int64{4, 1, -1}},
+			resync:  outcome{false, 11, ActionSkipped, 1, 12, []int64{4, 4, 4}},
+		},
+		{
+			// Nothing valid follows in its segment, but later segments do,
+			// so it is not a torn write
+			name:    "checksum at the end of a middle segment",
+			segment: 1,
+			entry:   3,
+			damage:  flipChecksum,
+			fail:    outcome{true, 7, ActionFailed, -1, 0, []int64{4, 4, 4}},
+			stop:    outcome{false, 7, ActionDiscarded, -1, 7, []int64{4, 3, -1}},
+			resync:  outcome{false, 11, ActionSkipped, -1, 12, []int64{4, 4, 4}},
+		},
+	}
+
+	for _, test := range tests {
+		policies := []struct {
+			name   string
+			policy CorruptionPolicy
+			want   outcome
+		}{
+			{"fail", CorruptionFail, test.fail},
+			{"stop", CorruptionStop, test.stop},
+			{"resync", CorruptionResync, test.resync},
+		}
+		for _, policy := range policies {
+			t.Run(test.name+"/"+policy.name, func(t *testing.T) {
+				dir := t.TempDir()
+				segments, recordSize := writeTestLog(t, dir)
+				damaged := segments[test.segment]
+				offset := header + int64(test.entry)*recordSize
+				test.damage(t, damaged, offset, recordSize)
+				size := fileSize(t, damaged.Path)
+				want := policy.want
+
+				var replayed []string
+				report, err := NewRecovery(dir, policy.policy).Replay(0, func(entry *LogEntry) error {
+					replayed = append(replayed, entry.Key)
+					return nil
+				})
+
+				var corruption *CorruptionError
+				if want.fail != errors.As(err, &corruption) {
+					t.Fatalf("Replay: got %v, want failure %v", err, want.fail)
+				}
+				if !want.fail && err != nil {
+					t.Fatal(err)
+				}
+				if len(replayed) != want.replayed || report.EntriesReplayed != want.replayed {
+					t.Fatalf("replayed %d entries, reported %d, want %d", len(replayed), report.EntriesReplayed, want.replayed)
+				}
+				for i, key := range replayed {
+					if i >= test.segment*perSegment+test.entry {
+						break
+					}
+					if key != fmt.Sprintf("key-%02d", i+1) {
+						t.Fatalf("entry %d is %s", i, key)
+					}
+				}
+
+				if len(report.Corruptions) != 1 {
+					t.Fatalf("report holds %d corruptions, want 1: %+v", len(report.Corruptions), report.Corruptions)
+				}
+				corrupted := report.Corruptions[0]
+				wantLength := want.length * recordSize
+				if want.length < 0 {
+					wantLength = size - offset
+				}
+				if corrupted.Action != want.action || corrupted.Segment != damaged.Path ||
+					corrupted.Position != damaged.Base+offset || corrupted.Length != wantLength {
+					t.Fatalf("corruption = %+v, want %v of %d bytes at %d", corrupted, want.action, wantLength, damaged.Base+offset)
+				}
+
+				// Every segment is as long as the first one was
+				segmentSize := segments[0].Size
+				wantEnd := int64(want.end/perSegment) * segmentSize
+				if want.end%perSegment != 0 {
+					wantEnd += header + int64(want.end%perSegment)*recordSize
+				}
+				if !want.fail && report.EndPosition != wantEnd {
+					t.Fatalf("EndPosition = %d, want %d", report.EndPosition, wantEnd)
+				}
+
+				for i, segment := range segments {
+					wantSize := header + want.sizes[i]*recordSize
+					if want.sizes[i] < 0 {
+						wantSize = -1
+					}
+					if got := fileSize(t, segment.Path); got != wantSize {
+						t.Fatalf("segment %d is %d bytes, want %d", i, got, wantSize)
+					}
+					if want.sizes[i] < 0 && fileSize(t, segment.Path+".discarded") != segment.Size {
+						t.Fatalf("segment %d was not moved aside", i)
+					}
+				}
+				if want.action == ActionDiscarded || want.action == ActionTruncated {
+					discarded := fileSize(t, damaged.Path+".discarded")
+					if discarded != size-fileSize(t, damaged.Path) {
+						t.Fatalf("%d bytes kept of %d discarded", discarded, size-fileSize(t, damaged.Path))
+					}
+				}
+			})
+		}
+	}
+}
+
+// flipChecksum damages the checksum of the entry at offset
+func flipChecksum(t *testing.T, segment segmentInfo, offset, recordSize int64) {
+	t.Helper()
+	data, err := os.ReadFile(segment.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset+recordSize-1] ^= 0xff
+	err = os.WriteFile(segment.Path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+package persistence
+
+import (
+	"fmt"
+	"time"
+)
+
+// CorruptionAction records what recovery did about a corrupted range
+type CorruptionAction int
+
+const (
+	// ActionFailed means recovery stopped with an error
+	ActionFailed CorruptionAction = iota
+	// ActionTruncated means a torn tail was cut off the log
+	ActionTruncated
+	// ActionDiscarded means the range and everything after it was moved aside
+	ActionDiscarded
+	// ActionSkipped means replay resumed after the range
+	ActionSkipped
+)
+
+// String returns a readable name for the action
+func (a CorruptionAction) String() string {
+	switch a {
+	case ActionFailed:
+		return "failed"
+	case ActionTruncated:
+		return "truncated"
+	case ActionDiscarded:
+		return "discarded"
+	case ActionSkipped:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// CorruptedRange describes damaged bytes found in the log
+type CorruptedRange struct {
+	Segment  string // Path of the segment file
+	Position int64  // Logical log position of the first damaged byte
+	Length   int64  // Number of bytes affected
+	Reason   string
+	Action   CorruptionAction
+}
+
+// SkippedSnapshot describes a snapshot recovery could not use
+type SkippedSnapshot struct {
+	Path   string
+	Reason string
+}
+
+// RecoveryReport summarizes what happened while recovering from disk
+type RecoveryReport struct {
+	SnapshotPath     string // Empty if recovery started from the log alone
+	SnapshotPosition int64
+	SnapshotEntries  int
+	SkippedSnapshots []SkippedSnapshot
+	StartPosition    int64 // Log position replay started from
+	EndPosition      int64 // Log position replay reached, after any truncation
+	SegmentsScanned  int
+	EntriesReplayed  int
+	BytesScanned     int64
+	Corruptions      []CorruptedRange
+	Duration         time.Duration
+}
+
+// CorruptionError is returned when recovery stops at a corrupted range
+type CorruptionError struct {
+	Range CorruptedRange
+}
+
+// Error implements the error interface
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted entry at position %d in %s: %s", e.Range.Position, e.Range.Segment, e.Range.Reason)
+}
@@ -0,0 +1,271 @@
+package persistence
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+
+	// legacyLogName is the single log file used before segmentation
+	legacyLogName = "database.log"
+)
+
+// segmentInfo describes a log segment on disk. Positions in the log are
+// logical: a segment is named after the position of its first byte, and
+// positions keep increasing across segments.
+type segmentInfo struct {
+	Path string
+	Base int64
+	Size int64
+}
+
+// segmentName builds the file name for a segment starting at base
+func segmentName(base int64) string {
+	return fmt.Sprintf("%s%020d%s", segmentPrefix, base, segmentSuffix)
+}
+
+// segmentEnd returns the logical position just past segment i. Sealed
+// segments end where the next one begins, even if compaction shrank them.
+func segmentEnd(segments []segmentInfo, i int) int64 {
+	if i+1 < len(segments) {
+		return segments[i+1].Base
+	}
+	return segments[i].Base + segments[i].Size
+}
+
+// isRewritten reports whether segment i has been rewritten by compaction or
+// a format upgrade, in which case offsets inside it no longer match logical
+// positions
+func isRewritten(segments []segmentInfo, i int) bool {
+	return segments[i].Size != segmentEnd(segments, i)-segments[i].Base
+}
+
+// listSegments returns the segments in dir ordered by base position. A
+// legacy single-file log is reported as the segment at position zero.
+func listSegments(dir string) ([]segmentInfo, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read log directory: %w", err)
+	}
+
+	var segments []segmentInfo
+	var legacy *segmentInfo
+	for _, file := range files {
+		name := file.Name()
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+
+		if name == legacyLogName {
+			legacy = &segmentInfo{
+				Path: filepath.Join(dir, name),
+				Size: info.Size(),
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		var base int64
+		_, err = fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), "%d", &base)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, segmentInfo{
+			Path: filepath.Join(dir, name),
+			Base: base,
+			Size: info.Size(),
+		})
+	}
+
+	if len(segments) == 0 && legacy != nil {
+		return []segmentInfo{*legacy}, nil
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Base < segments[j].Base
+	})
+
+	return segments, nil
+}
+
+// migrateLegacyLog turns a single-file log into the first segment
+func migrateLegacyLog(dir string) error {
+	legacyPath := filepath.Join(dir, legacyLogName)
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	if len(segments) != 1 || segments[0].Path != legacyPath {
+		return fmt.Errorf("found both %s and log segments", legacyLogName)
+	}
+
+	err = os.Rename(legacyPath, filepath.Join(dir, segmentName(0)))
+	if err != nil {
+		return fmt.Errorf("failed to migrate legacy log: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// rewriteSegment atomically replaces the segment at path with one in the
+// current format holding entries
+func rewriteSegment(path string, baseSequence uint64, entries []*LogEntry) error {
+	tempPath := path + ".rewrite"
+	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create rewritten segment: %w", err)
+	}
+
+	writer := bufio.NewWriter(tempFile)
+	writer.Write(encodeSegmentHeader(segmentHeader{
+		Version:      CurrentFormatVersion,
+		BaseSequence: baseSequence,
+	}))
+	for _, entry := range entries {
+		data, err := codecV2{}.encode(entry)
+		if err == nil {
+			_, err = writer.Write(data)
+		}
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempPath)
+			return fmt.Errorf("failed to write rewritten segment: %w", err)
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write rewritten segment: %w", err)
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace segment: %w", err)
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// upgradeLegacySegments rewrites segments in the headerless version 1
+// format into the current format, numbering their entries in order. If the
+// newest segment is upgraded, an empty segment is first started where it
+// used to end, so that log positions recorded against the old layout, such
+// as those of snapshots, still fall inside the upgraded segment.
+func upgradeLegacySegments(dir string) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	versions := make([]uint16, len(segments))
+	lastLegacy := -1
+	for i, segment := range segments {
+		file, err := os.Open(segment.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open log segment: %w", err)
+		}
+		header, _, err := readSegmentHeader(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		versions[i] = header.Version
+		if header.Version == FormatVersion1 {
+			lastLegacy = i
+		}
+	}
+
+	var sequence uint64 = 1
+	for i := 0; i <= lastLegacy; i++ {
+		segment := segments[i]
+		if versions[i] != FormatVersion1 {
+			// Left over from an interrupted upgrade; keep numbering after it
+			sequence, err = nextSequenceAfter(segment)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Unreadable entries were already dealt with by recovery, if it
+		// ran, so anything that still fails to decode is dropped
+		recovery := NewRecovery(dir, CorruptionResync)
+		var entries []*LogEntry
+		_, err = recovery.recoverSegment(segment, 0, false, &RecoveryReport{}, func(entry *LogEntry) error {
+			entry.Sequence = sequence
+			sequence++
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upgrade log segment: %w", err)
+		}
+
+		baseSequence := sequence - uint64(len(entries))
+		if i == len(segments)-1 && segment.Size > 0 {
+			err = createSegment(dir, segment.Base+segment.Size, sequence)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = rewriteSegment(segment.Path, baseSequence, entries)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade log segment: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// createSegment creates an empty segment holding only its header
+func createSegment(dir string, base int64, baseSequence uint64) error {
+	path := filepath.Join(dir, segmentName(base))
+	err := os.WriteFile(path, encodeSegmentHeader(segmentHeader{
+		Version:      CurrentFormatVersion,
+		BaseSequence: baseSequence,
+	}), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create log segment: %w", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to create log segment: %w", err)
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to sync log segment: %w", err)
+	}
+
+	return syncDir(dir)
+}
@@ -0,0 +1,138 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyFixture is a single-file log written in the version 1 format,
+// holding: set a 1, set b 2, delete a, set c 3
+const legacyFixture = "testdata/database.log"
+
+// copyFixture copies the legacy fixture into dir under name
+func copyFixture(t *testing.T, dir, name string) int64 {
+	t.Helper()
+	data, err := os.ReadFile(legacyFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(data))
+}
+
+// checkUpgraded opens the log in dir and checks that it holds the entries
+// of the legacy fixture, numbered in order, in the current format, and
+// that appending carries on after them
+func checkUpgraded(t *testing.T, dir string) {
+	t.Helper()
+
+	log, err := NewLog(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequence, err := log.Append(OperationSet, "d", []byte("4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != 5 {
+		t.Fatalf("Append after the upgrade numbered its entry %d, want 5", sequence)
+	}
+	err = log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, report, err := NewRecovery(dir, CorruptionFail).RecoverEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corruptions) != 0 {
+		t.Fatalf("recovery found corruption: %+v", report.Corruptions)
+	}
+	want := []struct {
+		operation LogOperation
+		key       string
+		value     string
+	}{
+		{OperationSet, "a", "1"},
+		{OperationSet, "b", "2"},
+		{OperationDelete, "a", ""},
+		{OperationSet, "c", "3"},
+		{OperationSet, "d", "4"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("recovered %d entries, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Sequence != uint64(i+1) || entry.Operation != want[i].operation ||
+			entry.Key != want[i].key || string(entry.Value) != want[i].value {
+			t.Fatalf("entry %d = %+v, want %+v", i, entry, want[i])
+		}
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, segment := range segments {
+		file, err := os.Open(segment.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _, err := readSegmentHeader(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Version != CurrentFormatVersion {
+			t.Fatalf("%s is in format %d after the upgrade", segment.Path, header.Version)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		switch filepath.Ext(file) {
+		case ".rewrite", ".discarded":
+			t.Fatalf("%s left behind", file)
+		}
+		if filepath.Base(file) == legacyLogName {
+			t.Fatalf("%s left behind", file)
+		}
+	}
+}
+
+// TestUpgradeLegacyLog opens a single-file log written in the version 1
+// format
+func TestUpgradeLegacyLog(t *testing.T) {
+	dir := t.TempDir()
+	copyFixture(t, dir, legacyLogName)
+	checkUpgraded(t, dir)
+}
+
+// TestUpgradeInterrupted opens a legacy log whose upgrade was cut short
+// after the empty segment following it was started and partway through
+// writing the rewritten segment
+func TestUpgradeInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	size := copyFixture(t, dir, segmentName(0))
+
+	err := createSegment(dir, size, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := encodeSegmentHeader(segmentHeader{Version: CurrentFormatVersion, BaseSequence: 1})
+	partial = append(partial, recordMagic, 0x40)
+	err = os.WriteFile(filepath.Join(dir, segmentName(0)+".rewrite"), partial, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkUpgraded(t, dir)
+}
@@ -0,0 +1,436 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	snapshotMagic   uint32 = 0x4B565350 // "KVSP"
+	snapshotVersion byte   = 3
+	snapshotPrefix         = "snapshot-"
+	snapshotSuffix         = ".snap"
+)
+
+// SnapshotInfo describes a snapshot file on disk
+type SnapshotInfo struct {
+	Path     string
+	Position int64
+}
+
+// SnapshotEntry is one key stored in a snapshot
+type SnapshotEntry struct {
+	Key       string
+	Value     []byte
+	ExpiresAt int64 // Unix nanoseconds; zero if the key does not expire
+	Version   uint64
+	Type      uint8 // Kind of value, a storage.ValueType; zero for strings
+}
+
+// Entry markers. Version 1 snapshots mark entries that carry an expiry with
+// their own marker; from version 2 on every entry carries its expiry and
+// version, and from version 3 on the type of its value.
+const (
+	snapshotEnd           byte = 0
+	snapshotEntryPlain    byte = 1
+	snapshotEntryExpiring byte = 2
+)
+
+// Snapshotter writes and loads point-in-time copies of the key space. Each
+// snapshot is tagged with the log position it covers, so recovery only has
+// to replay the log from that position onwards.
+type Snapshotter struct {
+	dir    string
+	retain int
+}
+
+// NewSnapshotter creates a snapshotter that keeps the newest retain snapshots
+func NewSnapshotter(dir string, retain int) *Snapshotter {
+	if retain < 1 {
+		retain = 1
+	}
+	return &Snapshotter{
+		dir:    dir,
+		retain: retain,
+	}
+}
+
+// Save writes a snapshot covering the log up to position. The iterate
+// function must call fn once for every key in the database.
+func (s *Snapshotter) Save(position int64, iterate func(fn func(entry *SnapshotEntry))) error {
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	tempPath := filepath.Join(s.dir, "snapshot.tmp")
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+
+	err = WriteSnapshot(file, position, iterate)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	err = os.Rename(tempPath, filepath.Join(s.dir, snapshotName(position)))
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+
+	err = syncDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to sync snapshot directory: %w", err)
+	}
+
+	return s.prune()
+}
+
+// WriteSnapshot serializes a snapshot covering the log up to position: the
+// header, every entry and the trailer. The trailer holds the entry count
+// and a checksum over everything before it. Besides snapshot files, it is
+// used to send a snapshot over a network; the data ends itself, so the
+// reader knows where it stops.
+func WriteSnapshot(w io.Writer, position int64, iterate func(fn func(entry *SnapshotEntry))) error {
+	checksum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	header := make([]byte, 13)
+	binary.LittleEndian.PutUint32(header[0:4], snapshotMagic)
+	header[4] = snapshotVersion
+	binary.LittleEndian.PutUint64(header[5:13], uint64(position))
+	writer.Write(header)
+
+	var count uint64
+	var err error
+	iterate(func(entry *SnapshotEntry) {
+		if err != nil {
+			return
+		}
+		if len(entry.Key) > 65535 {
+			err = fmt.Errorf("key is too long")
+			return
+		}
+		if len(entry.Value) > maxEntrySize {
+			err = fmt.Errorf("value is too long")
+			return
+		}
+
+		// Each entry starts with a marker byte so the reader knows when the
+		// entries end and the trailer begins
+		prefix := make([]byte, 3)
+		prefix[0] = snapshotEntryPlain
+		binary.LittleEndian.PutUint16(prefix[1:3], uint16(len(entry.Key)))
+		writer.Write(prefix)
+		writer.WriteString(entry.Key)
+
+		valueLen := make([]byte, 4)
+		binary.LittleEndian.PutUint32(valueLen, uint32(len(entry.Value)))
+		writer.Write(valueLen)
+		writer.Write(entry.Value)
+
+		suffix := make([]byte, 17)
+		binary.LittleEndian.PutUint64(suffix[0:8], uint64(entry.ExpiresAt))
+		binary.LittleEndian.PutUint64(suffix[8:16], entry.Version)
+		suffix[16] = entry.Type
+		_, err = writer.Write(suffix)
+		count++
+	})
+	if err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 9)
+	binary.LittleEndian.PutUint64(trailer[1:9], count)
+	_, err = writer.Write(trailer)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	checksumBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksumBytes, checksum.Sum32())
+	_, err = w.Write(checksumBytes)
+	return err
+}
+
+// Load applies the newest valid snapshot and returns it along with the
+// snapshots that were passed over. Snapshots that are corrupt or claim a
+// position past logSize are skipped in favour of older ones. If no usable
+// snapshot exists, the returned info is empty and nothing is applied.
+func (s *Snapshotter) Load(logSize int64, apply func(entry *SnapshotEntry)) (SnapshotInfo, []SkippedSnapshot, error) {
+	snapshots, err := s.List()
+	if err != nil {
+		return SnapshotInfo{}, nil, err
+	}
+
+	var skipped []SkippedSnapshot
+
+	// Newest first
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		if snapshot.Position > logSize {
+			skipped = append(skipped, SkippedSnapshot{
+				Path:   snapshot.Path,
+				Reason: "position beyond end of log",
+			})
+			continue
+		}
+
+		// Verify the whole file before applying anything from it
+		err = s.readSnapshot(snapshot, nil)
+		if err != nil {
+			skipped = append(skipped, SkippedSnapshot{
+				Path:   snapshot.Path,
+				Reason: err.Error(),
+			})
+			continue
+		}
+
+		err = s.readSnapshot(snapshot, apply)
+		if err != nil {
+			return SnapshotInfo{}, skipped, fmt.Errorf("failed to load snapshot %s: %w", snapshot.Path, err)
+		}
+
+		return snapshot, skipped, nil
+	}
+
+	return SnapshotInfo{}, skipped, nil
+}
+
+// readSnapshot decodes a snapshot file, passing every entry to apply when it
+// is not nil, and validates the header, entry count and checksum
+func (s *Snapshotter) readSnapshot(snapshot SnapshotInfo, apply func(entry *SnapshotEntry)) error {
+	file, err := os.Open(snapshot.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	position, err := ReadSnapshot(bufio.NewReader(file), apply)
+	if err != nil {
+		return err
+	}
+	if position != snapshot.Position {
+		return fmt.Errorf("snapshot position does not match file name")
+	}
+
+	return nil
+}
+
+// ReadSnapshot decodes a snapshot written by WriteSnapshot, passing every
+// entry to apply when it is not nil, and returns the position it covers.
+// It reads exactly up to the end of the snapshot. Entries are applied as
+// they are read, so callers that must not act on a corrupt snapshot should
+// read it once without apply first or hold on to the entries until it
+// returns.
+func ReadSnapshot(r io.Reader, apply func(entry *SnapshotEntry)) (int64, error) {
+	checksum := crc32.NewIEEE()
+	reader := io.TeeReader(r, checksum)
+
+	header := make([]byte, 13)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != snapshotMagic {
+		return 0, fmt.Errorf("bad snapshot magic")
+	}
+	version := header[4]
+	if version < 1 || version > snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", header[4])
+	}
+	position := int64(binary.LittleEndian.Uint64(header[5:13]))
+
+	var count uint64
+	for {
+		marker := make([]byte, 1)
+		_, err = io.ReadFull(reader, marker)
+		if err != nil {
+			return 0, err
+		}
+		if marker[0] == snapshotEnd {
+			break
+		}
+		if marker[0] != snapshotEntryPlain && (version != 1 || marker[0] != snapshotEntryExpiring) {
+			return 0, fmt.Errorf("bad entry marker %d", marker[0])
+		}
+
+		entry, err := readSnapshotEntry(reader, version, marker[0])
+		if err != nil {
+			return 0, err
+		}
+		if apply != nil {
+			apply(entry)
+		}
+		count++
+	}
+
+	countBytes := make([]byte, 8)
+	_, err = io.ReadFull(reader, countBytes)
+	if err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint64(countBytes) != count {
+		return 0, fmt.Errorf("entry count mismatch")
+	}
+
+	expected := checksum.Sum32()
+	checksumBytes := make([]byte, 4)
+	_, err = io.ReadFull(reader, checksumBytes)
+	if err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(checksumBytes) != expected {
+		return 0, fmt.Errorf("checksum mismatch")
+	}
+
+	return position, nil
+}
+
+// readSnapshotEntry reads one entry following its marker in a snapshot of
+// the given format version. Keys are at most 64 KiB by their encoding, and
+// values longer than maxEntrySize are rejected before they are read.
+func readSnapshotEntry(reader io.Reader, version byte, marker byte) (*SnapshotEntry, error) {
+	keyLenBytes := make([]byte, 2)
+	_, err := io.ReadFull(reader, keyLenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes := make([]byte, binary.LittleEndian.Uint16(keyLenBytes))
+	_, err = io.ReadFull(reader, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	valueLenBytes := make([]byte, 4)
+	_, err = io.ReadFull(reader, valueLenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	valueLen := binary.LittleEndian.Uint32(valueLenBytes)
+	if valueLen > maxEntrySize {
+		return nil, fmt.Errorf("value of %d bytes is too long", valueLen)
+	}
+	value := make([]byte, valueLen)
+	_, err = io.ReadFull(reader, value)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &SnapshotEntry{
+		Key:   string(keyBytes),
+		Value: value,
+	}
+	switch {
+	case version == 1 && marker == snapshotEntryExpiring:
+		expiresAt := make([]byte, 8)
+		_, err = io.ReadFull(reader, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.ExpiresAt = int64(binary.LittleEndian.Uint64(expiresAt))
+	case version >= 2:
+		suffix := make([]byte, 16, 17)
+		if version >= 3 {
+			suffix = suffix[:17]
+		}
+		_, err = io.ReadFull(reader, suffix)
+		if err != nil {
+			return nil, err
+		}
+		entry.ExpiresAt = int64(binary.LittleEndian.Uint64(suffix[0:8]))
+		entry.Version = binary.LittleEndian.Uint64(suffix[8:16])
+		if version >= 3 {
+			entry.Type = suffix[16]
+		}
+	}
+
+	return entry, nil
+}
+
+// List returns the snapshots on disk ordered from oldest to newest
+func (s *Snapshotter) List() ([]SnapshotInfo, error) {
+	return listSnapshots(s.dir)
+}
+
+// prune removes all but the newest retained snapshots
+func (s *Snapshotter) prune() error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(snapshots)-s.retain; i++ {
+		err = os.Remove(snapshots[i].Path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old snapshot: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// listSnapshots finds snapshot files in dir ordered by position
+func listSnapshots(dir string) ([]SnapshotInfo, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+
+	var snapshots []SnapshotInfo
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+
+		var position int64
+		_, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix), "%d", &position)
+		if err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, SnapshotInfo{
+			Path:     filepath.Join(dir, name),
+			Position: position,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Position < snapshots[j].Position
+	})
+
+	return snapshots, nil
+}
+
+// snapshotName builds the file name for a snapshot at position
+func snapshotName(position int64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, position, snapshotSuffix)
+}
@@ -0,0 +1,166 @@
+package raft
+
+import (
+	"fmt"
+	"io"
+)
+
+// runApplier applies committed entries as they are committed, until the
+// node is closed
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.applyWake:
+		case <-n.ctx.Done():
+			return
+		}
+
+		n.applyCommitted()
+	}
+}
+
+// applyCommitted applies every committed entry not applied yet, and then
+// compacts the log if it has grown past the threshold
+func (n *Node) applyCommitted() {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	for {
+		n.mutex.Lock()
+		if n.closed || n.applyErr != nil || n.lastApplied >= n.commitIndex {
+			n.mutex.Unlock()
+			break
+		}
+		count := int(min(n.commitIndex-n.lastApplied, maxApplyEntries))
+		entries := n.store.slice(n.lastApplied+1, count)
+		n.mutex.Unlock()
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			var err error
+			if entry.Type == EntryCommand {
+				err = n.fsm.Apply(entry.Index, entry.Data)
+			}
+
+			n.mutex.Lock()
+			if err != nil {
+				n.applyErr = fmt.Errorf("failed to apply entry %d: %w", entry.Index, err)
+				n.mutex.Unlock()
+				return
+			}
+			n.lastApplied = entry.Index
+			n.resolve(entry)
+			ready := n.role == Leader && entry.Index == n.readyIndex
+			term := n.store.meta.Term
+			n.mutex.Unlock()
+
+			if ready {
+				n.fsm.LeaderReady(term)
+			}
+		}
+	}
+
+	n.compact()
+}
+
+// resolve ends the wait for an applied entry. A different term at the
+// index means the entry waited for was overwritten. The caller must hold
+// the mutex.
+func (n *Node) resolve(entry Entry) {
+	w, ok := n.waiters[entry.Index]
+	if !ok {
+		return
+	}
+	delete(n.waiters, entry.Index)
+
+	if entry.Term == w.term {
+		w.done <- nil
+	} else {
+		w.done <- ErrLeadershipLost
+	}
+}
+
+// compact discards applied entries once there are more than the threshold,
+// keeping the most recent ones for followers that are only just behind.
+// The caller must hold the apply mutex.
+func (n *Node) compact() {
+	n.mutex.Lock()
+	applied := n.lastApplied
+	due := applied-n.store.meta.SnapshotIndex > uint64(n.options.SnapshotThreshold+trailingEntries)
+	n.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	// Every command up to applied must survive a restart before the
+	// entries are gone. Entries after the state machine's last command
+	// are not commands, so nothing is lost with them.
+	_, err := n.fsm.Persisted()
+	if err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	index := applied - trailingEntries
+	term, _ := n.store.term(index)
+	members, _ := n.configAt(index)
+	n.store.compact(index, term, members)
+}
+
+// installSnapshot replaces the state machine with a snapshot sent by the
+// leader, read from r, and discards the log it covers
+func (n *Node) installSnapshot(request *snapshotRequest, r io.Reader) (*snapshotResponse, error) {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return nil, ErrClosed
+	}
+	if request.Term < n.store.meta.Term {
+		defer n.mutex.Unlock()
+		return &snapshotResponse{Term: n.store.meta.Term}, nil
+	}
+	n.observeLeader(request.Term, request.LeaderID)
+	response := &snapshotResponse{Term: n.store.meta.Term}
+	if request.LastIndex <= n.commitIndex {
+		n.mutex.Unlock()
+		return response, nil
+	}
+	// Loading a large snapshot may outlast the election timeout, and the
+	// leader sends nothing else meanwhile
+	n.installing = true
+	n.mutex.Unlock()
+
+	defer func() {
+		n.mutex.Lock()
+		n.installing = false
+		n.resetElectionTimer()
+		n.mutex.Unlock()
+	}()
+
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	err := n.fsm.Restore(request.LastIndex, r)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	err = n.store.compact(request.LastIndex, request.LastTerm, request.Members)
+	if err != nil {
+		return nil, err
+	}
+	n.lastApplied = request.LastIndex
+	n.commitIndex = max(n.commitIndex, request.LastIndex)
+	n.members, n.configIndex = n.latestConfig()
+
+	return response, nil
+}
@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// TestSnapshotInstall checks that a follower that was down while the
+// leader discarded the entries it missed is sent a snapshot, and then
+// carries on from the log
+func TestSnapshotInstall(t *testing.T) {
+	const (
+		writers  = 8
+		commands = 1100 // Enough to go past trailingEntries
+	)
+
+	c := newTestCluster(t, 3, 16)
+	leader := c.leader()
+	var follower string
+	for id := range c.nodes {
+		if id != leader.ID() {
+			follower = id
+			break
+		}
+	}
+	c.stop(follower)
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < commands; i += writers {
+				err := propose(leader, fmt.Sprint(i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	waitFor(t, "the leader to discard applied entries", func() bool {
+		return leader.Status().SnapshotIndex > 0
+	})
+
+	c.restart(follower)
+	err := propose(leader, "last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := c.machines[leader.ID()].applied()
+	if len(want) != commands+1 {
+		t.Fatalf("leader applied %d commands, want %d", len(want), commands+1)
+	}
+	c.waitApplied(want...)
+
+	machine := c.machines[follower]
+	machine.mutex.Lock()
+	restores := machine.restores
+	machine.mutex.Unlock()
+	if restores != 1 {
+		t.Fatalf("follower restored %d snapshots, want 1", restores)
+	}
+	status := c.nodes[follower].Status()
+	if status.SnapshotIndex == 0 || status.LastIndex != leader.Status().LastIndex {
+		t.Fatalf("follower status %+v, want a discarded prefix and the leader's last index %d", status, leader.Status().LastIndex)
+	}
+	if !slices.Equal(machine.applied(), want) {
+		t.Fatal("follower state differs from the leader's")
+	}
+}
@@ -0,0 +1,400 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	logFileName  = "raft.log"
+	metaFileName = "raft.meta"
+
+	// recordHeaderSize is the length and checksum in front of every record
+	recordHeaderSize = 8
+
+	// maxRecordSize bounds a record so a corrupt length is not trusted
+	maxRecordSize = 64 << 20
+)
+
+// EntryType identifies what a log entry holds
+type EntryType uint8
+
+// Entry types
+const (
+	EntryCommand EntryType = iota + 1 // A command for the state machine
+	EntryNoop                         // Appended by every new leader to commit earlier entries
+	EntryConfig                       // The cluster's new membership
+)
+
+// Entry is one entry of the Raft log
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// Member is one server of the cluster
+type Member struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// metadata is the state kept in the meta file: the vote, and where the log
+// starts once a prefix has been discarded
+type metadata struct {
+	Term           uint64   `json:"term"`
+	VotedFor       string   `json:"voted_for,omitempty"`
+	SnapshotIndex  uint64   `json:"snapshot_index"`
+	SnapshotTerm   uint64   `json:"snapshot_term"`
+	SnapshotConfig []Member `json:"snapshot_config"` // Membership as of SnapshotIndex
+}
+
+// logStore keeps the log entries after the last discarded prefix, both in
+// memory and in an append-only file of records. A record is a length and
+// CRC32 of its payload, then the index, term and type of the entry and its
+// data, all integers little-endian. The file is synced before append
+// returns, as Raft requires entries to be durable before they count.
+type logStore struct {
+	dir     string
+	file    *os.File
+	size    int64
+	entries []Entry
+	offsets []int64 // Where each entry's record starts in the file
+	meta    metadata
+}
+
+// openLogStore loads the log in dir, creating it if necessary. A torn or
+// corrupt record at the end of the file is cut off, as it can only be an
+// append that never completed.
+func openLogStore(dir string) (*logStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %w", err)
+	}
+
+	s := &logStore{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, metaFileName))
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, &s.meta)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse raft metadata: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read raft metadata: %w", err)
+	}
+
+	s.file, err = os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+
+	err = s.load()
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load reads every record in the file
+func (s *logStore) load() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		entry, size, err := readRecord(reader)
+		if err != nil {
+			break
+		}
+		// Entries the meta file says were discarded may remain if a
+		// compaction was interrupted before rewriting the file
+		if entry.Index > s.meta.SnapshotIndex {
+			if entry.Index != s.lastIndex()+1 {
+				return fmt.Errorf("raft log skips from index %d to %d", s.lastIndex(), entry.Index)
+			}
+			s.entries = append(s.entries, entry)
+			s.offsets = append(s.offsets, offset)
+		}
+		offset += size
+	}
+
+	s.size = offset
+	err := s.file.Truncate(offset)
+	if err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	_, err = s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readRecord reads one record and returns its entry and size
+func readRecord(r io.Reader) (Entry, int64, error) {
+	var header [recordHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return Entry{}, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[:4])
+	if length < 17 || length > maxRecordSize {
+		return Entry{}, 0, fmt.Errorf("bad record length %d", length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return Entry{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return Entry{}, 0, errors.New("record checksum mismatch")
+	}
+
+	entry := Entry{
+		Index: binary.LittleEndian.Uint64(payload[:8]),
+		Term:  binary.LittleEndian.Uint64(payload[8:16]),
+		Type:  EntryType(payload[16]),
+		Data:  payload[17:],
+	}
+	return entry, recordHeaderSize + int64(length), nil
+}
+
+// appendRecord appends the record for entry to buf
+func appendRecord(buf []byte, entry Entry) []byte {
+	length := 17 + len(entry.Data)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(length))
+	start := len(buf) + 4
+	buf = binary.LittleEndian.AppendUint32(buf, 0)
+	buf = binary.LittleEndian.AppendUint64(buf, entry.Index)
+	buf = binary.LittleEndian.AppendUint64(buf, entry.Term)
+	buf = append(buf, byte(entry.Type))
+	buf = append(buf, entry.Data...)
+	binary.LittleEndian.PutUint32(buf[start-4:], crc32.ChecksumIEEE(buf[start:]))
+	return buf
+}
+
+// firstIndex returns the index of the first entry kept
+func (s *logStore) firstIndex() uint64 {
+	return s.meta.SnapshotIndex + 1
+}
+
+// lastIndex returns the index of the last entry, or of the last discarded
+// one if none are kept
+func (s *logStore) lastIndex() uint64 {
+	return s.meta.SnapshotIndex + uint64(len(s.entries))
+}
+
+// lastTerm returns the term of the last entry
+func (s *logStore) lastTerm() uint64 {
+	if len(s.entries) == 0 {
+		return s.meta.SnapshotTerm
+	}
+	return s.entries[len(s.entries)-1].Term
+}
+
+// term returns the term of the entry at index, or false if it has been
+// discarded or not written yet. The last discarded entry's term is known.
+func (s *logStore) term(index uint64) (uint64, bool) {
+	if index == s.meta.SnapshotIndex {
+		return s.meta.SnapshotTerm, true
+	}
+	if index < s.firstIndex() || index > s.lastIndex() {
+		return 0, false
+	}
+	return s.entries[index-s.firstIndex()].Term, true
+}
+
+// entry returns the entry at index, which must be kept
+func (s *logStore) entry(index uint64) Entry {
+	return s.entries[index-s.firstIndex()]
+}
+
+// slice returns a copy of up to max entries starting at from, which must
+// be kept
+func (s *logStore) slice(from uint64, max int) []Entry {
+	start := int(from - s.firstIndex())
+	end := min(len(s.entries), start+max)
+	if start >= end {
+		return nil
+	}
+	return append([]Entry(nil), s.entries[start:end]...)
+}
+
+// append writes entries, which must follow on from the last one, and syncs
+// them
+func (s *logStore) append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	offsets := make([]int64, len(entries))
+	for i, entry := range entries {
+		if entry.Index != s.lastIndex()+uint64(i)+1 {
+			return fmt.Errorf("raft log append at index %d after %d", entry.Index, s.lastIndex()+uint64(i))
+		}
+		offsets[i] = s.size + int64(len(buf))
+		buf = appendRecord(buf, entry)
+	}
+
+	_, err := s.file.Write(buf)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// Cut off whatever part made it so the file stays whole
+		s.file.Truncate(s.size)
+		s.file.Seek(s.size, io.SeekStart)
+		return fmt.Errorf("failed to write raft log: %w", err)
+	}
+
+	s.size += int64(len(buf))
+	s.entries = append(s.entries, entries...)
+	s.offsets = append(s.offsets, offsets...)
+	return nil
+}
+
+// truncateFrom removes the entry at index and every one after it
+func (s *logStore) truncateFrom(index uint64) error {
+	if index < s.firstIndex() || index > s.lastIndex() {
+		return nil
+	}
+
+	i := int(index - s.firstIndex())
+	offset := s.offsets[i]
+	err := s.file.Truncate(offset)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	_, err = s.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	s.size = offset
+	s.entries = s.entries[:i]
+	s.offsets = s.offsets[:i]
+	return nil
+}
+
+// compact discards the entries up to index, which the state machine has
+// made durable, recording its term and the membership as of it. If the
+// entries after index do not follow on from it, they are all discarded.
+func (s *logStore) compact(index, term uint64, config []Member) error {
+	keep := s.entries[:0:0]
+	if t, ok := s.term(index); ok && t == term && index >= s.meta.SnapshotIndex {
+		keep = s.entries[index-s.meta.SnapshotIndex:]
+	}
+
+	// The meta file goes first: a log file still holding the discarded
+	// entries is fine, one missing entries the meta file claims is not
+	meta := s.meta
+	meta.SnapshotIndex = index
+	meta.SnapshotTerm = term
+	meta.SnapshotConfig = config
+	err := s.saveMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	offsets := make([]int64, len(keep))
+	for i, entry := range keep {
+		offsets[i] = int64(len(buf))
+		buf = appendRecord(buf, entry)
+	}
+
+	path := filepath.Join(s.dir, logFileName)
+	err = writeFileAtomic(path, buf)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite raft log: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen raft log: %w", err)
+	}
+	_, err = file.Seek(int64(len(buf)), io.SeekStart)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = int64(len(buf))
+	s.entries = append([]Entry(nil), keep...)
+	s.offsets = offsets
+	return nil
+}
+
+// setVote records the current term and the vote cast in it
+func (s *logStore) setVote(term uint64, votedFor string) error {
+	if term == s.meta.Term && votedFor == s.meta.VotedFor {
+		return nil
+	}
+	meta := s.meta
+	meta.Term = term
+	meta.VotedFor = votedFor
+	return s.saveMeta(meta)
+}
+
+// saveMeta replaces the meta file
+func (s *logStore) saveMeta(meta metadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(s.dir, metaFileName), data)
+	if err != nil {
+		return fmt.Errorf("failed to write raft metadata: %w", err)
+	}
+	s.meta = meta
+	return nil
+}
+
+// close closes the log file
+func (s *logStore) close() error {
+	return s.file.Close()
+}
+
+// writeFileAtomic replaces the file at path with data, syncing both the
+// file and its directory so that the replacement survives a crash
+func writeFileAtomic(path string, data []byte) error {
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
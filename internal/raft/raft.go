@@ -0,0 +1,932 @@
+// Package raft keeps a replicated state machine consistent across a cluster
+// of servers using the Raft consensus algorithm.
+//
+// Each server runs a Node. The members elect a leader, which appends the
+// commands proposed to it to its log and replicates them to the others;
+// once a majority has stored an entry it is committed, and every member
+// applies committed commands to its state machine in log order. A leader
+// that stops being heard from is replaced after an election timeout.
+//
+// Membership changes one server at a time through configuration entries,
+// which take effect as soon as they are appended. Once the log grows past
+// a threshold, the prefix the state machine has made durable is
+// discarded; members that need discarded entries are sent a snapshot of
+// the state machine instead.
+//
+// Nodes talk to each other over HTTP, with gob-encoded messages.
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often a leader contacts idle followers
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+
+	// DefaultElectionTimeout is how long a follower waits to hear from a
+	// leader before standing for election. The actual wait is randomized
+	// between one and two timeouts so that candidates rarely collide.
+	DefaultElectionTimeout = time.Second
+
+	// DefaultSnapshotThreshold is how many applied entries the log keeps
+	// before its prefix is discarded
+	DefaultSnapshotThreshold = 8192
+
+	// trailingEntries is how many applied entries are kept when the log is
+	// compacted, so that followers just behind need no snapshot
+	trailingEntries = 1024
+
+	// maxAppendEntries bounds the entries sent in one AppendEntries call
+	maxAppendEntries = 512
+
+	// maxApplyEntries bounds the entries applied between checks of the log
+	maxApplyEntries = 256
+)
+
+var (
+	// ErrNotLeader is returned by operations only the leader can carry out
+	ErrNotLeader = errors.New("not the leader")
+
+	// ErrLeaderNotReady is returned by a new leader until it has committed
+	// an entry of its own term, before which it may not have applied every
+	// committed entry
+	ErrLeaderNotReady = fmt.Errorf("%w yet", ErrNotLeader)
+
+	// ErrLeadershipLost is returned when a leader steps down before an
+	// entry it appended is committed. The entry may still be committed by
+	// the next leader.
+	ErrLeadershipLost = errors.New("leadership lost before the entry was committed")
+
+	// ErrMembershipChangePending is returned when a membership change is
+	// asked for before the previous one is committed
+	ErrMembershipChangePending = errors.New("a membership change is already in progress")
+
+	// ErrUnknownMember is returned when removing a server that is not a
+	// member
+	ErrUnknownMember = errors.New("not a member of the cluster")
+
+	// ErrClosed is returned once Close has been called
+	ErrClosed = errors.New("raft node closed")
+)
+
+// NotLeaderError is returned by a follower asked to do what only the leader
+// can. It names the leader, if the follower knows it.
+type NotLeaderError struct {
+	Leader Member
+}
+
+// Error implements the error interface
+func (e *NotLeaderError) Error() string {
+	if e.Leader.ID == "" {
+		return fmt.Sprintf("%v; no leader is known", ErrNotLeader)
+	}
+	return fmt.Sprintf("%v; the leader is %s at %s", ErrNotLeader, e.Leader.ID, e.Leader.Addr)
+}
+
+// Unwrap returns ErrNotLeader
+func (e *NotLeaderError) Unwrap() error {
+	return ErrNotLeader
+}
+
+// StateMachine is what a Node replicates. Apply and Restore are called from
+// one goroutine at a time; Snapshot may be called alongside them.
+type StateMachine interface {
+	// Apply applies a committed command. An error stops the node from
+	// applying anything further.
+	Apply(index uint64, data []byte) error
+
+	// Snapshot writes the state for a follower that needs entries no
+	// longer in the log. It must cover at least every entry applied when
+	// it is called; it may also cover some applied while it runs, as long
+	// as applying those again leaves the same result.
+	Snapshot(w io.Writer) error
+
+	// Restore replaces the state with a snapshot covering the log up to
+	// index
+	Restore(index uint64, r io.Reader) error
+
+	// Persisted makes every applied command durable, and returns the
+	// index of the last one applied. The log is only compacted up to what
+	// survives a restart.
+	Persisted() (uint64, error)
+
+	// LeaderReady is called once this node, as leader for term, has
+	// applied every entry committed before it was elected. Commands
+	// proposed from then on see the latest state.
+	LeaderReady(term uint64)
+}
+
+// Options configures a Node
+type Options struct {
+	ID  string // Unique name of this server
+	Dir string // Where the log and vote are kept
+
+	// Bootstrap lists the members of a new cluster, this one included. It
+	// is only used when Dir holds no state yet, and must be the same on
+	// every founding member. Servers joining later leave it empty and are
+	// added through the leader.
+	Bootstrap []Member
+
+	HeartbeatInterval time.Duration // Zero means DefaultHeartbeatInterval
+	ElectionTimeout   time.Duration // Zero means DefaultElectionTimeout
+	SnapshotThreshold int           // Zero means DefaultSnapshotThreshold
+}
+
+// Role is the part a node plays in the cluster
+type Role int
+
+// Roles
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+// String returns the name of the role
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// Status describes a node
+type Status struct {
+	ID            string     `json:"id"`
+	Role          Role       `json:"role"`
+	Term          uint64     `json:"term"`
+	Leader        Member     `json:"leader"`
+	CommitIndex   uint64     `json:"commit_index"`
+	AppliedIndex  uint64     `json:"applied_index"`
+	LastIndex     uint64     `json:"last_index"`
+	SnapshotIndex uint64     `json:"snapshot_index"` // Last entry discarded from the log
+	Members       []Member   `json:"members"`
+	Followers     []Progress `json:"followers,omitempty"` // Only reported by the leader
+	Error         string     `json:"error,omitempty"`     // Why applying stopped
+}
+
+// Progress describes how far the leader has replicated to a follower
+type Progress struct {
+	ID          string    `json:"id"`
+	MatchIndex  uint64    `json:"match_index"`
+	LastContact time.Time `json:"last_contact"`
+}
+
+// Node is one member of a Raft cluster
+type Node struct {
+	id      string
+	options Options
+	fsm     StateMachine
+
+	mutex            sync.Mutex
+	store            *logStore
+	role             Role
+	leaderID         string
+	lastContact      time.Time // When the leader was last heard from
+	electionDeadline time.Time
+	commitIndex      uint64
+	lastApplied      uint64
+	members          []Member
+	configIndex      uint64 // Index of the entry holding members, zero if it was discarded
+	votes            map[string]bool
+	peers            map[string]*peer // Followers, while leader
+	readyIndex       uint64           // Index of the leader's first entry of its term
+	waiters          map[uint64]*waiter
+	installing       bool
+	applyErr         error
+	closed           bool
+	server           *http.Server
+
+	// applyMutex keeps snapshots from being restored while entries are
+	// applied
+	applyMutex sync.Mutex
+	applyWake  chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// peer is the leader's view of a follower
+type peer struct {
+	member      Member
+	nextIndex   uint64
+	matchIndex  uint64
+	lastContact time.Time
+	wake        chan struct{}
+	stop        chan struct{}
+}
+
+// waiter is a proposal waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// NewNode opens the node's state in options.Dir and starts it. It does not
+// accept calls from other members until Serve is called.
+func NewNode(options Options, fsm StateMachine) (*Node, error) {
+	if options.ID == "" {
+		return nil, errors.New("raft node needs an ID")
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if options.ElectionTimeout <= 0 {
+		options.ElectionTimeout = DefaultElectionTimeout
+	}
+	if options.SnapshotThreshold <= 0 {
+		options.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+
+	store, err := openLogStore(options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		id:        options.ID,
+		options:   options,
+		fsm:       fsm,
+		store:     store,
+		waiters:   make(map[uint64]*waiter),
+		applyWake: make(chan struct{}, 1),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	err = n.bootstrap()
+	if err == nil {
+		err = n.restoreApplied()
+	}
+	if err != nil {
+		store.close()
+		return nil, err
+	}
+	n.members, n.configIndex = n.latestConfig()
+	n.resetElectionTimer()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.runApplier()
+
+	return n, nil
+}
+
+// bootstrap writes the founding membership to a new log
+func (n *Node) bootstrap() error {
+	if len(n.options.Bootstrap) == 0 || n.store.meta.Term != 0 || n.store.lastIndex() != 0 {
+		return nil
+	}
+
+	found := false
+	for _, member := range n.options.Bootstrap {
+		found = found || member.ID == n.id
+	}
+	if !found {
+		return fmt.Errorf("bootstrap members do not include %s", n.id)
+	}
+
+	data, err := json.Marshal(n.options.Bootstrap)
+	if err != nil {
+		return err
+	}
+	err = n.store.setVote(1, "")
+	if err != nil {
+		return err
+	}
+	return n.store.append([]Entry{{Index: 1, Term: 1, Type: EntryConfig, Data: data}})
+}
+
+// restoreApplied picks up from the last entry the state machine kept
+// across the restart. Entries after it are applied again once the node
+// learns they are committed.
+func (n *Node) restoreApplied() error {
+	persisted, err := n.fsm.Persisted()
+	if err != nil {
+		return err
+	}
+	if persisted > n.store.lastIndex() {
+		return fmt.Errorf("state machine has applied index %d, beyond the raft log's last index %d", persisted, n.store.lastIndex())
+	}
+
+	n.lastApplied = max(persisted, n.store.meta.SnapshotIndex)
+	n.commitIndex = n.lastApplied
+	return nil
+}
+
+// Serve answers other members on listener until Close is called, and then
+// returns ErrClosed
+func (n *Node) Serve(listener net.Listener) error {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		listener.Close()
+		return ErrClosed
+	}
+	server := &http.Server{Handler: n.handler()}
+	n.server = server
+	n.mutex.Unlock()
+
+	err := server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ErrClosed
+	}
+	return err
+}
+
+// ID returns the node's ID
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Status describes the node
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	status := Status{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.store.meta.Term,
+		Leader:        n.member(n.leaderID),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		LastIndex:     n.store.lastIndex(),
+		SnapshotIndex: n.store.meta.SnapshotIndex,
+		Members:       append([]Member(nil), n.members...),
+	}
+	for _, member := range n.members {
+		if p, ok := n.peers[member.ID]; ok {
+			status.Followers = append(status.Followers, Progress{
+				ID:          member.ID,
+				MatchIndex:  p.matchIndex,
+				LastContact: p.lastContact,
+			})
+		}
+	}
+	if n.applyErr != nil {
+		status.Error = n.applyErr.Error()
+	}
+	return status
+}
+
+// Propose appends a command to the log and waits until it is applied on
+// this node, returning its index. It fails with ErrNotLeader unless this
+// node is the leader for term, which must be one LeaderReady was called
+// with. If the context ends or ErrLeadershipLost is returned, the command
+// may still be committed later.
+func (n *Node) Propose(ctx context.Context, term uint64, data []byte) (uint64, error) {
+	n.mutex.Lock()
+	err := n.checkLeader()
+	if err == nil && n.store.meta.Term != term {
+		err = ErrLeaderNotReady
+	}
+	if err != nil {
+		n.mutex.Unlock()
+		return 0, err
+	}
+
+	index, err := n.appendAsLeader(EntryCommand, data)
+	if err != nil {
+		n.mutex.Unlock()
+		return 0, err
+	}
+	w := n.addWaiter(index)
+	n.mutex.Unlock()
+
+	return index, n.wait(ctx, index, w)
+}
+
+// AddMember adds a server to the cluster, waiting until the change is
+// applied on this node. The server should be started without bootstrap
+// members; the leader then brings it up to date.
+func (n *Node) AddMember(ctx context.Context, member Member) error {
+	if member.ID == "" || member.Addr == "" {
+		return errors.New("member needs an ID and an address")
+	}
+
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		for _, existing := range members {
+			if existing.ID == member.ID {
+				if existing.Addr == member.Addr {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("%s is already a member at %s", member.ID, existing.Addr)
+			}
+		}
+		return append(members, member), nil
+	})
+}
+
+// RemoveMember removes a server from the cluster, waiting until the change
+// is applied on this node. A leader removing itself steps down once the
+// change is committed. The removed server no longer hears from the leader
+// and should be shut down.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		for i, existing := range members {
+			if existing.ID == id {
+				return append(members[:i], members[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMember, id)
+	})
+}
+
+// changeMembers appends the membership change returns, unless it returns
+// nil for no change. Only one change may be in progress at a time, and
+// none before the leader has committed an entry of its term.
+func (n *Node) changeMembers(ctx context.Context, change func(members []Member) ([]Member, error)) error {
+	n.mutex.Lock()
+	err := n.checkLeader()
+	if err == nil && n.commitIndex < n.readyIndex {
+		err = ErrLeaderNotReady
+	}
+	if err == nil && n.configIndex > n.commitIndex {
+		err = ErrMembershipChangePending
+	}
+	if err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+
+	members, err := change(append([]Member(nil), n.members...))
+	if err != nil || members == nil {
+		n.mutex.Unlock()
+		return err
+	}
+	if len(members) == 0 {
+		n.mutex.Unlock()
+		return errors.New("cannot remove the last member")
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	index, err := n.appendAsLeader(EntryConfig, data)
+	if err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	w := n.addWaiter(index)
+	n.mutex.Unlock()
+
+	return n.wait(ctx, index, w)
+}
+
+// Close stops the node. The state machine is left as it is.
+func (n *Node) Close() error {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.cancel()
+	n.stopPeers()
+	n.failWaiters(0, ErrClosed)
+	server := n.server
+	n.mutex.Unlock()
+
+	if server != nil {
+		server.Close()
+	}
+	n.wg.Wait()
+
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.store.close()
+}
+
+// checkLeader returns an error unless the node is an open leader. The
+// caller must hold the mutex.
+func (n *Node) checkLeader() error {
+	if n.closed {
+		return ErrClosed
+	}
+	if n.role != Leader {
+		return &NotLeaderError{Leader: n.member(n.leaderID)}
+	}
+	return nil
+}
+
+// member returns the member with id, or a zero Member. The caller must
+// hold the mutex.
+func (n *Node) member(id string) Member {
+	for _, member := range n.members {
+		if member.ID == id {
+			return member
+		}
+	}
+	return Member{ID: id}
+}
+
+// isMember reports whether id is a member. The caller must hold the mutex.
+func (n *Node) isMember(id string) bool {
+	for _, member := range n.members {
+		if member.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// latestConfig returns the membership in the last configuration entry of
+// the log, or the one recorded with the discarded prefix, along with the
+// entry's index. The caller must hold the mutex.
+func (n *Node) latestConfig() ([]Member, uint64) {
+	return n.configAt(n.store.lastIndex())
+}
+
+// configAt returns the membership as of index. The caller must hold the
+// mutex.
+func (n *Node) configAt(index uint64) ([]Member, uint64) {
+	for i := min(index, n.store.lastIndex()); i >= n.store.firstIndex() && i > 0; i-- {
+		entry := n.store.entry(i)
+		if entry.Type != EntryConfig {
+			continue
+		}
+		var members []Member
+		if json.Unmarshal(entry.Data, &members) == nil {
+			return members, i
+		}
+	}
+	return n.store.meta.SnapshotConfig, 0
+}
+
+// appendLocal appends entries to the log, and picks up any membership
+// change among them. The caller must hold the mutex.
+func (n *Node) appendLocal(entries []Entry) error {
+	err := n.store.append(entries)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Type == EntryConfig {
+			n.members, n.configIndex = n.latestConfig()
+			if n.role == Leader {
+				n.syncPeers()
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// appendAsLeader appends an entry of the leader's term and starts
+// replicating it. The caller must hold the mutex.
+func (n *Node) appendAsLeader(entryType EntryType, data []byte) (uint64, error) {
+	entry := Entry{Index: n.store.lastIndex() + 1, Term: n.store.meta.Term, Type: entryType, Data: data}
+	err := n.appendLocal([]Entry{entry})
+	if err != nil {
+		return 0, err
+	}
+
+	n.advanceCommit()
+	for _, p := range n.peers {
+		notify(p.wake)
+	}
+
+	return entry.Index, nil
+}
+
+// addWaiter registers a wait for the entry the leader just appended at
+// index. The caller must hold the mutex, and must not have released it
+// since appending, so that the entry cannot have been applied yet.
+func (n *Node) addWaiter(index uint64) *waiter {
+	w := &waiter{term: n.store.meta.Term, done: make(chan error, 1)}
+	n.waiters[index] = w
+	return w
+}
+
+// wait waits for the entry at index to be applied
+func (n *Node) wait(ctx context.Context, index uint64, w *waiter) error {
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		n.mutex.Lock()
+		if n.waiters[index] == w {
+			delete(n.waiters, index)
+		}
+		n.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// failWaiters ends the waits for entries after index with err. The caller
+// must hold the mutex.
+func (n *Node) failWaiters(index uint64, err error) {
+	for i, w := range n.waiters {
+		if i > index {
+			w.done <- err
+			delete(n.waiters, i)
+		}
+	}
+}
+
+// resetElectionTimer picks a new random election deadline. The caller
+// must hold the mutex.
+func (n *Node) resetElectionTimer() {
+	timeout := n.options.ElectionTimeout
+	n.electionDeadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+// run drives elections, and the leader's check that it can still reach a
+// majority, until the node is closed
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.options.ElectionTimeout / 20)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.ctx.Done():
+			return
+		}
+
+		n.mutex.Lock()
+		switch {
+		case n.closed:
+		case n.role == Leader:
+			n.checkQuorum()
+		case !n.installing && n.isMember(n.id) && time.Now().After(n.electionDeadline):
+			n.startElection()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// checkQuorum steps down a leader that has not heard from a majority
+// within an election timeout, as it has most likely been replaced. The
+// caller must hold the mutex.
+func (n *Node) checkQuorum() {
+	cutoff := time.Now().Add(-n.options.ElectionTimeout)
+	reached := make(map[string]bool, len(n.members))
+	reached[n.id] = true
+	for id, p := range n.peers {
+		reached[id] = p.lastContact.After(cutoff)
+	}
+	if !n.hasQuorum(reached) {
+		n.stepDown(n.store.meta.Term)
+	}
+}
+
+// hasQuorum reports whether the members in set make up a majority. The
+// caller must hold the mutex.
+func (n *Node) hasQuorum(set map[string]bool) bool {
+	count := 0
+	for _, member := range n.members {
+		if set[member.ID] {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+// startElection stands for election in the next term. The caller must
+// hold the mutex.
+func (n *Node) startElection() {
+	n.resetElectionTimer()
+	term := n.store.meta.Term + 1
+	err := n.store.setVote(term, n.id)
+	if err != nil {
+		return
+	}
+
+	n.role = Candidate
+	n.leaderID = ""
+	n.votes = map[string]bool{n.id: true}
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+		return
+	}
+
+	request := &voteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.store.lastIndex(),
+		LastLogTerm:  n.store.lastTerm(),
+	}
+	for _, member := range n.members {
+		if member.ID != n.id {
+			go n.requestVote(member, request)
+		}
+	}
+}
+
+// requestVote asks member for its vote and counts it
+func (n *Node) requestVote(member Member, request *voteRequest) {
+	var response voteResponse
+	err := n.call(member.Addr, pathVote, request, &response)
+	if err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.closed {
+		return
+	}
+	if response.Term > n.store.meta.Term {
+		n.stepDown(response.Term)
+		return
+	}
+	if n.role != Candidate || n.store.meta.Term != request.Term || !response.Granted {
+		return
+	}
+
+	n.votes[member.ID] = true
+	if n.hasQuorum(n.votes) {
+		n.becomeLeader()
+	}
+}
+
+// becomeLeader takes over as leader and appends an empty entry, whose
+// commitment commits every earlier entry. The caller must hold the mutex.
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leaderID = n.id
+	n.votes = nil
+	n.peers = make(map[string]*peer)
+	n.syncPeers()
+
+	index, err := n.appendAsLeader(EntryNoop, nil)
+	if err != nil {
+		n.stepDown(n.store.meta.Term)
+		return
+	}
+	n.readyIndex = index
+}
+
+// stepDown makes the node a follower, moving on to term if it is newer.
+// The caller must hold the mutex.
+func (n *Node) stepDown(term uint64) {
+	if term > n.store.meta.Term {
+		err := n.store.setVote(term, "")
+		if err != nil {
+			return
+		}
+		n.leaderID = ""
+	}
+
+	if n.role == Leader {
+		// Committed entries are still applied, and their waits end then
+		n.stopPeers()
+		n.failWaiters(n.commitIndex, ErrLeadershipLost)
+		n.readyIndex = 0
+		n.leaderID = ""
+	}
+	n.role = Follower
+	n.votes = nil
+}
+
+// observeLeader records a call from the leader of term. The caller must
+// hold the mutex.
+func (n *Node) observeLeader(term uint64, leaderID string) {
+	if term > n.store.meta.Term || n.role != Follower {
+		n.stepDown(term)
+	}
+	n.leaderID = leaderID
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+}
+
+// handleVote answers a candidate's request for a vote. The caller must
+// hold the mutex.
+func (n *Node) handleVote(request *voteRequest) *voteResponse {
+	if n.closed {
+		return &voteResponse{Term: n.store.meta.Term}
+	}
+
+	// A server that has recently heard from a leader ignores candidates,
+	// so that one removed from the cluster cannot disrupt it
+	if n.role == Leader || (n.leaderID != "" && time.Since(n.lastContact) < n.options.ElectionTimeout) {
+		return &voteResponse{Term: n.store.meta.Term}
+	}
+
+	if request.Term < n.store.meta.Term {
+		return &voteResponse{Term: n.store.meta.Term}
+	}
+	if request.Term > n.store.meta.Term {
+		n.stepDown(request.Term)
+	}
+
+	response := &voteResponse{Term: n.store.meta.Term}
+	votedFor := n.store.meta.VotedFor
+	upToDate := request.LastLogTerm > n.store.lastTerm() ||
+		(request.LastLogTerm == n.store.lastTerm() && request.LastLogIndex >= n.store.lastIndex())
+	if (votedFor == "" || votedFor == request.CandidateID) && upToDate {
+		err := n.store.setVote(request.Term, request.CandidateID)
+		if err == nil {
+			response.Granted = true
+			n.resetElectionTimer()
+		}
+	}
+
+	return response
+}
+
+// handleAppend answers the leader's AppendEntries call. The caller must
+// hold the mutex.
+func (n *Node) handleAppend(request *appendRequest) *appendResponse {
+	if n.closed || request.Term < n.store.meta.Term {
+		return &appendResponse{Term: n.store.meta.Term}
+	}
+	n.observeLeader(request.Term, request.LeaderID)
+	response := &appendResponse{Term: n.store.meta.Term}
+
+	// Entries already discarded are committed, so they match
+	prevIndex, prevTerm, entries := request.PrevLogIndex, request.PrevLogTerm, request.Entries
+	if prevIndex < n.store.meta.SnapshotIndex {
+		skip := min(n.store.meta.SnapshotIndex-prevIndex, uint64(len(entries)))
+		entries = entries[skip:]
+		prevIndex, prevTerm = n.store.meta.SnapshotIndex, n.store.meta.SnapshotTerm
+	}
+
+	if prevIndex > n.store.lastIndex() {
+		response.ConflictIndex = n.store.lastIndex() + 1
+		return response
+	}
+	if term, _ := n.store.term(prevIndex); term != prevTerm {
+		response.ConflictTerm = term
+		response.ConflictIndex = prevIndex
+		for response.ConflictIndex > n.store.firstIndex() {
+			if t, _ := n.store.term(response.ConflictIndex - 1); t != term {
+				break
+			}
+			response.ConflictIndex--
+		}
+		return response
+	}
+
+	// Keep the entries that match and replace the rest, never cutting off
+	// what is already in the log when a delayed, shorter call arrives
+	for i, entry := range entries {
+		if entry.Index <= n.store.lastIndex() {
+			if term, _ := n.store.term(entry.Index); term == entry.Term {
+				continue
+			}
+			if entry.Index <= n.commitIndex {
+				return response
+			}
+			err := n.store.truncateFrom(entry.Index)
+			if err != nil {
+				return response
+			}
+			n.members, n.configIndex = n.latestConfig()
+		}
+
+		err := n.appendLocal(entries[i:])
+		if err != nil {
+			response.ConflictIndex = n.store.lastIndex() + 1
+			return response
+		}
+		break
+	}
+
+	last := prevIndex + uint64(len(entries))
+	if request.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		n.commitIndex = min(request.LeaderCommit, last)
+		notify(n.applyWake)
+	}
+
+	response.Success = true
+	return response
+}
+
+// notify wakes whoever waits on a channel of capacity one, without
+// blocking
+func notify(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,567 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Timings of the test clusters, short enough for elections to take a
+// fraction of a second
+const (
+	testHeartbeatInterval = 20 * time.Millisecond
+	testElectionTimeout   = 200 * time.Millisecond
+)
+
+// testMachine is a state machine that records the commands applied to it
+// by index, so that applying one again, as after a snapshot covering more
+// than it claims, changes nothing
+type testMachine struct {
+	mutex    sync.Mutex
+	index    uint64
+	commands map[uint64]string
+	restores int
+	ready    uint64 // Term LeaderReady was last called with
+}
+
+// testSnapshot is what testMachine's snapshots hold
+type testSnapshot struct {
+	Index    uint64
+	Commands map[uint64]string
+}
+
+func newTestMachine() *testMachine {
+	return &testMachine{commands: make(map[uint64]string)}
+}
+
+func (m *testMachine) Apply(index uint64, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.index = index
+	m.commands[index] = string(data)
+	return nil
+}
+
+func (m *testMachine) Snapshot(w io.Writer) error {
+	m.mutex.Lock()
+	snapshot := testSnapshot{Index: m.index, Commands: maps.Clone(m.commands)}
+	m.mutex.Unlock()
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+func (m *testMachine) Restore(index uint64, r io.Reader) error {
+	var snapshot testSnapshot
+	err := json.NewDecoder(r).Decode(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.index = max(index, snapshot.Index)
+	m.commands = snapshot.Commands
+	m.restores++
+	return nil
+}
+
+func (m *testMachine) Persisted() (uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.index, nil
+}
+
+func (m *testMachine) LeaderReady(term uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.ready = term
+}
+
+// applied returns the commands applied, in log order
+func (m *testMachine) applied() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var commands []string
+	for _, index := range slices.Sorted(maps.Keys(m.commands)) {
+		commands = append(commands, m.commands[index])
+	}
+	return commands
+}
+
+// readyTerm returns the term LeaderReady was last called with
+func (m *testMachine) readyTerm() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.ready
+}
+
+// testCluster runs nodes in one process, talking to each other over
+// loopback TCP
+type testCluster struct {
+	t                 *testing.T
+	snapshotThreshold int
+	nodes             map[string]*Node
+	machines          map[string]*testMachine
+	members           map[string]Member // Every node started, running or not
+	dirs              map[string]string
+}
+
+// newTestCluster bootstraps and starts a cluster of size nodes, named n1,
+// n2 and so on. A snapshotThreshold of zero keeps the default.
+func newTestCluster(t *testing.T, size, snapshotThreshold int) *testCluster {
+	c := &testCluster{
+		t:                 t,
+		snapshotThreshold: snapshotThreshold,
+		nodes:             make(map[string]*Node),
+		machines:          make(map[string]*testMachine),
+		members:           make(map[string]Member),
+		dirs:              make(map[string]string),
+	}
+
+	var bootstrap []Member
+	listeners := make([]net.Listener, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		bootstrap = append(bootstrap, Member{ID: fmt.Sprint("n", i+1), Addr: listener.Addr().String()})
+	}
+	for i, member := range bootstrap {
+		c.start(member.ID, listeners[i], bootstrap)
+	}
+	return c
+}
+
+// start runs a node with a new state machine on listener until the test
+// ends or it is stopped. A node started before keeps its Raft state.
+func (c *testCluster) start(id string, listener net.Listener, bootstrap []Member) *Node {
+	c.t.Helper()
+
+	dir, ok := c.dirs[id]
+	if !ok {
+		dir = c.t.TempDir()
+		c.dirs[id] = dir
+	}
+	machine := newTestMachine()
+	node, err := NewNode(Options{
+		ID:                id,
+		Dir:               dir,
+		Bootstrap:         bootstrap,
+		HeartbeatInterval: testHeartbeatInterval,
+		ElectionTimeout:   testElectionTimeout,
+		SnapshotThreshold: c.snapshotThreshold,
+	}, machine)
+	if err != nil {
+		listener.Close()
+		c.t.Fatal(err)
+	}
+	go node.Serve(listener)
+	c.t.Cleanup(func() {
+		node.Close()
+	})
+
+	c.nodes[id] = node
+	c.machines[id] = machine
+	c.members[id] = Member{ID: id, Addr: listener.Addr().String()}
+	return node
+}
+
+// join starts a node that has no state and is not yet a member
+func (c *testCluster) join(id string) Member {
+	c.t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.start(id, listener, nil)
+	return c.members[id]
+}
+
+// restart starts a stopped node again on its old address
+func (c *testCluster) restart(id string) {
+	c.t.Helper()
+	listener, err := net.Listen("tcp", c.members[id].Addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.start(id, listener, nil)
+}
+
+// stop closes a node, which keeps its Raft state for a restart
+func (c *testCluster) stop(id string) {
+	c.nodes[id].Close()
+	delete(c.nodes, id)
+	delete(c.machines, id)
+}
+
+// leader waits until exactly one running node leads and is ready for
+// proposals, and returns it
+func (c *testCluster) leader() *Node {
+	c.t.Helper()
+
+	var leader *Node
+	waitFor(c.t, "a leader", func() bool {
+		leader = nil
+		for id, node := range c.nodes {
+			status := node.Status()
+			if status.Role != Leader || c.machines[id].readyTerm() != status.Term {
+				continue
+			}
+			if leader != nil {
+				return false
+			}
+			leader = node
+		}
+		return leader != nil
+	})
+	return leader
+}
+
+// waitApplied waits until every running node has applied exactly want
+func (c *testCluster) waitApplied(want ...string) {
+	c.t.Helper()
+	waitFor(c.t, fmt.Sprintf("every node to apply %q", want), func() bool {
+		for _, machine := range c.machines {
+			if !slices.Equal(machine.applied(), want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitMembers waits until every running node sees the members listed
+func (c *testCluster) waitMembers(ids ...string) {
+	c.t.Helper()
+	slices.Sort(ids)
+	waitFor(c.t, fmt.Sprintf("every node to see members %v", ids), func() bool {
+		for _, node := range c.nodes {
+			var members []string
+			for _, member := range node.Status().Members {
+				members = append(members, member.ID)
+			}
+			slices.Sort(members)
+			if !slices.Equal(members, ids) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// propose proposes a command to the leader and waits for it to be applied
+// there
+func propose(leader *Node, command string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := leader.Propose(ctx, leader.Status().Term, []byte(command))
+	return err
+}
+
+// waitFor fails the test if condition does not hold within a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestElection checks that a cluster elects a leader every member follows,
+// and elects another in a later term once the leader is gone
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	term := leader.Status().Term
+	waitFor(t, "every node to follow the leader", func() bool {
+		for _, node := range c.nodes {
+			status := node.Status()
+			if status.Leader.ID != leader.ID() || status.Term != term {
+				return false
+			}
+		}
+		return true
+	})
+
+	err := propose(leader, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied("a")
+
+	// A follower turns proposals away and names the leader
+	for _, node := range c.nodes {
+		if node == leader {
+			continue
+		}
+		_, err = node.Propose(context.Background(), term, []byte("x"))
+		var notLeader *NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader.ID != leader.ID() {
+			t.Fatalf("Propose on a follower: got %v, want a NotLeaderError naming %s", err, leader.ID())
+		}
+	}
+
+	c.stop(leader.ID())
+	next := c.leader()
+	if next.Status().Term <= term {
+		t.Fatalf("new leader has term %d, want one after %d", next.Status().Term, term)
+	}
+
+	err = propose(next, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied("a", "b")
+}
+
+// TestHandleVote checks that a vote is only granted to a candidate whose
+// log is at least as up to date, and to one candidate per term
+func TestHandleVote(t *testing.T) {
+	// A node that is not a member never stands for election itself
+	node, err := NewNode(Options{ID: "n1", Dir: t.TempDir(), ElectionTimeout: testElectionTimeout}, newTestMachine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	node.mutex.Lock()
+	node.handleAppend(&appendRequest{Term: 2, LeaderID: "leader", Entries: testEntries(1, 1, 2)})
+	node.mutex.Unlock()
+
+	// Candidates are ignored while the leader is still heard from
+	vote := func(request voteRequest) *voteResponse {
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		return node.handleVote(&request)
+	}
+	if response := vote(voteRequest{Term: 3, CandidateID: "a", LastLogIndex: 2, LastLogTerm: 2}); response.Granted {
+		t.Fatal("vote granted while the leader is heard from")
+	}
+	time.Sleep(testElectionTimeout)
+
+	tests := []struct {
+		name    string
+		request voteRequest
+		granted bool
+		term    uint64
+	}{
+		{"older last term", voteRequest{Term: 3, CandidateID: "a", LastLogIndex: 5, LastLogTerm: 1}, false, 3},
+		{"shorter log", voteRequest{Term: 3, CandidateID: "b", LastLogIndex: 1, LastLogTerm: 2}, false, 3},
+		{"up to date", voteRequest{Term: 3, CandidateID: "c", LastLogIndex: 2, LastLogTerm: 2}, true, 3},
+		{"already voted", voteRequest{Term: 3, CandidateID: "d", LastLogIndex: 9, LastLogTerm: 9}, false, 3},
+		{"same candidate again", voteRequest{Term: 3, CandidateID: "c", LastLogIndex: 2, LastLogTerm: 2}, true, 3},
+		{"stale term", voteRequest{Term: 2, CandidateID: "e", LastLogIndex: 9, LastLogTerm: 9}, false, 3},
+		{"next term", voteRequest{Term: 4, CandidateID: "d", LastLogIndex: 9, LastLogTerm: 9}, true, 4},
+	}
+	for _, test := range tests {
+		response := vote(test.request)
+		if response.Granted != test.granted || response.Term != test.term {
+			t.Fatalf("%s: got %+v, want granted %v in term %d", test.name, response, test.granted, test.term)
+		}
+	}
+}
+
+// TestHandleAppend checks how a follower's log follows AppendEntries:
+// gaps and conflicts are reported so the leader can back up, uncommitted
+// entries from an old term are replaced, and neither a delayed call nor a
+// conflicting one cuts off entries it should keep
+func TestHandleAppend(t *testing.T) {
+	node, err := NewNode(Options{ID: "n1", Dir: t.TempDir()}, newTestMachine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	appendEntries := func(request appendRequest) *appendResponse {
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		request.LeaderID = "leader"
+		return node.handleAppend(&request)
+	}
+	expectLog := func(step string, want ...uint64) {
+		t.Helper()
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+		var terms []uint64
+		for index := node.store.firstIndex(); index <= node.store.lastIndex(); index++ {
+			term, _ := node.store.term(index)
+			terms = append(terms, term)
+		}
+		if !slices.Equal(terms, want) {
+			t.Fatalf("%s: log has terms %v, want %v", step, terms, want)
+		}
+	}
+
+	response := appendEntries(appendRequest{Term: 1, Entries: testEntries(1, 1, 1, 1), LeaderCommit: 1})
+	if !response.Success {
+		t.Fatalf("first append: %+v", response)
+	}
+	expectLog("first append", 1, 1, 1)
+	if commit := node.Status().CommitIndex; commit != 1 {
+		t.Fatalf("commit index is %d, want 1", commit)
+	}
+
+	// A gap points the leader at the end of the log
+	response = appendEntries(appendRequest{Term: 1, PrevLogIndex: 5, PrevLogTerm: 1})
+	if response.Success || response.ConflictIndex != 4 || response.ConflictTerm != 0 {
+		t.Fatalf("append past the end: got %+v, want a conflict at 4", response)
+	}
+
+	// A new leader replaces the uncommitted entries of the old term
+	response = appendEntries(appendRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 1, Entries: testEntries(2, 2, 2)})
+	if !response.Success {
+		t.Fatalf("conflicting append: %+v", response)
+	}
+	expectLog("conflicting append", 1, 2, 2)
+
+	// A delayed call carrying a prefix of what is stored cuts nothing off
+	response = appendEntries(appendRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 1, Entries: testEntries(2, 2)})
+	if !response.Success {
+		t.Fatalf("delayed append: %+v", response)
+	}
+	expectLog("delayed append", 1, 2, 2)
+
+	// A mismatch points the leader at the first entry of the conflicting
+	// term
+	response = appendEntries(appendRequest{Term: 3, PrevLogIndex: 3, PrevLogTerm: 3})
+	if response.Success || response.ConflictTerm != 2 || response.ConflictIndex != 2 {
+		t.Fatalf("mismatched previous entry: got %+v, want term 2 from index 2", response)
+	}
+
+	// A leader of an older term is turned away
+	response = appendEntries(appendRequest{Term: 2, PrevLogIndex: 3, PrevLogTerm: 2, Entries: testEntries(4, 2)})
+	if response.Success || response.Term != 3 {
+		t.Fatalf("stale leader: got %+v, want a refusal in term 3", response)
+	}
+	expectLog("stale leader", 1, 2, 2)
+
+	// Committed entries are never replaced
+	response = appendEntries(appendRequest{Term: 3, PrevLogIndex: 3, PrevLogTerm: 2, LeaderCommit: 3})
+	if !response.Success {
+		t.Fatalf("commit: %+v", response)
+	}
+	response = appendEntries(appendRequest{Term: 4, PrevLogIndex: 1, PrevLogTerm: 1, Entries: testEntries(2, 4)})
+	if response.Success {
+		t.Fatalf("append over committed entries succeeded")
+	}
+	expectLog("append over committed entries", 1, 2, 2)
+
+	waitFor(t, "the committed entries to be applied", func() bool {
+		return node.Status().AppliedIndex == 3
+	})
+}
+
+// testEntries returns commands at consecutive indexes from first, in the
+// terms given
+func testEntries(first uint64, terms ...uint64) []Entry {
+	entries := make([]Entry, len(terms))
+	for i, term := range terms {
+		index := first + uint64(i)
+		entries[i] = Entry{Index: index, Term: term, Type: EntryCommand, Data: []byte(fmt.Sprint(index))}
+	}
+	return entries
+}
+
+// TestMembership checks that servers are added and removed through the
+// leader, and that a leader removing itself hands over to the rest
+func TestMembership(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	err := propose(leader, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, node := range c.nodes {
+		if node != leader {
+			err = node.AddMember(ctx, Member{ID: "n9", Addr: "127.0.0.1:1"})
+			if !errors.Is(err, ErrNotLeader) {
+				t.Fatalf("AddMember on a follower: got %v, want %v", err, ErrNotLeader)
+			}
+		}
+	}
+	err = leader.RemoveMember(ctx, "n9")
+	if !errors.Is(err, ErrUnknownMember) {
+		t.Fatalf("RemoveMember of a stranger: got %v, want %v", err, ErrUnknownMember)
+	}
+
+	// A new server is brought up to date by the leader
+	err = leader.AddMember(ctx, c.join("n4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitMembers("n1", "n2", "n3", "n4")
+	err = propose(leader, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied("a", "b")
+
+	// A removed follower hears no more
+	var removed string
+	for id := range c.nodes {
+		if id != leader.ID() && id != "n4" {
+			removed = id
+			break
+		}
+	}
+	err = leader.RemoveMember(ctx, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left out of waitApplied, which it must not satisfy
+	removedMachine := c.machines[removed]
+	delete(c.machines, removed)
+	err = propose(leader, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied("a", "b", "c")
+	if applied := removedMachine.applied(); slices.Contains(applied, "c") {
+		t.Fatalf("removed member applied %q", applied)
+	}
+	c.stop(removed)
+	remaining := slices.Sorted(maps.Keys(c.nodes))
+	c.waitMembers(remaining...)
+
+	// A leader removing itself steps down once that is committed
+	err = leader.RemoveMember(ctx, leader.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the removed leader to step down", func() bool {
+		return leader.Status().Role != Leader
+	})
+	c.stop(leader.ID())
+	remaining = slices.Sorted(maps.Keys(c.nodes))
+	c.waitMembers(remaining...)
+
+	next := c.leader()
+	err = propose(next, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied("a", "b", "c", "d")
+}
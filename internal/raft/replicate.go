@@ -0,0 +1,240 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+// syncPeers starts replicating to members that have no peer yet and stops
+// replicating to servers no longer members. The caller must hold the
+// mutex.
+func (n *Node) syncPeers() {
+	for _, member := range n.members {
+		if member.ID == n.id {
+			continue
+		}
+		if p, ok := n.peers[member.ID]; ok {
+			p.member = member
+			continue
+		}
+
+		p := &peer{
+			member:      member,
+			nextIndex:   n.store.lastIndex() + 1,
+			lastContact: time.Now(),
+			wake:        make(chan struct{}, 1),
+			stop:        make(chan struct{}),
+		}
+		n.peers[member.ID] = p
+		n.wg.Add(1)
+		go n.runPeer(p, n.store.meta.Term)
+	}
+
+	for id, p := range n.peers {
+		if !n.isMember(id) {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+}
+
+// stopPeers stops replicating to every follower. The caller must hold the
+// mutex.
+func (n *Node) stopPeers() {
+	for id, p := range n.peers {
+		close(p.stop)
+		delete(n.peers, id)
+	}
+}
+
+// runPeer replicates to a follower while this node is leader for term. It
+// sends whenever there are new entries, and at least once every heartbeat
+// interval.
+func (n *Node) runPeer(p *peer, term uint64) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.options.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		n.replicate(p, term)
+
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// replicate sends AppendEntries calls to a follower until it has every
+// entry, or a snapshot if it needs entries no longer in the log
+func (n *Node) replicate(p *peer, term uint64) {
+	for {
+		n.mutex.Lock()
+		if n.role != Leader || n.store.meta.Term != term || n.peers[p.member.ID] != p {
+			n.mutex.Unlock()
+			return
+		}
+		if p.nextIndex <= n.store.meta.SnapshotIndex {
+			n.mutex.Unlock()
+			n.sendSnapshot(p, term)
+			return
+		}
+
+		prevIndex := p.nextIndex - 1
+		prevTerm, _ := n.store.term(prevIndex)
+		request := &appendRequest{
+			Term:         term,
+			LeaderID:     n.id,
+			PrevLogIndex: prevIndex,
+			PrevLogTerm:  prevTerm,
+			Entries:      n.store.slice(p.nextIndex, maxAppendEntries),
+			LeaderCommit: n.commitIndex,
+		}
+		addr := p.member.Addr
+		n.mutex.Unlock()
+
+		var response appendResponse
+		err := n.call(addr, pathAppend, request, &response)
+		if err != nil {
+			return
+		}
+
+		n.mutex.Lock()
+		more := n.handleAppendResponse(p, term, request, &response)
+		n.mutex.Unlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// handleAppendResponse records a follower's answer to AppendEntries and
+// reports whether there is more to send right away. The caller must hold
+// the mutex.
+func (n *Node) handleAppendResponse(p *peer, term uint64, request *appendRequest, response *appendResponse) bool {
+	if response.Term > n.store.meta.Term {
+		n.stepDown(response.Term)
+		return false
+	}
+	if n.role != Leader || n.store.meta.Term != term {
+		return false
+	}
+	p.lastContact = time.Now()
+
+	if response.Success {
+		match := request.PrevLogIndex + uint64(len(request.Entries))
+		if match > p.matchIndex {
+			p.matchIndex = match
+			n.advanceCommit()
+		}
+		p.nextIndex = max(p.nextIndex, match+1)
+		return p.nextIndex <= n.store.lastIndex()
+	}
+
+	// Skip back past the whole conflicting term rather than one entry at
+	// a time
+	next := response.ConflictIndex
+	if response.ConflictTerm != 0 {
+		for i := n.store.lastIndex(); i > n.store.meta.SnapshotIndex; i-- {
+			t, _ := n.store.term(i)
+			if t == response.ConflictTerm {
+				next = i + 1
+				break
+			}
+			if t < response.ConflictTerm {
+				break
+			}
+		}
+	}
+	p.nextIndex = max(1, min(next, request.PrevLogIndex))
+	return true
+}
+
+// advanceCommit commits the newest entry of the leader's term that a
+// majority has stored. Entries of earlier terms are committed along with
+// it, never by counting their own replicas. The caller must hold the
+// mutex.
+func (n *Node) advanceCommit() {
+	for index := n.store.lastIndex(); index > n.commitIndex; index-- {
+		term, _ := n.store.term(index)
+		if term != n.store.meta.Term {
+			break
+		}
+
+		stored := make(map[string]bool, len(n.members))
+		stored[n.id] = true
+		for id, p := range n.peers {
+			stored[id] = p.matchIndex >= index
+		}
+		if !n.hasQuorum(stored) {
+			continue
+		}
+
+		n.commitIndex = index
+		notify(n.applyWake)
+
+		// A leader that removed itself hands over once that is committed
+		if !n.isMember(n.id) && n.configIndex <= n.commitIndex {
+			n.stepDown(n.store.meta.Term)
+		}
+		return
+	}
+}
+
+// sendSnapshot sends a follower a snapshot of the state machine, covering
+// the log up to the last applied entry
+func (n *Node) sendSnapshot(p *peer, term uint64) {
+	n.mutex.Lock()
+	index := n.lastApplied
+	lastTerm, _ := n.store.term(index)
+	members, _ := n.configAt(index)
+	request := &snapshotRequest{
+		Term:      term,
+		LeaderID:  n.id,
+		LastIndex: index,
+		LastTerm:  lastTerm,
+		Members:   members,
+	}
+	addr := p.member.Addr
+	n.mutex.Unlock()
+
+	body, writer := io.Pipe()
+	go func() {
+		buffered := bufio.NewWriter(writer)
+		err := gob.NewEncoder(buffered).Encode(request)
+		if err == nil {
+			err = n.fsm.Snapshot(buffered)
+		}
+		if err == nil {
+			err = buffered.Flush()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	var response snapshotResponse
+	err := n.stream(addr, pathSnapshot, body, &response)
+	body.Close()
+	if err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if response.Term > n.store.meta.Term {
+		n.stepDown(response.Term)
+		return
+	}
+	if n.role != Leader || n.store.meta.Term != term {
+		return
+	}
+	p.lastContact = time.Now()
+	p.matchIndex = max(p.matchIndex, index)
+	p.nextIndex = p.matchIndex + 1
+	n.advanceCommit()
+}
@@ -0,0 +1,239 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Paths of the calls between members
+const (
+	pathVote     = "/raft/vote"
+	pathAppend   = "/raft/append"
+	pathSnapshot = "/raft/snapshot"
+)
+
+// membershipTimeout bounds how long an HTTP request to change the
+// membership waits for the change to be applied
+const membershipTimeout = 10 * time.Second
+
+// voteRequest is a candidate's RequestVote call
+type voteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// voteResponse answers a voteRequest
+type voteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// appendRequest is the leader's AppendEntries call, which is also its
+// heartbeat when it carries no entries
+type appendRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// appendResponse answers an appendRequest. When the follower's log does not
+// match, it points the leader at where to try next: the first index of the
+// conflicting term, or the end of its log if it is too short.
+type appendResponse struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+	ConflictTerm  uint64
+}
+
+// snapshotRequest heads the leader's InstallSnapshot call. The state
+// machine's snapshot follows it in the request body.
+type snapshotRequest struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+	Members   []Member
+}
+
+// snapshotResponse answers a snapshotRequest
+type snapshotResponse struct {
+	Term uint64
+}
+
+// handler routes the calls between members, along with requests to see
+// the node's status and to change the membership:
+//
+//	GET    /raft/status        the node's Status as JSON
+//	POST   /raft/members       add the member in the JSON body {"id", "addr"}
+//	DELETE /raft/members/{id}  remove a member
+//
+// Membership changes must be sent to the leader.
+func (n *Node) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+pathVote, n.serveVote)
+	mux.HandleFunc("POST "+pathAppend, n.serveAppend)
+	mux.HandleFunc("POST "+pathSnapshot, n.serveSnapshot)
+	mux.HandleFunc("GET /raft/status", n.serveStatus)
+	mux.HandleFunc("POST /raft/members", n.serveAddMember)
+	mux.HandleFunc("DELETE /raft/members/{id}", n.serveRemoveMember)
+	return mux
+}
+
+// serveVote answers RequestVote
+func (n *Node) serveVote(w http.ResponseWriter, r *http.Request) {
+	var request voteRequest
+	err := gob.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.mutex.Lock()
+	response := n.handleVote(&request)
+	n.mutex.Unlock()
+
+	gob.NewEncoder(w).Encode(response)
+}
+
+// serveAppend answers AppendEntries
+func (n *Node) serveAppend(w http.ResponseWriter, r *http.Request) {
+	var request appendRequest
+	err := gob.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.mutex.Lock()
+	response := n.handleAppend(&request)
+	n.mutex.Unlock()
+
+	gob.NewEncoder(w).Encode(response)
+}
+
+// serveSnapshot answers InstallSnapshot
+func (n *Node) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	// The decoder must not read past the header into the snapshot, which
+	// it avoids when given a reader it can read byte by byte
+	reader := bufio.NewReader(r.Body)
+	var request snapshotRequest
+	err := gob.NewDecoder(reader).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := n.installSnapshot(&request, reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gob.NewEncoder(w).Encode(response)
+}
+
+// serveStatus reports the node's status
+func (n *Node) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+// serveAddMember adds a member
+func (n *Node) serveAddMember(w http.ResponseWriter, r *http.Request) {
+	var member Member
+	err := json.NewDecoder(r.Body).Decode(&member)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), membershipTimeout)
+	defer cancel()
+	n.writeMembershipResult(w, n.AddMember(ctx, member))
+}
+
+// serveRemoveMember removes a member
+func (n *Node) serveRemoveMember(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), membershipTimeout)
+	defer cancel()
+	n.writeMembershipResult(w, n.RemoveMember(ctx, r.PathValue("id")))
+}
+
+// writeMembershipResult answers a membership change with the new status,
+// or with the error and a status code matching it
+func (n *Node) writeMembershipResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, n.Status())
+	case errors.Is(err, ErrNotLeader), errors.Is(err, ErrLeadershipLost), errors.Is(err, ErrClosed):
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrMembershipChangePending):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrUnknownMember):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, context.DeadlineExceeded):
+		writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+}
+
+// writeJSON writes value as a JSON response
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// call sends request to the member at addr and decodes its response
+func (n *Node) call(addr, path string, request, response any) error {
+	var body bytes.Buffer
+	err := gob.NewEncoder(&body).Encode(request)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.options.ElectionTimeout)
+	defer cancel()
+	return n.post(ctx, addr, path, &body, response)
+}
+
+// stream sends a request body that may take a while to produce, such as a
+// snapshot, waiting for as long as it takes or until the node is closed
+func (n *Node) stream(addr, path string, body io.Reader, response any) error {
+	return n.post(n.ctx, addr, path, body, response)
+}
+
+// post sends a gob-encoded body and decodes the gob-encoded response
+func (n *Node) post(ctx context.Context, addr, path string, body io.Reader, response any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-gob")
+
+	result, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	if result.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(result.Body, 512))
+		return fmt.Errorf("%s%s: %s: %s", addr, path, result.Status, bytes.TrimSpace(message))
+	}
+	return gob.NewDecoder(result.Body).Decode(response)
+}
@@ -0,0 +1,335 @@
+package replication
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+const (
+	// minReconnectDelay and maxReconnectDelay bound the wait before a
+	// follower reconnects; it doubles after every failed attempt
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// Follower states
+const (
+	StateConnecting = "connecting"
+	StateSyncing    = "syncing"
+	StateStreaming  = "streaming"
+)
+
+// Follower keeps a database in step with a primary. The database is made
+// read-only so that it only changes through replication.
+type Follower struct {
+	db      *database.DB
+	primary string
+	mutex   sync.Mutex
+	conn    net.Conn
+	status  FollowerStatus
+	closed  bool
+	closing chan struct{}
+}
+
+// FollowerStatus describes how a follower is doing
+type FollowerStatus struct {
+	Primary         string
+	State           string
+	Sequence        uint64    // Last sequence number applied
+	PrimarySequence uint64    // Last sequence number the primary reported
+	Lag             uint64    // Entries yet to apply, as far as the follower has heard
+	LastContact     time.Time // When the primary was last heard from
+	FullSyncs       int       // Snapshots loaded since the follower started
+	LastError       string    // Why the last connection ended
+}
+
+// NewFollower creates a follower replicating into db from the primary at
+// primaryAddr
+func NewFollower(db *database.DB, primaryAddr string) *Follower {
+	db.SetReadOnly(true)
+	return &Follower{
+		db:      db,
+		primary: primaryAddr,
+		status: FollowerStatus{
+			Primary: primaryAddr,
+			State:   StateConnecting,
+		},
+		closing: make(chan struct{}),
+	}
+}
+
+// Run replicates until Close is called, reconnecting whenever the
+// connection is lost, and then returns ErrClosed
+func (f *Follower) Run() error {
+	delay := minReconnectDelay
+	for {
+		streamed, err := f.replicate()
+
+		f.mutex.Lock()
+		closed := f.closed
+		f.conn = nil
+		f.status.State = StateConnecting
+		if err != nil && !closed {
+			f.status.LastError = err.Error()
+		}
+		f.mutex.Unlock()
+		if closed {
+			return ErrClosed
+		}
+
+		if streamed {
+			delay = minReconnectDelay
+		}
+		select {
+		case <-time.After(delay):
+		case <-f.closing:
+			return ErrClosed
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// Status describes the follower
+func (f *Follower) Status() FollowerStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	status := f.status
+	if status.PrimarySequence > status.Sequence {
+		status.Lag = status.PrimarySequence - status.Sequence
+	}
+	return status
+}
+
+// Close stops replicating. The database stays read-only.
+func (f *Follower) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.closing)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+
+	return nil
+}
+
+// replicate connects to the primary and applies what it sends until the
+// connection fails. It reports whether streaming got underway.
+func (f *Follower) replicate() (bool, error) {
+	netConn, err := net.DialTimeout("tcp", f.primary, timeout)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to %s: %w", f.primary, err)
+	}
+	defer netConn.Close()
+
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return false, nil
+	}
+	f.conn = netConn
+	f.mutex.Unlock()
+
+	conn := timeoutConn{netConn}
+	reader := bufio.NewReader(conn)
+
+	sequence := f.db.LastSequence()
+	err = writeHandshake(conn, sequence)
+	if err != nil {
+		return false, err
+	}
+	f.setApplied(sequence, 0)
+
+	// Acknowledgements are sent on their own so that the primary keeps
+	// hearing from the follower while it loads a snapshot
+	acks := newAcker(conn, f)
+	defer acks.stop()
+
+	messageType, err := reader.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	switch messageType {
+	case messageFullSync:
+		err = f.fullSync(reader)
+	case messageResume:
+		_, err = readUint64(reader)
+	default:
+		err = fmt.Errorf("%w: unexpected message %q", errProtocol, messageType)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	f.setState(StateStreaming)
+	acks.notify()
+
+	for {
+		err = f.receive(reader, acks)
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// fullSync loads the snapshot that follows a full sync message. The whole
+// snapshot is read and verified before anything is replaced.
+func (f *Follower) fullSync(reader *bufio.Reader) error {
+	f.setState(StateSyncing)
+
+	sequence, err := readUint64(reader)
+	if err != nil {
+		return err
+	}
+
+	var entries []*persistence.SnapshotEntry
+	_, err = persistence.ReadSnapshot(reader, func(entry *persistence.SnapshotEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	err = f.db.LoadReplicaSnapshot(sequence, entries)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	f.status.FullSyncs++
+	f.mutex.Unlock()
+	f.setApplied(sequence, sequence)
+
+	return nil
+}
+
+// receive handles one message from the primary
+func (f *Follower) receive(reader *bufio.Reader, acks *acker) error {
+	messageType, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch messageType {
+	case messageEntries:
+		sequence, entries, err := readEntries(reader)
+		if err != nil {
+			return err
+		}
+		err = f.db.ApplyReplicated(entries)
+		if err != nil {
+			return err
+		}
+		f.setApplied(entries[len(entries)-1].Sequence, sequence)
+		acks.notify()
+	case messageHeartbeat:
+		sequence, err := readUint64(reader)
+		if err != nil {
+			return err
+		}
+		f.setApplied(f.applied(), sequence)
+	default:
+		return fmt.Errorf("%w: unexpected message %q", errProtocol, messageType)
+	}
+
+	return nil
+}
+
+// setApplied records the last sequence number applied and the last one
+// the primary reported
+func (f *Follower) setApplied(sequence, primarySequence uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.status.Sequence = sequence
+	f.status.PrimarySequence = max(primarySequence, sequence)
+	f.status.LastContact = time.Now()
+}
+
+// setState records the follower's state
+func (f *Follower) setState(state string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.status.State = state
+}
+
+// applied returns the last sequence number applied
+func (f *Follower) applied() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.status.Sequence
+}
+
+// acker sends acknowledgements to the primary once every heartbeat
+// interval, and as soon as it is notified of newly applied entries
+type acker struct {
+	conn     timeoutConn
+	follower *Follower
+	wake     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// newAcker starts acknowledging on conn
+func newAcker(conn timeoutConn, follower *Follower) *acker {
+	a := &acker{
+		conn:     conn,
+		follower: follower,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// run sends acknowledgements until stopped or the connection fails
+func (a *acker) run() {
+	defer close(a.stopped)
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.wake:
+		case <-a.done:
+			return
+		}
+
+		err := writeSequence(a.conn, messageAck, a.follower.applied())
+		if err != nil {
+			// Make sure the reader notices the broken connection too
+			a.conn.Close()
+			return
+		}
+	}
+}
+
+// notify asks for an acknowledgement to be sent soon
+func (a *acker) notify() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the acknowledgements and waits for the last one to be sent
+func (a *acker) stop() {
+	close(a.done)
+	<-a.stopped
+}
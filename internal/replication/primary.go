@@ -0,0 +1,300 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+// DefaultAddr is the address a primary listens on for followers by default
+const DefaultAddr = ":7379"
+
+// Primary streams a database's log to the followers that connect to it
+type Primary struct {
+	db        *database.DB
+	addr      string
+	listener  net.Listener
+	followers map[*followerConn]struct{}
+	mutex     sync.Mutex
+	closed    bool
+	closing   context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// followerConn is one connected follower
+type followerConn struct {
+	primary *Primary
+	conn    net.Conn
+	info    FollowerInfo
+}
+
+// FollowerInfo describes a follower connected to a primary
+type FollowerInfo struct {
+	Addr      string
+	FullSync  bool      // Whether the follower was sent a snapshot
+	Sequence  uint64    // Last sequence number the follower has applied
+	Lag       uint64    // Entries logged by the primary the follower has not applied
+	LastAck   time.Time // When the follower last acknowledged
+	Connected time.Time
+}
+
+// NewPrimary creates a primary for db that will listen on addr
+func NewPrimary(db *database.DB, addr string) *Primary {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	closing, cancel := context.WithCancel(context.Background())
+	return &Primary{
+		db:        db,
+		addr:      addr,
+		followers: make(map[*followerConn]struct{}),
+		closing:   closing,
+		cancel:    cancel,
+	}
+}
+
+// ListenAndServe listens on the configured address and serves followers
+// until Close is called
+func (p *Primary) ListenAndServe() error {
+	listener, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", p.addr, err)
+	}
+
+	return p.Serve(listener)
+}
+
+// Serve accepts followers on listener until Close is called, and then
+// returns ErrClosed
+func (p *Primary) Serve(listener net.Listener) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		listener.Close()
+		return ErrClosed
+	}
+	p.listener = listener
+	p.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			p.mutex.Lock()
+			closed := p.closed
+			p.mutex.Unlock()
+			if closed {
+				return ErrClosed
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		follower := &followerConn{
+			primary: p,
+			conn:    conn,
+			info: FollowerInfo{
+				Addr:      conn.RemoteAddr().String(),
+				Connected: time.Now(),
+			},
+		}
+
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			conn.Close()
+			return ErrClosed
+		}
+		p.followers[follower] = struct{}{}
+		p.wg.Add(1)
+		p.mutex.Unlock()
+
+		go follower.serve()
+	}
+}
+
+// Addr returns the address the primary is listening on, or nil if it is
+// not listening yet
+func (p *Primary) Addr() net.Addr {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+// Followers describes the connected followers, ordered by address
+func (p *Primary) Followers() []FollowerInfo {
+	last := p.db.LastSequence()
+
+	p.mutex.Lock()
+	followers := make([]FollowerInfo, 0, len(p.followers))
+	for follower := range p.followers {
+		info := follower.info
+		if last > info.Sequence {
+			info.Lag = last - info.Sequence
+		}
+		followers = append(followers, info)
+	}
+	p.mutex.Unlock()
+
+	sort.Slice(followers, func(i, j int) bool {
+		return followers[i].Addr < followers[j].Addr
+	})
+	return followers
+}
+
+// Close stops accepting followers and disconnects the connected ones. It
+// does not close the database.
+func (p *Primary) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.cancel()
+
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	for follower := range p.followers {
+		follower.conn.Close()
+	}
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+// serve runs the handshake and then streams entries until the follower
+// disconnects, falls too far behind or the primary closes
+func (f *followerConn) serve() {
+	p := f.primary
+	defer func() {
+		f.conn.Close()
+
+		p.mutex.Lock()
+		delete(p.followers, f)
+		p.mutex.Unlock()
+		p.wg.Done()
+	}()
+
+	conn := timeoutConn{f.conn}
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	sequence, err := readHandshake(reader)
+	if err != nil {
+		return
+	}
+
+	stream, err := p.db.OpenReplication(sequence)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	p.mutex.Lock()
+	f.info.FullSync = stream.FullSync()
+	f.info.Sequence = sequence
+	p.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(p.closing)
+	defer cancel()
+	go func() {
+		f.readAcks(reader)
+		cancel()
+	}()
+
+	if stream.FullSync() {
+		err = writeSequence(writer, messageFullSync, stream.Sequence())
+		if err == nil {
+			err = persistence.WriteSnapshot(writer, 0, stream.Snapshot)
+		}
+	} else {
+		err = writeSequence(writer, messageResume, stream.Sequence())
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	for {
+		err = f.send(ctx, stream, writer)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// send writes the next entries to the follower, or a heartbeat if none
+// turn up within heartbeatInterval
+func (f *followerConn) send(ctx context.Context, stream *database.ReplicationStream, writer *bufio.Writer) error {
+	waitCtx, cancel := context.WithTimeout(ctx, heartbeatInterval)
+	entries, err := stream.Next(waitCtx)
+	cancel()
+
+	switch {
+	case err == nil:
+		last := f.primary.db.LastSequence()
+		for len(entries) > 0 {
+			n := min(len(entries), maxBatchEntries)
+			err = writeEntries(writer, last, entries[:n])
+			if err != nil {
+				return err
+			}
+			entries = entries[n:]
+		}
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		err = writeSequence(writer, messageHeartbeat, f.primary.db.LastSequence())
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// readAcks records the follower's acknowledgements until the connection
+// fails
+func (f *followerConn) readAcks(reader *bufio.Reader) {
+	for {
+		messageType, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if messageType != messageAck {
+			return
+		}
+
+		sequence, err := readUint64(reader)
+		if err != nil {
+			return
+		}
+
+		f.primary.mutex.Lock()
+		f.info.Sequence = sequence
+		f.info.LastAck = time.Now()
+		f.primary.mutex.Unlock()
+	}
+}
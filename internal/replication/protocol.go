@@ -0,0 +1,189 @@
+// Package replication copies a database to read-only followers by
+// streaming the primary's append-only log over TCP.
+//
+// A follower connects and sends the sequence number its own log ends at.
+// If the primary still holds every entry after it, it carries on from
+// there; otherwise it first sends a snapshot of the key space and the
+// sequence number it covers. Either way it then streams log entries as
+// they are written, along with a heartbeat whenever it is idle. Followers
+// log the entries under the same sequence numbers and acknowledge them, so
+// both sides can tell how far the follower lags behind.
+//
+// The wire format, all integers big-endian:
+//
+//	handshake  follower -> primary  "KVRP" version:1 sequence:8
+//	full sync  primary -> follower  'F' sequence:8 snapshot
+//	resume     primary -> follower  'R' sequence:8
+//	entries    primary -> follower  'E' sequence:8 count:4 record...
+//	heartbeat  primary -> follower  'H' sequence:8
+//	ack        follower -> primary  'A' sequence:8
+//
+// Heartbeats and entry batches carry the primary's last sequence number,
+// from which the follower works out its lag. Snapshots use the snapshot
+// file format and records the log's own format, so both carry their
+// checksums across the network.
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/persistence"
+)
+
+const (
+	protocolMagic   = "KVRP"
+	protocolVersion = 1
+)
+
+// Message types
+const (
+	messageFullSync  byte = 'F'
+	messageResume    byte = 'R'
+	messageEntries   byte = 'E'
+	messageHeartbeat byte = 'H'
+	messageAck       byte = 'A'
+)
+
+const (
+	// heartbeatInterval is how often an idle primary tells its followers
+	// it is still there
+	heartbeatInterval = time.Second
+
+	// timeout is how long either side waits on the network before giving
+	// up on the connection
+	timeout = 5 * heartbeatInterval
+
+	// maxBatchEntries bounds the number of entries sent in one message
+	maxBatchEntries = 1024
+)
+
+// ErrClosed is returned once Close has been called
+var ErrClosed = errors.New("replication closed")
+
+// errProtocol is returned when a peer sends something unexpected
+var errProtocol = errors.New("replication protocol error")
+
+// timeoutConn moves a connection's deadlines forward before every read and
+// write, so that only a stalled peer times out and a long transfer does not
+type timeoutConn struct {
+	net.Conn
+}
+
+// Read implements io.Reader
+func (c timeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	return c.Conn.Read(p)
+}
+
+// Write implements io.Writer
+func (c timeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	return c.Conn.Write(p)
+}
+
+// writeHandshake sends the follower's side of the handshake
+func writeHandshake(w io.Writer, sequence uint64) error {
+	message := make([]byte, 0, 13)
+	message = append(message, protocolMagic...)
+	message = append(message, protocolVersion)
+	message = binary.BigEndian.AppendUint64(message, sequence)
+
+	_, err := w.Write(message)
+	return err
+}
+
+// readHandshake reads the follower's handshake and returns its sequence
+func readHandshake(r io.Reader) (uint64, error) {
+	var message [13]byte
+	_, err := io.ReadFull(r, message[:])
+	if err != nil {
+		return 0, err
+	}
+	if string(message[:4]) != protocolMagic {
+		return 0, fmt.Errorf("%w: bad handshake", errProtocol)
+	}
+	if message[4] != protocolVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", errProtocol, message[4])
+	}
+
+	return binary.BigEndian.Uint64(message[5:]), nil
+}
+
+// writeSequence sends a message consisting of its type and a sequence
+// number
+func writeSequence(w io.Writer, messageType byte, sequence uint64) error {
+	message := make([]byte, 0, 9)
+	message = append(message, messageType)
+	message = binary.BigEndian.AppendUint64(message, sequence)
+
+	_, err := w.Write(message)
+	return err
+}
+
+// writeEntries sends a batch of log entries along with the primary's last
+// sequence number
+func writeEntries(w io.Writer, sequence uint64, entries []*persistence.LogEntry) error {
+	message := make([]byte, 0, 13)
+	message = append(message, messageEntries)
+	message = binary.BigEndian.AppendUint64(message, sequence)
+	message = binary.BigEndian.AppendUint32(message, uint32(len(entries)))
+	_, err := w.Write(message)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		record, err := persistence.EncodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readUint64 reads one big-endian integer
+func readUint64(r io.Reader) (uint64, error) {
+	var data [8]byte
+	_, err := io.ReadFull(r, data[:])
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data[:]), nil
+}
+
+// readEntries reads the body of an entries message, returning the
+// primary's last sequence number and the entries
+func readEntries(r io.Reader) (uint64, []*persistence.LogEntry, error) {
+	var header [12]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sequence := binary.BigEndian.Uint64(header[:8])
+	count := binary.BigEndian.Uint32(header[8:])
+	if count == 0 || count > maxBatchEntries {
+		return 0, nil, fmt.Errorf("%w: batch of %d entries", errProtocol, count)
+	}
+
+	entries := make([]*persistence.LogEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		entry, err := persistence.ReadEntry(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return sequence, entries, nil
+}
@@ -0,0 +1,154 @@
+package replication
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+)
+
+// backlogSize is the primary's replication backlog in these tests, small
+// enough that a few writes push a new follower onto a full sync
+const backlogSize = 4
+
+// TestReplication runs a primary and a follower over loopback TCP. The
+// follower catches up from a snapshot, then receives writes as they are
+// made, and rejects writes of its own. A second follower on the same
+// database, starting where the first stopped, resumes from the backlog.
+func TestReplication(t *testing.T) {
+	primaryDB := openDB(t)
+	for i := range 3 * backlogSize {
+		err := primaryDB.Set(fmt.Sprint("key", i), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := primaryDB.Delete("key0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary := NewPrimary(primaryDB, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go primary.Serve(listener)
+	defer primary.Close()
+	addr := listener.Addr().String()
+
+	followerDB := openDB(t)
+	follower := startFollower(t, followerDB, addr)
+
+	// Snapshot catch-up
+	waitFor(t, "the snapshot", func() bool {
+		return follower.Status().State == StateStreaming
+	})
+	if syncs := follower.Status().FullSyncs; syncs != 1 {
+		t.Fatalf("follower made %d full syncs, want 1", syncs)
+	}
+	for i := 1; i < 3*backlogSize; i++ {
+		expectValue(t, followerDB, fmt.Sprint("key", i), fmt.Sprint(i))
+	}
+	_, err = followerDB.Get("key0")
+	if !errors.Is(err, database.ErrKeyNotFound) {
+		t.Fatalf("Get(key0) on the follower: got %v, want %v", err, database.ErrKeyNotFound)
+	}
+
+	// Live streaming
+	err = primaryDB.Set("live", []byte("streamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the live write", func() bool {
+		value, _ := followerDB.Get("live")
+		return string(value) == "streamed"
+	})
+	waitFor(t, "the acknowledgement", func() bool {
+		followers := primary.Followers()
+		return len(followers) == 1 && followers[0].Sequence == primaryDB.LastSequence()
+	})
+
+	// Writes on the follower
+	err = followerDB.Set("live", []byte("local"))
+	if !errors.Is(err, database.ErrReadOnly) {
+		t.Fatalf("Set on the follower: got %v, want %v", err, database.ErrReadOnly)
+	}
+	expectValue(t, followerDB, "live", "streamed")
+
+	// Resuming from the backlog
+	follower.Close()
+	err = primaryDB.Set("resumed", []byte("from the backlog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower = startFollower(t, followerDB, addr)
+	waitFor(t, "the resumed follower", func() bool {
+		return follower.Status().Sequence == primaryDB.LastSequence()
+	})
+	if syncs := follower.Status().FullSyncs; syncs != 0 {
+		t.Fatalf("resumed follower made %d full syncs, want 0", syncs)
+	}
+	expectValue(t, followerDB, "resumed", "from the backlog")
+}
+
+// openDB opens a database in a temporary directory that is closed when the
+// test ends
+func openDB(t *testing.T) *database.DB {
+	t.Helper()
+	config := database.DefaultConfig()
+	config.LogPath = t.TempDir()
+	config.SnapshotInterval = 0
+	config.ReplicationBacklog = backlogSize
+	db, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// startFollower runs a follower of the primary at addr until the test ends
+// or it is closed
+func startFollower(t *testing.T, db *database.DB, addr string) *Follower {
+	t.Helper()
+	follower := NewFollower(db, addr)
+	done := make(chan error, 1)
+	go func() {
+		done <- follower.Run()
+	}()
+	t.Cleanup(func() {
+		follower.Close()
+		if err := <-done; !errors.Is(err, ErrClosed) {
+			t.Errorf("Run: got %v, want %v", err, ErrClosed)
+		}
+	})
+	return follower
+}
+
+// waitFor fails the test if condition does not hold within a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expectValue fails the test unless key holds want in db
+func expectValue(t *testing.T, db *database.DB, key, want string) {
+	t.Helper()
+	value, err := db.Get(key)
+	if err != nil || !bytes.Equal(value, []byte(want)) {
+		t.Fatalf("Get(%s) = %q, %v; want %q", key, value, err, want)
+	}
+}
@@ -0,0 +1,270 @@
+// Package rpc holds what the gRPC server and client share: the messages of
+// the KeyValue service, gRPC message framing, status codes and the
+// encoding of the gRPC headers. It is written against the gRPC over HTTP/2
+// specification directly so that the module needs no dependencies.
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Method paths of the KeyValue service
+const (
+	ServiceName  = "kvdb.v1.KeyValue"
+	MethodGet    = "/" + ServiceName + "/Get"
+	MethodSet    = "/" + ServiceName + "/Set"
+	MethodDelete = "/" + ServiceName + "/Delete"
+	MethodKeys   = "/" + ServiceName + "/Keys"
+	MethodSize   = "/" + ServiceName + "/Size"
+	MethodScan   = "/" + ServiceName + "/Scan"
+	MethodWatch  = "/" + ServiceName + "/Watch"
+)
+
+// ContentType is the content type of gRPC requests and responses
+const ContentType = "application/grpc"
+
+// gRPC header and trailer names
+const (
+	HeaderTimeout = "Grpc-Timeout"
+	HeaderStatus  = "Grpc-Status"
+	HeaderMessage = "Grpc-Message"
+)
+
+// DefaultMaxMessageSize is the largest message read by default, the same
+// limit gRPC implementations use
+const DefaultMaxMessageSize = 4 << 20
+
+// Code is a gRPC status code
+type Code uint32
+
+// The status codes used by the service
+const (
+	CodeOK                 Code = 0
+	CodeCanceled           Code = 1
+	CodeUnknown            Code = 2
+	CodeInvalidArgument    Code = 3
+	CodeDeadlineExceeded   Code = 4
+	CodeNotFound           Code = 5
+	CodeAlreadyExists      Code = 6
+	CodeResourceExhausted  Code = 8
+	CodeFailedPrecondition Code = 9
+	CodeAborted            Code = 10
+	CodeOutOfRange         Code = 11
+	CodeUnimplemented      Code = 12
+	CodeInternal           Code = 13
+	CodeUnavailable        Code = 14
+)
+
+// String returns the name gRPC gives the code
+func (c Code) String() string {
+	switch c {
+	case CodeOK:
+		return "OK"
+	case CodeCanceled:
+		return "Canceled"
+	case CodeUnknown:
+		return "Unknown"
+	case CodeInvalidArgument:
+		return "InvalidArgument"
+	case CodeDeadlineExceeded:
+		return "DeadlineExceeded"
+	case CodeNotFound:
+		return "NotFound"
+	case CodeAlreadyExists:
+		return "AlreadyExists"
+	case CodeResourceExhausted:
+		return "ResourceExhausted"
+	case CodeFailedPrecondition:
+		return "FailedPrecondition"
+	case CodeAborted:
+		return "Aborted"
+	case CodeOutOfRange:
+		return "OutOfRange"
+	case CodeUnimplemented:
+		return "Unimplemented"
+	case CodeInternal:
+		return "Internal"
+	case CodeUnavailable:
+		return "Unavailable"
+	default:
+		return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+	}
+}
+
+// Status is a call's outcome other than OK, as carried in the trailers
+type Status struct {
+	Code    Code
+	Message string
+}
+
+// Errorf creates a status error
+func Errorf(code Code, format string, args ...interface{}) *Status {
+	return &Status{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Error implements the error interface
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", s.Code, s.Message)
+}
+
+// errMessageTooLarge is returned when a peer sends a message over the limit
+var errMessageTooLarge = errors.New("message exceeds the maximum size")
+
+// WriteMessage writes m in a gRPC length-prefixed frame. Compression is
+// never used.
+func WriteMessage(w io.Writer, m Message) error {
+	data := m.Marshal()
+
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	frame = append(frame, data...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadMessage reads one gRPC frame into m. It returns io.EOF if the stream
+// ends cleanly before a frame starts.
+func ReadMessage(r io.Reader, m Message, maxSize int) error {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Errorf(CodeInternal, "truncated message frame")
+		}
+		return err
+	}
+	if header[0] != 0 {
+		return Errorf(CodeUnimplemented, "compressed messages are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if int64(length) > int64(maxSize) {
+		return Errorf(CodeResourceExhausted, "%v: %d > %d", errMessageTooLarge, length, maxSize)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return Errorf(CodeInternal, "truncated message frame")
+		}
+		return err
+	}
+
+	err = m.Unmarshal(data)
+	if err != nil {
+		return Errorf(CodeInternal, "failed to decode message: %v", err)
+	}
+	return nil
+}
+
+// EncodeTimeout formats a timeout for the grpc-timeout header, which
+// allows at most eight digits
+func EncodeTimeout(timeout time.Duration) string {
+	if timeout <= 0 {
+		return "0n"
+	}
+
+	units := []struct {
+		unit   time.Duration
+		suffix string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+		{time.Hour, "H"},
+	}
+	for _, u := range units {
+		// Round up so the peer never sees a shorter deadline
+		value := (timeout + u.unit - 1) / u.unit
+		if value <= 99999999 {
+			return strconv.FormatInt(int64(value), 10) + u.suffix
+		}
+	}
+	return "99999999H"
+}
+
+// DecodeTimeout parses a grpc-timeout header
+func DecodeTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+
+	value, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'n':
+		unit = time.Nanosecond
+	case 'u':
+		unit = time.Microsecond
+	case 'm':
+		unit = time.Millisecond
+	case 'S':
+		unit = time.Second
+	case 'M':
+		unit = time.Minute
+	case 'H':
+		unit = time.Hour
+	default:
+		return 0, fmt.Errorf("invalid timeout unit in %q", s)
+	}
+
+	// Hours of eight digits overflow a Duration; treat them as forever
+	if value > int64(1<<63-1)/int64(unit) {
+		return 1<<63 - 1, nil
+	}
+	return time.Duration(value) * unit, nil
+}
+
+// EncodeStatusMessage percent-encodes a message for the grpc-message
+// trailer, which must be printable ASCII
+func EncodeStatusMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// DecodeStatusMessage reverses EncodeStatusMessage, leaving invalid escapes
+// as they are
+func DecodeStatusMessage(message string) string {
+	if !strings.Contains(message, "%") {
+		return message
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if message[i] == '%' && i+2 < len(message) {
+			c, err := strconv.ParseUint(message[i+1:i+3], 16, 8)
+			if err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(message[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,381 @@
+package rpc
+
+// The messages of the KeyValue service, encoded by hand to match
+// proto/kvdb/v1/kvdb.proto field for field. Keep the two in sync.
+
+// Message is a protobuf message that can be sent over the service
+type Message interface {
+	Marshal() []byte
+	Unmarshal(data []byte) error
+}
+
+// GetRequest asks for the value of a key
+type GetRequest struct {
+	Key string
+}
+
+// GetResponse holds a value and its version
+type GetResponse struct {
+	Value   []byte
+	Version uint64
+}
+
+// SetRequest stores a value, expiring after TTLMillis when it is positive.
+// With IfAbsent set it is only stored if the key does not exist.
+type SetRequest struct {
+	Key       string
+	Value     []byte
+	TTLMillis int64
+	IfAbsent  bool
+}
+
+// SetResponse holds the version of the value stored
+type SetResponse struct {
+	Version uint64
+}
+
+// DeleteRequest removes a key, only if it is at IfVersion when that is
+// not zero
+type DeleteRequest struct {
+	Key       string
+	IfVersion uint64
+}
+
+// DeleteResponse acknowledges a DeleteRequest
+type DeleteResponse struct{}
+
+// KeysRequest lists the keys starting with Prefix
+type KeysRequest struct {
+	Prefix string
+}
+
+// KeysResponse holds keys in ascending order
+type KeysResponse struct {
+	Keys []string
+}
+
+// SizeRequest asks for the number of keys
+type SizeRequest struct{}
+
+// SizeResponse holds the number of keys
+type SizeResponse struct {
+	Size int64
+}
+
+// ScanRequest streams the entries selected like database.ScanOptions. A
+// Limit of zero streams every selected entry.
+type ScanRequest struct {
+	Start   string
+	End     string
+	Prefix  string
+	Limit   int64
+	Reverse bool
+}
+
+// KeyValue is one entry streamed by Scan. TTLMillis is the time left
+// before it expires, or zero if it does not.
+type KeyValue struct {
+	Key       string
+	Value     []byte
+	Version   uint64
+	TTLMillis int64
+}
+
+// WatchRequest streams the changes to keys starting with Prefix, or to Key
+// alone, replaying those made after the one numbered After first
+type WatchRequest struct {
+	Prefix string
+	Key    string
+	After  uint64
+}
+
+// Watch event types
+const (
+	EventSet    = 1
+	EventDelete = 2
+	EventExpire = 3
+)
+
+// WatchEvent is one change streamed by Watch
+type WatchEvent struct {
+	Type     int64
+	Key      string
+	Value    []byte
+	Sequence uint64
+	OldValue []byte
+}
+
+func (m *GetRequest) Marshal() []byte {
+	return appendStringField(nil, 1, m.Key)
+}
+
+func (m *GetRequest) Unmarshal(data []byte) error {
+	*m = GetRequest{}
+	return rangeFields(data, func(f field) error {
+		if f.number == 1 {
+			m.Key = string(f.data)
+			return f.check(wireBytes)
+		}
+		return nil
+	})
+}
+
+func (m *GetResponse) Marshal() []byte {
+	b := appendBytesField(nil, 1, m.Value)
+	return appendVarintField(b, 2, m.Version)
+}
+
+func (m *GetResponse) Unmarshal(data []byte) error {
+	*m = GetResponse{Value: []byte{}}
+	return rangeFields(data, func(f field) error {
+		switch f.number {
+		case 1:
+			m.Value = f.bytes()
+			return f.check(wireBytes)
+		case 2:
+			m.Version = f.varint
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *SetRequest) Marshal() []byte {
+	b := appendStringField(nil, 1, m.Key)
+	b = appendBytesField(b, 2, m.Value)
+	b = appendVarintField(b, 3, uint64(m.TTLMillis))
+	return appendBoolField(b, 4, m.IfAbsent)
+}
+
+func (m *SetRequest) Unmarshal(data []byte) error {
+	*m = SetRequest{Value: []byte{}}
+	return rangeFields(data, func(f field) error {
+		switch f.number {
+		case 1:
+			m.Key = string(f.data)
+			return f.check(wireBytes)
+		case 2:
+			m.Value = f.bytes()
+			return f.check(wireBytes)
+		case 3:
+			m.TTLMillis = int64(f.varint)
+			return f.check(wireVarint)
+		case 4:
+			m.IfAbsent = f.varint != 0
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *SetResponse) Marshal() []byte {
+	return appendVarintField(nil, 1, m.Version)
+}
+
+func (m *SetResponse) Unmarshal(data []byte) error {
+	*m = SetResponse{}
+	return rangeFields(data, func(f field) error {
+		if f.number == 1 {
+			m.Version = f.varint
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *DeleteRequest) Marshal() []byte {
+	b := appendStringField(nil, 1, m.Key)
+	return appendVarintField(b, 2, m.IfVersion)
+}
+
+func (m *DeleteRequest) Unmarshal(data []byte) error {
+	*m = DeleteRequest{}
+	return rangeFields(data, func(f field) error {
+		switch f.number {
+		case 1:
+			m.Key = string(f.data)
+			return f.check(wireBytes)
+		case 2:
+			m.IfVersion = f.varint
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *DeleteResponse) Marshal() []byte {
+	return nil
+}
+
+func (m *DeleteResponse) Unmarshal(data []byte) error {
+	return rangeFields(data, func(f field) error { return nil })
+}
+
+func (m *KeysRequest) Marshal() []byte {
+	return appendStringField(nil, 1, m.Prefix)
+}
+
+func (m *KeysRequest) Unmarshal(data []byte) error {
+	*m = KeysRequest{}
+	return rangeFields(data, func(f field) error {
+		if f.number == 1 {
+			m.Prefix = string(f.data)
+			return f.check(wireBytes)
+		}
+		return nil
+	})
+}
+
+func (m *KeysResponse) Marshal() []byte {
+	return appendRepeatedStringField(nil, 1, m.Keys)
+}
+
+func (m *KeysResponse) Unmarshal(data []byte) error {
+	*m = KeysResponse{}
+	return rangeFields(data, func(f field) error {
+		if f.number == 1 {
+			m.Keys = append(m.Keys, string(f.data))
+			return f.check(wireBytes)
+		}
+		return nil
+	})
+}
+
+func (m *SizeRequest) Marshal() []byte {
+	return nil
+}
+
+func (m *SizeRequest) Unmarshal(data []byte) error {
+	return rangeFields(data, func(f field) error { return nil })
+}
+
+func (m *SizeResponse) Marshal() []byte {
+	return appendVarintField(nil, 1, uint64(m.Size))
+}
+
+func (m *SizeResponse) Unmarshal(data []byte) error {
+	*m = SizeResponse{}
+	return rangeFields(data, func(f field) error {
+		if f.number == 1 {
+			m.Size = int64(f.varint)
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *ScanRequest) Marshal() []byte {
+	b := appendStringField(nil, 1, m.Start)
+	b = appendStringField(b, 2, m.End)
+	b = appendStringField(b, 3, m.Prefix)
+	b = appendVarintField(b, 4, uint64(m.Limit))
+	return appendBoolField(b, 5, m.Reverse)
+}
+
+func (m *ScanRequest) Unmarshal(data []byte) error {
+	*m = ScanRequest{}
+	return rangeFields(data, func(f field) error {
+		switch f.number {
+		case 1:
+			m.Start = string(f.data)
+			return f.check(wireBytes)
+		case 2:
+			m.End = string(f.data)
+			return f.check(wireBytes)
+		case 3:
+			m.Prefix = string(f.data)
+			return f.check(wireBytes)
+		case 4:
+			m.Limit = int64(f.varint)
+			return f.check(wireVarint)
+		case 5:
+			m.Reverse = f.varint != 0
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *KeyValue) Marshal() []byte {
+	b := appendStringField(nil, 1, m.Key)
+	b = appendBytesField(b, 2, m.Value)
+	b = appendVarintField(b, 3, m.Version)
+	return appendVarintField(b, 4, uint64(m.TTLMillis))
+}
+
+func (m *KeyValue) Unmarshal(data []byte) error {
+	*m = KeyValue{Value: []byte{}}
+	return rangeFields(data, func(f field) error {
+		switch f.number {
+		case 1:
+			m.Key = string(f.data)
+			return f.check(wireBytes)
+		case 2:
+			m.Value = f.bytes()
+			return f.check(wireBytes)
+		case 3:
+			m.Version = f.varint
+			return f.check(wireVarint)
+		case 4:
+			m.TTLMillis = int64(f.varint)
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *WatchRequest) Marshal() []byte {
+	b := appendStringField(nil, 1, m.Prefix)
+	b = appendStringField(b, 2, m.Key)
+	return appendVarintField(b, 3, m.After)
+}
+
+func (m *WatchRequest) Unmarshal(data []byte) error {
+	*m = WatchRequest{}
+	return rangeFields(data, func(f field) error {
+		switch f.number {
+		case 1:
+			m.Prefix = string(f.data)
+			return f.check(wireBytes)
+		case 2:
+			m.Key = string(f.data)
+			return f.check(wireBytes)
+		case 3:
+			m.After = f.varint
+			return f.check(wireVarint)
+		}
+		return nil
+	})
+}
+
+func (m *WatchEvent) Marshal() []byte {
+	b := appendVarintField(nil, 1, uint64(m.Type))
+	b = appendStringField(b, 2, m.Key)
+	b = appendBytesField(b, 3, m.Value)
+	b = appendVarintField(b, 4, m.Sequence)
+	return appendBytesField(b, 5, m.OldValue)
+}
+
+func (m *WatchEvent) Unmarshal(data []byte) error {
+	*m = WatchEvent{}
+	return rangeFields(data, func(f field) error {
+		switch f.number {
+		case 1:
+			m.Type = int64(f.varint)
+			return f.check(wireVarint)
+		case 2:
+			m.Key = string(f.data)
+			return f.check(wireBytes)
+		case 3:
+			m.Value = f.bytes()
+			return f.check(wireBytes)
+		case 4:
+			m.Sequence = f.varint
+			return f.check(wireVarint)
+		case 5:
+			m.OldValue = f.bytes()
+			return f.check(wireBytes)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,175 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// errTruncated is returned when a message ends in the middle of a field
+var errTruncated = errors.New("truncated protobuf message")
+
+// appendVarint appends v in base 128 varint encoding
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendTag appends the key of a field
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendVarintField appends an integer field, omitted when zero as proto3
+// does
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+// appendBoolField appends a bool field, omitted when false
+func appendBoolField(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarintField(b, field, 1)
+}
+
+// appendBytesField appends a bytes field, omitted when empty
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendStringField appends a string field, omitted when empty
+func appendStringField(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendRepeatedStringField appends every element of a repeated string
+// field, empty ones included
+func appendRepeatedStringField(b []byte, field int, values []string) []byte {
+	for _, v := range values {
+		b = appendTag(b, field, wireBytes)
+		b = appendVarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// consumeVarint decodes a varint from the start of b and returns it with
+// the number of bytes it took
+func consumeVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errTruncated
+}
+
+// field is one decoded field of a message: the value of a varint field or
+// the contents of a length-delimited one. Fixed-size fields are skipped as
+// no message here uses them.
+type field struct {
+	number   int
+	wireType int
+	varint   uint64
+	data     []byte
+}
+
+// rangeFields calls fn for each field of an encoded message in order.
+// Unknown fields are passed to fn too, which ignores them, so that newer
+// peers can add fields.
+func rangeFields(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		tag, n, err := consumeVarint(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		f := field{number: int(tag >> 3), wireType: int(tag & 7)}
+		if f.number == 0 {
+			return fmt.Errorf("invalid field number 0")
+		}
+
+		switch f.wireType {
+		case wireVarint:
+			f.varint, n, err = consumeVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+		case wireBytes:
+			length, n, err := consumeVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+			if length > uint64(len(b)) {
+				return errTruncated
+			}
+			f.data = b[:length]
+			b = b[length:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			b = b[8:]
+			continue
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			b = b[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d", f.wireType)
+		}
+
+		err = fn(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check verifies that a known field was sent with the expected wire type
+func (f field) check(wireType int) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("field %d has wire type %d, expected %d", f.number, f.wireType, wireType)
+	}
+	return nil
+}
+
+// bytes returns a copy of a length-delimited field, which must not alias
+// the buffer the message was read into
+func (f field) bytes() []byte {
+	return append([]byte{}, f.data...)
+}
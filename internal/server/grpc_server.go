@@ -0,0 +1,409 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/rpc"
+)
+
+// DefaultGRPCAddr is the address the gRPC server listens on by default
+const DefaultGRPCAddr = ":50051"
+
+// GRPCServer serves the KeyValue service described in
+// proto/kvdb/v1/kvdb.proto over cleartext HTTP/2, the transport gRPC
+// clients use for insecure connections
+type GRPCServer struct {
+	db     *database.DB
+	server *http.Server
+
+	// Shutdown cancels closing, which every request's context derives
+	// from, so that it does not wait for Watch streams that would otherwise
+	// never finish
+	closing context.Context
+	cancel  context.CancelFunc
+}
+
+// grpcStream sends the messages of one response
+type grpcStream struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+}
+
+// NewGRPCServer creates a server for db that will listen on addr
+func NewGRPCServer(db *database.DB, addr string) *GRPCServer {
+	if addr == "" {
+		addr = DefaultGRPCAddr
+	}
+
+	closing, cancel := context.WithCancel(context.Background())
+	s := &GRPCServer{
+		db:      db,
+		closing: closing,
+		cancel:  cancel,
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		Protocols:         protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return closing
+		},
+	}
+	return s
+}
+
+// ListenAndServe listens on the configured address and serves calls until
+// Shutdown is called
+func (s *GRPCServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.server.Addr, err)
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts calls on listener until Shutdown is called, and then
+// returns ErrServerClosed
+func (s *GRPCServer) Serve(listener net.Listener) error {
+	err := s.server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting calls, ends open streams and waits for unary
+// calls in progress to finish, or for ctx to be done. It does not close
+// the database.
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	s.cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// ServeHTTP dispatches a gRPC call
+func (s *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType != rpc.ContentType && !strings.HasPrefix(contentType, rpc.ContentType+"+proto") {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := r.Context()
+	if timeout := r.Header.Get(rpc.HeaderTimeout); timeout != "" {
+		duration, err := rpc.DecodeTimeout(timeout)
+		if err != nil {
+			writeGRPCStatus(w, rpc.Errorf(rpc.CodeInternal, "%v", err))
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", rpc.ContentType)
+	w.Header().Add("Trailer", rpc.HeaderStatus)
+	w.Header().Add("Trailer", rpc.HeaderMessage)
+	w.WriteHeader(http.StatusOK)
+
+	stream := &grpcStream{writer: w}
+	stream.flusher, _ = w.(http.Flusher)
+
+	var err error
+	switch r.URL.Path {
+	case rpc.MethodGet:
+		err = unary(ctx, r.Body, stream, &rpc.GetRequest{}, s.get)
+	case rpc.MethodSet:
+		err = unary(ctx, r.Body, stream, &rpc.SetRequest{}, s.set)
+	case rpc.MethodDelete:
+		err = unary(ctx, r.Body, stream, &rpc.DeleteRequest{}, s.delete)
+	case rpc.MethodKeys:
+		err = unary(ctx, r.Body, stream, &rpc.KeysRequest{}, s.keys)
+	case rpc.MethodSize:
+		err = unary(ctx, r.Body, stream, &rpc.SizeRequest{}, s.size)
+	case rpc.MethodScan:
+		request := &rpc.ScanRequest{}
+		err = readRequest(r.Body, request)
+		if err == nil {
+			err = s.scan(ctx, request, stream)
+		}
+	case rpc.MethodWatch:
+		request := &rpc.WatchRequest{}
+		err = readRequest(r.Body, request)
+		if err == nil {
+			err = s.watch(ctx, request, stream)
+		}
+	default:
+		err = rpc.Errorf(rpc.CodeUnimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	writeGRPCStatus(w, err)
+}
+
+// unary reads the request of a unary call, handles it and sends the
+// response
+func unary[Request rpc.Message, Response rpc.Message](ctx context.Context, body io.Reader, stream *grpcStream, request Request, handle func(context.Context, Request) (Response, error)) error {
+	err := readRequest(body, request)
+	if err != nil {
+		return err
+	}
+
+	response, err := handle(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	return stream.send(response)
+}
+
+// readRequest reads the single request message of a call
+func readRequest(body io.Reader, request rpc.Message) error {
+	err := rpc.ReadMessage(body, request, rpc.DefaultMaxMessageSize)
+	if errors.Is(err, io.EOF) {
+		return rpc.Errorf(rpc.CodeInternal, "missing request message")
+	}
+	return err
+}
+
+// send writes one response message and flushes it to the client
+func (s *grpcStream) send(m rpc.Message) error {
+	err := rpc.WriteMessage(s.writer, m)
+	if err != nil {
+		return rpc.Errorf(rpc.CodeUnavailable, "failed to send message: %v", err)
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+func (s *GRPCServer) get(ctx context.Context, request *rpc.GetRequest) (*rpc.GetResponse, error) {
+	value, version, err := s.db.GetWithVersion(request.Key)
+	if err != nil {
+		return nil, databaseStatus(err)
+	}
+	return &rpc.GetResponse{Value: value, Version: version}, nil
+}
+
+func (s *GRPCServer) set(ctx context.Context, request *rpc.SetRequest) (*rpc.SetResponse, error) {
+	version, err := s.db.SetWithOptions(request.Key, request.Value, &database.SetOptions{
+		TTL:      time.Duration(request.TTLMillis) * time.Millisecond,
+		IfAbsent: request.IfAbsent,
+	})
+	if err != nil {
+		return nil, databaseStatus(err)
+	}
+	if version == 0 {
+		return nil, rpc.Errorf(rpc.CodeAlreadyExists, "key %q already exists", request.Key)
+	}
+	return &rpc.SetResponse{Version: version}, nil
+}
+
+func (s *GRPCServer) delete(ctx context.Context, request *rpc.DeleteRequest) (*rpc.DeleteResponse, error) {
+	var err error
+	if request.IfVersion != 0 {
+		err = s.db.DeleteIfVersion(request.Key, request.IfVersion)
+	} else {
+		err = s.db.Delete(request.Key)
+	}
+	if err != nil {
+		return nil, databaseStatus(err)
+	}
+	return &rpc.DeleteResponse{}, nil
+}
+
+func (s *GRPCServer) keys(ctx context.Context, request *rpc.KeysRequest) (*rpc.KeysResponse, error) {
+	response := &rpc.KeysResponse{}
+	err := s.forEachEntry(ctx, &database.ScanOptions{Prefix: request.Prefix}, 0, func(entry database.KeyValue) error {
+		response.Keys = append(response.Keys, entry.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (s *GRPCServer) size(ctx context.Context, request *rpc.SizeRequest) (*rpc.SizeResponse, error) {
+	return &rpc.SizeResponse{Size: int64(s.db.Size())}, nil
+}
+
+// scan streams the selected entries page by page
+func (s *GRPCServer) scan(ctx context.Context, request *rpc.ScanRequest, stream *grpcStream) error {
+	if request.Limit < 0 {
+		return databaseStatus(database.ErrInvalidLimit)
+	}
+
+	options := &database.ScanOptions{
+		Start:   request.Start,
+		End:     request.End,
+		Prefix:  request.Prefix,
+		Reverse: request.Reverse,
+	}
+	return s.forEachEntry(ctx, options, request.Limit, func(entry database.KeyValue) error {
+		// Only strings can be sent
+		if entry.Type != database.TypeString {
+			return nil
+		}
+		kv := &rpc.KeyValue{Key: entry.Key, Value: entry.Value, Version: entry.Version}
+		if !entry.ExpiresAt.IsZero() {
+			// Round up, so that a key about to expire is not sent as one
+			// that never does
+			kv.TTLMillis = max(1, int64((time.Until(entry.ExpiresAt)+time.Millisecond-1)/time.Millisecond))
+		}
+		return stream.send(kv)
+	})
+}
+
+// forEachEntry calls fn for up to limit entries selected by options, or
+// all of them if limit is zero
+func (s *GRPCServer) forEachEntry(ctx context.Context, options *database.ScanOptions, limit int64, fn func(entry database.KeyValue) error) error {
+	var sent int64
+	for {
+		if ctx.Err() != nil {
+			return contextStatus(ctx.Err())
+		}
+
+		options.Limit = database.DefaultScanLimit
+		if limit > 0 && limit-sent < int64(options.Limit) {
+			options.Limit = int(limit - sent)
+		}
+
+		result, err := s.db.ScanWithOptions(options)
+		if err != nil {
+			return databaseStatus(err)
+		}
+		for _, entry := range result.Entries {
+			err = fn(entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		sent += int64(len(result.Entries))
+		if result.Cursor == "" || (limit > 0 && sent >= limit) {
+			return nil
+		}
+		options.Cursor = result.Cursor
+	}
+}
+
+// watch streams changes until the client goes away or the server shuts
+// down
+func (s *GRPCServer) watch(ctx context.Context, request *rpc.WatchRequest, stream *grpcStream) error {
+	events, err := s.db.WatchWithOptions(ctx, &database.WatchOptions{
+		Prefix: request.Prefix,
+		Key:    request.Key,
+		After:  request.After,
+	})
+	if err != nil {
+		return databaseStatus(err)
+	}
+
+	// Send the headers now so the client knows the watch is in place
+	if stream.flusher != nil {
+		stream.flusher.Flush()
+	}
+
+	for event := range events {
+		eventType := int64(rpc.EventSet)
+		switch event.Type {
+		case database.EventDelete:
+			eventType = rpc.EventDelete
+		case database.EventExpire:
+			eventType = rpc.EventExpire
+		}
+
+		err = stream.send(&rpc.WatchEvent{
+			Type:     eventType,
+			Key:      event.Key,
+			Value:    event.Value,
+			Sequence: event.Sequence,
+			OldValue: event.OldValue,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The channel closes when ctx is done, the database closes or the
+	// client fell too far behind
+	if s.closing.Err() != nil {
+		return rpc.Errorf(rpc.CodeUnavailable, "server is shutting down")
+	}
+	if ctx.Err() != nil {
+		return contextStatus(ctx.Err())
+	}
+	return rpc.Errorf(rpc.CodeUnavailable, "watch ended; watch again to continue")
+}
+
+// writeGRPCStatus sets the trailers that end a call
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	if err == nil {
+		w.Header().Set(rpc.HeaderStatus, strconv.Itoa(int(rpc.CodeOK)))
+		return
+	}
+
+	var status *rpc.Status
+	if !errors.As(err, &status) {
+		status = rpc.Errorf(rpc.CodeInternal, "%v", err)
+	}
+	w.Header().Set(rpc.HeaderStatus, strconv.Itoa(int(status.Code)))
+	w.Header().Set(rpc.HeaderMessage, rpc.EncodeStatusMessage(status.Message))
+}
+
+// databaseStatus maps a database error to a status
+func databaseStatus(err error) *rpc.Status {
+	code := rpc.CodeInternal
+	switch {
+	case errors.Is(err, database.ErrKeyNotFound):
+		code = rpc.CodeNotFound
+	case errors.Is(err, database.ErrEmptyKey),
+		errors.Is(err, database.ErrNilValue),
+		errors.Is(err, database.ErrInvalidTTL),
+		errors.Is(err, database.ErrInvalidLimit):
+		code = rpc.CodeInvalidArgument
+	case errors.Is(err, database.ErrVersionMismatch):
+		code = rpc.CodeAborted
+	case errors.Is(err, database.ErrWatchHistoryLost):
+		code = rpc.CodeOutOfRange
+	case errors.Is(err, database.ErrReadOnly),
+		errors.Is(err, database.ErrWrongType):
+		code = rpc.CodeFailedPrecondition
+	case errors.Is(err, database.ErrDatabaseClosed),
+		errors.Is(err, database.ErrNotLeader):
+		code = rpc.CodeUnavailable
+	}
+	return rpc.Errorf(code, "%v", err)
+}
+
+// contextStatus maps the error of a done context to a status
+func contextStatus(err error) *rpc.Status {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return rpc.Errorf(rpc.CodeDeadlineExceeded, "deadline exceeded")
+	}
+	return rpc.Errorf(rpc.CodeCanceled, "call canceled")
+}
@@ -0,0 +1,501 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+)
+
+// DefaultHTTPAddr is the address the HTTP server listens on by default
+const DefaultHTTPAddr = ":8080"
+
+// maxHTTPBodySize is the largest request body accepted by a PUT
+const maxHTTPBodySize = 64 << 20
+
+const (
+	contentTypeJSON  = "application/json"
+	contentTypeOctet = "application/octet-stream"
+)
+
+// HTTPServer serves a database as a JSON REST API:
+//
+//	GET    /keys/{key}  value of a key
+//	PUT    /keys/{key}  store a value, optionally with a ?ttl= duration
+//	DELETE /keys/{key}  remove a key
+//	GET    /keys        list entries, filtered by ?prefix= or ?start= and
+//	                    ?end=, paged with ?limit= and ?cursor=; lists,
+//	                    hashes, sets and sorted sets are listed with their
+//	                    type and a null value
+//	GET    /watch       stream changes as server-sent events, filtered by
+//	                    ?prefix= or ?key= and resumed after ?after=
+//	GET    /replication replication role, sequence and lag
+//
+// JSON carries values base64-encoded. A single value may be sent and
+// received as a raw body instead by using application/octet-stream as the
+// Content-Type or Accept header.
+//
+// Writes return the new version of the key in the X-Version header. A PUT
+// or DELETE with an If-Match header holding a version only succeeds if the
+// key is still at that version, and a PUT with If-None-Match: * only if the
+// key does not exist; otherwise they fail with 412 Precondition Failed.
+type HTTPServer struct {
+	db          *database.DB
+	server      *http.Server
+	replication *Replication
+
+	// Shutdown cancels closing, which every request's context derives
+	// from, so that it does not wait for watches that would otherwise
+	// never finish
+	closing context.Context
+	cancel  context.CancelFunc
+}
+
+// keyValueJSON is the JSON form of one entry
+type keyValueJSON struct {
+	Key     string `json:"key"`
+	Value   []byte `json:"value"`
+	Type    string `json:"type,omitempty"` // Set for values other than strings
+	Version uint64 `json:"version,omitempty"`
+}
+
+// putRequestJSON is the JSON body of a PUT
+type putRequestJSON struct {
+	Value []byte `json:"value"`
+}
+
+// listResponseJSON is one page of a listing
+type listResponseJSON struct {
+	Entries []keyValueJSON `json:"entries"`
+	Cursor  string         `json:"cursor,omitempty"`
+}
+
+// errorJSON is the body of every error response
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+// watchEventJSON is the data of one server-sent watch event
+type watchEventJSON struct {
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Value    []byte `json:"value,omitempty"`
+	OldValue []byte `json:"old_value,omitempty"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// NewHTTPServer creates a server for db that will listen on addr
+func NewHTTPServer(db *database.DB, addr string) *HTTPServer {
+	if addr == "" {
+		addr = DefaultHTTPAddr
+	}
+
+	closing, cancel := context.WithCancel(context.Background())
+	s := &HTTPServer{
+		db:      db,
+		closing: closing,
+		cancel:  cancel,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", s.handleList)
+	mux.HandleFunc("/keys/", s.handleKey)
+	mux.HandleFunc("/watch", s.handleWatch)
+	mux.HandleFunc("/replication", s.handleReplication)
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return closing
+		},
+	}
+	return s
+}
+
+// ListenAndServe listens on the configured address and serves requests
+// until Shutdown is called
+func (s *HTTPServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.server.Addr, err)
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts requests on listener until Shutdown is called, and then
+// returns ErrServerClosed
+func (s *HTTPServer) Serve(listener net.Listener) error {
+	err := s.server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Handler returns the handler serving the API, for mounting it elsewhere
+func (s *HTTPServer) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Shutdown stops accepting requests, ends open watches and waits for the
+// other requests in progress to finish, or for ctx to be done. It does not
+// close the database.
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	s.cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// handleKey serves a single key
+func (s *HTTPServer) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.getKey(w, r, key)
+	case http.MethodPut:
+		s.putKey(w, r, key)
+	case http.MethodDelete:
+		s.deleteKey(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// getKey writes the value of key, raw if the client only accepts raw bytes
+func (s *HTTPServer) getKey(w http.ResponseWriter, r *http.Request, key string) {
+	value, version, err := s.db.GetWithVersion(key)
+	if err != nil {
+		writeDatabaseHTTPError(w, err)
+		return
+	}
+
+	if acceptsOctetStream(r) {
+		w.Header().Set("Content-Type", contentTypeOctet)
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		w.Header().Set("X-Version", strconv.FormatUint(version, 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(value)
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keyValueJSON{
+		Key:     key,
+		Value:   value,
+		Version: version,
+	})
+}
+
+// putKey stores the request body under key
+func (s *HTTPServer) putKey(w http.ResponseWriter, r *http.Request, key string) {
+	var ttl time.Duration
+	if query := r.URL.Query().Get("ttl"); query != "" {
+		var err error
+		ttl, err = time.ParseDuration(query)
+		if err != nil || ttl <= 0 {
+			writeHTTPError(w, http.StatusBadRequest, "ttl must be a positive duration such as 30s")
+			return
+		}
+	}
+
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ifAbsent := r.Header.Get("If-None-Match") == "*"
+	switch {
+	case ifVersion != 0 && ttl > 0:
+		writeHTTPError(w, http.StatusBadRequest, "ttl cannot be combined with If-Match")
+		return
+	case ifVersion != 0 && ifAbsent:
+		writeHTTPError(w, http.StatusBadRequest, "If-Match cannot be combined with If-None-Match")
+		return
+	}
+
+	value, err := readValue(w, r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeHTTPError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+			return
+		}
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var version uint64
+	if ifVersion != 0 {
+		version, err = s.db.SetIfVersion(key, value, ifVersion)
+	} else {
+		version, err = s.db.SetWithOptions(key, value, &database.SetOptions{TTL: ttl, IfAbsent: ifAbsent})
+	}
+	if err != nil {
+		writeDatabaseHTTPError(w, err)
+		return
+	}
+	if version == 0 {
+		writeHTTPError(w, http.StatusPreconditionFailed, "key already exists")
+		return
+	}
+
+	w.Header().Set("X-Version", strconv.FormatUint(version, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteKey removes key
+func (s *HTTPServer) deleteKey(w http.ResponseWriter, r *http.Request, key string) {
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if ifVersion != 0 {
+		err = s.db.DeleteIfVersion(key, ifVersion)
+	} else {
+		err = s.db.Delete(key)
+	}
+	if err != nil {
+		writeDatabaseHTTPError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ifMatchVersion returns the version in the If-Match header of r, quoted
+// as an entity tag or not, or zero if there is none
+func ifMatchVersion(r *http.Request) (uint64, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseUint(strings.Trim(header, `"`), 10, 64)
+	if err != nil || version == 0 {
+		return 0, errors.New("If-Match must hold a version")
+	}
+	return version, nil
+}
+
+// handleList serves one page of entries
+func (s *HTTPServer) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	options := &database.ScanOptions{
+		Start:  query.Get("start"),
+		End:    query.Get("end"),
+		Prefix: query.Get("prefix"),
+		Cursor: query.Get("cursor"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		options.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "limit must be an integer")
+			return
+		}
+	}
+	if reverse := query.Get("reverse"); reverse != "" {
+		var err error
+		options.Reverse, err = strconv.ParseBool(reverse)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "reverse must be true or false")
+			return
+		}
+	}
+
+	result, err := s.db.ScanWithOptions(options)
+	if err != nil {
+		writeDatabaseHTTPError(w, err)
+		return
+	}
+
+	response := listResponseJSON{
+		Entries: make([]keyValueJSON, 0, len(result.Entries)),
+		Cursor:  result.Cursor,
+	}
+	for _, entry := range result.Entries {
+		// Only strings have a value to send; other types are named instead
+		kv := keyValueJSON{Key: entry.Key, Value: entry.Value}
+		if entry.Type != database.TypeString {
+			kv.Value, kv.Type = nil, entry.Type.String()
+		}
+		response.Entries = append(response.Entries, kv)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleWatch streams changes as server-sent events until the client goes
+// away. Each event is named after its type and carries its sequence number
+// as its id, so an EventSource that reconnects resumes where it left off
+// by sending it back as Last-Event-ID.
+func (s *HTTPServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	query := r.URL.Query()
+	options := &database.WatchOptions{
+		Prefix: query.Get("prefix"),
+		Key:    query.Get("key"),
+	}
+	after := query.Get("after")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		after = id
+	}
+	if after != "" {
+		var err error
+		options.After, err = strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "after must be a sequence number")
+			return
+		}
+	}
+
+	events, err := s.db.WatchWithOptions(r.Context(), options)
+	if err != nil {
+		writeDatabaseHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// The stream ends when the client goes away, the server shuts down or
+	// the client fell too far behind; a client reconnecting resumes
+	for event := range events {
+		data, err := json.Marshal(watchEventJSON{
+			Type:     event.Type.String(),
+			Key:      event.Key,
+			Value:    event.Value,
+			OldValue: event.OldValue,
+			Sequence: event.Sequence,
+		})
+		if err != nil {
+			return
+		}
+
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Type, data)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// readValue reads the value of a PUT, either the raw body or a JSON object
+// holding it base64-encoded
+func readValue(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := http.MaxBytesReader(w, r.Body, maxHTTPBodySize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == contentTypeOctet {
+		value, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		// An empty body is an empty value, not a missing one
+		if value == nil {
+			value = []byte{}
+		}
+		return value, nil
+	}
+
+	var request putRequestJSON
+	err := json.NewDecoder(body).Decode(&request)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid JSON body: %v", err)
+	}
+
+	return request.Value, nil
+}
+
+// acceptsOctetStream reports whether the client asked for a raw value
+func acceptsOctetStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == contentTypeOctet {
+			return true
+		}
+	}
+	return false
+}
+
+// httpStatus maps a database error to a status code
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrEmptyKey),
+		errors.Is(err, database.ErrNilValue),
+		errors.Is(err, database.ErrInvalidTTL),
+		errors.Is(err, database.ErrInvalidLimit):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, database.ErrWrongType):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, database.ErrWatchHistoryLost):
+		return http.StatusGone
+	case errors.Is(err, database.ErrDatabaseClosed),
+		errors.Is(err, database.ErrNotLeader):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeDatabaseHTTPError writes a database error with its status code
+func writeDatabaseHTTPError(w http.ResponseWriter, err error) {
+	writeHTTPError(w, httpStatus(err), err.Error())
+}
+
+// writeHTTPError writes an error response
+func writeHTTPError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorJSON{Error: message})
+}
+
+// writeJSON writes v as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
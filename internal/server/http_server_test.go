@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+)
+
+// startHTTPServer serves a new database over HTTP for the length of a test
+func startHTTPServer(t *testing.T) (*httptest.Server, *database.DB) {
+	t.Helper()
+
+	config := database.DefaultConfig()
+	config.LogPath = t.TempDir()
+	config.SnapshotInterval = 0
+	db, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewHTTPServer(db, "").Handler())
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+	return server, db
+}
+
+// doHTTP sends a request with the given header names and values and
+// returns the response and its body
+func doHTTP(t *testing.T, method, url, body string, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, data
+}
+
+// TestHTTPStatus checks the status code each kind of request and failure
+// is answered with
+func TestHTTPStatus(t *testing.T) {
+	server, db := startHTTPServer(t)
+
+	_, err := db.RPush("list", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers []string
+		want    int
+	}{
+		{"put", http.MethodPut, "/keys/a", `{"value":"MQ=="}`, nil, http.StatusNoContent},
+		{"put raw", http.MethodPut, "/keys/b", "raw", []string{"Content-Type", contentTypeOctet}, http.StatusNoContent},
+		{"put with ttl", http.MethodPut, "/keys/c?ttl=1m", `{"value":"MQ=="}`, nil, http.StatusNoContent},
+		{"get", http.MethodGet, "/keys/a", "", nil, http.StatusOK},
+		{"get missing", http.MethodGet, "/keys/missing", "", nil, http.StatusNotFound},
+		{"delete missing", http.MethodDelete, "/keys/missing", "", nil, http.StatusNotFound},
+		{"empty key", http.MethodGet, "/keys/", "", nil, http.StatusBadRequest},
+		{"bad ttl", http.MethodPut, "/keys/a?ttl=soon", `{"value":"MQ=="}`, nil, http.StatusBadRequest},
+		{"negative ttl", http.MethodPut, "/keys/a?ttl=-1s", `{"value":"MQ=="}`, nil, http.StatusBadRequest},
+		{"bad body", http.MethodPut, "/keys/a", "{", nil, http.StatusBadRequest},
+		{"bad limit", http.MethodGet, "/keys?limit=x", "", nil, http.StatusBadRequest},
+		{"bad watch position", http.MethodGet, "/watch?after=x", "", nil, http.StatusBadRequest},
+		{"method", http.MethodPost, "/keys/a", "", nil, http.StatusMethodNotAllowed},
+		{"list method", http.MethodDelete, "/keys", "", nil, http.StatusMethodNotAllowed},
+		{"wrong type", http.MethodGet, "/keys/list", "", nil, http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, body := doHTTP(t, test.method, server.URL+test.path, test.body, test.headers...)
+			if response.StatusCode != test.want {
+				t.Fatalf("%s %s = %d %s, want %d", test.method, test.path, response.StatusCode, body, test.want)
+			}
+			if test.want >= 400 {
+				var message errorJSON
+				if err := json.Unmarshal(body, &message); err != nil || message.Error == "" {
+					t.Fatalf("error body %q is not an error message", body)
+				}
+			}
+		})
+	}
+
+	// A raw value comes back raw, with its version in a header
+	response, body := doHTTP(t, http.MethodGet, server.URL+"/keys/b", "", "Accept", contentTypeOctet)
+	if response.StatusCode != http.StatusOK || string(body) != "raw" || response.Header.Get("X-Version") == "" {
+		t.Fatalf("raw GET = %d %q, version %q", response.StatusCode, body, response.Header.Get("X-Version"))
+	}
+
+	// A closed database is unavailable
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, body = doHTTP(t, http.MethodGet, server.URL+"/keys/a", "")
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("GET after close = %d %s, want %d", response.StatusCode, body, http.StatusServiceUnavailable)
+	}
+}
+
+// TestHTTPConditionalWrites checks If-Match and If-None-Match on PUT and
+// DELETE
+func TestHTTPConditionalWrites(t *testing.T) {
+	server, _ := startHTTPServer(t)
+	url := server.URL + "/keys/key"
+	raw := []string{"Content-Type", contentTypeOctet}
+
+	// If-None-Match: * only creates
+	response, _ := doHTTP(t, http.MethodPut, url, "1", append(raw, "If-None-Match", "*")...)
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT of a new key with If-None-Match = %d, want %d", response.StatusCode, http.StatusNoContent)
+	}
+	version := response.Header.Get("X-Version")
+	if version == "" {
+		t.Fatal("PUT returned no version")
+	}
+	response, _ = doHTTP(t, http.MethodPut, url, "2", append(raw, "If-None-Match", "*")...)
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("PUT of an existing key with If-None-Match = %d, want %d", response.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	// If-Match takes the version, as an entity tag or not
+	response, _ = doHTTP(t, http.MethodPut, url, "3", append(raw, "If-Match", `"`+version+`"`)...)
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT with the current version = %d, want %d", response.StatusCode, http.StatusNoContent)
+	}
+	next := response.Header.Get("X-Version")
+	if n, _ := strconv.ParseUint(next, 10, 64); next == version || n == 0 {
+		t.Fatalf("PUT with If-Match returned version %q after %q", next, version)
+	}
+	response, _ = doHTTP(t, http.MethodPut, url, "4", append(raw, "If-Match", version)...)
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with an old version = %d, want %d", response.StatusCode, http.StatusPreconditionFailed)
+	}
+	response, _ = doHTTP(t, http.MethodDelete, url, "", "If-Match", version)
+	if response.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with an old version = %d, want %d", response.StatusCode, http.StatusPreconditionFailed)
+	}
+	_, body := doHTTP(t, http.MethodGet, url, "", "Accept", contentTypeOctet)
+	if string(body) != "3" {
+		t.Fatalf("value after failed conditional writes = %q, want %q", body, "3")
+	}
+
+	// Requests that cannot be met are rejected before anything is written
+	for _, headers := range [][]string{
+		{"If-Match", "x"},
+		{"If-Match", "0"},
+		{"If-Match", next, "If-None-Match", "*"},
+	} {
+		response, _ = doHTTP(t, http.MethodPut, url, "5", append(raw, headers...)...)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("PUT with %q = %d, want %d", headers, response.StatusCode, http.StatusBadRequest)
+		}
+	}
+	response, _ = doHTTP(t, http.MethodPut, url+"?ttl=1m", "5", append(raw, "If-Match", next)...)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("PUT with If-Match and a ttl = %d, want %d", response.StatusCode, http.StatusBadRequest)
+	}
+
+	response, _ = doHTTP(t, http.MethodDelete, url, "", "If-Match", next)
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE with the current version = %d, want %d", response.StatusCode, http.StatusNoContent)
+	}
+	response, _ = doHTTP(t, http.MethodPut, url, "6", append(raw, "If-Match", next)...)
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("PUT of a deleted key with If-Match = %d, want %d", response.StatusCode, http.StatusNotFound)
+	}
+}
+
+// TestHTTPList pages through a listing and checks that keys of every type
+// are listed
+func TestHTTPList(t *testing.T) {
+	server, db := startHTTPServer(t)
+
+	var want []string
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		err := db.Set(key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	_, err := db.RPush("list", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "list")
+	err = db.Set("other", []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("listing does not end")
+		}
+		response, body := doHTTP(t, http.MethodGet, server.URL+"/keys?start=a&end=m&limit=2&cursor="+cursor, "")
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("GET /keys = %d %s", response.StatusCode, body)
+		}
+		var page listResponseJSON
+		err = json.Unmarshal(body, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Entries) > 2 {
+			t.Fatalf("page of %d entries, want at most 2", len(page.Entries))
+		}
+		for _, entry := range page.Entries {
+			got = append(got, entry.Key)
+			switch {
+			case entry.Key == "list" && (entry.Type != "list" || entry.Value != nil):
+				t.Fatalf("list entry = %+v, want type list and no value", entry)
+			case entry.Key != "list" && (entry.Type != "" || string(entry.Value) != entry.Key):
+				t.Fatalf("string entry = %+v", entry)
+			}
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("listed %q, want %q", got, want)
+	}
+
+	// Values of other types are sent as null rather than left out
+	_, body := doHTTP(t, http.MethodGet, server.URL+"/keys?prefix=list", "")
+	if !bytes.Contains(body, []byte(`{"key":"list","value":null,"type":"list"}`)) {
+		t.Fatalf("listing of a list is %s", body)
+	}
+}
+
+// TestHTTPWatch streams changes to a key as server-sent events
+func TestHTTPWatch(t *testing.T) {
+	server, _ := startHTTPServer(t)
+
+	response, err := http.Get(server.URL + "/watch?key=key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /watch = %d, %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	raw := []string{"Content-Type", contentTypeOctet}
+	doHTTP(t, http.MethodPut, server.URL+"/keys/other", "0", raw...)
+	put, _ := doHTTP(t, http.MethodPut, server.URL+"/keys/key", "1", raw...)
+	doHTTP(t, http.MethodDelete, server.URL+"/keys/key", "")
+
+	reader := bufio.NewReader(response.Body)
+	readEvent := func() (id, event string, data watchEventJSON) {
+		t.Helper()
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return id, event, data
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data)
+				if err != nil {
+					t.Fatal(err)
+				}
+			default:
+				t.Fatalf("unexpected line %q", line)
+			}
+		}
+	}
+
+	id, event, data := readEvent()
+	if id != put.Header.Get("X-Version") || event != "set" || data.Type != event || data.Key != "key" || string(data.Value) != "1" {
+		t.Fatalf("first event = %s %s %+v, want the PUT at version %s", id, event, data, put.Header.Get("X-Version"))
+	}
+	if strconv.FormatUint(data.Sequence, 10) != id {
+		t.Fatalf("event %s carries sequence %d", id, data.Sequence)
+	}
+	_, event, data = readEvent()
+	if event != "delete" || data.Type != event || data.Key != "key" || string(data.OldValue) != "1" {
+		t.Fatalf("second event = %s %+v, want the DELETE", event, data)
+	}
+}
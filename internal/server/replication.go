@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/replication"
+)
+
+// Replication tells the servers what part the database plays in
+// replication, so that they can report on it. At most one of the fields
+// is set; neither means the database is not replicated.
+type Replication struct {
+	Primary  *replication.Primary
+	Follower *replication.Follower
+}
+
+// replicationJSON is the body of GET /replication
+type replicationJSON struct {
+	Role      string              `json:"role"`
+	Sequence  uint64              `json:"sequence"`
+	Followers []followerInfoJSON  `json:"followers,omitempty"`
+	Follower  *followerStatusJSON `json:"follower,omitempty"`
+}
+
+// followerInfoJSON describes a follower connected to this primary
+type followerInfoJSON struct {
+	Addr     string    `json:"addr"`
+	FullSync bool      `json:"full_sync"`
+	Sequence uint64    `json:"sequence"`
+	Lag      uint64    `json:"lag"`
+	LastAck  time.Time `json:"last_ack"`
+}
+
+// followerStatusJSON describes this follower
+type followerStatusJSON struct {
+	Primary         string    `json:"primary"`
+	State           string    `json:"state"`
+	PrimarySequence uint64    `json:"primary_sequence"`
+	Lag             uint64    `json:"lag"`
+	LastContact     time.Time `json:"last_contact"`
+	FullSyncs       int       `json:"full_syncs"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+// SetReplication makes INFO report on replication, and HELLO give the
+// role of the server. It must be called before the server starts serving.
+func (s *RESPServer) SetReplication(r *Replication) {
+	s.replication = r
+}
+
+// SetReplication makes GET /replication report on replication. It must be
+// called before the server starts serving.
+func (s *HTTPServer) SetReplication(r *Replication) {
+	s.replication = r
+}
+
+// replicationInfo formats the replication section of INFO, using the
+// field names Redis uses so that existing tools understand it
+func replicationInfo(r *Replication, sequence uint64) string {
+	var b strings.Builder
+	b.WriteString("# Replication\r\n")
+
+	if r != nil && r.Follower != nil {
+		status := r.Follower.Status()
+		host, port, err := net.SplitHostPort(status.Primary)
+		if err != nil {
+			host = status.Primary
+		}
+		linkStatus := "down"
+		if status.State == replication.StateStreaming {
+			linkStatus = "up"
+		}
+		syncing := 0
+		if status.State == replication.StateSyncing {
+			syncing = 1
+		}
+		lastIO := -1
+		if !status.LastContact.IsZero() {
+			lastIO = int(time.Since(status.LastContact).Seconds())
+		}
+
+		fmt.Fprintf(&b, "role:slave\r\nmaster_host:%s\r\nmaster_port:%s\r\n", host, port)
+		fmt.Fprintf(&b, "master_link_status:%s\r\nmaster_last_io_seconds_ago:%d\r\n", linkStatus, lastIO)
+		fmt.Fprintf(&b, "master_sync_in_progress:%d\r\nslave_repl_offset:%d\r\n", syncing, status.Sequence)
+		fmt.Fprintf(&b, "master_repl_offset:%d\r\nslave_lag:%d\r\nslave_read_only:1\r\n", status.PrimarySequence, status.Lag)
+		return b.String()
+	}
+
+	b.WriteString("role:master\r\n")
+	var followers []replication.FollowerInfo
+	if r != nil && r.Primary != nil {
+		followers = r.Primary.Followers()
+	}
+	fmt.Fprintf(&b, "connected_slaves:%d\r\n", len(followers))
+	for i, follower := range followers {
+		host, port, err := net.SplitHostPort(follower.Addr)
+		if err != nil {
+			host = follower.Addr
+		}
+		fmt.Fprintf(&b, "slave%d:ip=%s,port=%s,state=online,offset=%d,lag=%d\r\n", i, host, port, follower.Sequence, follower.Lag)
+	}
+	fmt.Fprintf(&b, "master_repl_offset:%d\r\n", sequence)
+	return b.String()
+}
+
+// handleReplication reports on replication
+func (s *HTTPServer) handleReplication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	response := replicationJSON{
+		Role:     "primary",
+		Sequence: s.db.LastSequence(),
+	}
+	if s.replication != nil && s.replication.Follower != nil {
+		status := s.replication.Follower.Status()
+		response.Role = "follower"
+		response.Follower = &followerStatusJSON{
+			Primary:         status.Primary,
+			State:           status.State,
+			PrimarySequence: status.PrimarySequence,
+			Lag:             status.Lag,
+			LastContact:     status.LastContact,
+			FullSyncs:       status.FullSyncs,
+			LastError:       status.LastError,
+		}
+	}
+	if s.replication != nil && s.replication.Primary != nil {
+		for _, follower := range s.replication.Primary.Followers() {
+			response.Followers = append(response.Followers, followerInfoJSON{
+				Addr:     follower.Addr,
+				FullSync: follower.FullSync,
+				Sequence: follower.Sequence,
+				Lag:      follower.Lag,
+				LastAck:  follower.LastAck,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
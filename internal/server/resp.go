@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+const (
+	// maxBulkLength is the largest bulk string a client may send
+	maxBulkLength = 512 << 20
+
+	// maxArrayLength is the largest number of arguments in one command
+	maxArrayLength = 1 << 20
+
+	// maxInlineLength is the longest inline command line accepted
+	maxInlineLength = 64 << 10
+
+	// bulkChunkSize is how much of a bulk string is read before its buffer
+	// has to grow
+	bulkChunkSize = 64 << 10
+)
+
+// errProtocol is returned when a client sends something that is not RESP
+var errProtocol = errors.New("protocol error")
+
+// respReader reads commands sent by a client. Commands are normally arrays
+// of bulk strings, but plain space-separated lines are accepted as well so
+// the server can be used with telnet.
+type respReader struct {
+	reader *bufio.Reader
+}
+
+// newRESPReader creates a reader on top of r
+func newRESPReader(r io.Reader) *respReader {
+	return &respReader{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// readCommand reads one command and returns its arguments. An empty inline
+// line yields no arguments.
+func (r *respReader) readCommand() ([][]byte, error) {
+	prefix, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != '*' {
+		return r.readInline()
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count > maxArrayLength {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+
+	args := make([][]byte, 0, max(count, 0))
+	for i := 0; i < count; i++ {
+		arg, err := r.readBulk()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// readBulk reads one bulk string argument
+func (r *respReader) readBulk() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, truncate(line))
+	}
+
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length < 0 || length > maxBulkLength {
+		return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+	}
+
+	// The buffer grows as data arrives, at most doubling each time, so a
+	// client cannot make the server allocate far more than it has sent
+	total := length + 2
+	data := make([]byte, 0, min(total, bulkChunkSize))
+	for len(data) < total {
+		if len(data) == cap(data) {
+			data = slices.Grow(data, min(len(data), total-len(data)))
+		}
+		n, err := io.ReadFull(r.reader, data[len(data):min(cap(data), total)])
+		data = data[:len(data)+n]
+		if err != nil {
+			return nil, err
+		}
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+	}
+
+	return data[:length], nil
+}
+
+// readInline reads a command written as a plain line
+func (r *respReader) readInline() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.Fields(line), nil
+}
+
+// readLine reads up to the next newline and strips the line ending
+func (r *respReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxInlineLength {
+			return nil, fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// truncate shortens client input quoted in error messages
+func truncate(data []byte) []byte {
+	if len(data) > 32 {
+		return data[:32]
+	}
+	return data
+}
+
+// respWriter writes replies in RESP2 or, once a client has asked for it
+// with HELLO, RESP3. The two only differ for the reply types RESP2 lacks.
+type respWriter struct {
+	writer   *bufio.Writer
+	protocol int
+}
+
+// newRESPWriter creates a RESP2 writer on top of w
+func newRESPWriter(w io.Writer) *respWriter {
+	return &respWriter{
+		writer:   bufio.NewWriter(w),
+		protocol: 2,
+	}
+}
+
+// writeSimple writes a simple string such as OK
+func (w *respWriter) writeSimple(s string) {
+	w.writer.WriteByte('+')
+	w.writer.WriteString(s)
+	w.writer.WriteString("\r\n")
+}
+
+// writeError writes an error reply. The message should start with an error
+// code such as ERR.
+func (w *respWriter) writeError(message string) {
+	w.writer.WriteByte('-')
+	w.writer.WriteString(message)
+	w.writer.WriteString("\r\n")
+}
+
+// writeInteger writes an integer reply
+func (w *respWriter) writeInteger(n int64) {
+	w.writer.WriteByte(':')
+	w.writer.WriteString(strconv.FormatInt(n, 10))
+	w.writer.WriteString("\r\n")
+}
+
+// writeBulk writes a binary-safe string
+func (w *respWriter) writeBulk(data []byte) {
+	w.writer.WriteByte('$')
+	w.writer.WriteString(strconv.Itoa(len(data)))
+	w.writer.WriteString("\r\n")
+	w.writer.Write(data)
+	w.writer.WriteString("\r\n")
+}
+
+// writeBulkString writes a string as a bulk string
+func (w *respWriter) writeBulkString(s string) {
+	w.writeBulk([]byte(s))
+}
+
+// writeNull writes a missing value
+func (w *respWriter) writeNull() {
+	if w.protocol >= 3 {
+		w.writer.WriteString("_\r\n")
+		return
+	}
+	w.writer.WriteString("$-1\r\n")
+}
+
+// writeArray writes the header of an array of n elements, which the caller
+// writes next
+func (w *respWriter) writeArray(n int) {
+	w.writer.WriteByte('*')
+	w.writer.WriteString(strconv.Itoa(n))
+	w.writer.WriteString("\r\n")
+}
+
+// writeMap writes the header of a map of n key-value pairs. RESP2 has no
+// maps, so there they are sent as a flat array.
+func (w *respWriter) writeMap(n int) {
+	if w.protocol >= 3 {
+		w.writer.WriteByte('%')
+		w.writer.WriteString(strconv.Itoa(n))
+		w.writer.WriteString("\r\n")
+		return
+	}
+	w.writeArray(2 * n)
+}
+
+// writePush writes the header of an out-of-band push of n elements, such
+// as a pub/sub message. RESP2 has no push type, so there pushes are sent
+// as arrays.
+func (w *respWriter) writePush(n int) {
+	if w.protocol >= 3 {
+		w.writer.WriteByte('>')
+		w.writer.WriteString(strconv.Itoa(n))
+		w.writer.WriteString("\r\n")
+		return
+	}
+	w.writeArray(n)
+}
+
+// flush sends buffered replies to the client
+func (w *respWriter) flush() error {
+	return w.writer.Flush()
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parseScore parses a sorted set score, which may be inf or -inf
+func parseScore(arg []byte) (float64, bool) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	return score, err == nil && !math.IsNaN(score)
+}
+
+// formatScore formats a sorted set score the way Redis does
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func cmdType(c *respConn, args [][]byte) {
+	valueType, err := c.server.db.Type(string(args[0]))
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeSimple("none")
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeSimple(valueType.String())
+}
+
+func cmdLPush(c *respConn, args [][]byte) {
+	length, err := c.server.db.LPush(string(args[0]), args[1:]...)
+	writeCount(c, length, err)
+}
+
+func cmdRPush(c *respConn, args [][]byte) {
+	length, err := c.server.db.RPush(string(args[0]), args[1:]...)
+	writeCount(c, length, err)
+}
+
+func cmdLPop(c *respConn, args [][]byte) {
+	pop(c, args, c.server.db.LPop)
+}
+
+func cmdRPop(c *respConn, args [][]byte) {
+	pop(c, args, c.server.db.RPop)
+}
+
+// pop implements LPOP and RPOP key [count]. Without a count a single
+// element is returned rather than an array.
+func pop(c *respConn, args [][]byte, fn func(key string, count int) ([][]byte, error)) {
+	count := int64(1)
+	if len(args) == 2 {
+		var ok bool
+		count, ok = parseInt(args[1])
+		if !ok || count < 0 {
+			c.writer.writeError("ERR value is out of range, must be positive")
+			return
+		}
+		if count == 0 {
+			c.writer.writeArray(0)
+			return
+		}
+	}
+
+	values, err := fn(string(args[0]), int(count))
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeNull()
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+
+	if len(args) == 1 {
+		c.writer.writeBulk(values[0])
+		return
+	}
+	writeBulks(c, values)
+}
+
+func cmdLRange(c *respConn, args [][]byte) {
+	start, stop, ok := parseRange(c, args[1], args[2])
+	if !ok {
+		return
+	}
+
+	values, err := c.server.db.LRange(string(args[0]), start, stop)
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	writeBulks(c, values)
+}
+
+func cmdLLen(c *respConn, args [][]byte) {
+	length, err := c.server.db.LLen(string(args[0]))
+	writeCount(c, length, err)
+}
+
+// cmdHSet implements HSET key field value [field value ...]
+func cmdHSet(c *respConn, args [][]byte) {
+	if len(args)%2 != 1 {
+		c.writer.writeError("ERR wrong number of arguments for 'hset' command")
+		return
+	}
+
+	fields := make(map[string][]byte, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		fields[string(args[i])] = args[i+1]
+	}
+	added, err := c.server.db.HSet(string(args[0]), fields)
+	writeCount(c, added, err)
+}
+
+func cmdHGet(c *respConn, args [][]byte) {
+	value, err := c.server.db.HGet(string(args[0]), string(args[1]))
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeNull()
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeBulk(value)
+}
+
+// cmdHGetAll replies with the fields of a hash in ascending order
+func cmdHGetAll(c *respConn, args [][]byte) {
+	hash, err := c.server.db.HGetAll(string(args[0]))
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	c.writer.writeMap(len(fields))
+	for _, field := range fields {
+		c.writer.writeBulkString(field)
+		c.writer.writeBulk(hash[field])
+	}
+}
+
+func cmdHDel(c *respConn, args [][]byte) {
+	removed, err := c.server.db.HDel(string(args[0]), toStrings(args[1:])...)
+	writeCount(c, removed, err)
+}
+
+func cmdSAdd(c *respConn, args [][]byte) {
+	added, err := c.server.db.SAdd(string(args[0]), toStrings(args[1:])...)
+	writeCount(c, added, err)
+}
+
+func cmdSRem(c *respConn, args [][]byte) {
+	removed, err := c.server.db.SRem(string(args[0]), toStrings(args[1:])...)
+	writeCount(c, removed, err)
+}
+
+func cmdSIsMember(c *respConn, args [][]byte) {
+	member, err := c.server.db.SIsMember(string(args[0]), string(args[1]))
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(boolToInt(member))
+}
+
+func cmdSMembers(c *respConn, args [][]byte) {
+	members, err := c.server.db.SMembers(string(args[0]))
+	writeStrings(c, members, err)
+}
+
+func cmdSInter(c *respConn, args [][]byte) {
+	members, err := c.server.db.SInter(toStrings(args)...)
+	writeStrings(c, members, err)
+}
+
+// cmdZAdd implements ZADD key score member [score member ...]
+func cmdZAdd(c *respConn, args [][]byte) {
+	if len(args)%2 != 1 {
+		c.writer.writeError(errSyntax)
+		return
+	}
+
+	members := make(map[string]float64, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		score, ok := parseScore(args[i])
+		if !ok {
+			c.writer.writeError(errNotFloat)
+			return
+		}
+		members[string(args[i+1])] = score
+	}
+	added, err := c.server.db.ZAdd(string(args[0]), members)
+	writeCount(c, added, err)
+}
+
+func cmdZRem(c *respConn, args [][]byte) {
+	removed, err := c.server.db.ZRem(string(args[0]), toStrings(args[1:])...)
+	writeCount(c, removed, err)
+}
+
+// cmdZRange implements ZRANGE key start stop [WITHSCORES]
+func cmdZRange(c *respConn, args [][]byte) {
+	withScores := false
+	if len(args) == 4 {
+		if strings.ToLower(string(args[3])) != "withscores" {
+			c.writer.writeError(errSyntax)
+			return
+		}
+		withScores = true
+	} else if len(args) > 4 {
+		c.writer.writeError(errSyntax)
+		return
+	}
+
+	start, stop, ok := parseRange(c, args[1], args[2])
+	if !ok {
+		return
+	}
+
+	members, err := c.server.db.ZRange(string(args[0]), start, stop)
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+
+	if !withScores {
+		c.writer.writeArray(len(members))
+		for _, member := range members {
+			c.writer.writeBulkString(member.Member)
+		}
+		return
+	}
+	c.writer.writeArray(2 * len(members))
+	for _, member := range members {
+		c.writer.writeBulkString(member.Member)
+		c.writer.writeBulkString(formatScore(member.Score))
+	}
+}
+
+func cmdZRank(c *respConn, args [][]byte) {
+	rank, err := c.server.db.ZRank(string(args[0]), string(args[1]))
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeNull()
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(int64(rank))
+}
+
+func cmdZScore(c *respConn, args [][]byte) {
+	score, err := c.server.db.ZScore(string(args[0]), string(args[1]))
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeNull()
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeBulkString(formatScore(score))
+}
+
+// parseRange parses the start and stop indexes of LRANGE and ZRANGE,
+// replying with an error if they are not integers
+func parseRange(c *respConn, startArg, stopArg []byte) (int, int, bool) {
+	start, ok := parseInt(startArg)
+	if ok {
+		var stop int64
+		stop, ok = parseInt(stopArg)
+		if ok {
+			return int(start), int(stop), true
+		}
+	}
+	c.writer.writeError(errNotInteger)
+	return 0, 0, false
+}
+
+// writeCount replies with a count, or with the error that prevented it
+func writeCount(c *respConn, n int, err error) {
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(int64(n))
+}
+
+// writeBulks replies with an array of values
+func writeBulks(c *respConn, values [][]byte) {
+	c.writer.writeArray(len(values))
+	for _, value := range values {
+		c.writer.writeBulk(value)
+	}
+}
+
+// writeStrings replies with an array of strings, or with the error that
+// prevented it
+func writeStrings(c *respConn, values []string, err error) {
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeArray(len(values))
+	for _, value := range values {
+		c.writer.writeBulkString(value)
+	}
+}
+
+// toStrings turns arguments into strings
+func toStrings(args [][]byte) []string {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = string(arg)
+	}
+	return values
+}
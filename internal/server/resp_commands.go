@@ -0,0 +1,602 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/glob"
+)
+
+// respCommand describes a command the RESP server understands. Arity
+// counts the command name; a negative arity is a minimum.
+type respCommand struct {
+	arity   int
+	handler func(c *respConn, args [][]byte)
+}
+
+// respCommands maps lower-case command names to their implementation
+var respCommands = map[string]respCommand{
+	"ping":    {-1, cmdPing},
+	"echo":    {2, cmdEcho},
+	"hello":   {-1, cmdHello},
+	"select":  {2, cmdSelect},
+	"client":  {-2, cmdClient},
+	"command": {-1, cmdCommand},
+	"info":    {-1, cmdInfo},
+	"quit":    {1, cmdQuit},
+	"get":     {2, cmdGet},
+	"set":     {-3, cmdSet},
+	"setnx":   {3, cmdSetNX},
+	"setex":   {4, cmdSetEX},
+	"psetex":  {4, cmdPSetEX},
+	"mget":    {-2, cmdMGet},
+	"mset":    {-3, cmdMSet},
+	"del":     {-2, cmdDel},
+	"unlink":  {-2, cmdDel},
+	"exists":  {-2, cmdExists},
+	"keys":    {2, cmdKeys},
+	"dbsize":  {1, cmdDBSize},
+	"expire":  {3, cmdExpire},
+	"pexpire": {3, cmdPExpire},
+	"ttl":     {2, cmdTTL},
+	"pttl":    {2, cmdPTTL},
+	"persist": {2, cmdPersist},
+	"type":    {2, cmdType},
+
+	"incr":        {2, cmdIncr},
+	"incrby":      {3, cmdIncrBy},
+	"incrbyfloat": {3, cmdIncrByFloat},
+	"decr":        {2, cmdDecr},
+	"decrby":      {3, cmdDecrBy},
+
+	"lpush":     {-3, cmdLPush},
+	"rpush":     {-3, cmdRPush},
+	"lpop":      {-2, cmdLPop},
+	"rpop":      {-2, cmdRPop},
+	"lrange":    {4, cmdLRange},
+	"llen":      {2, cmdLLen},
+	"hset":      {-4, cmdHSet},
+	"hget":      {3, cmdHGet},
+	"hgetall":   {2, cmdHGetAll},
+	"hdel":      {-3, cmdHDel},
+	"sadd":      {-3, cmdSAdd},
+	"srem":      {-3, cmdSRem},
+	"sismember": {3, cmdSIsMember},
+	"smembers":  {2, cmdSMembers},
+	"sinter":    {-2, cmdSInter},
+	"zadd":      {-4, cmdZAdd},
+	"zrem":      {-3, cmdZRem},
+	"zrange":    {-4, cmdZRange},
+	"zrank":     {3, cmdZRank},
+	"zscore":    {3, cmdZScore},
+
+	"publish":      {3, cmdPublish},
+	"subscribe":    {-2, cmdSubscribe},
+	"psubscribe":   {-2, cmdPSubscribe},
+	"unsubscribe":  {-1, cmdUnsubscribe},
+	"punsubscribe": {-1, cmdPUnsubscribe},
+}
+
+const (
+	errSyntax     = "ERR syntax error"
+	errNotInteger = "ERR value is not an integer or out of range"
+	errNotFloat   = "ERR value is not a valid float"
+)
+
+// parseInt parses an integer argument
+func parseInt(arg []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	return n, err == nil
+}
+
+// ttlDuration returns n units as a duration, or false if it is too long
+// for one or for the expiry time it leads to to be held in nanoseconds
+func ttlDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > (math.MaxInt64-time.Now().UnixNano())/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// isNotFound reports whether err means the key does not exist
+func isNotFound(err error) bool {
+	return errors.Is(err, database.ErrKeyNotFound)
+}
+
+func cmdPing(c *respConn, args [][]byte) {
+	// A subscribed RESP2 client gets the pong as a message would arrive
+	if c.subscribed() && c.writer.protocol < 3 && len(args) <= 1 {
+		c.writer.writeArray(2)
+		c.writer.writeBulkString("pong")
+		if len(args) == 1 {
+			c.writer.writeBulk(args[0])
+		} else {
+			c.writer.writeBulkString("")
+		}
+		return
+	}
+
+	switch len(args) {
+	case 0:
+		c.writer.writeSimple("PONG")
+	case 1:
+		c.writer.writeBulk(args[0])
+	default:
+		c.writer.writeError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func cmdEcho(c *respConn, args [][]byte) {
+	c.writer.writeBulk(args[0])
+}
+
+// cmdHello switches protocol version and describes the server
+func cmdHello(c *respConn, args [][]byte) {
+	protocol := c.writer.protocol
+	if len(args) > 0 {
+		version, ok := parseInt(args[0])
+		if !ok || (version != 2 && version != 3) {
+			c.writer.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+		protocol = int(version)
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		switch strings.ToLower(string(args[0])) {
+		case "setname":
+			if len(args) < 2 {
+				c.writer.writeError(errSyntax)
+				return
+			}
+			c.name = string(args[1])
+			args = args[2:]
+		case "auth":
+			c.writer.writeError("ERR AUTH is not supported by this server")
+			return
+		default:
+			c.writer.writeError(errSyntax)
+			return
+		}
+	}
+
+	role := "master"
+	if r := c.server.replication; r != nil && r.Follower != nil {
+		role = "replica"
+	}
+
+	c.writer.protocol = protocol
+	c.writer.writeMap(6)
+	c.writer.writeBulkString("server")
+	c.writer.writeBulkString("kvdb")
+	c.writer.writeBulkString("version")
+	c.writer.writeBulkString("7.0.0")
+	c.writer.writeBulkString("proto")
+	c.writer.writeInteger(int64(protocol))
+	c.writer.writeBulkString("mode")
+	c.writer.writeBulkString("standalone")
+	c.writer.writeBulkString("role")
+	c.writer.writeBulkString(role)
+	c.writer.writeBulkString("modules")
+	c.writer.writeArray(0)
+}
+
+// cmdSelect accepts database 0, the only one there is
+func cmdSelect(c *respConn, args [][]byte) {
+	if string(args[0]) != "0" {
+		c.writer.writeError("ERR DB index is out of range")
+		return
+	}
+	c.writer.writeSimple("OK")
+}
+
+// cmdClient implements the CLIENT subcommands clients send on connect
+func cmdClient(c *respConn, args [][]byte) {
+	switch strings.ToLower(string(args[0])) {
+	case "setname":
+		if len(args) != 2 {
+			c.writer.writeError(errSyntax)
+			return
+		}
+		c.name = string(args[1])
+		c.writer.writeSimple("OK")
+	case "getname":
+		if c.name == "" {
+			c.writer.writeNull()
+			return
+		}
+		c.writer.writeBulkString(c.name)
+	case "setinfo":
+		c.writer.writeSimple("OK")
+	default:
+		c.writer.writeError(fmt.Sprintf("ERR unknown subcommand '%s'", truncate(args[0])))
+	}
+}
+
+// cmdCommand returns no command documentation; redis-cli copes with that
+func cmdCommand(c *respConn, args [][]byte) {
+	c.writer.writeArray(0)
+}
+
+func cmdInfo(c *respConn, args [][]byte) {
+	info := "# Server\r\nredis_version:7.0.0\r\nredis_mode:standalone\r\n\r\n" +
+		replicationInfo(c.server.replication, c.server.db.LastSequence()) +
+		fmt.Sprintf("\r\n# Keyspace\r\ndb0:keys=%d\r\n", c.server.db.Size())
+	c.writer.writeBulkString(info)
+}
+
+func cmdQuit(c *respConn, args [][]byte) {
+	c.writer.writeSimple("OK")
+	c.quit = true
+}
+
+func cmdGet(c *respConn, args [][]byte) {
+	value, err := c.server.db.Get(string(args[0]))
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeNull()
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeBulk(value)
+}
+
+// cmdSet implements SET key value [EX seconds|PX milliseconds] [NX|XX]
+func cmdSet(c *respConn, args [][]byte) {
+	options := &database.SetOptions{}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			options.IfAbsent = true
+		case "xx":
+			options.IfExists = true
+		case "ex", "px":
+			if i+1 == len(args) || options.TTL != 0 {
+				c.writer.writeError(errSyntax)
+				return
+			}
+			n, ok := parseInt(args[i+1])
+			if !ok {
+				c.writer.writeError(errNotInteger)
+				return
+			}
+			unit := time.Second
+			if strings.ToLower(string(args[i])) == "px" {
+				unit = time.Millisecond
+			}
+			options.TTL, ok = ttlDuration(n, unit)
+			if n <= 0 || !ok {
+				c.writer.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			i++
+		default:
+			c.writer.writeError(errSyntax)
+			return
+		}
+	}
+	if options.IfAbsent && options.IfExists {
+		c.writer.writeError(errSyntax)
+		return
+	}
+
+	version, err := c.server.db.SetWithOptions(string(args[0]), args[1], options)
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	if version == 0 {
+		c.writer.writeNull()
+		return
+	}
+	c.writer.writeSimple("OK")
+}
+
+func cmdSetNX(c *respConn, args [][]byte) {
+	stored, err := c.server.db.SetIfAbsent(string(args[0]), args[1])
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(boolToInt(stored))
+}
+
+func cmdSetEX(c *respConn, args [][]byte) {
+	setWithTTL(c, args[0], args[2], args[1], time.Second)
+}
+
+func cmdPSetEX(c *respConn, args [][]byte) {
+	setWithTTL(c, args[0], args[2], args[1], time.Millisecond)
+}
+
+// setWithTTL stores a value that expires after ttl units
+func setWithTTL(c *respConn, key, value, ttl []byte, unit time.Duration) {
+	n, ok := parseInt(ttl)
+	if !ok {
+		c.writer.writeError(errNotInteger)
+		return
+	}
+	duration, ok := ttlDuration(n, unit)
+	if n <= 0 || !ok {
+		c.writer.writeError("ERR invalid expire time")
+		return
+	}
+
+	err := c.server.db.SetWithTTL(string(key), value, duration)
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeSimple("OK")
+}
+
+func cmdIncr(c *respConn, args [][]byte) {
+	n, err := c.server.db.Incr(string(args[0]))
+	writeCounter(c, n, err)
+}
+
+func cmdDecr(c *respConn, args [][]byte) {
+	n, err := c.server.db.Decr(string(args[0]))
+	writeCounter(c, n, err)
+}
+
+func cmdIncrBy(c *respConn, args [][]byte) {
+	delta, ok := parseInt(args[1])
+	if !ok {
+		c.writer.writeError(errNotInteger)
+		return
+	}
+	n, err := c.server.db.IncrBy(string(args[0]), delta)
+	writeCounter(c, n, err)
+}
+
+func cmdDecrBy(c *respConn, args [][]byte) {
+	delta, ok := parseInt(args[1])
+	if !ok {
+		c.writer.writeError(errNotInteger)
+		return
+	}
+	if delta == math.MinInt64 {
+		c.writer.writeError("ERR decrement would overflow")
+		return
+	}
+	n, err := c.server.db.IncrBy(string(args[0]), -delta)
+	writeCounter(c, n, err)
+}
+
+func cmdIncrByFloat(c *respConn, args [][]byte) {
+	delta, err := strconv.ParseFloat(string(args[1]), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		c.writer.writeError(errNotFloat)
+		return
+	}
+	n, err := c.server.db.IncrByFloat(string(args[0]), delta)
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeBulkString(strconv.FormatFloat(n, 'f', -1, 64))
+}
+
+// writeCounter replies with the value of a counter, or with the error that
+// prevented changing it
+func writeCounter(c *respConn, n int64, err error) {
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(n)
+}
+
+func cmdMGet(c *respConn, args [][]byte) {
+	c.writer.writeArray(len(args))
+	for _, key := range args {
+		value, err := c.server.db.Get(string(key))
+		if err != nil {
+			c.writer.writeNull()
+			continue
+		}
+		c.writer.writeBulk(value)
+	}
+}
+
+// cmdMSet stores all pairs in one transaction
+func cmdMSet(c *respConn, args [][]byte) {
+	if len(args)%2 != 0 {
+		c.writer.writeError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	txn, err := c.server.db.Begin()
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	for i := 0; i < len(args); i += 2 {
+		err = txn.Set(string(args[i]), args[i+1])
+		if err != nil {
+			txn.Rollback()
+			c.writeDatabaseError(err)
+			return
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeSimple("OK")
+}
+
+// cmdDel removes keys and replies with how many existed
+func cmdDel(c *respConn, args [][]byte) {
+	var removed int64
+	for _, key := range args {
+		err := c.server.db.Delete(string(key))
+		if err == nil {
+			removed++
+		} else if !isNotFound(err) {
+			c.writeDatabaseError(err)
+			return
+		}
+	}
+	c.writer.writeInteger(removed)
+}
+
+// cmdExists counts how many of the keys exist, repeats included
+func cmdExists(c *respConn, args [][]byte) {
+	var count int64
+	for _, key := range args {
+		_, err := c.server.db.Type(string(key))
+		if err == nil {
+			count++
+		}
+	}
+	c.writer.writeInteger(count)
+}
+
+// cmdKeys lists the keys matching a glob pattern. Only keys sharing the
+// pattern's literal prefix are scanned.
+func cmdKeys(c *respConn, args [][]byte) {
+	pattern := string(args[0])
+	options := &database.ScanOptions{
+		Prefix: glob.Prefix(pattern),
+		Limit:  1000,
+	}
+
+	var keys []string
+	for {
+		result, err := c.server.db.ScanWithOptions(options)
+		if err != nil {
+			c.writeDatabaseError(err)
+			return
+		}
+		for _, entry := range result.Entries {
+			if glob.Match(pattern, entry.Key) {
+				keys = append(keys, entry.Key)
+			}
+		}
+		if result.Cursor == "" {
+			break
+		}
+		options.Cursor = result.Cursor
+	}
+
+	c.writer.writeArray(len(keys))
+	for _, key := range keys {
+		c.writer.writeBulkString(key)
+	}
+}
+
+func cmdDBSize(c *respConn, args [][]byte) {
+	c.writer.writeInteger(int64(c.server.db.Size()))
+}
+
+func cmdExpire(c *respConn, args [][]byte) {
+	expire(c, args[0], args[1], time.Second)
+}
+
+func cmdPExpire(c *respConn, args [][]byte) {
+	expire(c, args[0], args[1], time.Millisecond)
+}
+
+// expire sets a key to expire after ttl units. As in Redis, a ttl that is
+// not positive deletes the key right away.
+func expire(c *respConn, key, ttl []byte, unit time.Duration) {
+	n, ok := parseInt(ttl)
+	if !ok {
+		c.writer.writeError(errNotInteger)
+		return
+	}
+
+	duration, ok := ttlDuration(n, unit)
+	if !ok {
+		c.writer.writeError("ERR invalid expire time")
+		return
+	}
+
+	var err error
+	if n <= 0 {
+		err = c.server.db.Delete(string(key))
+	} else {
+		err = c.server.db.Expire(string(key), duration)
+	}
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeInteger(0)
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(1)
+}
+
+func cmdTTL(c *respConn, args [][]byte) {
+	ttl(c, args[0], time.Second)
+}
+
+func cmdPTTL(c *respConn, args [][]byte) {
+	ttl(c, args[0], time.Millisecond)
+}
+
+// ttl replies with the time left before a key expires in the given unit,
+// -1 if it does not expire and -2 if it does not exist
+func ttl(c *respConn, key []byte, unit time.Duration) {
+	remaining, err := c.server.db.TTL(string(key))
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeInteger(-2)
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	if remaining == database.NoExpiry {
+		c.writer.writeInteger(-1)
+		return
+	}
+	c.writer.writeInteger(int64(remaining.Round(unit) / unit))
+}
+
+// cmdPersist removes an expiry and replies 1 if there was one
+func cmdPersist(c *respConn, args [][]byte) {
+	key := string(args[0])
+	remaining, err := c.server.db.TTL(key)
+	if err != nil || remaining == database.NoExpiry {
+		if err != nil && !isNotFound(err) {
+			c.writeDatabaseError(err)
+			return
+		}
+		c.writer.writeInteger(0)
+		return
+	}
+
+	err = c.server.db.Persist(key)
+	if err != nil {
+		if isNotFound(err) {
+			c.writer.writeInteger(0)
+			return
+		}
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(1)
+}
+
+// boolToInt converts a boolean to the 1 or 0 Redis replies with
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+)
+
+// subscribedCommands are the commands a RESP2 client may send while it is
+// subscribed to anything
+var subscribedCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+// subscribed reports whether the client is subscribed to any channel or
+// pattern
+func (c *respConn) subscribed() bool {
+	return c.subscription != nil && c.subscription.Count() > 0
+}
+
+// subscribe returns the client's subscription, creating it and starting to
+// forward its messages on first use
+func (c *respConn) subscribe() (*database.Subscription, error) {
+	if c.subscription != nil {
+		return c.subscription, nil
+	}
+
+	s, err := c.server.db.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	c.subscription = s
+	c.forwarded = make(chan struct{})
+	go c.forward(s)
+	return s, nil
+}
+
+// forward writes the messages of a subscription to the client until the
+// subscription ends. A client disconnected for falling behind is
+// disconnected at once, even if a write to it is blocked.
+func (c *respConn) forward(s *database.Subscription) {
+	defer close(c.forwarded)
+
+	go func() {
+		<-s.Done()
+		if errors.Is(s.Err(), database.ErrSlowSubscriber) {
+			c.conn.Close()
+		}
+	}()
+
+	for message := range s.Messages() {
+		c.writeMutex.Lock()
+		if message.Pattern != "" {
+			c.writer.writePush(4)
+			c.writer.writeBulkString("pmessage")
+			c.writer.writeBulkString(message.Pattern)
+		} else {
+			c.writer.writePush(3)
+			c.writer.writeBulkString("message")
+		}
+		c.writer.writeBulkString(message.Channel)
+		c.writer.writeBulk(message.Payload)
+
+		// Messages published together are sent together
+		var err error
+		if len(s.Messages()) == 0 {
+			err = c.writer.flush()
+		}
+		c.writeMutex.Unlock()
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// writeSubscription confirms a change of subscription with the number of
+// channels and patterns the client is left subscribed to. A nil name is
+// sent as null, for unsubscribing from everything when there was nothing
+// to unsubscribe from.
+func (c *respConn) writeSubscription(kind string, name []byte, count int) {
+	c.writer.writePush(3)
+	c.writer.writeBulkString(kind)
+	if name == nil {
+		c.writer.writeNull()
+	} else {
+		c.writer.writeBulk(name)
+	}
+	c.writer.writeInteger(int64(count))
+}
+
+func cmdPublish(c *respConn, args [][]byte) {
+	receivers, err := c.server.db.Publish(string(args[0]), args[1])
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+	c.writer.writeInteger(int64(receivers))
+}
+
+func cmdSubscribe(c *respConn, args [][]byte) {
+	subscribeEach(c, "subscribe", args, (*database.Subscription).Subscribe)
+}
+
+func cmdPSubscribe(c *respConn, args [][]byte) {
+	subscribeEach(c, "psubscribe", args, (*database.Subscription).PSubscribe)
+}
+
+func cmdUnsubscribe(c *respConn, args [][]byte) {
+	unsubscribeEach(c, "unsubscribe", args, (*database.Subscription).Channels, (*database.Subscription).Unsubscribe)
+}
+
+func cmdPUnsubscribe(c *respConn, args [][]byte) {
+	unsubscribeEach(c, "punsubscribe", args, (*database.Subscription).Patterns, (*database.Subscription).PUnsubscribe)
+}
+
+// subscribeEach subscribes to each name in turn, confirming each one
+func subscribeEach(c *respConn, kind string, names [][]byte, add func(*database.Subscription, ...string) error) {
+	s, err := c.subscribe()
+	if err != nil {
+		c.writeDatabaseError(err)
+		return
+	}
+
+	for _, name := range names {
+		err = add(s, string(name))
+		if err != nil {
+			c.writeDatabaseError(err)
+			return
+		}
+		c.writeSubscription(kind, name, s.Count())
+	}
+}
+
+// unsubscribeEach unsubscribes from each name in turn, or from every name
+// listed by current if none are given, confirming each one
+func unsubscribeEach(c *respConn, kind string, names [][]byte, current func(*database.Subscription) []string, remove func(*database.Subscription, ...string) error) {
+	s := c.subscription
+	if len(names) == 0 && s != nil {
+		for _, name := range current(s) {
+			names = append(names, []byte(name))
+		}
+	}
+	if len(names) == 0 {
+		c.writeSubscription(kind, nil, countSubscribed(s))
+		return
+	}
+
+	for _, name := range names {
+		if s != nil {
+			err := remove(s, string(name))
+			if err != nil {
+				c.writeDatabaseError(err)
+				return
+			}
+		}
+		c.writeSubscription(kind, name, countSubscribed(s))
+	}
+}
+
+// countSubscribed returns how many channels and patterns s is subscribed
+// to, which is none if it is nil
+func countSubscribed(s *database.Subscription) int {
+	if s == nil {
+		return 0
+	}
+	return s.Count()
+}
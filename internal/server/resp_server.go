@@ -0,0 +1,247 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+)
+
+// DefaultRESPAddr is the address the RESP server listens on by default,
+// the standard Redis port
+const DefaultRESPAddr = ":6379"
+
+// ErrServerClosed is returned by Serve once Close has been called
+var ErrServerClosed = errors.New("server closed")
+
+// RESPServer serves a database over TCP using the Redis serialization
+// protocol, so that Redis clients and redis-cli can talk to it
+type RESPServer struct {
+	db          *database.DB
+	addr        string
+	listener    net.Listener
+	conns       map[*respConn]struct{}
+	mutex       sync.Mutex
+	closed      bool
+	wg          sync.WaitGroup
+	replication *Replication
+}
+
+// respConn is one client connection
+type respConn struct {
+	server *RESPServer
+	conn   net.Conn
+	reader *respReader
+	writer *respWriter
+	name   string
+	quit   bool
+
+	// writeMutex is held while replies are written and flushed, as pub/sub
+	// messages are written by another goroutine
+	writeMutex   sync.Mutex
+	subscription *database.Subscription // Nil until the first SUBSCRIBE or PSUBSCRIBE
+	forwarded    chan struct{}          // Closed once the subscription's messages are written
+}
+
+// NewRESPServer creates a server for db that will listen on addr
+func NewRESPServer(db *database.DB, addr string) *RESPServer {
+	if addr == "" {
+		addr = DefaultRESPAddr
+	}
+	return &RESPServer{
+		db:    db,
+		addr:  addr,
+		conns: make(map[*respConn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the configured address and serves clients
+// until Close is called
+func (s *RESPServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts clients on listener until Close is called, and then
+// returns ErrServerClosed
+func (s *RESPServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		client := &respConn{
+			server: s,
+			conn:   conn,
+			reader: newRESPReader(conn),
+			writer: newRESPWriter(conn),
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[client] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go client.serve()
+	}
+}
+
+// Addr returns the address the server is listening on, or nil if it is not
+// listening yet
+func (s *RESPServer) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops accepting clients, disconnects the connected ones and waits
+// for their current commands to finish. It does not close the database.
+func (s *RESPServer) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for client := range s.conns {
+		client.conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serve reads and executes commands until the client disconnects
+func (c *respConn) serve() {
+	defer func() {
+		c.conn.Close()
+		if c.subscription != nil {
+			c.subscription.Close()
+			<-c.forwarded
+		}
+
+		c.server.mutex.Lock()
+		delete(c.server.conns, c)
+		c.server.mutex.Unlock()
+		c.server.wg.Done()
+	}()
+
+	for !c.quit {
+		args, err := c.reader.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.writeMutex.Lock()
+				c.writer.writeError("ERR " + err.Error())
+				c.writer.flush()
+				c.writeMutex.Unlock()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		c.writeMutex.Lock()
+		c.execute(args)
+
+		// Pipelined commands are answered together
+		if c.reader.reader.Buffered() == 0 {
+			err = c.writer.flush()
+		}
+		c.writeMutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	c.writeMutex.Lock()
+	c.writer.flush()
+	c.writeMutex.Unlock()
+}
+
+// execute runs one command and writes its reply
+func (c *respConn) execute(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	command, exists := respCommands[name]
+	if !exists {
+		c.writer.writeError(fmt.Sprintf("ERR unknown command '%s'", truncate(args[0])))
+		return
+	}
+
+	if (command.arity > 0 && len(args) != command.arity) || (command.arity < 0 && len(args) < -command.arity) {
+		c.writer.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+
+	// RESP2 cannot tell replies from messages, so a subscribed client may
+	// only manage its subscriptions
+	if c.subscribed() && c.writer.protocol < 3 && !subscribedCommands[name] {
+		c.writer.writeError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", name))
+		return
+	}
+
+	command.handler(c, args[1:])
+}
+
+// writeDatabaseError replies with a database error. Errors Redis also
+// has are sent as Redis sends them, so that clients recognize them; Redis
+// has no codes for the others, so they are sent as ERR.
+func (c *respConn) writeDatabaseError(err error) {
+	switch {
+	case errors.Is(err, database.ErrReadOnly):
+		c.writer.writeError("READONLY You can't write against a read only replica.")
+	case errors.Is(err, database.ErrWrongType):
+		c.writer.writeError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	case errors.Is(err, database.ErrNotInteger):
+		c.writer.writeError(errNotInteger)
+	case errors.Is(err, database.ErrNotFloat):
+		c.writer.writeError(errNotFloat)
+	case errors.Is(err, database.ErrOverflow):
+		c.writer.writeError("ERR increment or decrement would overflow")
+	default:
+		c.writer.writeError("ERR " + err.Error())
+	}
+}
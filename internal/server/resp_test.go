@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sidquark/KeyValueDatabase/internal/database"
+	"github.com/sidquark/KeyValueDatabase/internal/replication"
+)
+
+func TestReadCommand(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 3*bulkChunkSize+7)
+
+	tests := []struct {
+		name  string
+		input string
+		want  [][]byte
+	}{
+		{"array", "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", [][]byte{[]byte("GET"), []byte("key")}},
+		{"empty bulk", "*1\r\n$0\r\n\r\n", [][]byte{{}}},
+		{"large bulk", fmt.Sprintf("*1\r\n$%d\r\n%s\r\n", len(large), large), [][]byte{large}},
+		{"inline", "SET key value\r\n", [][]byte{[]byte("SET"), []byte("key"), []byte("value")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := newRESPReader(strings.NewReader(test.input)).readCommand()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(args) != len(test.want) {
+				t.Fatalf("got %d arguments, want %d", len(args), len(test.want))
+			}
+			for i := range args {
+				if !bytes.Equal(args[i], test.want[i]) {
+					t.Fatalf("argument %d = %.32q, want %.32q", i, args[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadCommandInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"negative length", "*1\r\n$-1\r\n", errProtocol},
+		{"too long", fmt.Sprintf("*1\r\n$%d\r\n", maxBulkLength+1), errProtocol},
+		{"missing CRLF", "*1\r\n$3\r\nGETxx", errProtocol},
+		{"not a bulk", "*1\r\n:1\r\n", errProtocol},
+		{"truncated", "*1\r\n$10\r\nGET", io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newRESPReader(strings.NewReader(test.input)).readCommand()
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestReadBulkAllocation checks that advertising a large bulk string does
+// not make the reader allocate it before the data arrives
+func TestReadBulkAllocation(t *testing.T) {
+	input := fmt.Sprintf("*1\r\n$%d\r\nshort", maxBulkLength)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := newRESPReader(strings.NewReader(input)).readCommand()
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("allocated %d bytes for a truncated bulk string", allocated)
+	}
+}
+
+// newTestRESPConn returns a connection to a new database whose replies are
+// written to out
+func newTestRESPConn(t *testing.T, out io.Writer) *respConn {
+	t.Helper()
+
+	config := database.DefaultConfig()
+	config.LogPath = t.TempDir()
+	config.SnapshotInterval = 0
+	db, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &respConn{
+		server: NewRESPServer(db, ""),
+		writer: newRESPWriter(out),
+	}
+}
+
+// TestHelloRole checks that HELLO reports a follower as a replica
+func TestHelloRole(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestRESPConn(t, &out)
+
+	c.execute([][]byte{[]byte("HELLO")})
+	c.writer.flush()
+	if !strings.Contains(out.String(), "$4\r\nrole\r\n$6\r\nmaster\r\n") {
+		t.Fatalf("HELLO on a primary = %q, want role master", out.String())
+	}
+
+	out.Reset()
+	c.server.SetReplication(&Replication{Follower: replication.NewFollower(c.server.db, "127.0.0.1:1")})
+	c.execute([][]byte{[]byte("HELLO")})
+	c.writer.flush()
+	if !strings.Contains(out.String(), "$4\r\nrole\r\n$7\r\nreplica\r\n") {
+		t.Fatalf("HELLO on a follower = %q, want role replica", out.String())
+	}
+}
+
+// TestExpireTimeOverflow checks that expire times too long to hold in
+// nanoseconds are refused rather than wrapping around
+func TestExpireTimeOverflow(t *testing.T) {
+	var out bytes.Buffer
+	c := newTestRESPConn(t, &out)
+	err := c.server.db.Set("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	huge := strconv.FormatInt(math.MaxInt64/int64(time.Second)+1, 10)
+	hugeMillis := strconv.FormatInt(math.MaxInt64/int64(time.Millisecond)-1, 10)
+	tests := [][]string{
+		{"SET", "key", "other", "EX", huge},
+		{"SET", "key", "other", "PX", hugeMillis},
+		{"SETEX", "key", huge, "other"},
+		{"PSETEX", "key", hugeMillis, "other"},
+		{"EXPIRE", "key", huge},
+		{"PEXPIRE", "key", hugeMillis},
+		{"EXPIRE", "key", "9223372036"},
+	}
+	for _, test := range tests {
+		args := make([][]byte, len(test))
+		for i, arg := range test {
+			args[i] = []byte(arg)
+		}
+		out.Reset()
+		c.execute(args)
+		c.writer.flush()
+		if !strings.HasPrefix(out.String(), "-ERR invalid expire time") {
+			t.Fatalf("%q = %q, want an invalid expire time error", test, out.String())
+		}
+	}
+
+	// The key is left as it was
+	value, err := c.server.db.Get("key")
+	if err != nil || string(value) != "value" {
+		t.Fatalf("Get = %q, %v; want %q", value, err, "value")
+	}
+	if ttl, err := c.server.db.TTL("key"); err != nil || ttl != database.NoExpiry {
+		t.Fatalf("TTL = %v, %v; want no expiry", ttl, err)
+	}
+
+	// A long expiry that fits is accepted
+	out.Reset()
+	c.execute([][]byte{[]byte("EXPIRE"), []byte("key"), []byte("3153600000")})
+	c.writer.flush()
+	if out.String() != ":1\r\n" {
+		t.Fatalf("EXPIRE for a century = %q, want :1", out.String())
+	}
+}
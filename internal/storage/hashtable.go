@@ -1,109 +1,694 @@
 package storage
 
 import (
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// HashTable implements an in-memory key-value store with thread safety
+const (
+	// DefaultMaxLoadFactor is the average number of entries per bucket above
+	// which the table doubles its bucket count
+	DefaultMaxLoadFactor = 4.0
+
+	// migrateStep is how many old buckets each write moves while growing
+	migrateStep = 2
+)
+
+// HashTable implements an in-memory key-value store with thread safety.
+//
+// The table grows online: once it holds more than MaxLoadFactor entries per
+// bucket, a table with twice as many buckets is allocated and writes move the
+// old buckets over a few at a time. Until a bucket has been moved, its keys
+// are served from the old table, so no operation ever waits for more than
+// one bucket.
 type HashTable struct {
-	buckets    []*Bucket
-	bucketSize int
-	mutex      sync.RWMutex
+	state         atomic.Pointer[tableState]
+	seed          uint64
+	maxLoadFactor float64
+	size          atomic.Int64
+
+	// growMutex serializes starting a resize and handing out old buckets to
+	// migrate. migrated is the index of the next old bucket to move.
+	growMutex sync.Mutex
+	migrated  int
+
+	// resizeMutex is held for reading by iterations and for writing while a
+	// bucket moves, so an iteration sees each key exactly once
+	resizeMutex sync.RWMutex
+
+	// sweepCursor is the bucket the next DeleteExpired call starts from
+	sweepCursor atomic.Uint64
+
+	// index orders the keys for range scans. It is updated while the key's
+	// bucket is locked, so it always agrees with the buckets about which
+	// keys exist.
+	index *skipList
+
+	onExpire func(key string, entry Entry)
+}
+
+// Entry is a stored value along with its type, expiry and version
+type Entry struct {
+	Value     []byte
+	Type      ValueType
+	ExpiresAt int64  // Unix nanoseconds; zero means the entry never expires
+	Version   uint64 // Changes whenever the value is written
+
+	// Collection holds a collection in whatever form its owner keeps it
+	// in, so that it can be changed in place; Value is then unused. The
+	// table never looks inside it.
+	Collection any
+}
+
+// ValueType is the kind of value an entry holds. Values other than strings
+// are collections, held in Entry.Collection or encoded in Value in the form
+// of persistence.EncodeItems.
+type ValueType uint8
+
+const (
+	TypeString ValueType = iota
+	TypeList
+	TypeHash
+	TypeSet
+	TypeSortedSet
+)
+
+// String returns the name of the type, as Redis calls it
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeHash:
+		return "hash"
+	case TypeSet:
+		return "set"
+	case TypeSortedSet:
+		return "zset"
+	default:
+		return "unknown"
+	}
+}
+
+// expired reports whether the entry has expired at time now
+func (e Entry) expired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now
+}
+
+// tableState is the set of bucket arrays a key may live in. old is non-nil
+// while a resize is in progress.
+type tableState struct {
+	current *bucketArray
+	old     *bucketArray
+}
+
+// bucketArray is a power-of-two sized array of buckets
+type bucketArray struct {
+	buckets []*Bucket
+	mask    uint64
 }
 
+// bucketIDs numbers buckets so that several can be locked in a fixed order
+var bucketIDs atomic.Uint64
+
 // Bucket holds entries for a portion of the key space
 type Bucket struct {
-	entries map[string][]byte
-	mutex   sync.RWMutex // Fine-grained locking
+	id       uint64
+	entries  map[string]Entry
+	mutex    sync.RWMutex // Fine-grained locking
+	migrated bool         // Set once the entries have moved to a newer table
+}
+
+// HashTableOptions configures a hash table
+type HashTableOptions struct {
+	NumBuckets    int     // Initial bucket count, rounded up to a power of two
+	Seed          uint64  // Hash seed; zero picks a random one
+	MaxLoadFactor float64 // Zero uses DefaultMaxLoadFactor; negative disables growth
+
+	// OnExpire, if set, is called for every expired entry removed, while
+	// its bucket is locked. It must not use the table.
+	OnExpire func(key string, entry Entry)
+}
+
+// Stats describes how keys are spread over the buckets
+type Stats struct {
+	Entries         int
+	Buckets         int
+	UsedBuckets     int
+	MaxBucketSize   int
+	Resizing        bool
+	MigratedBuckets int // Old buckets moved so far while resizing
 }
 
 // NewHashTable creates a new hash table with specified bucket count
 func NewHashTable(numBuckets int) *HashTable {
-	buckets := make([]*Bucket, numBuckets)
-	for i := 0; i < numBuckets; i++ {
+	return NewHashTableWithOptions(&HashTableOptions{NumBuckets: numBuckets})
+}
+
+// NewHashTableWithOptions creates a new hash table with the given options
+func NewHashTableWithOptions(options *HashTableOptions) *HashTable {
+	if options == nil {
+		options = &HashTableOptions{}
+	}
+
+	seed := options.Seed
+	for seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	maxLoadFactor := options.MaxLoadFactor
+	if maxLoadFactor == 0 {
+		maxLoadFactor = DefaultMaxLoadFactor
+	}
+
+	ht := &HashTable{
+		seed:          seed,
+		maxLoadFactor: maxLoadFactor,
+		index:         newSkipList(),
+		onExpire:      options.OnExpire,
+	}
+	ht.state.Store(&tableState{current: newBucketArray(options.NumBuckets)})
+	return ht
+}
+
+// newBucketArray allocates at least numBuckets empty buckets
+func newBucketArray(numBuckets int) *bucketArray {
+	size := 1
+	for size < numBuckets {
+		size <<= 1
+	}
+
+	buckets := make([]*Bucket, size)
+	for i := range buckets {
 		buckets[i] = &Bucket{
-			entries: make(map[string][]byte),
+			id:      bucketIDs.Add(1),
+			entries: make(map[string]Entry),
 		}
 	}
-	return &HashTable{
-		buckets:    buckets,
-		bucketSize: numBuckets,
+	return &bucketArray{
+		buckets: buckets,
+		mask:    uint64(size - 1),
+	}
+}
+
+// bucket returns the bucket a hash maps to
+func (a *bucketArray) bucket(hash uint64) *Bucket {
+	return a.buckets[hash&a.mask]
+}
+
+// hash computes a seeded 64-bit FNV-1a hash of key, finished with the
+// MurmurHash3 mixer so that the low bits used for bucket selection depend on
+// every byte of the key
+func (ht *HashTable) hash(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+
+	hash := uint64(offset64) ^ ht.seed
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= prime64
+	}
+
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// lockBucket locks and returns the bucket currently holding key. While a
+// resize is in progress, keys stay in the old table until their bucket has
+// been moved.
+func (ht *HashTable) lockBucket(key string, write bool) *Bucket {
+	hash := ht.hash(key)
+	for {
+		state := ht.state.Load()
+		if state.old != nil {
+			bucket := state.old.bucket(hash)
+			if lockUnlessMigrated(bucket, write) {
+				return bucket
+			}
+		}
+
+		// A resize may have started after the state was loaded, in which
+		// case the bucket has moved on and the state must be read again
+		bucket := state.current.bucket(hash)
+		if lockUnlessMigrated(bucket, write) {
+			return bucket
+		}
 	}
 }
 
-// hash determines which bucket a key belongs to
-func (ht *HashTable) hash(key string) int {
-	hash := 0
-	for _, char := range key {
-		hash += int(char)
+// lockUnlessMigrated locks bucket and reports true, or reports false
+// without holding the lock if its entries have moved to a newer table
+func lockUnlessMigrated(bucket *Bucket, write bool) bool {
+	if write {
+		bucket.mutex.Lock()
+		if !bucket.migrated {
+			return true
+		}
+		bucket.mutex.Unlock()
+		return false
 	}
-	return hash % ht.bucketSize
+
+	bucket.mutex.RLock()
+	if !bucket.migrated {
+		return true
+	}
+	bucket.mutex.RUnlock()
+	return false
 }
 
-// Set stores a value for a given key
+// Set stores a value for a given key, clearing any expiry
 func (ht *HashTable) Set(key string, value []byte) {
-	bucketIndex := ht.hash(key)
-	bucket := ht.buckets[bucketIndex]
-	
-	bucket.mutex.Lock()
-	defer bucket.mutex.Unlock()
-	
-	bucket.entries[key] = value
+	ht.SetWithExpiry(key, value, 0)
+}
+
+// SetWithExpiry stores a value that expires at the given Unix time in
+// nanoseconds, or never if expiresAt is zero. A value stored with a time
+// already in the past is treated as expired, as SetEntry describes.
+func (ht *HashTable) SetWithExpiry(key string, value []byte, expiresAt int64) {
+	ht.SetEntry(key, Entry{Value: value, ExpiresAt: expiresAt})
+}
+
+// SetEntry stores an entry for a given key as it is. An entry that has
+// already expired is kept until it is read or swept, so that a change
+// replayed after it, such as clearing its expiry, still finds it.
+func (ht *HashTable) SetEntry(key string, entry Entry) {
+	bucket := ht.lockBucket(key, true)
+	_, exists := bucket.entries[key]
+	bucket.entries[key] = entry
+	if !exists {
+		ht.index.insert(key)
+	}
+	bucket.mutex.Unlock()
+
+	if !exists {
+		ht.size.Add(1)
+	}
+	ht.maybeGrow()
 }
 
 // Get retrieves a value for a given key
 func (ht *HashTable) Get(key string) ([]byte, bool) {
-	bucketIndex := ht.hash(key)
-	bucket := ht.buckets[bucketIndex]
-	
-	bucket.mutex.RLock()
-	defer bucket.mutex.RUnlock()
-	
-	value, exists := bucket.entries[key]
-	return value, exists
+	entry, exists := ht.GetEntry(key)
+	return entry.Value, exists
+}
+
+// GetEntry retrieves the value and expiry for a given key. Expired entries
+// are removed when found.
+func (ht *HashTable) GetEntry(key string) (Entry, bool) {
+	now := time.Now().UnixNano()
+
+	bucket := ht.lockBucket(key, false)
+	entry, exists := bucket.entries[key]
+	bucket.mutex.RUnlock()
+
+	if exists && entry.expired(now) {
+		ht.deleteIfExpired(key, now)
+		return Entry{}, false
+	}
+	return entry, exists
+}
+
+// Lookup returns the entry stored for key as it is, even if it has expired,
+// without removing it
+func (ht *HashTable) Lookup(key string) (Entry, bool) {
+	bucket := ht.lockBucket(key, false)
+	entry, exists := bucket.entries[key]
+	bucket.mutex.RUnlock()
+
+	return entry, exists
+}
+
+// Expire sets the expiry of a stored key, or clears it if expiresAt is
+// zero, and gives it version unless it already has a later one, which it
+// can when replaying onto a snapshot taken while writes carried on. Like
+// SetEntry, it applies to a key that has expired but not yet been removed.
+// It reports whether the key was stored.
+func (ht *HashTable) Expire(key string, expiresAt int64, version uint64) bool {
+	bucket := ht.lockBucket(key, true)
+	defer bucket.mutex.Unlock()
+
+	entry, exists := bucket.entries[key]
+	if !exists {
+		return false
+	}
+
+	entry.ExpiresAt = expiresAt
+	entry.Version = max(entry.Version, version)
+	bucket.entries[key] = entry
+	return true
+}
+
+// deleteIfExpired removes key if it is still expired at time now
+func (ht *HashTable) deleteIfExpired(key string, now int64) {
+	bucket := ht.lockBucket(key, true)
+	entry, exists := bucket.entries[key]
+	removed := exists && entry.expired(now)
+	if removed {
+		delete(bucket.entries, key)
+		ht.index.remove(key)
+		if ht.onExpire != nil {
+			ht.onExpire(key, entry)
+		}
+	}
+	bucket.mutex.Unlock()
+
+	if removed {
+		ht.size.Add(-1)
+	}
+}
+
+// DeleteExpired removes expired entries from up to maxBuckets buckets,
+// continuing from where the previous call stopped. It returns how many
+// entries were examined and how many of them were removed.
+func (ht *HashTable) DeleteExpired(maxBuckets int) (examined, removed int) {
+	ht.resizeMutex.RLock()
+	defer ht.resizeMutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	buckets := ht.buckets()
+	if maxBuckets > len(buckets) {
+		maxBuckets = len(buckets)
+	}
+
+	start := ht.sweepCursor.Add(uint64(maxBuckets)) - uint64(maxBuckets)
+	for i := 0; i < maxBuckets; i++ {
+		bucket := buckets[(start+uint64(i))%uint64(len(buckets))]
+
+		bucket.mutex.Lock()
+		for k, entry := range bucket.entries {
+			examined++
+			if entry.expired(now) {
+				delete(bucket.entries, k)
+				ht.index.remove(k)
+				removed++
+				if ht.onExpire != nil {
+					ht.onExpire(k, entry)
+				}
+			}
+		}
+		bucket.mutex.Unlock()
+	}
+
+	ht.size.Add(-int64(removed))
+	return examined, removed
+}
+
+// Operation is one change made by Apply
+type Operation struct {
+	Key       string
+	Value     []byte
+	ExpiresAt int64
+	Version   uint64
+	Delete    bool
+}
+
+// Apply makes several changes, in order, while holding the buckets of all
+// the keys involved, so the changes become visible together. Entries are
+// stored as they are, as with SetEntry.
+func (ht *HashTable) Apply(operations []Operation) {
+	// Buckets cannot move while resizeMutex is held, so the buckets found
+	// here keep owning their keys until they are unlocked
+	ht.resizeMutex.RLock()
+	state := ht.state.Load()
+	owners := make([]*Bucket, len(operations))
+	var buckets []*Bucket
+	for i, operation := range operations {
+		owners[i] = ht.ownerBucket(state, ht.hash(operation.Key))
+		buckets = append(buckets, owners[i])
+	}
+
+	// Lock in a fixed order to avoid deadlocks between concurrent calls
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].id < buckets[j].id
+	})
+	for i, bucket := range buckets {
+		if i == 0 || bucket != buckets[i-1] {
+			bucket.mutex.Lock()
+		}
+	}
+
+	var delta int64
+	for i, operation := range operations {
+		bucket := owners[i]
+		entry := Entry{Value: operation.Value, ExpiresAt: operation.ExpiresAt, Version: operation.Version}
+		_, exists := bucket.entries[operation.Key]
+
+		if operation.Delete {
+			if exists {
+				delete(bucket.entries, operation.Key)
+				ht.index.remove(operation.Key)
+				delta--
+			}
+			continue
+		}
+
+		bucket.entries[operation.Key] = entry
+		if !exists {
+			ht.index.insert(operation.Key)
+			delta++
+		}
+	}
+
+	for i, bucket := range buckets {
+		if i == 0 || bucket != buckets[i-1] {
+			bucket.mutex.Unlock()
+		}
+	}
+	ht.resizeMutex.RUnlock()
+
+	ht.size.Add(delta)
+	ht.maybeGrow()
+}
+
+// ownerBucket returns the bucket holding a hash. The caller must hold
+// resizeMutex so that the answer cannot change.
+func (ht *HashTable) ownerBucket(state *tableState, hash uint64) *Bucket {
+	if state.old != nil {
+		bucket := state.old.bucket(hash)
+		if !bucket.migrated {
+			return bucket
+		}
+	}
+	return state.current.bucket(hash)
 }
 
 // Delete removes a key-value pair
 func (ht *HashTable) Delete(key string) bool {
-	bucketIndex := ht.hash(key)
-	bucket := ht.buckets[bucketIndex]
-	
-	bucket.mutex.Lock()
-	defer bucket.mutex.Unlock()
-	
+	bucket := ht.lockBucket(key, true)
 	_, exists := bucket.entries[key]
 	if exists {
 		delete(bucket.entries, key)
-		return true
+		ht.index.remove(key)
 	}
-	return false
+	bucket.mutex.Unlock()
+
+	if exists {
+		ht.size.Add(-1)
+	}
+	return exists
+}
+
+// maybeGrow starts a resize once the load factor is exceeded and moves a
+// few old buckets if one is in progress
+func (ht *HashTable) maybeGrow() {
+	state := ht.state.Load()
+	if state.old == nil {
+		if ht.maxLoadFactor < 0 || float64(ht.size.Load()) <= float64(len(state.current.buckets))*ht.maxLoadFactor {
+			return
+		}
+
+		ht.growMutex.Lock()
+		state = ht.state.Load()
+		if state.old == nil {
+			state = &tableState{
+				current: newBucketArray(2 * len(state.current.buckets)),
+				old:     state.current,
+			}
+			ht.migrated = 0
+			ht.state.Store(state)
+		}
+		ht.growMutex.Unlock()
+	}
+
+	ht.migrate(migrateStep)
 }
 
-// Keys returns all keys in the hash table
+// migrate moves up to n buckets of the old table into the current one. It
+// gives up rather than wait for an iteration to finish, since the next
+// write will try again.
+func (ht *HashTable) migrate(n int) {
+	if !ht.resizeMutex.TryLock() {
+		return
+	}
+	defer ht.resizeMutex.Unlock()
+
+	ht.growMutex.Lock()
+	defer ht.growMutex.Unlock()
+
+	state := ht.state.Load()
+	if state.old == nil {
+		return
+	}
+
+	for ; n > 0 && ht.migrated < len(state.old.buckets); n-- {
+		ht.migrateBucket(state, state.old.buckets[ht.migrated])
+		ht.migrated++
+	}
+
+	if ht.migrated == len(state.old.buckets) {
+		ht.state.Store(&tableState{current: state.current})
+	}
+}
+
+// migrateBucket moves the entries of one old bucket into the current table,
+// locking each new bucket while holding the old one. The caller holds
+// resizeMutex for writing. Locks are taken in this order: resizeMutex, then
+// bucket locks. Apply, the only other holder of several bucket locks, holds
+// resizeMutex for reading and so never runs alongside a migration; every
+// other operation holds one bucket lock at a time, so none can deadlock.
+func (ht *HashTable) migrateBucket(state *tableState, bucket *Bucket) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	for k, v := range bucket.entries {
+		target := state.current.bucket(ht.hash(k))
+		target.mutex.Lock()
+		target.entries[k] = v
+		target.mutex.Unlock()
+	}
+
+	bucket.entries = nil
+	bucket.migrated = true
+}
+
+// buckets returns every bucket that may hold entries. The caller must hold
+// resizeMutex for reading so that no entries move in the meantime.
+func (ht *HashTable) buckets() []*Bucket {
+	state := ht.state.Load()
+	if state.old == nil {
+		return state.current.buckets
+	}
+
+	buckets := make([]*Bucket, 0, len(state.old.buckets)+len(state.current.buckets))
+	buckets = append(buckets, state.old.buckets...)
+	return append(buckets, state.current.buckets...)
+}
+
+// Keys returns all keys in the hash table that have not expired, in
+// ascending order
 func (ht *HashTable) Keys() []string {
-	ht.mutex.RLock()
-	defer ht.mutex.RUnlock()
-	
 	keys := []string{}
-	for _, bucket := range ht.buckets {
+	ht.Range("", "", false, func(key string, entry Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range calls fn in key order for every entry with a key in [start, end)
+// until fn returns false. An empty end means no upper bound. With reverse
+// set, keys are visited in descending order.
+//
+// Keys are read from the index a batch at a time and each batch picks up
+// after the last key visited, so the iteration stays valid under
+// concurrent writes. Keys added or removed behind the current position may
+// or may not be observed.
+func (ht *HashTable) Range(start, end string, reverse bool, fn func(key string, entry Entry) bool) {
+	const batchSize = 64
+
+	for {
+		keys := ht.index.collect(start, end, reverse, batchSize)
+		for _, key := range keys {
+			entry, exists := ht.GetEntry(key)
+			if exists && !fn(key, entry) {
+				return
+			}
+		}
+		if len(keys) < batchSize {
+			return
+		}
+
+		last := keys[len(keys)-1]
+		if reverse {
+			end = last
+		} else {
+			// The smallest key greater than last
+			start = last + "\x00"
+		}
+	}
+}
+
+// ForEach calls fn for every entry that has not expired. Each bucket is
+// copied under its lock and fn runs without holding it, so fn may be slow
+// without blocking writers. Changes made during iteration may or may not be
+// observed.
+func (ht *HashTable) ForEach(fn func(key string, entry Entry)) {
+	ht.resizeMutex.RLock()
+	defer ht.resizeMutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	for _, bucket := range ht.buckets() {
 		bucket.mutex.RLock()
-		for k := range bucket.entries {
-			keys = append(keys, k)
+		keys := make([]string, 0, len(bucket.entries))
+		entries := make([]Entry, 0, len(bucket.entries))
+		for k, entry := range bucket.entries {
+			if !entry.expired(now) {
+				keys = append(keys, k)
+				entries = append(entries, entry)
+			}
 		}
 		bucket.mutex.RUnlock()
+
+		for i := range keys {
+			fn(keys[i], entries[i])
+		}
 	}
-	return keys
 }
 
-// Size returns the number of entries in the hash table
+// Size returns the number of entries in the hash table. Expired entries
+// are counted until they are removed.
 func (ht *HashTable) Size() int {
-	count := 0
-	
-	for _, bucket := range ht.buckets {
+	return int(ht.size.Load())
+}
+
+// Stats reports how entries are distributed over the buckets
+func (ht *HashTable) Stats() Stats {
+	ht.resizeMutex.RLock()
+	defer ht.resizeMutex.RUnlock()
+
+	state := ht.state.Load()
+	stats := Stats{
+		Buckets:  len(state.current.buckets),
+		Resizing: state.old != nil,
+	}
+	if state.old != nil {
+		ht.growMutex.Lock()
+		stats.MigratedBuckets = ht.migrated
+		ht.growMutex.Unlock()
+	}
+
+	for _, bucket := range ht.buckets() {
 		bucket.mutex.RLock()
-		count += len(bucket.entries)
+		n := len(bucket.entries)
 		bucket.mutex.RUnlock()
+
+		stats.Entries += n
+		if n > 0 {
+			stats.UsedBuckets++
+		}
+		if n > stats.MaxBucketSize {
+			stats.MaxBucketSize = n
+		}
 	}
-	
-	return count
+	return stats
 }
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestExpiredEntryKept checks that an entry stored after its expiry is
+// kept until it is read, so that a later change can still clear it
+func TestExpiredEntryKept(t *testing.T) {
+	ht := NewHashTable(16)
+	past := time.Now().Add(-time.Minute).UnixNano()
+
+	ht.SetEntry("key", Entry{Value: []byte("value"), ExpiresAt: past, Version: 1})
+	if _, exists := ht.Lookup("key"); !exists {
+		t.Fatal("expired entry was not stored")
+	}
+	if !ht.Expire("key", 0, 2) {
+		t.Fatal("Expire did not find the expired entry")
+	}
+
+	entry, exists := ht.GetEntry("key")
+	if !exists || string(entry.Value) != "value" || entry.ExpiresAt != 0 || entry.Version != 2 {
+		t.Fatalf("GetEntry = %+v, %v", entry, exists)
+	}
+
+	ht.Expire("key", past, 3)
+	if _, exists := ht.GetEntry("key"); exists {
+		t.Fatal("GetEntry returned an expired entry")
+	}
+	if _, exists := ht.Lookup("key"); exists {
+		t.Fatal("reading an expired entry did not remove it")
+	}
+}
+
+// TestExpireKeepsLaterVersion checks that replaying an expiry onto a newer
+// entry does not move its version back
+func TestExpireKeepsLaterVersion(t *testing.T) {
+	ht := NewHashTable(16)
+	ht.SetEntry("key", Entry{Value: []byte("value"), Version: 12})
+
+	ht.Expire("key", 0, 10)
+	entry, _ := ht.GetEntry("key")
+	if entry.Version != 12 {
+		t.Fatalf("Version = %d, want 12", entry.Version)
+	}
+}
+
+// TestRange checks that Range visits every key in range exactly once, in
+// order both ways, across several of the batches it reads the index in,
+// and skips expired entries
+func TestRange(t *testing.T) {
+	const numKeys = 200
+
+	ht := NewHashTable(16)
+	past := time.Now().Add(-time.Minute).UnixNano()
+	var want []string
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		if i%3 == 0 {
+			ht.SetEntry(key, Entry{Value: []byte("expired"), ExpiresAt: past})
+			continue
+		}
+		ht.Set(key, []byte("value"))
+		want = append(want, key)
+	}
+
+	collect := func(start, end string, reverse bool) []string {
+		var keys []string
+		ht.Range(start, end, reverse, func(key string, entry Entry) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	if got := collect("", "", false); !slices.Equal(got, want) {
+		t.Fatalf("Range forward = %d keys %q..., want %d", len(got), got[:min(3, len(got))], len(want))
+	}
+	if got := collect("", "", true); !slices.Equal(got, reverse(want)) {
+		t.Fatalf("Range reverse = %d keys, want %d", len(got), len(want))
+	}
+
+	// A range starting and ending inside batches
+	start, end := "key:010", "key:150"
+	var inRange []string
+	for _, key := range want {
+		if key >= start && key < end {
+			inRange = append(inRange, key)
+		}
+	}
+	if got := collect(start, end, false); !slices.Equal(got, inRange) {
+		t.Fatalf("Range(%s, %s) = %q, want %q", start, end, got, inRange)
+	}
+	if got := collect(start, end, true); !slices.Equal(got, reverse(inRange)) {
+		t.Fatalf("reverse Range(%s, %s) = %q, want %q", start, end, got, reverse(inRange))
+	}
+
+	// Stopping early
+	visited := 0
+	ht.Range("", "", false, func(key string, entry Entry) bool {
+		visited++
+		return visited < 100
+	})
+	if visited != 100 {
+		t.Fatalf("Range visited %d keys after fn returned false at 100", visited)
+	}
+}
+
+// TestHashDistribution checks that prefixed keys and their anagrams spread
+// evenly over the buckets, and that the seed decides where they land
+func TestHashDistribution(t *testing.T) {
+	const (
+		numBuckets = 1024
+		numKeys    = 16 * numBuckets
+	)
+	// Sequential keys share a prefix and include every anagram of their
+	// digits, such as user:12 and user:21
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+
+	for _, seed := range []uint64{1, 2, 0x9e3779b97f4a7c15} {
+		ht := NewHashTableWithOptions(&HashTableOptions{NumBuckets: numBuckets, Seed: seed, MaxLoadFactor: -1})
+		for _, key := range keys {
+			ht.Set(key, nil)
+		}
+
+		// The keys average 16 a bucket; with a uniform hash an empty bucket
+		// or one three times the average is all but impossible
+		stats := ht.Stats()
+		if stats.Entries != numKeys || stats.Buckets != numBuckets {
+			t.Fatalf("seed %#x: %d entries in %d buckets, want %d in %d", seed, stats.Entries, stats.Buckets, numKeys, numBuckets)
+		}
+		if stats.UsedBuckets != numBuckets {
+			t.Errorf("seed %#x: %d of %d buckets used", seed, stats.UsedBuckets, numBuckets)
+		}
+		if stats.MaxBucketSize >= 3*numKeys/numBuckets {
+			t.Errorf("seed %#x: largest bucket holds %d entries", seed, stats.MaxBucketSize)
+		}
+	}
+
+	a := NewHashTableWithOptions(&HashTableOptions{Seed: 1})
+	b := NewHashTableWithOptions(&HashTableOptions{Seed: 2})
+	same := 0
+	for _, key := range keys {
+		if a.hash(key)%numBuckets == b.hash(key)%numBuckets {
+			same++
+		}
+	}
+	if same > numKeys/100 {
+		t.Errorf("%d of %d keys share a bucket under different seeds", same, numKeys)
+	}
+}
+
+// BenchmarkParallel runs parallel reads and writes against a table that is
+// not resizing and against one that is, so the cost of looking keys up
+// across two bucket arrays, and of moving buckets, shows up
+func BenchmarkParallel(b *testing.B) {
+	const numKeys = 1 << 16
+
+	// resizing returns a table holding numKeys keys that has just started
+	// to grow, with almost all of its old buckets still to move
+	resizing := func(b *testing.B) *HashTable {
+		ht := NewHashTable(numKeys / DefaultMaxLoadFactor)
+		for i := 0; i <= numKeys; i++ {
+			ht.Set(fmt.Sprintf("key:%d", i), nil)
+		}
+		if !ht.Stats().Resizing {
+			b.Fatal("table is not resizing")
+		}
+		return ht
+	}
+	stable := func(b *testing.B) *HashTable {
+		ht := NewHashTable(numKeys)
+		for i := 0; i <= numKeys; i++ {
+			ht.Set(fmt.Sprintf("key:%d", i), nil)
+		}
+		if ht.Stats().Resizing {
+			b.Fatal("table is resizing")
+		}
+		return ht
+	}
+
+	for _, table := range []struct {
+		name string
+		new  func(b *testing.B) *HashTable
+	}{
+		{"stable", stable},
+		{"resizing", resizing},
+	} {
+		b.Run("get/"+table.name, func(b *testing.B) {
+			ht := table.new(b)
+			var next atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := next.Add(1) * 7919
+				for pb.Next() {
+					ht.Get(fmt.Sprintf("key:%d", i%numKeys))
+					i++
+				}
+			})
+		})
+	}
+
+	// Writes of new keys to a table that starts with a single bucket keep
+	// it growing throughout, each write moving a few buckets
+	b.Run("set/growing", func(b *testing.B) {
+		ht := NewHashTable(1)
+		var next atomic.Uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ht.Set(fmt.Sprintf("key:%d", next.Add(1)), nil)
+			}
+		})
+	})
+	b.Run("set/presized", func(b *testing.B) {
+		ht := NewHashTableWithOptions(&HashTableOptions{NumBuckets: b.N, MaxLoadFactor: -1})
+		var next atomic.Uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ht.Set(fmt.Sprintf("key:%d", next.Add(1)), nil)
+			}
+		})
+	})
+
+	// A mix of reads and writes while the table grows, one write in four
+	b.Run("mixed/growing", func(b *testing.B) {
+		ht := NewHashTable(1)
+		var next atomic.Uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				n := next.Add(1)
+				if n%4 == 0 {
+					ht.Set(fmt.Sprintf("key:%d", n), nil)
+				} else {
+					ht.Get(fmt.Sprintf("key:%d", n/2))
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	// skipListMaxLevel bounds the height of a node, enough for 4^32 keys
+	skipListMaxLevel = 32
+
+	// skipListP is the chance that a node reaches the next level up
+	skipListP = 0.25
+)
+
+// skipNode is one key in the skip list. Only the bottom level is linked
+// backwards, which is all reverse iteration needs.
+type skipNode struct {
+	key  string
+	next []*skipNode
+	prev *skipNode
+}
+
+// skipList keeps keys in sorted order so they can be scanned by range. It
+// holds keys only; values stay in the hash buckets.
+type skipList struct {
+	mutex sync.RWMutex
+	head  *skipNode
+	level int
+}
+
+// newSkipList creates an empty skip list
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+// randomLevel picks the height of a new node
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// findPredecessors fills update with the last node before key on each level
+// and returns the first node at or after key
+func (s *skipList) findPredecessors(key string, update []*skipNode) *skipNode {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// insert adds key if it is not already present
+func (s *skipList) insert(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	update := make([]*skipNode, skipListMaxLevel)
+	next := s.findPredecessors(key, update)
+	if next != nil && next.key == key {
+		return
+	}
+
+	level := randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+
+	node := &skipNode{
+		key:  key,
+		next: make([]*skipNode, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+
+	if update[0] != s.head {
+		node.prev = update[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	}
+}
+
+// remove deletes key if it is present
+func (s *skipList) remove(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	update := make([]*skipNode, skipListMaxLevel)
+	node := s.findPredecessors(key, update)
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	}
+
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+}
+
+// collect returns up to max keys in [start, end), in ascending order or, if
+// reverse is set, descending order. An empty end means no upper bound.
+func (s *skipList) collect(start, end string, reverse bool, max int) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keys []string
+	if !reverse {
+		for node := s.findPredecessors(start, nil); node != nil && len(keys) < max; node = node.next[0] {
+			if end != "" && node.key >= end {
+				break
+			}
+			keys = append(keys, node.key)
+		}
+		return keys
+	}
+
+	// Find the last node before end
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && (end == "" || node.next[i].key < end) {
+			node = node.next[i]
+		}
+	}
+	if node == s.head {
+		return nil
+	}
+
+	for ; node != nil && len(keys) < max; node = node.prev {
+		if node.key < start {
+			break
+		}
+		keys = append(keys, node.key)
+	}
+	return keys
+}
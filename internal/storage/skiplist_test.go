@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// checkSkipList checks that the skip list holds exactly want, in order on
+// every level, and that the backward links mirror the bottom level
+func checkSkipList(t *testing.T, s *skipList, want []string) {
+	t.Helper()
+
+	var keys []string
+	var prev *skipNode
+	for node := s.head.next[0]; node != nil; node = node.next[0] {
+		if node.prev != prev {
+			t.Fatalf("%q links back to %v, want %v", node.key, nodeKey(node.prev), nodeKey(prev))
+		}
+		keys = append(keys, node.key)
+		prev = node
+	}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("skip list holds %q, want %q", keys, want)
+	}
+
+	for level := 1; level < s.level; level++ {
+		var last string
+		for node := s.head.next[level]; node != nil; node = node.next[level] {
+			if last != "" && node.key <= last {
+				t.Fatalf("level %d is out of order: %q after %q", level, node.key, last)
+			}
+			if _, found := slices.BinarySearch(want, node.key); !found {
+				t.Fatalf("level %d holds removed key %q", level, node.key)
+			}
+			last = node.key
+		}
+	}
+
+	reversed := s.collect("", "", true, len(want)+1)
+	if !slices.Equal(reversed, reverse(want)) {
+		t.Fatalf("reverse collect = %q, want %q", reversed, reverse(want))
+	}
+}
+
+// nodeKey names a node in failure messages
+func nodeKey(node *skipNode) string {
+	if node == nil {
+		return "nothing"
+	}
+	return fmt.Sprintf("%q", node.key)
+}
+
+// reverse returns keys in the opposite order
+func reverse(keys []string) []string {
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+	return reversed
+}
+
+// TestSkipListInsertRemove inserts and removes keys in random order,
+// including the first and last keys, and checks the links after each
+// change
+func TestSkipListInsertRemove(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	s := newSkipList()
+	var want []string
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%03d", i)
+	}
+	random.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	for _, key := range keys {
+		s.insert(key)
+		i, _ := slices.BinarySearch(want, key)
+		want = slices.Insert(want, i, key)
+		checkSkipList(t, s, want)
+	}
+
+	// Inserting a key twice or removing a missing one changes nothing
+	s.insert(keys[0])
+	s.remove("missing")
+	checkSkipList(t, s, want)
+
+	// Remove the ends first, then the rest in random order
+	removals := append([]string{want[0], want[len(want)-1]}, keys...)
+	for _, key := range removals {
+		s.remove(key)
+		if i, found := slices.BinarySearch(want, key); found {
+			want = slices.Delete(want, i, i+1)
+		}
+		checkSkipList(t, s, want)
+	}
+	if s.level != 1 {
+		t.Fatalf("empty skip list has %d levels, want 1", s.level)
+	}
+}
+
+// TestSkipListCollect checks the bounds and limits of collect in both
+// directions
+func TestSkipListCollect(t *testing.T) {
+	s := newSkipList()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		s.insert(key)
+	}
+
+	tests := []struct {
+		start, end string
+		reverse    bool
+		max        int
+		want       []string
+	}{
+		{"", "", false, 10, []string{"a", "b", "c", "d", "e"}},
+		{"b", "d", false, 10, []string{"b", "c"}},
+		{"bb", "", false, 2, []string{"c", "d"}},
+		{"", "", true, 10, []string{"e", "d", "c", "b", "a"}},
+		{"b", "d", true, 10, []string{"c", "b"}},
+		{"", "cc", true, 2, []string{"c", "b"}},
+		{"", "a", true, 10, nil},
+		{"f", "", false, 10, nil},
+	}
+	for _, test := range tests {
+		got := s.collect(test.start, test.end, test.reverse, test.max)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("collect(%q, %q, %v, %d) = %q, want %q", test.start, test.end, test.reverse, test.max, got, test.want)
+		}
+	}
+}
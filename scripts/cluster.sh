@@ -0,0 +1,30 @@
+#!/bin/sh
+# Runs a three-member Raft cluster on this machine for testing. Members n1,
+# n2 and n3 serve RESP clients on ports 6381 to 6383 and each other on 7381
+# to 7383, and keep their data under the directory given, ./cluster-data by
+# default. Raft status is at http://localhost:7381/raft/status and so on.
+# Interrupt the script to stop every member.
+set -e
+
+data=${1:-./cluster-data}
+bin=$(mktemp -d)
+trap 'rm -rf "$bin"' EXIT
+
+cd "$(dirname "$0")/.."
+go build -o "$bin/kv" ./cmd/server
+cd - >/dev/null
+
+members=n1=127.0.0.1:7381,n2=127.0.0.1:7382,n3=127.0.0.1:7383
+pids=
+for i in 1 2 3; do
+	mkdir -p "$data/n$i"
+	"$bin/kv" -mode resp -addr 127.0.0.1:638$i -data "$data/n$i" \
+		-cluster-id n$i -cluster-addr 127.0.0.1:738$i -cluster-bootstrap $members &
+	pids="$pids $!"
+done
+
+# Members started in the background ignore interrupts, so they are sent
+# SIGTERM, which shuts them down just the same
+trap 'kill $pids 2>/dev/null' INT TERM
+wait
+wait